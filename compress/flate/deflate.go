@@ -0,0 +1,461 @@
+package flate
+
+import "github.com/alaisi/syscalltodo/io"
+
+const (
+	blockSize = 1 << 16
+	hashBits  = 15
+	hashMask  = 1<<hashBits - 1
+	maxChain  = 64
+	goodMatch = 128
+)
+
+type token struct {
+	litLen uint16
+	dist   uint16
+}
+
+type Writer struct {
+	writer  io.Writer
+	bits    bitWriter
+	window  []byte
+	pending int
+	base    int
+	head    []int
+	prev    []int
+	tokens  []token
+	closed  bool
+	err     error
+}
+
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	count uint
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{
+		writer: writer,
+		window: make([]byte, 0, windowSize+blockSize),
+		head:   make([]int, 1<<hashBits),
+		prev:   make([]int, windowSize),
+		tokens: make([]token, 0, blockSize),
+	}
+}
+
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return -1, w.err
+	}
+	if w.closed {
+		return -1, ErrClosed
+	}
+	written := 0
+	for written < len(data) {
+		free := blockSize - (len(w.window) - w.pending)
+		n := len(data) - written
+		if n > free {
+			n = free
+		}
+		w.window = append(w.window, data[written:written+n]...)
+		written += n
+		if len(w.window)-w.pending == blockSize {
+			if w.err = w.compressBlock(false); w.err != nil {
+				return -1, w.err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return ErrClosed
+	}
+	if len(w.window) > w.pending {
+		if w.err = w.compressBlock(false); w.err != nil {
+			return w.err
+		}
+	}
+	w.bits.writeBits(blockTypeStored<<1, 3)
+	w.bits.align()
+	w.bits.out = append(w.bits.out, 0, 0, 0xff, 0xff)
+	w.err = w.flushOutput()
+	return w.err
+}
+
+func (w *Writer) Close() error {
+	if w.closed || w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	if w.err = w.compressBlock(true); w.err != nil {
+		return w.err
+	}
+	w.bits.align()
+	w.err = w.flushOutput()
+	return w.err
+}
+
+func (w *Writer) flushOutput() error {
+	if len(w.bits.out) == 0 {
+		return nil
+	}
+	_, err := w.writer.Write(w.bits.out)
+	w.bits.out = w.bits.out[:0]
+	return err
+}
+
+func (w *Writer) compressBlock(final bool) error {
+	data := w.window
+	w.tokens = w.tokens[:0]
+	for i := w.pending; i < len(data); {
+		length, dist := 0, 0
+		if i+minMatchLength <= len(data) {
+			length, dist = w.findMatch(i)
+			w.insertHash(i)
+		}
+		if length < minMatchLength {
+			w.tokens = append(w.tokens, token{litLen: uint16(data[i])})
+			i++
+			continue
+		}
+		w.tokens = append(w.tokens,
+			token{litLen: uint16(length), dist: uint16(dist)})
+		for end := i + length; i+1 < end; {
+			i++
+			if i+minMatchLength <= len(data) {
+				w.insertHash(i)
+			}
+		}
+		i++
+	}
+	w.writeBlock(data[w.pending:], final)
+	w.slideWindow()
+	return w.flushOutput()
+}
+
+func (w *Writer) hash(i int) int {
+	data := w.window
+	h := uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])
+	return int((h * 0x9e3779b1) >> (32 - hashBits) & hashMask)
+}
+
+func (w *Writer) insertHash(i int) {
+	h := w.hash(i)
+	abs := w.base + i
+	w.prev[abs&(windowSize-1)] = w.head[h]
+	w.head[h] = abs + 1
+}
+
+func (w *Writer) findMatch(i int) (int, int) {
+	data := w.window
+	abs := w.base + i
+	limit := len(data) - i
+	if limit > maxMatchLength {
+		limit = maxMatchLength
+	}
+	bestLength, bestDist := 0, 0
+	candidate := w.head[w.hash(i)] - 1
+	for chain := 0; chain < maxChain && candidate >= w.base; chain++ {
+		dist := abs - candidate
+		if dist <= 0 || dist > windowSize {
+			break
+		}
+		j := candidate - w.base
+		if data[j+bestLength] == data[i+bestLength] {
+			length := 0
+			for length < limit && data[j+length] == data[i+length] {
+				length++
+			}
+			if length > bestLength {
+				bestLength, bestDist = length, dist
+				if length >= goodMatch || length == limit {
+					break
+				}
+			}
+		}
+		next := w.prev[candidate&(windowSize-1)] - 1
+		if next >= candidate {
+			break
+		}
+		candidate = next
+	}
+	if bestLength < minMatchLength {
+		return 0, 0
+	}
+	return bestLength, bestDist
+}
+
+func (w *Writer) slideWindow() {
+	w.pending = len(w.window)
+	if drop := len(w.window) - windowSize; drop > 0 {
+		copy(w.window, w.window[drop:])
+		w.window = w.window[:windowSize]
+		w.base += drop
+		w.pending = windowSize
+	}
+}
+
+func (w *Writer) writeBlock(raw []byte, final bool) {
+	litLenFreqs := make([]int, numLitLenCodes)
+	distFreqs := make([]int, numDistCodes)
+	for _, t := range w.tokens {
+		if t.dist == 0 {
+			litLenFreqs[t.litLen]++
+		} else {
+			litLenFreqs[257+lengthCode(int(t.litLen))]++
+			distFreqs[distCode(int(t.dist))]++
+		}
+	}
+	litLenFreqs[endOfBlock]++
+	litLenLengths := huffmanLengths(litLenFreqs, maxCodeBits)
+	distLengths := huffmanLengths(distFreqs, maxCodeBits)
+	if countUsed(distLengths) == 0 {
+		distLengths[0] = 1
+	}
+	header := newDynamicHeader(litLenLengths, distLengths)
+
+	dynamicBits := header.bits() +
+		w.tokensBits(litLenLengths, distLengths, litLenFreqs, distFreqs)
+	fixedBits := 3 +
+		w.tokensBits(fixedLitLenLengths, fixedDistLengths, litLenFreqs, distFreqs)
+	storedBits := (len(raw)/maxStoredBlock + 1) * (3 + 7 + 32)
+	storedBits += len(raw) * 8
+
+	finalBit := 0
+	if final {
+		finalBit = 1
+	}
+	switch {
+	case storedBits < dynamicBits && storedBits < fixedBits:
+		w.writeStored(raw, finalBit)
+	case fixedBits <= dynamicBits:
+		w.bits.writeBits(uint64(finalBit|blockTypeFixed<<1), 3)
+		w.writeTokens(fixedLitLenLengths, fixedDistLengths)
+	default:
+		w.bits.writeBits(uint64(finalBit|blockTypeDynamic<<1), 3)
+		header.write(&w.bits)
+		w.writeTokens(litLenLengths, distLengths)
+	}
+}
+
+func (w *Writer) writeStored(raw []byte, finalBit int) {
+	for first := true; first || len(raw) > 0; first = false {
+		n := len(raw)
+		if n > maxStoredBlock {
+			n = maxStoredBlock
+		}
+		last := 0
+		if n == len(raw) {
+			last = finalBit
+		}
+		w.bits.writeBits(uint64(last|blockTypeStored<<1), 3)
+		w.bits.align()
+		w.bits.out = append(w.bits.out,
+			byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		w.bits.out = append(w.bits.out, raw[:n]...)
+		raw = raw[n:]
+	}
+}
+
+func (w *Writer) tokensBits(
+	litLenLengths []uint8,
+	distLengths []uint8,
+	litLenFreqs []int,
+	distFreqs []int,
+) int {
+	bits := 0
+	for symbol, freq := range litLenFreqs {
+		if freq == 0 {
+			continue
+		}
+		if litLenLengths[symbol] == 0 {
+			return 1 << 30
+		}
+		bits += freq * int(litLenLengths[symbol])
+		if symbol > endOfBlock {
+			bits += freq * int(lengthExtra[symbol-257])
+		}
+	}
+	for code, freq := range distFreqs {
+		if freq == 0 {
+			continue
+		}
+		if distLengths[code] == 0 {
+			return 1 << 30
+		}
+		bits += freq * (int(distLengths[code]) + int(distExtra[code]))
+	}
+	return bits
+}
+
+func (w *Writer) writeTokens(litLenLengths []uint8, distLengths []uint8) {
+	litLenCodes := canonicalCodes(litLenLengths)
+	distCodes := canonicalCodes(distLengths)
+	for _, t := range w.tokens {
+		if t.dist == 0 {
+			w.bits.writeBits(
+				uint64(litLenCodes[t.litLen]), uint(litLenLengths[t.litLen]))
+			continue
+		}
+		length, dist := int(t.litLen), int(t.dist)
+		lc := lengthCode(length)
+		w.bits.writeBits(
+			uint64(litLenCodes[257+lc]), uint(litLenLengths[257+lc]))
+		w.bits.writeBits(uint64(length-lengthBase[lc]), lengthExtra[lc])
+		dc := distCode(dist)
+		w.bits.writeBits(uint64(distCodes[dc]), uint(distLengths[dc]))
+		w.bits.writeBits(uint64(dist-distBase[dc]), distExtra[dc])
+	}
+	w.bits.writeBits(
+		uint64(litLenCodes[endOfBlock]), uint(litLenLengths[endOfBlock]))
+}
+
+type dynamicHeader struct {
+	numLitLen     int
+	numDist       int
+	numCodeLen    int
+	symbols       []int
+	codeLenLength []uint8
+}
+
+func newDynamicHeader(litLenLengths []uint8, distLengths []uint8) *dynamicHeader {
+	h := &dynamicHeader{numLitLen: 257, numDist: 1, numCodeLen: 4}
+	for i := numLitLenCodes; i > 257; i-- {
+		if litLenLengths[i-1] != 0 {
+			h.numLitLen = i
+			break
+		}
+	}
+	for i := numDistCodes; i > 1; i-- {
+		if distLengths[i-1] != 0 {
+			h.numDist = i
+			break
+		}
+	}
+	lengths := make([]uint8, 0, h.numLitLen+h.numDist)
+	lengths = append(lengths, litLenLengths[:h.numLitLen]...)
+	lengths = append(lengths, distLengths[:h.numDist]...)
+	h.symbols = runLengthEncode(lengths)
+	freqs := make([]int, numCodeLenCodes)
+	for _, symbol := range h.symbols {
+		freqs[symbol&0xff]++
+	}
+	h.codeLenLength = huffmanLengths(freqs, maxCodeLenBits)
+	for i := numCodeLenCodes; i > 4; i-- {
+		if h.codeLenLength[codeLenOrder[i-1]] != 0 {
+			h.numCodeLen = i
+			break
+		}
+	}
+	return h
+}
+
+// runLengthEncode packs code lengths into symbols 0-18, keeping the repeat
+// count of symbols 16, 17 and 18 in the bits above the low byte.
+func runLengthEncode(lengths []uint8) []int {
+	symbols := make([]int, 0, len(lengths))
+	for i := 0; i < len(lengths); {
+		length := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == length {
+			run++
+		}
+		i += run
+		if length == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				symbols = append(symbols, 18|(n-11)<<8)
+				run -= n
+			}
+			if run >= 3 {
+				symbols = append(symbols, 17|(run-3)<<8)
+				run = 0
+			}
+		} else {
+			symbols = append(symbols, int(length))
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				symbols = append(symbols, 16|(n-3)<<8)
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			symbols = append(symbols, int(length))
+		}
+	}
+	return symbols
+}
+
+func (h *dynamicHeader) bits() int {
+	bits := 3 + 5 + 5 + 4 + 3*h.numCodeLen
+	for _, symbol := range h.symbols {
+		code := symbol & 0xff
+		bits += int(h.codeLenLength[code])
+		switch code {
+		case 16:
+			bits += 2
+		case 17:
+			bits += 3
+		case 18:
+			bits += 7
+		}
+	}
+	return bits
+}
+
+func (h *dynamicHeader) write(bits *bitWriter) {
+	bits.writeBits(uint64(h.numLitLen-257), 5)
+	bits.writeBits(uint64(h.numDist-1), 5)
+	bits.writeBits(uint64(h.numCodeLen-4), 4)
+	for i := 0; i < h.numCodeLen; i++ {
+		bits.writeBits(uint64(h.codeLenLength[codeLenOrder[i]]), 3)
+	}
+	codes := canonicalCodes(h.codeLenLength)
+	for _, symbol := range h.symbols {
+		code := symbol & 0xff
+		bits.writeBits(uint64(codes[code]), uint(h.codeLenLength[code]))
+		switch code {
+		case 16:
+			bits.writeBits(uint64(symbol>>8), 2)
+		case 17:
+			bits.writeBits(uint64(symbol>>8), 3)
+		case 18:
+			bits.writeBits(uint64(symbol>>8), 7)
+		}
+	}
+}
+
+func countUsed(lengths []uint8) int {
+	used := 0
+	for _, length := range lengths {
+		if length != 0 {
+			used++
+		}
+	}
+	return used
+}
+
+func (bw *bitWriter) writeBits(value uint64, count uint) {
+	bw.acc |= value << bw.count
+	bw.count += count
+	for bw.count >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.count -= 8
+	}
+}
+
+func (bw *bitWriter) align() {
+	if bw.count > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+	}
+	bw.acc = 0
+	bw.count = 0
+}
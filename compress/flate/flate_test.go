@@ -0,0 +1,245 @@
+package flate
+
+import (
+	"bytes"
+	stdflate "compress/flate"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+// randomBytes returns incompressible input, which is sent as stored blocks.
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// text returns skewed, repetitive input, which gets dynamic Huffman codes.
+func text(n int) []byte {
+	words := []string{"the ", "quick ", "brown ", "fox ", "jumps ", "over ",
+		"lazy ", "dog", ". ", "\n", "a ", "and ", "syscall ", "epoll "}
+	rng := rand.New(rand.NewSource(2))
+	data := make([]byte, 0, n+16)
+	for len(data) < n {
+		data = append(data, words[rng.Intn(len(words))]...)
+	}
+	return data[:n]
+}
+
+func compress(t *testing.T, data []byte, flushEvery int) []byte {
+	out := io.NewByteArrayWriter()
+	w := NewWriter(out)
+	for len(data) > 0 {
+		n := len(data)
+		if flushEvery > 0 && n > flushEvery {
+			n = flushEvery
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+		if flushEvery > 0 {
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	r := NewReader(io.NewByteArrayReader(compressed))
+	out := []byte{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func stdDecompress(t *testing.T, compressed []byte) []byte {
+	out := bytes.Buffer{}
+	if _, err := out.ReadFrom(stdflate.NewReader(bytes.NewReader(compressed))); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func stdCompress(t *testing.T, data []byte, level int) []byte {
+	out := bytes.Buffer{}
+	w, err := stdflate.NewWriter(&out, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		blockType int
+	}{
+		{"empty", []byte{}, blockTypeFixed},
+		{"stored", randomBytes(10000), blockTypeStored},
+		{"stored multiple blocks", randomBytes(3*blockSize + 17), blockTypeStored},
+		{"fixed", []byte("hello, hello"), blockTypeFixed},
+		{"dynamic", text(50000), blockTypeDynamic},
+		{"dynamic window slide", text(5 * blockSize), blockTypeDynamic},
+		{"long matches", bytes.Repeat([]byte("ab"), 100000), blockTypeDynamic},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compressed := compress(t, test.data, 0)
+			if blockType := int(compressed[0] >> 1 & 3); blockType != test.blockType {
+				t.Errorf("block type %d, want %d", blockType, test.blockType)
+			}
+			if got := stdDecompress(t, compressed); !bytes.Equal(got, test.data) {
+				t.Errorf("stdlib decoded %d bytes, want %d", len(got), len(test.data))
+			}
+			got, err := decompress(compressed)
+			if err != nil || !bytes.Equal(got, test.data) {
+				t.Errorf("decoded %d bytes, %v; want %d", len(got), err, len(test.data))
+			}
+			for _, level := range []int{
+				stdflate.NoCompression, stdflate.HuffmanOnly,
+				stdflate.BestSpeed, stdflate.BestCompression} {
+				got, err := decompress(stdCompress(t, test.data, level))
+				if err != nil || !bytes.Equal(got, test.data) {
+					t.Errorf("level %d: decoded %d bytes, %v; want %d",
+						level, len(got), err, len(test.data))
+				}
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	data := text(100000)
+	compressed := compress(t, data, 777)
+	if got := stdDecompress(t, compressed); !bytes.Equal(got, data) {
+		t.Errorf("stdlib decoded %d bytes, want %d", len(got), len(data))
+	}
+	got, err := decompress(compressed)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decoded %d bytes, %v; want %d", len(got), err, len(data))
+	}
+
+	out := io.NewByteArrayWriter()
+	w := NewWriter(out)
+	w.Write([]byte("hello"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out.Bytes, []byte{0, 0, 0xff, 0xff}) {
+		t.Errorf("flush ended with % x, want an empty stored block", out.Bytes)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("write after close: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestKnownVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		data    string
+	}{
+		{"empty fixed block", "0300", ""},
+		{"fixed literals", "cb48cdc9c90700", "hello"},
+		{"stored block", "010500faff68656c6c6f", "hello"},
+		{"stored then fixed", "000200fdff6865cbc9c90700", "hello"},
+		{"fixed back reference", "4b840100", "aaaaaaaaa"},
+		{"empty stored block", "010000ffff", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, _ := hex.DecodeString(test.encoded)
+			if got := stdDecompress(t, encoded); string(got) != test.data {
+				t.Fatalf("bad vector: stdlib decoded %q", got)
+			}
+			got, err := decompress(encoded)
+			if err != nil || string(got) != test.data {
+				t.Errorf("decoded %q, %v; want %q", got, err, test.data)
+			}
+		})
+	}
+
+	for data, encoded := range map[string]string{
+		"":      "0300",
+		"hello": "cb48cdc9c90700",
+	} {
+		if got := hex.EncodeToString(compress(t, []byte(data), 0)); got != encoded {
+			t.Errorf("compress(%q) = %s, want %s", data, got, encoded)
+		}
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"no input", ""},
+		{"reserved block type", "07"},
+		{"stored length mismatch", "0105000000"},
+		{"stored block truncated", "010500faff6865"},
+		{"distance before start", "0302"},
+		{"invalid fixed length symbol", "1b03"},
+		{"missing final block", "ca48cdc9c90700"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, _ := hex.DecodeString(test.encoded)
+			if _, err := decompress(encoded); err == nil {
+				t.Error("decoded corrupt input without error")
+			}
+		})
+	}
+}
+
+func TestTruncatedInput(t *testing.T) {
+	for _, data := range [][]byte{
+		randomBytes(1000), []byte("hello, hello"), text(20000)} {
+		compressed := compress(t, data, 0)
+		for n := 0; n < len(compressed); n++ {
+			if _, err := decompress(compressed[:n]); err != ErrCorrupt {
+				t.Fatalf("%d of %d bytes: %v, want %v", n, len(compressed), err, ErrCorrupt)
+			}
+		}
+	}
+}
+
+func TestGarbledInputDoesNotPanic(t *testing.T) {
+	compressed := compress(t, text(20000), 0)
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		garbled := append([]byte{}, compressed...)
+		for j := 0; j < 1+rng.Intn(4); j++ {
+			garbled[rng.Intn(len(garbled))] ^= byte(1 + rng.Intn(255))
+		}
+		decompress(garbled)
+	}
+	for i := 0; i < 2000; i++ {
+		garbage := make([]byte, 1+rng.Intn(300))
+		rng.Read(garbage)
+		decompress(garbage)
+	}
+}
@@ -0,0 +1,184 @@
+package flate
+
+const (
+	maxCodeBits      = 15
+	maxCodeLenBits   = 7
+	numLitLenCodes   = 286
+	numDistCodes     = 30
+	numCodeLenCodes  = 19
+	endOfBlock       = 256
+	windowSize       = 1 << 15
+	minMatchLength   = 3
+	maxMatchLength   = 258
+	maxStoredBlock   = 1<<16 - 1
+	blockTypeStored  = 0
+	blockTypeFixed   = 1
+	blockTypeDynamic = 2
+)
+
+var codeLenOrder = [numCodeLenCodes]int{
+	16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+var lengthBase = [29]int{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+	35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+
+var lengthExtra = [29]uint{
+	0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+	3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+
+var distBase = [numDistCodes]int{
+	1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+	257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289,
+	16385, 24577}
+
+var distExtra = [numDistCodes]uint{
+	0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+	7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+var fixedLitLenLengths, fixedDistLengths = fixedLengths()
+
+func fixedLengths() ([]uint8, []uint8) {
+	litLen := make([]uint8, 288)
+	for i := range litLen {
+		switch {
+		case i < 144:
+			litLen[i] = 8
+		case i < 256:
+			litLen[i] = 9
+		case i < 280:
+			litLen[i] = 7
+		default:
+			litLen[i] = 8
+		}
+	}
+	dist := make([]uint8, numDistCodes)
+	for i := range dist {
+		dist[i] = 5
+	}
+	return litLen, dist
+}
+
+func lengthCode(length int) int {
+	code := 0
+	for code < len(lengthBase)-1 && lengthBase[code+1] <= length {
+		code++
+	}
+	return code
+}
+
+func distCode(dist int) int {
+	code := 0
+	for code < len(distBase)-1 && distBase[code+1] <= dist {
+		code++
+	}
+	return code
+}
+
+// huffmanLengths builds code lengths from symbol frequencies. When the
+// tree gets deeper than maxBits the frequencies are flattened and the
+// tree rebuilt, which converges quickly for the alphabet sizes of DEFLATE.
+func huffmanLengths(freqs []int, maxBits int) []uint8 {
+	weights := make([]int, len(freqs))
+	copy(weights, freqs)
+	for {
+		lengths, depth := buildHuffmanTree(weights)
+		if depth <= maxBits {
+			return lengths
+		}
+		for i, w := range weights {
+			if w > 0 {
+				weights[i] = w>>1 | 1
+			}
+		}
+	}
+}
+
+func buildHuffmanTree(weights []int) ([]uint8, int) {
+	lengths := make([]uint8, len(weights))
+	nodes := make([]int, 0, 2*len(weights))
+	parents := make([]int, 0, 2*len(weights))
+	symbols := make([]int, 0, len(weights))
+	active := make([]int, 0, len(weights))
+	for symbol, w := range weights {
+		if w > 0 {
+			active = append(active, len(nodes))
+			nodes = append(nodes, w)
+			parents = append(parents, -1)
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) == 1 {
+		lengths[symbols[0]] = 1
+		return lengths, 1
+	}
+	for len(active) > 1 {
+		first := removeSmallest(&active, nodes)
+		second := removeSmallest(&active, nodes)
+		parents[first] = len(nodes)
+		parents[second] = len(nodes)
+		active = append(active, len(nodes))
+		nodes = append(nodes, nodes[first]+nodes[second])
+		parents = append(parents, -1)
+	}
+	maxDepth := 0
+	for leaf, symbol := range symbols {
+		depth := 0
+		for node := leaf; parents[node] >= 0; node = parents[node] {
+			depth++
+		}
+		lengths[symbol] = uint8(depth)
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	return lengths, maxDepth
+}
+
+func removeSmallest(active *[]int, nodes []int) int {
+	smallest := 0
+	for i, node := range *active {
+		if nodes[node] < nodes[(*active)[smallest]] {
+			smallest = i
+		}
+	}
+	node := (*active)[smallest]
+	last := len(*active) - 1
+	(*active)[smallest] = (*active)[last]
+	*active = (*active)[:last]
+	return node
+}
+
+// canonicalCodes assigns RFC 1951 canonical codes, returned bit-reversed
+// because DEFLATE packs Huffman codes starting from the most significant bit.
+func canonicalCodes(lengths []uint8) []uint16 {
+	counts := [maxCodeBits + 1]int{}
+	for _, length := range lengths {
+		counts[length]++
+	}
+	counts[0] = 0
+	next := [maxCodeBits + 1]int{}
+	code := 0
+	for bits := 1; bits <= maxCodeBits; bits++ {
+		code = (code + counts[bits-1]) << 1
+		next[bits] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		codes[symbol] = reverseBits(uint16(next[length]), uint(length))
+		next[length]++
+	}
+	return codes
+}
+
+func reverseBits(code uint16, length uint) uint16 {
+	reversed := uint16(0)
+	for i := uint(0); i < length; i++ {
+		reversed = reversed<<1 | code&1
+		code >>= 1
+	}
+	return reversed
+}
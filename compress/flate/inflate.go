@@ -0,0 +1,325 @@
+package flate
+
+import "github.com/alaisi/syscalltodo/io"
+
+type flateError string
+
+func (err flateError) Error() string {
+	return string(err)
+}
+
+const (
+	ErrCorrupt = flateError("Corrupt deflate stream")
+	ErrClosed  = flateError("Write to closed writer")
+)
+
+const (
+	stateBlockHeader = iota
+	stateStored
+	stateHuffman
+	stateDone
+)
+
+const outputChunk = 16 * 1024
+
+type Reader struct {
+	reader io.ByteReader
+	acc    uint32
+	count  uint
+	out    []byte
+	pos    int
+	state  int
+	final  bool
+	stored int
+	litLen *huffman
+	dist   *huffman
+	err    error
+}
+
+type huffman struct {
+	counts  [maxCodeBits + 1]int
+	symbols []int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	byteReader, isByteReader := reader.(io.ByteReader)
+	if !isByteReader {
+		byteReader = io.NewBufferedReader(reader)
+	}
+	return &Reader{reader: byteReader, out: make([]byte, 0, 2*windowSize)}
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	for r.pos == len(r.out) {
+		if r.err != nil {
+			return -1, r.err
+		}
+		if r.state == stateDone {
+			return -1, io.EOF
+		}
+		if len(r.out) >= 2*windowSize {
+			copy(r.out, r.out[len(r.out)-windowSize:])
+			r.out = r.out[:windowSize]
+			r.pos = windowSize
+		}
+		r.err = r.inflate()
+	}
+	n := copy(buf, r.out[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *Reader) inflate() error {
+	target := len(r.out) + outputChunk
+	for len(r.out) < target {
+		switch r.state {
+		case stateDone:
+			return nil
+		case stateBlockHeader:
+			if r.final {
+				r.state = stateDone
+				return nil
+			}
+			if err := r.readBlockHeader(); err != nil {
+				return err
+			}
+		case stateStored:
+			if r.stored == 0 {
+				r.state = stateBlockHeader
+				continue
+			}
+			b, err := r.reader.ReadByte()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			r.out = append(r.out, b)
+			r.stored--
+		case stateHuffman:
+			if err := r.inflateSymbol(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Reader) readBlockHeader() error {
+	header, err := r.bits(3)
+	if err != nil {
+		return err
+	}
+	r.final = header&1 == 1
+	switch header >> 1 {
+	case blockTypeStored:
+		r.acc, r.count = 0, 0
+		lengths := [4]byte{}
+		for i := range lengths {
+			if lengths[i], err = r.reader.ReadByte(); err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		length := int(lengths[0]) | int(lengths[1])<<8
+		if lengths[0] != ^lengths[2] || lengths[1] != ^lengths[3] {
+			return ErrCorrupt
+		}
+		r.stored = length
+		r.state = stateStored
+	case blockTypeFixed:
+		r.litLen, _ = newHuffman(fixedLitLenLengths)
+		r.dist, _ = newHuffman(fixedDistLengths)
+		r.state = stateHuffman
+	case blockTypeDynamic:
+		if err := r.readDynamicTables(); err != nil {
+			return err
+		}
+		r.state = stateHuffman
+	default:
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func (r *Reader) readDynamicTables() error {
+	counts, err := r.bits(14)
+	if err != nil {
+		return err
+	}
+	numLitLen := int(counts&0x1f) + 257
+	numDist := int(counts>>5&0x1f) + 1
+	numCodeLen := int(counts>>10) + 4
+	if numLitLen > numLitLenCodes || numDist > numDistCodes {
+		return ErrCorrupt
+	}
+	codeLenLengths := make([]uint8, numCodeLenCodes)
+	for i := 0; i < numCodeLen; i++ {
+		length, err := r.bits(3)
+		if err != nil {
+			return err
+		}
+		codeLenLengths[codeLenOrder[i]] = uint8(length)
+	}
+	codeLen, err := newHuffman(codeLenLengths)
+	if err != nil {
+		return err
+	}
+	lengths := make([]uint8, 0, numLitLen+numDist)
+	for len(lengths) < numLitLen+numDist {
+		symbol, err := r.decode(codeLen)
+		if err != nil {
+			return err
+		}
+		if symbol < 16 {
+			lengths = append(lengths, uint8(symbol))
+			continue
+		}
+		repeat, value := 0, uint8(0)
+		switch symbol {
+		case 16:
+			if len(lengths) == 0 {
+				return ErrCorrupt
+			}
+			value = lengths[len(lengths)-1]
+			extra, err := r.bits(2)
+			if err != nil {
+				return err
+			}
+			repeat = 3 + int(extra)
+		case 17:
+			extra, err := r.bits(3)
+			if err != nil {
+				return err
+			}
+			repeat = 3 + int(extra)
+		default:
+			extra, err := r.bits(7)
+			if err != nil {
+				return err
+			}
+			repeat = 11 + int(extra)
+		}
+		if len(lengths)+repeat > numLitLen+numDist {
+			return ErrCorrupt
+		}
+		for ; repeat > 0; repeat-- {
+			lengths = append(lengths, value)
+		}
+	}
+	if lengths[endOfBlock] == 0 {
+		return ErrCorrupt
+	}
+	if r.litLen, err = newHuffman(lengths[:numLitLen]); err != nil {
+		return err
+	}
+	r.dist, err = newHuffman(lengths[numLitLen:])
+	return err
+}
+
+func (r *Reader) inflateSymbol() error {
+	symbol, err := r.decode(r.litLen)
+	if err != nil {
+		return err
+	}
+	if symbol < endOfBlock {
+		r.out = append(r.out, byte(symbol))
+		return nil
+	}
+	if symbol == endOfBlock {
+		r.state = stateBlockHeader
+		return nil
+	}
+	symbol -= 257
+	if symbol >= len(lengthBase) {
+		return ErrCorrupt
+	}
+	extra, err := r.bits(lengthExtra[symbol])
+	if err != nil {
+		return err
+	}
+	length := lengthBase[symbol] + int(extra)
+	code, err := r.decode(r.dist)
+	if err != nil {
+		return err
+	}
+	if code >= numDistCodes {
+		return ErrCorrupt
+	}
+	if extra, err = r.bits(distExtra[code]); err != nil {
+		return err
+	}
+	dist := distBase[code] + int(extra)
+	if dist > len(r.out) {
+		return ErrCorrupt
+	}
+	start := len(r.out) - dist
+	for i := 0; i < length; i++ {
+		r.out = append(r.out, r.out[start+i])
+	}
+	return nil
+}
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbols: make([]int, 0, len(lengths))}
+	for _, length := range lengths {
+		h.counts[length]++
+	}
+	left := 1
+	for bits := 1; bits <= maxCodeBits; bits++ {
+		left <<= 1
+		if left -= h.counts[bits]; left < 0 {
+			return nil, ErrCorrupt
+		}
+	}
+	offsets := [maxCodeBits + 2]int{}
+	for bits := 1; bits <= maxCodeBits; bits++ {
+		offsets[bits+1] = offsets[bits] + h.counts[bits]
+	}
+	h.symbols = h.symbols[:offsets[maxCodeBits+1]]
+	for symbol, length := range lengths {
+		if length != 0 {
+			h.symbols[offsets[length]] = symbol
+			offsets[length]++
+		}
+	}
+	return h, nil
+}
+
+func (r *Reader) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for bits := 1; bits <= maxCodeBits; bits++ {
+		bit, err := r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := h.counts[bits]
+		if code-first < count {
+			return h.symbols[index+code-first], nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, ErrCorrupt
+}
+
+func (r *Reader) bits(count uint) (uint32, error) {
+	for r.count < count {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		r.acc |= uint32(b) << r.count
+		r.count += 8
+	}
+	value := r.acc & (1<<count - 1)
+	r.acc >>= count
+	r.count -= count
+	return value, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return ErrCorrupt
+	}
+	return err
+}
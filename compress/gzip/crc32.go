@@ -0,0 +1,31 @@
+package gzip
+
+var crc32Table = makeCrc32Table()
+
+func makeCrc32Table() [256]uint32 {
+	table := [256]uint32{}
+	for i := range table {
+		crc := uint32(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0xedb88320
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func Crc32(data []byte) uint32 {
+	return UpdateCrc32(0, data)
+}
+
+func UpdateCrc32(crc uint32, data []byte) uint32 {
+	crc = ^crc
+	for _, b := range data {
+		crc = crc32Table[byte(crc)^b] ^ crc>>8
+	}
+	return ^crc
+}
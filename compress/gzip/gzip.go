@@ -0,0 +1,173 @@
+package gzip
+
+import (
+	"github.com/alaisi/syscalltodo/compress/flate"
+	"github.com/alaisi/syscalltodo/io"
+)
+
+type gzipError string
+
+func (err gzipError) Error() string {
+	return string(err)
+}
+
+const (
+	ErrHeader   = gzipError("Invalid gzip header")
+	ErrChecksum = gzipError("Invalid gzip checksum")
+)
+
+const (
+	flagHeaderCrc = 1 << 1
+	flagExtra     = 1 << 2
+	flagName      = 1 << 3
+	flagComment   = 1 << 4
+	flagReserved  = 0xe0
+)
+
+type Writer struct {
+	writer        io.Writer
+	compressor    *flate.Writer
+	crc           uint32
+	size          uint32
+	headerWritten bool
+	closed        bool
+	err           error
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer, compressor: flate.NewWriter(writer)}
+}
+
+func (w *Writer) Write(data []byte) (int, error) {
+	if err := w.writeHeader(); err != nil {
+		return -1, err
+	}
+	w.crc = UpdateCrc32(w.crc, data)
+	w.size += uint32(len(data))
+	return w.compressor.Write(data)
+}
+
+func (w *Writer) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.compressor.Flush()
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	if w.err = w.compressor.Close(); w.err != nil {
+		return w.err
+	}
+	trailer := []byte{
+		byte(w.crc), byte(w.crc >> 8), byte(w.crc >> 16), byte(w.crc >> 24),
+		byte(w.size), byte(w.size >> 8), byte(w.size >> 16), byte(w.size >> 24)}
+	_, w.err = w.writer.Write(trailer)
+	return w.err
+}
+
+func (w *Writer) writeHeader() error {
+	if w.headerWritten || w.err != nil {
+		return w.err
+	}
+	w.headerWritten = true
+	_, w.err = w.writer.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255})
+	return w.err
+}
+
+type Reader struct {
+	reader       *io.BufferedReader
+	decompressor *flate.Reader
+	crc          uint32
+	size         uint32
+	err          error
+}
+
+func NewReader(reader io.Reader) (*Reader, error) {
+	buffered := io.NewBufferedReader(reader)
+	if err := readHeader(buffered); err != nil {
+		return nil, err
+	}
+	return &Reader{reader: buffered, decompressor: flate.NewReader(buffered)}, nil
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return -1, r.err
+	}
+	n, err := r.decompressor.Read(buf)
+	if err == io.EOF {
+		r.err = r.verifyTrailer()
+		return -1, r.err
+	}
+	if err != nil {
+		r.err = err
+		return -1, err
+	}
+	r.crc = UpdateCrc32(r.crc, buf[:n])
+	r.size += uint32(n)
+	return n, nil
+}
+
+func (r *Reader) verifyTrailer() error {
+	trailer := make([]byte, 8)
+	if _, err := io.ReadFull(r.reader, trailer); err != nil {
+		return ErrChecksum
+	}
+	crc := uint32(trailer[0]) | uint32(trailer[1])<<8 |
+		uint32(trailer[2])<<16 | uint32(trailer[3])<<24
+	size := uint32(trailer[4]) | uint32(trailer[5])<<8 |
+		uint32(trailer[6])<<16 | uint32(trailer[7])<<24
+	if crc != r.crc || size != r.size {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+func readHeader(reader *io.BufferedReader) error {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return ErrHeader
+	}
+	flags := header[3]
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 ||
+		flags&flagReserved != 0 {
+		return ErrHeader
+	}
+	if flags&flagExtra != 0 {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return ErrHeader
+		}
+		extra := make([]byte, int(length[0])|int(length[1])<<8)
+		if _, err := io.ReadFull(reader, extra); err != nil {
+			return ErrHeader
+		}
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return ErrHeader
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&flagHeaderCrc != 0 {
+		if _, err := io.ReadFull(reader, make([]byte, 2)); err != nil {
+			return ErrHeader
+		}
+	}
+	return nil
+}
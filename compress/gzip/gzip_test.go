@@ -0,0 +1,149 @@
+package gzip
+
+import (
+	"bytes"
+	stdgzip "compress/gzip"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+func testData() map[string][]byte {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("hello, hello"),
+		"text":   bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 3000),
+		"random": random,
+	}
+}
+
+func compress(t *testing.T, data []byte) []byte {
+	out := io.NewByteArrayWriter()
+	w := NewWriter(out)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	r, err := NewReader(io.NewByteArrayReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	out := []byte{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range testData() {
+		t.Run(name, func(t *testing.T) {
+			compressed := compress(t, data)
+			r, err := stdgzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := bytes.Buffer{}
+			if _, err := got.ReadFrom(r); err != nil || !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("stdlib decoded %d bytes, %v; want %d", got.Len(), err, len(data))
+			}
+
+			std := bytes.Buffer{}
+			w := stdgzip.NewWriter(&std)
+			w.Name, w.Comment, w.Extra = "todo.txt", "a comment", []byte{1, 2, 3}
+			w.Write(data)
+			w.Close()
+			for _, compressed := range [][]byte{compressed, std.Bytes()} {
+				got, err := decompress(compressed)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("decoded %d bytes, %v; want %d", len(got), err, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestKnownVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		data    string
+	}{
+		{"empty", "1f8b08000000000000ff03000000000000000000", ""},
+		{"hello", "1f8b08000000000000ffcb48cdc9c90700" + "86a61036" + "05000000", "hello"},
+		{"header crc", "1f8b08020000000000ff" + "0000" +
+			"cb48cdc9c90700" + "86a61036" + "05000000", "hello"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, _ := hex.DecodeString(test.encoded)
+			got, err := decompress(encoded)
+			if err != nil || string(got) != test.data {
+				t.Errorf("decoded %q, %v; want %q", got, err, test.data)
+			}
+		})
+	}
+	if got := hex.EncodeToString(compress(t, []byte("hello"))); got != tests[1].encoded {
+		t.Errorf("compress(hello) = %s, want %s", got, tests[1].encoded)
+	}
+	if crc := Crc32([]byte("123456789")); crc != 0xcbf43926 {
+		t.Errorf("crc32 check value %08x", crc)
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	valid := compress(t, []byte("hello, hello"))
+	trailer := len(valid) - 8
+	corrupt := func(i int, b byte) []byte {
+		data := append([]byte{}, valid...)
+		data[i] ^= b
+		return data
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"crc mismatch", corrupt(trailer, 1), ErrChecksum},
+		{"isize mismatch", corrupt(trailer+4, 1), ErrChecksum},
+		{"isize high bits", corrupt(len(valid)-1, 0x80), ErrChecksum},
+		{"missing trailer", valid[:trailer], ErrChecksum},
+		{"short trailer", valid[:len(valid)-1], ErrChecksum},
+		{"bad magic", corrupt(0, 1), ErrHeader},
+		{"bad method", corrupt(2, 1), ErrHeader},
+		{"reserved flags", corrupt(3, 0x20), ErrHeader},
+		{"unterminated name", append(corrupt(3, flagName)[:10], "todo.txt"...), ErrHeader},
+		{"short extra field", append(corrupt(3, flagExtra)[:10], 9, 0, 1), ErrHeader},
+		{"short header", valid[:9], ErrHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decompress(test.input); err != test.err {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	for n := 10; n < trailer; n++ {
+		if _, err := decompress(valid[:n]); err == nil {
+			t.Errorf("decoded %d of %d bytes without error", n, len(valid))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package zlib
+
+import (
+	"github.com/alaisi/syscalltodo/compress/flate"
+	"github.com/alaisi/syscalltodo/io"
+)
+
+type zlibError string
+
+func (err zlibError) Error() string {
+	return string(err)
+}
+
+const (
+	ErrHeader   = zlibError("Invalid zlib header")
+	ErrChecksum = zlibError("Invalid zlib checksum")
+)
+
+type Writer struct {
+	writer        io.Writer
+	compressor    *flate.Writer
+	adler         uint32
+	headerWritten bool
+	closed        bool
+	err           error
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer, compressor: flate.NewWriter(writer), adler: 1}
+}
+
+func (w *Writer) Write(data []byte) (int, error) {
+	if err := w.writeHeader(); err != nil {
+		return -1, err
+	}
+	w.adler = updateAdler32(w.adler, data)
+	return w.compressor.Write(data)
+}
+
+func (w *Writer) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.compressor.Flush()
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	if w.err = w.compressor.Close(); w.err != nil {
+		return w.err
+	}
+	_, w.err = w.writer.Write([]byte{
+		byte(w.adler >> 24), byte(w.adler >> 16), byte(w.adler >> 8), byte(w.adler)})
+	return w.err
+}
+
+func (w *Writer) writeHeader() error {
+	if w.headerWritten || w.err != nil {
+		return w.err
+	}
+	w.headerWritten = true
+	_, w.err = w.writer.Write([]byte{0x78, 0x9c})
+	return w.err
+}
+
+type Reader struct {
+	reader       *io.BufferedReader
+	decompressor *flate.Reader
+	adler        uint32
+	err          error
+}
+
+func NewReader(reader io.Reader) (*Reader, error) {
+	buffered := io.NewBufferedReader(reader)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return nil, ErrHeader
+	}
+	if header[0]&0x0f != 8 || header[0]>>4 > 7 || header[1]&0x20 != 0 ||
+		(int(header[0])<<8|int(header[1]))%31 != 0 {
+		return nil, ErrHeader
+	}
+	return &Reader{
+		reader: buffered, decompressor: flate.NewReader(buffered), adler: 1,
+	}, nil
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return -1, r.err
+	}
+	n, err := r.decompressor.Read(buf)
+	if err == io.EOF {
+		r.err = r.verifyTrailer()
+		return -1, r.err
+	}
+	if err != nil {
+		r.err = err
+		return -1, err
+	}
+	r.adler = updateAdler32(r.adler, buf[:n])
+	return n, nil
+}
+
+func (r *Reader) verifyTrailer() error {
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, trailer); err != nil {
+		return ErrChecksum
+	}
+	adler := uint32(trailer[0])<<24 | uint32(trailer[1])<<16 |
+		uint32(trailer[2])<<8 | uint32(trailer[3])
+	if adler != r.adler {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+func updateAdler32(adler uint32, data []byte) uint32 {
+	const mod = 65521
+	a, b := adler&0xffff, adler>>16
+	for len(data) > 0 {
+		n := min(len(data), 5552)
+		for _, c := range data[:n] {
+			a += uint32(c)
+			b += a
+		}
+		a %= mod
+		b %= mod
+		data = data[n:]
+	}
+	return b<<16 | a
+}
@@ -0,0 +1,144 @@
+package zlib
+
+import (
+	"bytes"
+	stdzlib "compress/zlib"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+func testData() map[string][]byte {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("hello, hello"),
+		"text":   bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 3000),
+		"random": random,
+	}
+}
+
+func compress(t *testing.T, data []byte) []byte {
+	out := io.NewByteArrayWriter()
+	w := NewWriter(out)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	r, err := NewReader(io.NewByteArrayReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	out := []byte{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range testData() {
+		t.Run(name, func(t *testing.T) {
+			compressed := compress(t, data)
+			r, err := stdzlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := bytes.Buffer{}
+			if _, err := got.ReadFrom(r); err != nil || !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("stdlib decoded %d bytes, %v; want %d", got.Len(), err, len(data))
+			}
+
+			for _, level := range []int{stdzlib.NoCompression, stdzlib.BestSpeed,
+				stdzlib.DefaultCompression, stdzlib.BestCompression} {
+				std := bytes.Buffer{}
+				w, _ := stdzlib.NewWriterLevel(&std, level)
+				w.Write(data)
+				w.Close()
+				got, err := decompress(std.Bytes())
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("level %d: decoded %d bytes, %v; want %d",
+						level, len(got), err, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestKnownVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		data    string
+	}{
+		{"empty", "789c030000000001", ""},
+		{"hello", "789ccb48cdc9c90700062c0215", "hello"},
+		{"fastest level", "7801cb48cdc9c90700062c0215", "hello"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, _ := hex.DecodeString(test.encoded)
+			got, err := decompress(encoded)
+			if err != nil || string(got) != test.data {
+				t.Errorf("decoded %q, %v; want %q", got, err, test.data)
+			}
+		})
+	}
+	if got := hex.EncodeToString(compress(t, []byte("hello"))); got != tests[1].encoded {
+		t.Errorf("compress(hello) = %s, want %s", got, tests[1].encoded)
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	valid := compress(t, []byte("hello, hello"))
+	trailer := len(valid) - 4
+	corrupt := func(i int, b byte) []byte {
+		data := append([]byte{}, valid...)
+		data[i] ^= b
+		return data
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"adler mismatch", corrupt(trailer, 1), ErrChecksum},
+		{"adler low byte", corrupt(len(valid)-1, 0x80), ErrChecksum},
+		{"missing trailer", valid[:trailer], ErrChecksum},
+		{"short trailer", valid[:len(valid)-1], ErrChecksum},
+		{"bad method", []byte{0x79, 0x9c}, ErrHeader},
+		{"window too large", []byte{0x88, 0x98}, ErrHeader},
+		{"bad check bits", corrupt(1, 1), ErrHeader},
+		{"preset dictionary", []byte{0x78, 0xbb}, ErrHeader},
+		{"short header", valid[:1], ErrHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decompress(test.input); err != test.err {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	for n := 2; n < trailer; n++ {
+		if _, err := decompress(valid[:n]); err == nil {
+			t.Errorf("decoded %d of %d bytes without error", n, len(valid))
+		}
+	}
+}
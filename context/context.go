@@ -0,0 +1,288 @@
+package context
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+type contextError string
+
+func (err contextError) Error() string {
+	return string(err)
+}
+
+const (
+	Canceled         = contextError("context canceled")
+	DeadlineExceeded = contextError("context deadline exceeded")
+)
+
+type Context interface {
+	Deadline() (time.Time, bool)
+	Done() <-chan struct{}
+	Err() error
+}
+
+type CancelFunc func()
+
+type emptyContext struct{}
+
+func (emptyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (emptyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (emptyContext) Err() error {
+	return nil
+}
+
+var background = emptyContext{}
+
+func Background() Context {
+	return background
+}
+
+type cancelContext struct {
+	parent   Context
+	deadline time.Time
+	lock     chan any
+	done     chan struct{}
+	children map[*cancelContext]bool
+	err      error
+}
+
+func WithCancel(parent Context) (Context, CancelFunc) {
+	ctx := newCancelContext(parent, time.Time{})
+	return ctx, func() { ctx.cancel(Canceled) }
+}
+
+func WithDeadline(parent Context, deadline time.Time) (Context, CancelFunc) {
+	if parentDeadline, ok := parent.Deadline(); ok &&
+		parentDeadline.Before(deadline) {
+		return WithCancel(parent)
+	}
+	ctx := newCancelContext(parent, deadline)
+	if !time.Now().Before(deadline) {
+		ctx.cancel(DeadlineExceeded)
+	} else {
+		timers.add(ctx)
+	}
+	return ctx, func() { ctx.cancel(Canceled) }
+}
+
+func WithTimeout(parent Context, timeout time.Duration) (Context, CancelFunc) {
+	return WithDeadline(parent, time.Now().Add(timeout))
+}
+
+func newCancelContext(parent Context, deadline time.Time) *cancelContext {
+	ctx := &cancelContext{
+		parent:   parent,
+		deadline: deadline,
+		lock:     make(chan any, 1),
+		done:     make(chan struct{}),
+	}
+	ctx.lock <- struct{}{}
+	ctx.propagate()
+	return ctx
+}
+
+// propagate links the context to its parent: children of our own contexts
+// are cancelled directly, any other parent gets a goroutine watching Done.
+func (ctx *cancelContext) propagate() {
+	parentDone := ctx.parent.Done()
+	if parentDone == nil {
+		return
+	}
+	if parent, isCancelContext := ctx.parent.(*cancelContext); isCancelContext {
+		var err error
+		parent.withLock(func() {
+			if err = parent.err; err == nil {
+				if parent.children == nil {
+					parent.children = make(map[*cancelContext]bool)
+				}
+				parent.children[ctx] = true
+			}
+		})
+		if err != nil {
+			ctx.cancel(err)
+		}
+		return
+	}
+	go func() {
+		select {
+		case <-parentDone:
+			ctx.cancel(ctx.parent.Err())
+		case <-ctx.done:
+		}
+	}()
+}
+
+func (ctx *cancelContext) Deadline() (time.Time, bool) {
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+func (ctx *cancelContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *cancelContext) Err() error {
+	var err error
+	ctx.withLock(func() {
+		err = ctx.err
+	})
+	return err
+}
+
+func (ctx *cancelContext) cancel(err error) {
+	var children map[*cancelContext]bool
+	cancelled := false
+	ctx.withLock(func() {
+		if ctx.err != nil {
+			return
+		}
+		ctx.err = err
+		children, ctx.children = ctx.children, nil
+		close(ctx.done)
+		cancelled = true
+	})
+	if !cancelled {
+		return
+	}
+	for child := range children {
+		child.cancel(err)
+	}
+	if parent, isCancelContext := ctx.parent.(*cancelContext); isCancelContext {
+		parent.withLock(func() {
+			delete(parent.children, ctx)
+		})
+	}
+	if !ctx.deadline.IsZero() {
+		timers.remove(ctx)
+	}
+}
+
+func (ctx *cancelContext) withLock(fn func()) {
+	locked := <-ctx.lock
+	defer func() {
+		ctx.lock <- locked
+	}()
+	fn()
+}
+
+// timerQueue expires deadlines from a single goroutine, which sleeps in
+// epoll_wait until the earliest deadline or until an eventfd write tells it
+// that an earlier deadline was added.
+type timerQueue struct {
+	lock     chan any
+	contexts map[*cancelContext]bool
+	wakefd   int
+	started  bool
+}
+
+var timers = newTimerQueue()
+
+func newTimerQueue() *timerQueue {
+	q := &timerQueue{
+		lock:     make(chan any, 1),
+		contexts: make(map[*cancelContext]bool),
+		wakefd:   -1,
+	}
+	q.lock <- struct{}{}
+	return q
+}
+
+func (q *timerQueue) add(ctx *cancelContext) {
+	var err error
+	q.withLock(func() {
+		q.contexts[ctx] = true
+		if !q.started {
+			err = q.start()
+		}
+	})
+	if err != nil {
+		go func() {
+			time.Sleep(time.Until(ctx.deadline))
+			ctx.cancel(DeadlineExceeded)
+		}()
+		return
+	}
+	io.Write(q.wakefd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+}
+
+func (q *timerQueue) remove(ctx *cancelContext) {
+	q.withLock(func() {
+		delete(q.contexts, ctx)
+	})
+}
+
+func (q *timerQueue) start() error {
+	eventfd, _, errno := syscall.Syscall(
+		syscall.SYS_EVENTFD,
+		uintptr(0),
+		uintptr(0),
+		uintptr(0))
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	poller, err := io.NewPoller()
+	if err != nil {
+		syscall.Close(int(eventfd))
+		return err
+	}
+	if err := poller.Add(int(eventfd), syscall.EPOLLIN); err != nil {
+		poller.Close()
+		syscall.Close(int(eventfd))
+		return err
+	}
+	q.wakefd = int(eventfd)
+	q.started = true
+	go q.run(poller)
+	return nil
+}
+
+func (q *timerQueue) run(poller *io.Poller) {
+	events := make([]syscall.EpollEvent, 1)
+	counter := make([]byte, 8)
+	for {
+		n, _ := poller.Wait(events, q.expire())
+		if n > 0 {
+			io.Read(q.wakefd, counter)
+		}
+	}
+}
+
+func (q *timerQueue) expire() int {
+	now := time.Now()
+	expired := make([]*cancelContext, 0)
+	timeout := -1
+	q.withLock(func() {
+		for ctx := range q.contexts {
+			remaining := ctx.deadline.Sub(now)
+			if remaining <= 0 {
+				expired = append(expired, ctx)
+				delete(q.contexts, ctx)
+				continue
+			}
+			millis := int((remaining + time.Millisecond - 1) / time.Millisecond)
+			if timeout < 0 || millis < timeout {
+				timeout = millis
+			}
+		}
+	})
+	for _, ctx := range expired {
+		ctx.cancel(DeadlineExceeded)
+	}
+	return timeout
+}
+
+func (q *timerQueue) withLock(fn func()) {
+	locked := <-q.lock
+	defer func() {
+		q.lock <- locked
+	}()
+	fn()
+}
@@ -0,0 +1,241 @@
+package crypto
+
+type cryptoError string
+
+func (err cryptoError) Error() string {
+	return string(err)
+}
+
+const ErrAuthentication = cryptoError("Message authentication failed")
+
+func ChaCha20Poly1305Seal(
+	key []byte,
+	nonce []byte,
+	plaintext []byte,
+	additionalData []byte,
+) []byte {
+	sealed := make([]byte, len(plaintext), len(plaintext)+16)
+	chacha20XorKeyStream(key, nonce, 1, sealed, plaintext)
+	tag := poly1305(chacha20PolyKey(key, nonce),
+		aeadMacData(additionalData, sealed))
+	return append(sealed, tag...)
+}
+
+func ChaCha20Poly1305Open(
+	key []byte,
+	nonce []byte,
+	sealed []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	if len(sealed) < 16 {
+		return nil, ErrAuthentication
+	}
+	ciphertext, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+	expected := poly1305(chacha20PolyKey(key, nonce),
+		aeadMacData(additionalData, ciphertext))
+	diff := byte(0)
+	for i := 0; i < 16; i++ {
+		diff |= expected[i] ^ tag[i]
+	}
+	if diff != 0 {
+		return nil, ErrAuthentication
+	}
+	plaintext := make([]byte, len(ciphertext))
+	chacha20XorKeyStream(key, nonce, 1, plaintext, ciphertext)
+	return plaintext, nil
+}
+
+func chacha20PolyKey(key []byte, nonce []byte) []byte {
+	polyKey := make([]byte, 32)
+	chacha20XorKeyStream(key, nonce, 0, polyKey, polyKey)
+	return polyKey
+}
+
+func aeadMacData(additionalData []byte, ciphertext []byte) []byte {
+	data := make([]byte, 0, len(additionalData)+len(ciphertext)+48)
+	data = append(data, additionalData...)
+	data = append(data, make([]byte, (16-len(additionalData)%16)%16)...)
+	data = append(data, ciphertext...)
+	data = append(data, make([]byte, (16-len(ciphertext)%16)%16)...)
+	data = appendUint64LE(data, uint64(len(additionalData)))
+	return appendUint64LE(data, uint64(len(ciphertext)))
+}
+
+func appendUint64LE(b []byte, v uint64) []byte {
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(v>>(uint(i)*8)))
+	}
+	return b
+}
+
+func readUint32LE(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func chacha20XorKeyStream(
+	key []byte,
+	nonce []byte,
+	counter uint32,
+	dst []byte,
+	src []byte,
+) {
+	state := [16]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+	for i := 0; i < 8; i++ {
+		state[4+i] = readUint32LE(key[i*4:])
+	}
+	for i := 0; i < 3; i++ {
+		state[13+i] = readUint32LE(nonce[i*4:])
+	}
+	block := make([]byte, 64)
+	for offset := 0; offset < len(src); offset += 64 {
+		state[12] = counter
+		chacha20Block(&state, block)
+		for i := 0; i < 64 && offset+i < len(src); i++ {
+			dst[offset+i] = src[offset+i] ^ block[i]
+		}
+		counter++
+	}
+}
+
+func chacha20Block(state *[16]uint32, output []byte) {
+	x := *state
+	for i := 0; i < 10; i++ {
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 1, 5, 9, 13)
+		quarterRound(&x, 2, 6, 10, 14)
+		quarterRound(&x, 3, 7, 11, 15)
+		quarterRound(&x, 0, 5, 10, 15)
+		quarterRound(&x, 1, 6, 11, 12)
+		quarterRound(&x, 2, 7, 8, 13)
+		quarterRound(&x, 3, 4, 9, 14)
+	}
+	for i := 0; i < 16; i++ {
+		v := x[i] + state[i]
+		output[i*4] = byte(v)
+		output[i*4+1] = byte(v >> 8)
+		output[i*4+2] = byte(v >> 16)
+		output[i*4+3] = byte(v >> 24)
+	}
+}
+
+func quarterRound(x *[16]uint32, a int, b int, c int, d int) {
+	x[a] += x[b]
+	x[d] = rol32(x[d]^x[a], 16)
+	x[c] += x[d]
+	x[b] = rol32(x[b]^x[c], 12)
+	x[a] += x[b]
+	x[d] = rol32(x[d]^x[a], 8)
+	x[c] += x[d]
+	x[b] = rol32(x[b]^x[c], 7)
+}
+
+func rol32(x uint32, n uint) uint32 {
+	return x<<n | x>>(32-n)
+}
+
+// poly1305 follows the 26-bit limb layout of poly1305-donna so that all
+// intermediate products fit in 64 bits.
+func poly1305(key []byte, message []byte) []byte {
+	const mask = 0x3ffffff
+	r0 := uint64(readUint32LE(key[0:]) & 0x3ffffff)
+	r1 := uint64(readUint32LE(key[3:]) >> 2 & 0x3ffff03)
+	r2 := uint64(readUint32LE(key[6:]) >> 4 & 0x3ffc0ff)
+	r3 := uint64(readUint32LE(key[9:]) >> 6 & 0x3f03fff)
+	r4 := uint64(readUint32LE(key[12:]) >> 8 & 0x00fffff)
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+	var h0, h1, h2, h3, h4 uint64
+	block := make([]byte, 16)
+	for offset := 0; offset < len(message); offset += 16 {
+		hibit := uint64(1 << 24)
+		if n := copy(block, message[offset:]); n < 16 {
+			block[n] = 1
+			for i := n + 1; i < 16; i++ {
+				block[i] = 0
+			}
+			hibit = 0
+		}
+		h0 += uint64(readUint32LE(block[0:]) & mask)
+		h1 += uint64(readUint32LE(block[3:]) >> 2 & mask)
+		h2 += uint64(readUint32LE(block[6:]) >> 4 & mask)
+		h3 += uint64(readUint32LE(block[9:]) >> 6 & mask)
+		h4 += uint64(readUint32LE(block[12:])>>8) | hibit
+		d0 := h0*r0 + h1*s4 + h2*s3 + h3*s2 + h4*s1
+		d1 := h0*r1 + h1*r0 + h2*s4 + h3*s3 + h4*s2
+		d2 := h0*r2 + h1*r1 + h2*r0 + h3*s4 + h4*s3
+		d3 := h0*r3 + h1*r2 + h2*r1 + h3*r0 + h4*s4
+		d4 := h0*r4 + h1*r3 + h2*r2 + h3*r1 + h4*r0
+		c := d0 >> 26
+		h0 = d0 & mask
+		d1 += c
+		c = d1 >> 26
+		h1 = d1 & mask
+		d2 += c
+		c = d2 >> 26
+		h2 = d2 & mask
+		d3 += c
+		c = d3 >> 26
+		h3 = d3 & mask
+		d4 += c
+		c = d4 >> 26
+		h4 = d4 & mask
+		h0 += c * 5
+		c = h0 >> 26
+		h0 &= mask
+		h1 += c
+	}
+	c := h1 >> 26
+	h1 &= mask
+	h2 += c
+	c = h2 >> 26
+	h2 &= mask
+	h3 += c
+	c = h3 >> 26
+	h3 &= mask
+	h4 += c
+	c = h4 >> 26
+	h4 &= mask
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= mask
+	h1 += c
+	g0 := h0 + 5
+	c = g0 >> 26
+	g0 &= mask
+	g1 := h1 + c
+	c = g1 >> 26
+	g1 &= mask
+	g2 := h2 + c
+	c = g2 >> 26
+	g2 &= mask
+	g3 := h3 + c
+	c = g3 >> 26
+	g3 &= mask
+	g4 := h4 + c - 1<<26
+	selectG := (g4 >> 63) - 1
+	h0 = h0&^selectG | g0&selectG
+	h1 = h1&^selectG | g1&selectG
+	h2 = h2&^selectG | g2&selectG
+	h3 = h3&^selectG | g3&selectG
+	h4 = h4&^selectG | g4&selectG
+	f0 := (h0 | h1<<26) & 0xffffffff
+	f1 := (h1>>6 | h2<<20) & 0xffffffff
+	f2 := (h2>>12 | h3<<14) & 0xffffffff
+	f3 := (h3>>18 | h4<<8) & 0xffffffff
+	f := f0 + uint64(readUint32LE(key[16:]))
+	tag := make([]byte, 16)
+	putUint32LE(tag[0:], uint32(f))
+	f = f1 + uint64(readUint32LE(key[20:])) + f>>32
+	putUint32LE(tag[4:], uint32(f))
+	f = f2 + uint64(readUint32LE(key[24:])) + f>>32
+	putUint32LE(tag[8:], uint32(f))
+	f = f3 + uint64(readUint32LE(key[28:])) + f>>32
+	putUint32LE(tag[12:], uint32(f))
+	return tag
+}
+
+func putUint32LE(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
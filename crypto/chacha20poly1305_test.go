@@ -0,0 +1,39 @@
+package crypto
+
+import "testing"
+
+// RFC 8439 section 2.5.2.
+func TestPoly1305(t *testing.T) {
+	key := fromHex("85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b")
+	checkHex(t, "tag", poly1305(key, []byte("Cryptographic Forum Research Group")),
+		"a8061dc1305136c6c22b8baf0c0127a9")
+}
+
+// RFC 8439 section 2.8.2.
+func TestChaCha20Poly1305(t *testing.T) {
+	key := fromHex("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := fromHex("070000004041424344454647")
+	additionalData := fromHex("50515253c0c1c2c3c4c5c6c7")
+	plaintext := "Ladies and Gentlemen of the class of '99: If I could offer you " +
+		"only one tip for the future, sunscreen would be it."
+	sealed := "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+		"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+		"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+		"3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691"
+	checkHex(t, "sealed", ChaCha20Poly1305Seal(
+		key, nonce, []byte(plaintext), additionalData), sealed)
+
+	opened, err := ChaCha20Poly1305Open(key, nonce, fromHex(sealed), additionalData)
+	if err != nil || string(opened) != plaintext {
+		t.Errorf("Open = %q, %v", opened, err)
+	}
+	tampered := fromHex(sealed)
+	tampered[0] ^= 1
+	if _, err := ChaCha20Poly1305Open(key, nonce, tampered, additionalData); err != ErrAuthentication {
+		t.Errorf("tampered ciphertext: got %v, want ErrAuthentication", err)
+	}
+	if _, err := ChaCha20Poly1305Open(key, nonce, fromHex(sealed), nil); err != ErrAuthentication {
+		t.Errorf("missing additional data: got %v, want ErrAuthentication", err)
+	}
+}
@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/str"
+)
+
+func fromHex(s string) []byte {
+	compact := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != ' ' && s[i] != '\n' && s[i] != '\t' {
+			compact = append(compact, s[i])
+		}
+	}
+	return str.DecodeHex(compact)
+}
+
+func toHex(b []byte) string {
+	const digits = "0123456789abcdef"
+	encoded := make([]byte, 0, len(b)*2)
+	for _, c := range b {
+		encoded = append(encoded, digits[c>>4], digits[c&0xf])
+	}
+	return string(encoded)
+}
+
+func checkHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if toHex(got) != toHex(fromHex(want)) {
+		t.Errorf("%s = %s, want %s", name, toHex(got), toHex(fromHex(want)))
+	}
+}
+
+// RFC 4231, test case 1.
+func TestHmacSha256(t *testing.T) {
+	key := fromHex("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	checkHex(t, "HMAC-SHA256", HmacSha256(key, []byte("Hi There")),
+		"b0344c61d8db38535ca8afceaf0bf12b881dc200c9833da726e9376c2e32cff7")
+}
@@ -0,0 +1,292 @@
+package crypto
+
+// Field and group arithmetic ported from TweetNaCl (public domain),
+// https://tweetnacl.cr.yp.to/. Elements of GF(2^255-19) are 16 limbs
+// of 16 bits held in int64s so products never overflow.
+
+type gf [16]int64
+
+var (
+	gf0      = gf{}
+	gf1      = gf{1}
+	gf121665 = gf{0xdb41, 1}
+	edD      = gf{0x78a3, 0x1359, 0x4dca, 0x75eb, 0xd8ab, 0x4141, 0x0a4d, 0x0070,
+		0xe898, 0x7779, 0x4079, 0x8cc7, 0xfe73, 0x2b6f, 0x6cee, 0x5203}
+	edD2 = gf{0xf159, 0x26b2, 0x9b94, 0xebd6, 0xb156, 0x8283, 0x149a, 0x00e0,
+		0xd130, 0xeef3, 0x80f2, 0x198e, 0xfce7, 0x56df, 0xd9dc, 0x2406}
+	edX = gf{0xd51a, 0x8f25, 0x2d60, 0xc956, 0xa7b2, 0x9525, 0xc760, 0x692c,
+		0xdc5c, 0xfdd6, 0xe231, 0xc0a4, 0x53fe, 0xcd6e, 0x36d3, 0x2169}
+	edY = gf{0x6658, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666,
+		0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666}
+)
+
+var edL = [32]int64{
+	0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58,
+	0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10}
+
+var X25519Basepoint = []byte{9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func X25519(scalar []byte, point []byte) []byte {
+	z := [32]byte{}
+	copy(z[:], scalar)
+	z[31] = z[31]&127 | 64
+	z[0] &= 248
+	x := unpack25519(point)
+	a, b, c, d := gf1, x, gf0, gf1
+	var e, f gf
+	for i := 254; i >= 0; i-- {
+		r := int64(z[i>>3]>>(uint(i)&7)) & 1
+		sel25519(&a, &b, r)
+		sel25519(&c, &d, r)
+		e = add25519(a, c)
+		a = sub25519(a, c)
+		c = add25519(b, d)
+		b = sub25519(b, d)
+		d = mul25519(e, e)
+		f = mul25519(a, a)
+		a = mul25519(c, a)
+		c = mul25519(b, e)
+		e = add25519(a, c)
+		a = sub25519(a, c)
+		b = mul25519(a, a)
+		c = sub25519(d, f)
+		a = mul25519(c, gf121665)
+		a = add25519(a, d)
+		c = mul25519(c, a)
+		a = mul25519(d, f)
+		d = mul25519(b, x)
+		b = mul25519(e, e)
+		sel25519(&a, &b, r)
+		sel25519(&c, &d, r)
+	}
+	a = mul25519(a, inv25519(c))
+	return pack25519(a)
+}
+
+func Ed25519PublicKey(seed []byte) []byte {
+	d := Sha512(seed[:32])
+	clampScalar(d)
+	return edPack(edScalarBase(d))
+}
+
+func Ed25519Sign(seed []byte, message []byte) []byte {
+	d := Sha512(seed[:32])
+	clampScalar(d)
+	publicKey := edPack(edScalarBase(d))
+	r := edReduce(Sha512(append(append([]byte{}, d[32:64]...), message...)))
+	signature := make([]byte, 0, 64)
+	signature = append(signature, edPack(edScalarBase(r))...)
+	hashed := make([]byte, 0, 64+len(message))
+	hashed = append(hashed, signature...)
+	hashed = append(hashed, publicKey...)
+	hashed = append(hashed, message...)
+	h := edReduce(Sha512(hashed))
+	x := [64]int64{}
+	for i := 0; i < 32; i++ {
+		x[i] = int64(r[i])
+	}
+	for i := 0; i < 32; i++ {
+		for j := 0; j < 32; j++ {
+			x[i+j] += int64(h[i]) * int64(d[j])
+		}
+	}
+	return append(signature, modL(&x)...)
+}
+
+func clampScalar(d []byte) {
+	d[0] &= 248
+	d[31] &= 127
+	d[31] |= 64
+}
+
+func car25519(o *gf) {
+	for i := 0; i < 16; i++ {
+		o[i] += 1 << 16
+		c := o[i] >> 16
+		if i < 15 {
+			o[i+1] += c - 1
+		} else {
+			o[0] += 38 * (c - 1)
+		}
+		o[i] -= c << 16
+	}
+}
+
+func sel25519(p *gf, q *gf, b int64) {
+	c := ^(b - 1)
+	for i := 0; i < 16; i++ {
+		t := c & (p[i] ^ q[i])
+		p[i] ^= t
+		q[i] ^= t
+	}
+}
+
+func pack25519(n gf) []byte {
+	t := n
+	car25519(&t)
+	car25519(&t)
+	car25519(&t)
+	m := gf{}
+	for j := 0; j < 2; j++ {
+		m[0] = t[0] - 0xffed
+		for i := 1; i < 15; i++ {
+			m[i] = t[i] - 0xffff - (m[i-1]>>16)&1
+			m[i-1] &= 0xffff
+		}
+		m[15] = t[15] - 0x7fff - (m[14]>>16)&1
+		b := (m[15] >> 16) & 1
+		m[14] &= 0xffff
+		sel25519(&t, &m, 1-b)
+	}
+	o := make([]byte, 32)
+	for i := 0; i < 16; i++ {
+		o[2*i] = byte(t[i])
+		o[2*i+1] = byte(t[i] >> 8)
+	}
+	return o
+}
+
+func unpack25519(n []byte) gf {
+	o := gf{}
+	for i := 0; i < 16; i++ {
+		o[i] = int64(n[2*i]) + int64(n[2*i+1])<<8
+	}
+	o[15] &= 0x7fff
+	return o
+}
+
+func par25519(a gf) byte {
+	return pack25519(a)[0] & 1
+}
+
+func add25519(a gf, b gf) gf {
+	o := gf{}
+	for i := 0; i < 16; i++ {
+		o[i] = a[i] + b[i]
+	}
+	return o
+}
+
+func sub25519(a gf, b gf) gf {
+	o := gf{}
+	for i := 0; i < 16; i++ {
+		o[i] = a[i] - b[i]
+	}
+	return o
+}
+
+func mul25519(a gf, b gf) gf {
+	t := [31]int64{}
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			t[i+j] += a[i] * b[j]
+		}
+	}
+	for i := 0; i < 15; i++ {
+		t[i] += 38 * t[i+16]
+	}
+	o := gf{}
+	copy(o[:], t[:16])
+	car25519(&o)
+	car25519(&o)
+	return o
+}
+
+func inv25519(i gf) gf {
+	c := i
+	for a := 253; a >= 0; a-- {
+		c = mul25519(c, c)
+		if a != 2 && a != 4 {
+			c = mul25519(c, i)
+		}
+	}
+	return c
+}
+
+type edPoint [4]gf
+
+func edAdd(p *edPoint, q edPoint) {
+	a := mul25519(sub25519(p[1], p[0]), sub25519(q[1], q[0]))
+	b := mul25519(add25519(p[0], p[1]), add25519(q[0], q[1]))
+	c := mul25519(mul25519(p[3], q[3]), edD2)
+	d := mul25519(p[2], q[2])
+	d = add25519(d, d)
+	e := sub25519(b, a)
+	f := sub25519(d, c)
+	g := add25519(d, c)
+	h := add25519(b, a)
+	p[0] = mul25519(e, f)
+	p[1] = mul25519(h, g)
+	p[2] = mul25519(g, f)
+	p[3] = mul25519(e, h)
+}
+
+func edCswap(p *edPoint, q *edPoint, b int64) {
+	for i := 0; i < 4; i++ {
+		sel25519(&p[i], &q[i], b)
+	}
+}
+
+func edPack(p edPoint) []byte {
+	zi := inv25519(p[2])
+	tx := mul25519(p[0], zi)
+	ty := mul25519(p[1], zi)
+	r := pack25519(ty)
+	r[31] ^= par25519(tx) << 7
+	return r
+}
+
+func edScalarMult(q edPoint, s []byte) edPoint {
+	p := edPoint{gf0, gf1, gf1, gf0}
+	for i := 255; i >= 0; i-- {
+		b := int64(s[i/8]>>(uint(i)&7)) & 1
+		edCswap(&p, &q, b)
+		edAdd(&q, p)
+		edAdd(&p, p)
+		edCswap(&p, &q, b)
+	}
+	return p
+}
+
+func edScalarBase(s []byte) edPoint {
+	return edScalarMult(edPoint{edX, edY, gf1, mul25519(edX, edY)}, s)
+}
+
+func modL(x *[64]int64) []byte {
+	for i := 63; i >= 32; i-- {
+		carry := int64(0)
+		j := i - 32
+		for ; j < i-12; j++ {
+			x[j] += carry - 16*x[i]*edL[j-(i-32)]
+			carry = (x[j] + 128) >> 8
+			x[j] -= carry << 8
+		}
+		x[j] += carry
+		x[i] = 0
+	}
+	carry := int64(0)
+	for j := 0; j < 32; j++ {
+		x[j] += carry - (x[31]>>4)*edL[j]
+		carry = x[j] >> 8
+		x[j] &= 255
+	}
+	for j := 0; j < 32; j++ {
+		x[j] -= carry * edL[j]
+	}
+	r := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		x[i+1] += x[i] >> 8
+		r[i] = byte(x[i] & 255)
+	}
+	return r
+}
+
+func edReduce(r []byte) []byte {
+	x := [64]int64{}
+	for i := 0; i < 64; i++ {
+		x[i] = int64(r[i])
+	}
+	return modL(&x)
+}
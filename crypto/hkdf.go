@@ -0,0 +1,22 @@
+package crypto
+
+func HkdfExtract(salt []byte, secret []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, 32)
+	}
+	return HmacSha256(salt, secret)
+}
+
+func HkdfExpand(prk []byte, info []byte, length int) []byte {
+	output := make([]byte, 0, length+32)
+	previous := []byte{}
+	for counter := byte(1); len(output) < length; counter++ {
+		input := make([]byte, 0, len(previous)+len(info)+1)
+		input = append(input, previous...)
+		input = append(input, info...)
+		input = append(input, counter)
+		previous = HmacSha256(prk, input)
+		output = append(output, previous...)
+	}
+	return output[:length]
+}
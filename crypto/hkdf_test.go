@@ -0,0 +1,31 @@
+package crypto
+
+import "testing"
+
+// RFC 5869 appendix A, test cases 1 and 3.
+func TestHkdf(t *testing.T) {
+	tests := []struct {
+		ikm, salt, info string
+		prk, okm        string
+	}{
+		{
+			ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			salt: "000102030405060708090a0b0c",
+			info: "f0f1f2f3f4f5f6f7f8f9",
+			prk:  "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5",
+			okm: "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf" +
+				"34007208d5b887185865",
+		},
+		{
+			ikm: "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			prk: "19ef24a32c717b167f33a91d6f648bdf96596776afdb6377ac434c1c293ccb04",
+			okm: "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d" +
+				"9d201395faa4b61a96c8",
+		},
+	}
+	for _, test := range tests {
+		prk := HkdfExtract(fromHex(test.salt), fromHex(test.ikm))
+		checkHex(t, "PRK", prk, test.prk)
+		checkHex(t, "OKM", HkdfExpand(prk, fromHex(test.info), 42), test.okm)
+	}
+}
@@ -0,0 +1,56 @@
+package crypto
+
+var sha1H = [5]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}
+
+func Sha1(data []byte) []byte {
+	h := sha1H
+	size := len(data)
+	padded := make([]byte, 0, size+128)
+	padded = append(padded, data...)
+	padded = append(padded, 0x80)
+	for len(padded)%64 != 56 {
+		padded = append(padded, 0)
+	}
+	bits := uint64(size) * 8
+	for i := 7; i >= 0; i-- {
+		padded = append(padded, byte(bits>>(uint(i)*8)))
+	}
+	w := [80]uint32{}
+	for block := 0; block < len(padded); block += 64 {
+		for i := 0; i < 16; i++ {
+			b := padded[block+i*4:]
+			w[i] = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		}
+		for i := 16; i < 80; i++ {
+			w[i] = rol32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+		}
+		a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+		for i := 0; i < 80; i++ {
+			var f, k uint32
+			switch {
+			case i < 20:
+				f, k = b&c|^b&d, 0x5a827999
+			case i < 40:
+				f, k = b^c^d, 0x6ed9eba1
+			case i < 60:
+				f, k = b&c|b&d|c&d, 0x8f1bbcdc
+			default:
+				f, k = b^c^d, 0xca62c1d6
+			}
+			a, b, c, d, e = rol32(a, 5)+f+e+k+w[i], a, rol32(b, 30), c, d
+		}
+		h[0] += a
+		h[1] += b
+		h[2] += c
+		h[3] += d
+		h[4] += e
+	}
+	output := make([]byte, 20)
+	for i, v := range h {
+		output[i*4] = byte(v >> 24)
+		output[i*4+1] = byte(v >> 16)
+		output[i*4+2] = byte(v >> 8)
+		output[i*4+3] = byte(v)
+	}
+	return output
+}
@@ -0,0 +1,24 @@
+package crypto
+
+import "testing"
+
+// FIPS 180-2 appendix C.
+func TestSha512(t *testing.T) {
+	tests := []struct {
+		message string
+		digest  string
+	}{
+		{"", "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce" +
+			"47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"},
+		{"abc", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a" +
+			"2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{"abcdefghbcdefghicdefghijdefghijkefghijklfghijklmghijklmn" +
+			"hijklmnoijklmnopjklmnopqklmnopqrlmnopqrsmnopqrstnopqrstu",
+			"8e959b75dae313da8cf4f72814fc143f8f7779c6eb9f7fa17299aeadb6889018" +
+				"501d289e4900f7e4331b99dec4b5433ac7d329eeb6dd26545e96e55b874be909"},
+	}
+	for _, test := range tests {
+		checkHex(t, "SHA-512 of "+test.message, Sha512([]byte(test.message)),
+			test.digest)
+	}
+}
@@ -0,0 +1,454 @@
+package tls
+
+import (
+	"github.com/alaisi/syscalltodo/crypto"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+type alert byte
+
+const (
+	alertLevelWarning = 1
+	alertLevelFatal   = 2
+)
+
+const (
+	alertCloseNotify           alert = 0
+	alertUnexpectedMessage     alert = 10
+	alertBadRecordMac          alert = 20
+	alertRecordOverflow        alert = 22
+	alertHandshakeFailure      alert = 40
+	alertIllegalParameter      alert = 47
+	alertDecodeError           alert = 50
+	alertDecryptError          alert = 51
+	alertProtocolVersion       alert = 70
+	alertInternalError         alert = 80
+	alertMissingExtension      alert = 109
+	alertNoApplicationProtocol alert = 120
+)
+
+func (a alert) Error() string {
+	return "TLS alert " + str.Itoa(int(a))
+}
+
+const (
+	typeClientHello         = 1
+	typeServerHello         = 2
+	typeEncryptedExtensions = 8
+	typeCertificate         = 11
+	typeCertificateVerify   = 15
+	typeFinished            = 20
+	typeKeyUpdate           = 24
+)
+
+const (
+	extServerName          = 0x0000
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+	extKeyShare            = 0x0033
+)
+
+const (
+	groupX25519         = 0x001d
+	schemeEd25519       = 0x0807
+	maxHandshakeMessage = 1 << 16
+)
+
+type clientHello struct {
+	raw              []byte
+	sessionId        []byte
+	cipherSuites     []int
+	versions         []int
+	keyShare         []byte
+	signatureSchemes []int
+	protocols        []string
+	serverName       string
+}
+
+func (c *Conn) Handshake() error {
+	if c.state.HandshakeComplete {
+		return nil
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.serverHandshake(); err != nil {
+		return c.fail(err)
+	}
+	c.state.HandshakeComplete = true
+	return nil
+}
+
+func (c *Conn) serverHandshake() error {
+	if len(c.config.Certificates) == 0 {
+		return alertInternalError
+	}
+	cert := c.config.Certificates[0]
+	msg, err := c.readHandshakeMessage()
+	if err != nil {
+		return err
+	}
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		return err
+	}
+	c.ccs = ccsAllowed
+	if !containsInt(hello.versions, VersionTLS13) {
+		return alertProtocolVersion
+	}
+	if !containsInt(hello.cipherSuites, TLS_CHACHA20_POLY1305_SHA256) ||
+		!containsInt(hello.signatureSchemes, schemeEd25519) ||
+		hello.keyShare == nil {
+		return alertHandshakeFailure
+	}
+	protocol, err := negotiateProtocol(c.config.NextProtos, hello.protocols)
+	if err != nil {
+		return err
+	}
+	c.state.Version = VersionTLS13
+	c.state.CipherSuite = TLS_CHACHA20_POLY1305_SHA256
+	c.state.ServerName = hello.serverName
+	c.state.NegotiatedProtocol = protocol
+
+	random := make([]byte, 32)
+	private := make([]byte, 32)
+	if c.readRandom(random) != nil || c.readRandom(private) != nil {
+		return alertInternalError
+	}
+	shared := crypto.X25519(private, hello.keyShare)
+	if isZero(shared) {
+		return alertIllegalParameter
+	}
+	serverHello := buildServerHello(
+		random, hello.sessionId, crypto.X25519(private, crypto.X25519Basepoint))
+	transcript := append(append([]byte{}, hello.raw...), serverHello...)
+	if err := c.writeRecord(recordHandshake, serverHello); err != nil {
+		return err
+	}
+	if len(hello.sessionId) > 0 {
+		if err := c.writeRecord(recordChangeCipherSpec, []byte{1}); err != nil {
+			return err
+		}
+	}
+
+	handshakeSecret := deriveHandshakeSecret(shared)
+	clientSecret := deriveSecret(handshakeSecret, "c hs traffic", transcript)
+	serverSecret := deriveSecret(handshakeSecret, "s hs traffic", transcript)
+	c.in.setSecret(clientSecret)
+	c.out.setSecret(serverSecret)
+
+	flight := buildEncryptedExtensions(protocol)
+	flight = append(flight, buildCertificate(cert.Certificate)...)
+	transcript = append(transcript, flight...)
+	verify := buildCertificateVerify(cert.PrivateKey, crypto.Sha256(transcript))
+	transcript = append(transcript, verify...)
+	finished := handshakeMessage(typeFinished,
+		finishedData(serverSecret, transcript))
+	transcript = append(transcript, finished...)
+	flight = append(append(flight, verify...), finished...)
+	if err := c.writeRecord(recordHandshake, flight); err != nil {
+		return err
+	}
+
+	masterSecret := deriveMasterSecret(handshakeSecret)
+	clientAppSecret := deriveSecret(masterSecret, "c ap traffic", transcript)
+	serverAppSecret := deriveSecret(masterSecret, "s ap traffic", transcript)
+	c.out.setSecret(serverAppSecret)
+
+	msg, err = c.readHandshakeMessage()
+	if err != nil {
+		return err
+	}
+	expected := handshakeMessage(typeFinished, finishedData(clientSecret, transcript))
+	if msg[0] != typeFinished {
+		return alertUnexpectedMessage
+	}
+	if !constantTimeEqual(msg, expected) {
+		return alertDecryptError
+	}
+	if len(c.handshake) > 0 {
+		return alertUnexpectedMessage
+	}
+	c.ccs = ccsNotAllowed
+	c.in.setSecret(clientAppSecret)
+	return nil
+}
+
+func (c *Conn) readRandom(b []byte) error {
+	if c.config.Rand == nil {
+		return crypto.Rand(b)
+	}
+	_, err := io.ReadFull(c.config.Rand, b)
+	return err
+}
+
+func (c *Conn) readHandshakeMessage() ([]byte, error) {
+	for {
+		if len(c.handshake) >= 4 {
+			length := 4 + (int(c.handshake[1])<<16 |
+				int(c.handshake[2])<<8 | int(c.handshake[3]))
+			if length > maxHandshakeMessage {
+				return nil, alertDecodeError
+			}
+			if len(c.handshake) >= length {
+				msg := c.handshake[:length]
+				c.handshake = c.handshake[length:]
+				return msg, nil
+			}
+		}
+		contentType, payload, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if contentType != recordHandshake {
+			return nil, alertUnexpectedMessage
+		}
+		c.handshake = append(c.handshake, payload...)
+	}
+}
+
+func (c *Conn) handlePostHandshake(payload []byte) error {
+	c.handshake = append(c.handshake, payload...)
+	for len(c.handshake) >= 4 {
+		length := 4 + (int(c.handshake[1])<<16 |
+			int(c.handshake[2])<<8 | int(c.handshake[3]))
+		if len(c.handshake) < length {
+			return nil
+		}
+		msg := c.handshake[:length]
+		c.handshake = c.handshake[length:]
+		if msg[0] != typeKeyUpdate || length != 5 || msg[4] > 1 {
+			return alertUnexpectedMessage
+		}
+		c.in.setSecret(expandLabel(c.in.secret, "traffic upd", nil, 32))
+		if msg[4] == 1 {
+			update := handshakeMessage(typeKeyUpdate, []byte{0})
+			if err := c.writeRecord(recordHandshake, update); err != nil {
+				return err
+			}
+			c.out.setSecret(expandLabel(c.out.secret, "traffic upd", nil, 32))
+		}
+	}
+	return nil
+}
+
+func parseClientHello(msg []byte) (*clientHello, error) {
+	hello := &clientHello{raw: msg}
+	p := &parser{data: msg}
+	if p.u8() != typeClientHello {
+		return nil, alertUnexpectedMessage
+	}
+	p.u24()
+	p.u16()
+	p.bytes(32)
+	hello.sessionId = p.vec8()
+	suites := &parser{data: p.vec16()}
+	for !suites.empty() {
+		hello.cipherSuites = append(hello.cipherSuites, suites.u16())
+	}
+	p.vec8()
+	extensions := &parser{data: p.vec16()}
+	for !extensions.empty() {
+		extType := extensions.u16()
+		ext := &parser{data: extensions.vec16()}
+		switch extType {
+		case extSupportedVersions:
+			versions := &parser{data: ext.vec8()}
+			for !versions.empty() {
+				hello.versions = append(hello.versions, versions.u16())
+			}
+		case extSignatureAlgorithms:
+			schemes := &parser{data: ext.vec16()}
+			for !schemes.empty() {
+				hello.signatureSchemes = append(hello.signatureSchemes, schemes.u16())
+			}
+		case extKeyShare:
+			shares := &parser{data: ext.vec16()}
+			for !shares.empty() {
+				group, key := shares.u16(), shares.vec16()
+				if group == groupX25519 && len(key) == 32 {
+					hello.keyShare = key
+				}
+			}
+		case extALPN:
+			protocols := &parser{data: ext.vec16()}
+			for !protocols.empty() {
+				hello.protocols = append(hello.protocols, string(protocols.vec8()))
+			}
+		case extServerName:
+			names := &parser{data: ext.vec16()}
+			for !names.empty() {
+				nameType, name := names.u8(), names.vec16()
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		}
+		if ext.failed {
+			return nil, alertDecodeError
+		}
+	}
+	if p.failed || !p.empty() || extensions.failed || suites.failed {
+		return nil, alertDecodeError
+	}
+	return hello, nil
+}
+
+func negotiateProtocol(supported []string, offered []string) (string, error) {
+	if len(offered) == 0 || len(supported) == 0 {
+		return "", nil
+	}
+	for _, protocol := range supported {
+		for _, candidate := range offered {
+			if protocol == candidate {
+				return protocol, nil
+			}
+		}
+	}
+	return "", alertNoApplicationProtocol
+}
+
+func buildServerHello(random []byte, sessionId []byte, publicKey []byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, random...)
+	body = append(body, byte(len(sessionId)))
+	body = append(body, sessionId...)
+	body = append(body, TLS_CHACHA20_POLY1305_SHA256>>8,
+		TLS_CHACHA20_POLY1305_SHA256&0xff, 0)
+	extensions := []byte{
+		extSupportedVersions >> 8, extSupportedVersions & 0xff, 0, 2,
+		VersionTLS13 >> 8, VersionTLS13 & 0xff,
+		extKeyShare >> 8, extKeyShare & 0xff, 0, 36,
+		groupX25519 >> 8, groupX25519 & 0xff, 0, 32}
+	extensions = append(extensions, publicKey...)
+	body = appendVec16(body, extensions)
+	return handshakeMessage(typeServerHello, body)
+}
+
+func buildEncryptedExtensions(protocol string) []byte {
+	extensions := []byte{}
+	if protocol != "" {
+		name := append([]byte{byte(len(protocol))}, protocol...)
+		extensions = append(extensions, extALPN>>8, extALPN&0xff)
+		extensions = appendVec16(extensions, appendVec16(nil, name))
+	}
+	return handshakeMessage(typeEncryptedExtensions, appendVec16(nil, extensions))
+}
+
+func buildCertificate(chain [][]byte) []byte {
+	list := []byte{}
+	for _, cert := range chain {
+		list = append(list, byte(len(cert)>>16), byte(len(cert)>>8), byte(len(cert)))
+		list = append(list, cert...)
+		list = append(list, 0, 0)
+	}
+	body := []byte{0, byte(len(list) >> 16), byte(len(list) >> 8), byte(len(list))}
+	return handshakeMessage(typeCertificate, append(body, list...))
+}
+
+func buildCertificateVerify(privateKey []byte, transcriptHash []byte) []byte {
+	content := make([]byte, 0, 130)
+	for i := 0; i < 64; i++ {
+		content = append(content, ' ')
+	}
+	content = append(content, "TLS 1.3, server CertificateVerify"...)
+	content = append(content, 0)
+	content = append(content, transcriptHash...)
+	signature := crypto.Ed25519Sign(privateKey, content)
+	body := []byte{schemeEd25519 >> 8, schemeEd25519 & 0xff}
+	return handshakeMessage(typeCertificateVerify, appendVec16(body, signature))
+}
+
+func finishedData(secret []byte, transcript []byte) []byte {
+	finishedKey := expandLabel(secret, "finished", nil, 32)
+	return crypto.HmacSha256(finishedKey, crypto.Sha256(transcript))
+}
+
+func handshakeMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, 0, len(body)+4)
+	msg = append(msg, msgType, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	return append(msg, body...)
+}
+
+func appendVec16(b []byte, data []byte) []byte {
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(b []byte) bool {
+	acc := byte(0)
+	for _, v := range b {
+		acc |= v
+	}
+	return acc == 0
+}
+
+func constantTimeEqual(a []byte, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	diff := byte(0)
+	for i := range a {
+		diff |= a[i] ^ b[i]
+	}
+	return diff == 0
+}
+
+type parser struct {
+	data   []byte
+	failed bool
+}
+
+func (p *parser) empty() bool {
+	return p.failed || len(p.data) == 0
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.failed || len(p.data) < n {
+		p.failed = true
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *parser) u8() int {
+	if b := p.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (p *parser) u16() int {
+	if b := p.bytes(2); b != nil {
+		return int(b[0])<<8 | int(b[1])
+	}
+	return 0
+}
+
+func (p *parser) u24() int {
+	if b := p.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+func (p *parser) vec8() []byte {
+	return p.bytes(p.u8())
+}
+
+func (p *parser) vec16() []byte {
+	return p.bytes(p.u16())
+}
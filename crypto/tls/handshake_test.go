@@ -0,0 +1,193 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed Ed25519 certificate, generated with
+// the standard library as no encoder exists here.
+func testCertificate(t *testing.T) Certificate {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(nil, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: seed}
+}
+
+// recordingConn keeps a copy of what the server writes.
+type recordingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordingConn) Write(buf []byte) (int, error) {
+	c.written = append(c.written, buf...)
+	return c.Conn.Write(buf)
+}
+
+// TestHandshakeWithStdlibClient checks the transcript hashes, signature and
+// record protection against an independent implementation, with the server
+// random and key share taken from RFC 8448 through Config.Rand.
+func TestHandshakeWithStdlibClient(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	recorded := &recordingConn{Conn: serverConn}
+	server := Server(recorded, &Config{
+		Certificates: []Certificate{testCertificate(t)},
+		NextProtos:   []string{"h2", "http/1.1"},
+		Rand: bytes.NewReader(
+			append(append([]byte{}, rfc8448ServerRandom...), rfc8448ServerPrivate...)),
+	})
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		buf := make([]byte, 64)
+		n, err := server.Read(buf)
+		if err == nil {
+			_, err = server.Write(append([]byte("echo "), buf[:n]...))
+		}
+		if err == nil {
+			_, err = server.Read(buf)
+		}
+		done <- err
+	}()
+
+	client := stdtls.Client(clientConn, &stdtls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+		MinVersion:         stdtls.VersionTLS13,
+	})
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "echo ping" {
+		t.Fatalf("client read %q, %v", buf[:n], err)
+	}
+	client.Close()
+	if err := <-done; err == nil || err.Error() != "EOF" {
+		t.Errorf("server read after close_notify: %v, want EOF", err)
+	}
+
+	state := client.ConnectionState()
+	if state.Version != stdtls.VersionTLS13 ||
+		state.CipherSuite != stdtls.TLS_CHACHA20_POLY1305_SHA256 ||
+		state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("client negotiated %x, %x, %q", state.Version, state.CipherSuite,
+			state.NegotiatedProtocol)
+	}
+	if name := server.ConnectionState().ServerName; name != "example.com" {
+		t.Errorf("server name %q", name)
+	}
+	serverHello := recorded.written[5:]
+	checkHex(t, "server random", serverHello[6:38], toHex(rfc8448ServerRandom))
+	length := 4 + (int(serverHello[1])<<16 | int(serverHello[2])<<8 | int(serverHello[3]))
+	checkHex(t, "server key share", serverHello[length-32:length], rfc8448ServerPublic)
+}
+
+func TestHandshakeFailsWithoutRandomness(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	server := Server(serverConn, &Config{
+		Certificates: []Certificate{testCertificate(t)},
+		Rand:         bytes.NewReader(make([]byte, 40)),
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+		serverConn.Close()
+	}()
+	client := stdtls.Client(clientConn, &stdtls.Config{InsecureSkipVerify: true})
+	if err := client.Handshake(); err == nil {
+		t.Error("client handshake succeeded")
+	}
+	if err := <-done; err != alertInternalError {
+		t.Errorf("server handshake: %v, want internal_error", err)
+	}
+}
+
+// ccsFlood follows its prefix with ChangeCipherSpec records without end.
+type ccsFlood struct {
+	prefix []byte
+	read   int
+}
+
+func (f *ccsFlood) Read(buf []byte) (int, error) {
+	if len(f.prefix) > 0 {
+		n := copy(buf, f.prefix)
+		f.prefix = f.prefix[n:]
+		return n, nil
+	}
+	n := 0
+	for ; n+6 <= len(buf); n += 6 {
+		copy(buf[n:], []byte{recordChangeCipherSpec, 3, 3, 0, 1, 1})
+	}
+	f.read += n
+	return n, nil
+}
+
+func (f *ccsFlood) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+// stdlibClientHello returns the first record a standard library client sends.
+func stdlibClientHello(t *testing.T) []byte {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go stdtls.Client(clientConn, &stdtls.Config{
+		ServerName: "example.com",
+		MinVersion: stdtls.VersionTLS13,
+	}).Handshake()
+	defer clientConn.Close()
+	record := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, record); err != nil {
+		t.Fatal(err)
+	}
+	record = append(record, make([]byte, int(record[3])<<8|int(record[4]))...)
+	if _, err := io.ReadFull(serverConn, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// TestChangeCipherSpecFlood sends an endless run of ChangeCipherSpec records,
+// which must fail the handshake at the first one that isn't allowed.
+func TestChangeCipherSpecFlood(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix []byte
+	}{
+		{"before ClientHello", nil},
+		{"after ClientHello", stdlibClientHello(t)},
+	}
+	for _, test := range tests {
+		flood := &ccsFlood{prefix: test.prefix}
+		server := Server(flood, &Config{Certificates: []Certificate{testCertificate(t)}})
+		if err := server.Handshake(); err != alertUnexpectedMessage {
+			t.Errorf("%s: got %v, want alertUnexpectedMessage", test.name, err)
+		}
+		if flood.read > maxCiphertext+5+4096 {
+			t.Errorf("%s: read %d bytes of ChangeCipherSpec", test.name, flood.read)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package tls
+
+import (
+	"github.com/alaisi/syscalltodo/crypto"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const (
+	VersionTLS13                 = 0x0304
+	TLS_CHACHA20_POLY1305_SHA256 = 0x1303
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+const (
+	maxPlaintext  = 1 << 14
+	maxCiphertext = maxPlaintext + 256
+)
+
+type tlsError string
+
+func (err tlsError) Error() string {
+	return string(err)
+}
+
+type Certificate struct {
+	Certificate [][]byte
+	PrivateKey  []byte
+}
+
+// Config holds the server certificates and ALPN protocols. Rand, when set,
+// supplies the server random and the ephemeral X25519 key in place of
+// crypto.Rand, which makes handshakes reproducible in tests.
+type Config struct {
+	Certificates []Certificate
+	NextProtos   []string
+	Rand         io.Reader
+}
+
+type ConnectionState struct {
+	Version            uint16
+	CipherSuite        uint16
+	HandshakeComplete  bool
+	ServerName         string
+	NegotiatedProtocol string
+}
+
+type Transport interface {
+	io.Reader
+	io.Writer
+}
+
+type Conn struct {
+	transport Transport
+	config    *Config
+	state     ConnectionState
+	in        halfConn
+	out       halfConn
+	raw       []byte
+	plain     []byte
+	handshake []byte
+	ccs       ccsState
+	err       error
+}
+
+// ccsState tracks the ChangeCipherSpec record that middlebox compatibility
+// mode lets the client send once between its ClientHello and Finished.
+type ccsState int
+
+const (
+	ccsNotAllowed ccsState = iota
+	ccsAllowed
+	ccsReceived
+)
+
+type halfConn struct {
+	secret []byte
+	key    []byte
+	iv     []byte
+	seq    uint64
+}
+
+func Server(transport Transport, config *Config) *Conn {
+	return &Conn{transport: transport, config: config}
+}
+
+func (c *Conn) ConnectionState() ConnectionState {
+	return c.state
+}
+
+func (c *Conn) Pending() bool {
+	return len(c.plain) > 0 || len(c.raw) > 0
+}
+
+func (c *Conn) Read(buf []byte) (int, error) {
+	if !c.state.HandshakeComplete {
+		if err := c.Handshake(); err != nil {
+			return -1, err
+		}
+	}
+	for len(c.plain) == 0 {
+		if c.err != nil {
+			return -1, c.err
+		}
+		contentType, payload, err := c.readRecord()
+		if err != nil {
+			return -1, err
+		}
+		switch contentType {
+		case recordApplicationData:
+			c.plain = payload
+		case recordHandshake:
+			if err := c.handlePostHandshake(payload); err != nil {
+				return -1, c.fail(err)
+			}
+		default:
+			return -1, c.fail(alertUnexpectedMessage)
+		}
+	}
+	n := copy(buf, c.plain)
+	if c.plain = c.plain[n:]; len(c.plain) == 0 {
+		c.plain = nil
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(buf []byte) (int, error) {
+	if !c.state.HandshakeComplete {
+		if err := c.Handshake(); err != nil {
+			return -1, err
+		}
+	}
+	if err := c.writeRecord(recordApplicationData, buf); err != nil {
+		return -1, err
+	}
+	return len(buf), nil
+}
+
+func (c *Conn) Close() error {
+	if c.out.key == nil {
+		return nil
+	}
+	return c.writeRecord(recordAlert, []byte{alertLevelWarning, byte(alertCloseNotify)})
+}
+
+func (c *Conn) fail(err error) error {
+	if a, isAlert := err.(alert); isAlert {
+		c.writeRecord(recordAlert, []byte{alertLevelFatal, byte(a)})
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+func (c *Conn) readRecord() (byte, []byte, error) {
+	for {
+		if len(c.raw) >= 5 {
+			length := int(c.raw[3])<<8 | int(c.raw[4])
+			if length > maxCiphertext {
+				return 0, nil, c.fail(alertRecordOverflow)
+			}
+			if len(c.raw) >= 5+length {
+				contentType, payload, err := c.decryptRecord(length)
+				if err != nil || contentType != recordChangeCipherSpec {
+					return contentType, payload, err
+				}
+				continue
+			}
+		}
+		if err := c.readMore(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+func (c *Conn) readMore() error {
+	if cap(c.raw)-len(c.raw) < 4096 {
+		grown := make([]byte, len(c.raw), len(c.raw)+maxCiphertext+5)
+		copy(grown, c.raw)
+		c.raw = grown
+	}
+	n, err := c.transport.Read(c.raw[len(c.raw):cap(c.raw)])
+	if err != nil {
+		return err
+	}
+	c.raw = c.raw[:len(c.raw)+n]
+	return nil
+}
+
+func (c *Conn) decryptRecord(length int) (byte, []byte, error) {
+	header := c.raw[:5]
+	contentType := header[0]
+	payload := make([]byte, length)
+	copy(payload, c.raw[5:5+length])
+	if c.raw = c.raw[5+length:]; len(c.raw) == 0 {
+		c.raw = nil
+	}
+	if contentType == recordChangeCipherSpec {
+		if c.ccs != ccsAllowed || len(payload) != 1 || payload[0] != 1 {
+			return 0, nil, c.fail(alertUnexpectedMessage)
+		}
+		c.ccs = ccsReceived
+		return contentType, nil, nil
+	}
+	if c.in.key == nil {
+		if contentType == recordAlert {
+			return 0, nil, c.receiveAlert(payload)
+		}
+		return contentType, payload, nil
+	}
+	if contentType != recordApplicationData {
+		return 0, nil, c.fail(alertUnexpectedMessage)
+	}
+	additionalData := []byte{header[0], header[1], header[2], header[3], header[4]}
+	plaintext, err := crypto.ChaCha20Poly1305Open(
+		c.in.key, c.in.nonce(), payload, additionalData)
+	if err != nil {
+		return 0, nil, c.fail(alertBadRecordMac)
+	}
+	c.in.seq++
+	end := len(plaintext) - 1
+	for end >= 0 && plaintext[end] == 0 {
+		end--
+	}
+	if end < 0 || end > maxPlaintext {
+		return 0, nil, c.fail(alertUnexpectedMessage)
+	}
+	contentType, plaintext = plaintext[end], plaintext[:end]
+	if contentType == recordAlert {
+		return 0, nil, c.receiveAlert(plaintext)
+	}
+	return contentType, plaintext, nil
+}
+
+func (c *Conn) receiveAlert(payload []byte) error {
+	if len(payload) != 2 {
+		return c.fail(alertDecodeError)
+	}
+	if alert(payload[1]) == alertCloseNotify {
+		c.err = io.EOF
+	} else {
+		c.err = tlsError("Received alert " + str.Itoa(int(payload[1])))
+	}
+	return c.err
+}
+
+func (c *Conn) writeRecord(contentType byte, data []byte) error {
+	out := make([]byte, 0, len(data)+(len(data)/maxPlaintext+1)*(5+17))
+	for first := true; first || len(data) > 0; first = false {
+		fragment := data
+		if len(fragment) > maxPlaintext {
+			fragment = fragment[:maxPlaintext]
+		}
+		data = data[len(fragment):]
+		if c.out.key == nil {
+			out = append(out, contentType, 3, 3,
+				byte(len(fragment)>>8), byte(len(fragment)))
+			out = append(out, fragment...)
+			continue
+		}
+		inner := make([]byte, 0, len(fragment)+1)
+		inner = append(inner, fragment...)
+		inner = append(inner, contentType)
+		length := len(inner) + 16
+		header := []byte{recordApplicationData, 3, 3, byte(length >> 8), byte(length)}
+		out = append(out, header...)
+		out = append(out, crypto.ChaCha20Poly1305Seal(
+			c.out.key, c.out.nonce(), inner, header)...)
+		c.out.seq++
+	}
+	_, err := c.transport.Write(out)
+	return err
+}
+
+func (hc *halfConn) setSecret(secret []byte) {
+	hc.secret = secret
+	hc.key = expandLabel(secret, "key", nil, 32)
+	hc.iv = expandLabel(secret, "iv", nil, 12)
+	hc.seq = 0
+}
+
+func (hc *halfConn) nonce() []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, hc.iv)
+	for i := 0; i < 8; i++ {
+		nonce[11-i] ^= byte(hc.seq >> (uint(i) * 8))
+	}
+	return nonce
+}
+
+func expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label)+len(context))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+	return crypto.HkdfExpand(secret, info, length)
+}
+
+func deriveSecret(secret []byte, label string, transcript []byte) []byte {
+	return expandLabel(secret, label, crypto.Sha256(transcript), 32)
+}
+
+// The key schedule of RFC 8446 section 7.1, without a pre-shared key.
+
+func deriveEarlySecret() []byte {
+	return crypto.HkdfExtract(nil, make([]byte, 32))
+}
+
+func deriveHandshakeSecret(shared []byte) []byte {
+	return crypto.HkdfExtract(deriveSecret(deriveEarlySecret(), "derived", nil), shared)
+}
+
+func deriveMasterSecret(handshakeSecret []byte) []byte {
+	return crypto.HkdfExtract(
+		deriveSecret(handshakeSecret, "derived", nil), make([]byte, 32))
+}
+
+func LoadX509KeyPair(certFile string, keyFile string) (Certificate, error) {
+	certPem, err := io.ReadFile(certFile)
+	if err != nil {
+		return Certificate{}, err
+	}
+	keyPem, err := io.ReadFile(keyFile)
+	if err != nil {
+		return Certificate{}, err
+	}
+	chain := decodePem(string(certPem), "CERTIFICATE")
+	if len(chain) == 0 {
+		return Certificate{}, tlsError("No certificate found in " + certFile)
+	}
+	keys := decodePem(string(keyPem), "PRIVATE KEY")
+	if len(keys) != 1 {
+		return Certificate{}, tlsError("No private key found in " + keyFile)
+	}
+	seed, err := parseEd25519PrivateKey(keys[0])
+	if err != nil {
+		return Certificate{}, err
+	}
+	return Certificate{Certificate: chain, PrivateKey: seed}, nil
+}
+
+func decodePem(pem string, label string) [][]byte {
+	begin := "-----BEGIN " + label + "-----"
+	end := "-----END " + label + "-----"
+	blocks := make([][]byte, 0, 1)
+	encoded := ""
+	inBlock := false
+	for _, line := range str.Split(pem, '\n') {
+		line = str.Trim(line)
+		switch {
+		case line == begin:
+			inBlock = true
+			encoded = ""
+		case line == end && inBlock:
+			inBlock = false
+			if len(encoded) > 0 && len(encoded)%4 == 0 {
+				blocks = append(blocks, str.DecodeB64(encoded))
+			}
+		case inBlock:
+			encoded += line
+		}
+	}
+	return blocks
+}
+
+var ed25519PrivateKeyPrefix = []byte{
+	0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70,
+	0x04, 0x22, 0x04, 0x20}
+
+func parseEd25519PrivateKey(der []byte) ([]byte, error) {
+	if len(der) != len(ed25519PrivateKeyPrefix)+32 {
+		return nil, tlsError("Unsupported private key, expected PKCS#8 Ed25519")
+	}
+	for i, b := range ed25519PrivateKeyPrefix {
+		if der[i] != b {
+			return nil, tlsError("Unsupported private key, expected PKCS#8 Ed25519")
+		}
+	}
+	return der[len(ed25519PrivateKeyPrefix):], nil
+}
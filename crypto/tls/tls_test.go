@@ -0,0 +1,163 @@
+package tls
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/crypto"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+func fromHex(s string) []byte {
+	compact := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != ' ' && s[i] != '\n' && s[i] != '\t' {
+			compact = append(compact, s[i])
+		}
+	}
+	return str.DecodeHex(compact)
+}
+
+func toHex(b []byte) string {
+	const digits = "0123456789abcdef"
+	encoded := make([]byte, 0, len(b)*2)
+	for _, c := range b {
+		encoded = append(encoded, digits[c>>4], digits[c&0xf])
+	}
+	return string(encoded)
+}
+
+func checkHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if toHex(got) != toHex(fromHex(want)) {
+		t.Errorf("%s = %s, want %s", name, toHex(got), toHex(fromHex(want)))
+	}
+}
+
+// Values from the simple 1-RTT handshake of RFC 8448 section 3.
+var (
+	rfc8448ClientPrivate = fromHex(
+		"49af42ba7f7994852d713ef2784bcbcaa7911de26adc5642cb634540e7ea5005")
+	rfc8448ServerRandom = fromHex(
+		"a6af06a4121860dc5e6e60249cd34c95930c8ac5cb1434dac155772ed3e26928")
+	rfc8448ServerPrivate = fromHex(
+		"b1580eeadf6dd589b8ef4f2d5652578cc810e9980191ec8d058308cea216a21e")
+	rfc8448ServerPublic = "c9828876112095fe66762bdbf7c672e156d6cc253b833df1dd69b1b04e751f0f"
+	// The transcript hash of ClientHello and ServerHello.
+	rfc8448HelloHash = fromHex(
+		"860c06edc07858ee8e78f0e7428c58edd6b43f2ca3e6e95f02ed063cf0e1cad8")
+	rfc8448ServerHandshakeSecret = fromHex(
+		"b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38")
+)
+
+func TestKeyScheduleRFC8448(t *testing.T) {
+	shared := crypto.X25519(rfc8448ServerPrivate,
+		crypto.X25519(rfc8448ClientPrivate, crypto.X25519Basepoint))
+	checkHex(t, "shared secret", shared,
+		"8bd4054fb55b9d63fdfbacf9f04b9f0d35e6d63f537563efd46272900f89492d")
+
+	early := deriveEarlySecret()
+	checkHex(t, "early secret", early,
+		"33ad0a1c607ec03b09e6cd9893680ce210adf300aa1f2660e1b22e10f170f92a")
+	checkHex(t, "derived secret", deriveSecret(early, "derived", nil),
+		"6f2615a108c702c5678f54fc9dbab69716c076189c48250cebeac3576c3611ba")
+
+	handshake := deriveHandshakeSecret(shared)
+	checkHex(t, "handshake secret", handshake,
+		"1dc826e93606aa6fdc0aadc12f741b01046aa6b99f691ed221a9f0ca043fbeac")
+	checkHex(t, "client handshake traffic secret",
+		expandLabel(handshake, "c hs traffic", rfc8448HelloHash, 32),
+		"b3eddb126e067f35a780b3abf45e2d8f3b1a950738f52e9600746a0e27a55a21")
+	checkHex(t, "server handshake traffic secret",
+		expandLabel(handshake, "s hs traffic", rfc8448HelloHash, 32),
+		toHex(rfc8448ServerHandshakeSecret))
+	checkHex(t, "server finished key",
+		expandLabel(rfc8448ServerHandshakeSecret, "finished", nil, 32),
+		"008d3b66f816ea559f96b537e885c31fc068bf492c652f01f288a1d8cdc19fc8")
+
+	checkHex(t, "derived secret", deriveSecret(handshake, "derived", nil),
+		"43de77e0c77713859a944db9db2590b53190a65b3ee2e4f12dd7a0bb7ce254b4")
+	checkHex(t, "master secret", deriveMasterSecret(handshake),
+		"18df06843d13a08bf2a449844c5f8a478001bc4d4c627984d5a41da8d0402919")
+}
+
+// RFC 8448 protects records with AES-128-GCM, whose key is shorter than that
+// of ChaCha20-Poly1305, but the 12 byte IV is derived the same way.
+func TestTrafficKeysRFC8448(t *testing.T) {
+	var hc halfConn
+	hc.setSecret(rfc8448ServerHandshakeSecret)
+	checkHex(t, "AES-128-GCM key",
+		expandLabel(rfc8448ServerHandshakeSecret, "key", nil, 16),
+		"3fce516009c21727d0f2e4e86ee403bc")
+	checkHex(t, "IV", hc.iv, "5d313eb2671276ee13000b30")
+	checkHex(t, "first nonce", hc.nonce(), "5d313eb2671276ee13000b30")
+	hc.seq = 0x0102
+	checkHex(t, "nonce 0x0102", hc.nonce(), "5d313eb2671276ee13000a32")
+}
+
+// pipeTransport reads from in and collects what is written in out.
+type pipeTransport struct {
+	in  *io.ByteArrayReader
+	out *io.ByteArrayWriter
+}
+
+func newPipeTransport(in []byte) *pipeTransport {
+	return &pipeTransport{io.NewByteArrayReader(in), io.NewByteArrayWriter()}
+}
+
+func (p *pipeTransport) Read(buf []byte) (int, error) {
+	return p.in.Read(buf)
+}
+
+func (p *pipeTransport) Write(buf []byte) (int, error) {
+	return p.out.Write(buf)
+}
+
+func TestRecordProtection(t *testing.T) {
+	secret := rfc8448ServerHandshakeSecret
+	sender := Server(newPipeTransport(nil), &Config{})
+	sender.out.setSecret(secret)
+	sender.state.HandshakeComplete = true
+	for _, message := range []string{"first", "second"} {
+		if _, err := sender.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := sender.transport.(*pipeTransport).out.Bytes
+
+	key := expandLabel(secret, "key", nil, 32)
+	iv := expandLabel(secret, "iv", nil, 12)
+	record := records[:5+len("first")+1+16]
+	checkHex(t, "record header", record[:5], "1703030016")
+	inner, err := crypto.ChaCha20Poly1305Open(key, iv, record[5:], record[:5])
+	if err != nil || string(inner) != "first\x17" {
+		t.Errorf("first record opened to %q, %v", inner, err)
+	}
+	iv[11] ^= 1
+	record = records[len(record):]
+	inner, err = crypto.ChaCha20Poly1305Open(key, iv, record[5:], record[:5])
+	if err != nil || string(inner) != "second\x17" {
+		t.Errorf("second record opened to %q, %v", inner, err)
+	}
+
+	receiver := Server(newPipeTransport(records), &Config{})
+	receiver.in.setSecret(secret)
+	receiver.state.HandshakeComplete = true
+	buf := make([]byte, 64)
+	for _, want := range []string{"first", "second"} {
+		n, err := receiver.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("Read = %q, %v, want %q", buf[:max(n, 0)], err, want)
+		}
+	}
+
+	tampered := append([]byte{}, records...)
+	tampered[len(tampered)-1] ^= 1
+	receiver = Server(newPipeTransport(tampered), &Config{})
+	receiver.in.setSecret(secret)
+	receiver.state.HandshakeComplete = true
+	receiver.Read(buf)
+	if _, err := receiver.Read(buf); err != alertBadRecordMac {
+		t.Errorf("tampered record: got %v, want bad_record_mac", err)
+	}
+}
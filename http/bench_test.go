@@ -0,0 +1,121 @@
+package http
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+// The benchmarks compare the epoll dispatcher with the model it replaced,
+// where each connection had a goroutine blocked in read while idle:
+//
+//	go test -run '^$' -bench . -benchmem ./http
+//
+// BenchmarkIdleConns reports the goroutines and heap kept per idle
+// keep-alive connection, BenchmarkKeepAlive the request throughput over
+// persistent connections.
+
+const benchIdleConns = 500
+
+// startBlockingServer serves handler with a goroutine per connection.
+func startBlockingServer(b *testing.B, handler Handler) string {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sockaddr, _ := syscall.Getsockname(sockfd)
+	syscall.SetNonblock(sockfd, false)
+	go func() {
+		for {
+			connfd, _, err := syscall.Accept4(sockfd, syscall.SOCK_CLOEXEC)
+			if err == syscall.EINTR || err == syscall.ECONNABORTED {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			configureConn(connfd)
+			go serveBlocking(connfd, handler)
+		}
+	}()
+	b.Cleanup(func() {
+		syscall.Shutdown(sockfd, syscall.SHUT_RDWR)
+		syscall.Close(sockfd)
+	})
+	return io.FormatSockaddr(sockaddr)
+}
+
+func serveBlocking(connfd int, handler Handler) {
+	defer syscall.Close(connfd)
+	c := &conn{fd: connfd}
+	c.lr = io.NewLineReader(c)
+	for {
+		req, err := readRequest(c.lr, DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+		if err != nil {
+			return
+		}
+		res := newHttpResponse(req.Proto, c)
+		handler.ServeHTTP(res, req)
+		if sendResponse(res) != nil || discardBody(req) != nil {
+			return
+		}
+	}
+}
+
+func benchServers(b *testing.B, bench func(*testing.B, string)) {
+	b.Run("epoll", func(b *testing.B) {
+		bench(b, startServer(b, &Server{Handler: helloHandler}))
+	})
+	b.Run("blocking", func(b *testing.B) {
+		bench(b, startBlockingServer(b, helloHandler))
+	})
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse + stats.StackInuse
+}
+
+func BenchmarkIdleConns(b *testing.B) {
+	benchServers(b, func(b *testing.B, addr string) {
+		goroutines, heap := 0.0, 0.0
+		for i := 0; i < b.N; i++ {
+			goroutinesBefore, heapBefore := runtime.NumGoroutine(), heapInUse()
+			conns := make([]*testConn, benchIdleConns)
+			for j := range conns {
+				conns[j] = dialTest(b, addr)
+				conns[j].send("GET / HTTP/1.1\r\nHost: bench\r\n\r\n")
+			}
+			for _, c := range conns {
+				c.response("GET")
+			}
+			goroutines += float64(runtime.NumGoroutine()-goroutinesBefore) /
+				benchIdleConns
+			heap += (float64(heapInUse()) - float64(heapBefore)) / benchIdleConns
+			for _, c := range conns {
+				c.close()
+			}
+		}
+		b.ReportMetric(goroutines/float64(b.N), "goroutines/conn")
+		b.ReportMetric(heap/float64(b.N), "heap-B/conn")
+	})
+}
+
+func BenchmarkKeepAlive(b *testing.B) {
+	benchServers(b, func(b *testing.B, addr string) {
+		b.RunParallel(func(pb *testing.PB) {
+			c := dialTest(b, addr)
+			for pb.Next() {
+				c.send("GET / HTTP/1.1\r\nHost: bench\r\n\r\n")
+				if res, _ := c.response("GET"); res.StatusCode != 200 {
+					b.Error(res.Status)
+					return
+				}
+			}
+		})
+	})
+}
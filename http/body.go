@@ -0,0 +1,243 @@
+package http
+
+import "github.com/alaisi/syscalltodo/io"
+
+const closeDelimitedBody = -2
+
+const errUnexpectedEndOfBody = protocolError("Unexpected end of body")
+
+type bodyReader struct {
+	lr             *io.LineReader
+	continueWriter io.Writer
+	withheld       bool
+	remaining      int
+	read           int
+	limit          int
+	chunked        bool
+	untilEOF       bool
+	started        bool
+	eof            bool
+	trailer        Header
+	err            error
+}
+
+func newBodyReader(
+	lr *io.LineReader,
+	contentLength int,
+	trailer Header,
+	limit int,
+) *bodyReader {
+	if contentLength == chunkedBody {
+		return &bodyReader{
+			lr: lr, chunked: true, trailer: trailer, limit: limit}
+	}
+	if contentLength == closeDelimitedBody {
+		return &bodyReader{lr: lr, untilEOF: true, limit: limit}
+	}
+	return &bodyReader{lr: lr, remaining: contentLength, limit: limit}
+}
+
+// exceeded fails the body once a handler's MaxBytesReader limit is reached,
+// so the server answers with 413 and closes the connection.
+func (body *bodyReader) exceeded() {
+	body.err = ErrBodyTooLarge
+}
+
+func (body *bodyReader) Read(buf []byte) (int, error) {
+	if body.err != nil {
+		return -1, body.err
+	}
+	if body.untilEOF {
+		return body.readUntilEOF(buf)
+	}
+	if body.awaitingContinue() {
+		body.err = body.sendContinue()
+		if body.err != nil {
+			return -1, body.err
+		}
+	}
+	body.withheld = false
+	if body.remaining == 0 && body.chunked && !body.eof {
+		if body.err = body.nextChunk(); body.err != nil {
+			if body.err == io.EOF {
+				body.err = errUnexpectedEndOfBody
+			}
+			return -1, body.err
+		}
+	}
+	if body.remaining == 0 {
+		return -1, io.EOF
+	}
+	if len(buf) > body.remaining {
+		buf = buf[:body.remaining]
+	}
+	n, err := body.lr.Read(buf)
+	if err != nil {
+		if err == io.EOF {
+			err = errUnexpectedEndOfBody
+		}
+		body.err = err
+		return -1, err
+	}
+	body.remaining -= n
+	body.read += n
+	return n, nil
+}
+
+// awaitingContinue reports whether the client sent "Expect: 100-continue"
+// and is still waiting for the interim response before sending the body.
+func (body *bodyReader) awaitingContinue() bool {
+	return body.continueWriter != nil && (body.remaining > 0 || body.chunked)
+}
+
+// skipContinue is called once the final response head is written, after
+// which the interim response can't be sent. A client that was still waiting
+// may never send the body, so unless the handler reads it anyway, the
+// connection can't be reused.
+func (body *bodyReader) skipContinue() {
+	if body.awaitingContinue() {
+		body.withheld = true
+	}
+	body.continueWriter = nil
+}
+
+// bodyWithheld reports whether the client may still be holding back the body.
+func (body *bodyReader) bodyWithheld() bool {
+	return body.awaitingContinue() || body.withheld
+}
+
+func (body *bodyReader) sendContinue() error {
+	writer := body.continueWriter
+	body.continueWriter = nil
+	_, err := writer.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	return err
+}
+
+func (body *bodyReader) readUntilEOF(buf []byte) (int, error) {
+	if body.read+len(buf) > body.limit {
+		buf = buf[:body.limit-body.read+1]
+	}
+	n, err := body.lr.Read(buf)
+	if err != nil {
+		body.err = err
+		return -1, err
+	}
+	if body.read += n; body.read > body.limit {
+		body.err = ErrBodyTooLarge
+		return -1, body.err
+	}
+	return n, nil
+}
+
+func (body *bodyReader) nextChunk() error {
+	if body.started {
+		line, err := body.lr.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != "" {
+			return protocolError("Invalid chunk terminator")
+		}
+	}
+	body.started = true
+	line, err := body.lr.ReadLine()
+	if err != nil {
+		return err
+	}
+	size, err := parseChunkSize(line)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		body.eof = true
+		return readTrailer(body.lr, body.trailer)
+	}
+	if body.read+size > body.limit {
+		return ErrBodyTooLarge
+	}
+	body.remaining = size
+	return nil
+}
+
+func readAll(reader io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	tmp := make([]byte, 4096)
+	for {
+		n, err := reader.Read(tmp)
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, tmp[:n]...)
+	}
+}
+
+type limitedBody interface {
+	exceeded()
+}
+
+type maxBytesReader struct {
+	body      io.Reader
+	remaining int64
+	err       error
+}
+
+// MaxBytesReader limits reading a request body to n bytes. Past the limit,
+// reads fail with ErrBodyTooLarge and unless the response is already being
+// streamed, the client gets a 413 instead of the handler's response.
+func MaxBytesReader(body io.Reader, n int64) io.Reader {
+	return &maxBytesReader{body: body, remaining: n}
+}
+
+// MaxBytesHandler limits the request bodies read by next to n bytes.
+func MaxBytesHandler(next Handler, n int64) Handler {
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		req.Body = MaxBytesReader(req.Body, n)
+		next.ServeHTTP(res, req)
+	})
+}
+
+func (reader *maxBytesReader) Read(buf []byte) (int, error) {
+	if reader.err != nil {
+		return -1, reader.err
+	}
+	if int64(len(buf)) > reader.remaining+1 {
+		buf = buf[:reader.remaining+1]
+	}
+	n, err := reader.body.Read(buf)
+	if err != nil {
+		reader.err = err
+		return -1, err
+	}
+	if reader.remaining -= int64(n); reader.remaining < 0 {
+		reader.exceeded()
+		return -1, reader.err
+	}
+	return n, nil
+}
+
+func (reader *maxBytesReader) exceeded() {
+	reader.err = ErrBodyTooLarge
+	if body, isLimited := reader.body.(limitedBody); isLimited {
+		body.exceeded()
+	}
+}
+
+const maxDiscardSize = 256 * 1024
+
+func discardBody(req *Request) error {
+	tmp := make([]byte, 4096)
+	for discarded := 0; discarded <= maxDiscardSize; {
+		n, err := req.bodyReader.Read(tmp)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		discarded += n
+	}
+	return ErrBodyTooLarge
+}
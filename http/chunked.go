@@ -0,0 +1,74 @@
+package http
+
+import (
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const chunkedBody = -1
+
+func parseChunkSize(line string) (int, error) {
+	if ext := str.IndexOf(line, ';'); ext >= 0 {
+		line = line[:ext]
+	}
+	line = str.Trim(line)
+	if len(line) == 0 || len(line) > 8 {
+		return 0, protocolError("Invalid chunk size")
+	}
+	size := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c >= '0' && c <= '9':
+			size = size*16 + int(c-'0')
+		case c >= 'a' && c <= 'f':
+			size = size*16 + int(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			size = size*16 + int(c-'A') + 10
+		default:
+			return 0, protocolError("Invalid chunk size")
+		}
+	}
+	return size, nil
+}
+
+func readTrailer(lr *io.LineReader, trailer Header) error {
+	for {
+		line, err := lr.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return err
+		}
+		trailer[name] = append(trailer[name], value)
+	}
+}
+
+func writeChunk(writer io.Writer, data []byte) error {
+	chunk := make([]byte, 0, len(data)+16)
+	chunk = append(chunk, formatChunkSize(len(data))...)
+	chunk = append(chunk, '\r', '\n')
+	chunk = append(chunk, data...)
+	chunk = append(chunk, '\r', '\n')
+	_, err := writer.Write(chunk)
+	return err
+}
+
+func formatChunkSize(size int) string {
+	if size == 0 {
+		return "0"
+	}
+	digits := make([]byte, 0, 8)
+	for ; size > 0; size /= 16 {
+		digits = append(digits, "0123456789abcdef"[size%16])
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
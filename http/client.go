@@ -0,0 +1,537 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const (
+	defaultMaxRedirects        = 10
+	defaultMaxIdleConnsPerHost = 2
+	maxResponseHeaderBytes     = 1 << 20
+	maxResponseBodyBytes       = int(^uint(0) >> 1)
+)
+
+const (
+	ErrTooManyRedirects = protocolError("Stopped after too many redirects")
+	errBodyClosed       = protocolError("Read on closed response body")
+)
+
+type Client struct {
+	Timeout             time.Duration
+	MaxRedirects        int
+	MaxIdleConnsPerHost int
+	idleConns           map[string][]*conn
+}
+
+var DefaultClient = &Client{}
+
+var poolLock = newLock()
+
+type Response struct {
+	Status        string
+	StatusCode    int
+	Proto         string
+	Header        Header
+	Trailer       Header
+	ContentLength int
+	Body          io.ReadCloser
+	Request       *Request
+}
+
+func NewRequest(method string, url string, body io.Reader) (*Request, error) {
+	u, err := parseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	header := make(Header)
+	req := &Request{Method: method, URL: u, Header: &header, Proto: "HTTP/1.1"}
+	if body != nil {
+		if req.body, err = readAll(body); err != nil {
+			return nil, err
+		}
+		req.contentLength = len(req.body)
+	}
+	return req, nil
+}
+
+func Get(url string) (*Response, error) {
+	return DefaultClient.Get(url)
+}
+
+func Post(url string, contentType string, body io.Reader) (*Response, error) {
+	return DefaultClient.Post(url, contentType, body)
+}
+
+func (client *Client) Get(url string) (*Response, error) {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func (client *Client) Post(
+	url string,
+	contentType string,
+	body io.Reader,
+) (*Response, error) {
+	req, err := NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return client.Do(req)
+}
+
+func (client *Client) Do(req *Request) (*Response, error) {
+	deadline := deadlineAfter(client.Timeout)
+	for redirects := 0; ; redirects++ {
+		res, err := client.send(req, deadline)
+		if err != nil {
+			return nil, err
+		}
+		next, err := redirectRequest(req, res)
+		if next == nil || err != nil || client.MaxRedirects < 0 ||
+			!req.isReplayable() {
+			if err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+			return res, nil
+		}
+		discardResponse(res)
+		if redirects >= client.maxRedirects() {
+			return nil, ErrTooManyRedirects
+		}
+		req = next
+	}
+}
+
+func (client *Client) send(req *Request, deadline time.Time) (*Response, error) {
+	if req.URL.Scheme != "http" {
+		return nil, protocolError("Unsupported protocol scheme " + req.URL.Scheme)
+	}
+	addr := hostPort(req.URL.Host)
+	for {
+		c, reused, err := client.getConn(addr, deadline)
+		if err != nil {
+			return nil, err
+		}
+		c.readDeadline = deadline
+		c.writeDeadline = deadline
+		res, reader, keepAlive, err := roundTrip(c, req)
+		if err != nil {
+			syscall.Close(c.fd)
+			if reused && isStaleConnErr(err) && req.isReplayable() {
+				continue
+			}
+			return nil, err
+		}
+		if res.StatusCode == 101 {
+			c.readDeadline, c.writeDeadline = time.Time{}, time.Time{}
+			res.Body = &switchedBody{c: c}
+			return res, nil
+		}
+		body := &responseBody{client: client, addr: addr, c: c,
+			keepAlive: keepAlive, reader: reader}
+		res.Body = body
+		if res.ContentLength == 0 {
+			body.release(keepAlive)
+		}
+		return res, nil
+	}
+}
+
+func roundTrip(c *conn, req *Request) (*Response, *bodyReader, bool, error) {
+	if err := writeRequest(c, req); err != nil {
+		return nil, nil, false, err
+	}
+	res, reader, err := readResponse(c.lr, req)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	keepAlive := res.ContentLength != closeDelimitedBody &&
+		str.ToLowerAscii(req.Header.Get("connection")) != "close"
+	connection := str.ToLowerAscii(res.Header.Get("connection"))
+	if res.Proto == "HTTP/1.0" {
+		keepAlive = keepAlive && connection == "keep-alive"
+	} else {
+		keepAlive = keepAlive && connection != "close"
+	}
+	if res.ContentLength < 0 {
+		res.ContentLength = -1
+	}
+	return res, reader, keepAlive, nil
+}
+
+func writeRequest(writer io.Writer, req *Request) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	buf := io.NewByteArrayWriter()
+	buf.Write([]byte(req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n"))
+	for _, name := range req.Header.sortedKeys() {
+		switch str.ToLowerAscii(name) {
+		case "host", "content-length", "transfer-encoding":
+			continue
+		}
+		for _, value := range (*req.Header)[name] {
+			buf.Write([]byte(name + ": " + value + "\r\n"))
+		}
+	}
+	streamed := !req.isReplayable()
+	switch {
+	case streamed && req.contentLength < 0:
+		buf.Write([]byte("Transfer-Encoding: chunked\r\n"))
+	case streamed:
+		buf.Write([]byte("Content-Length: " + str.Itoa(req.contentLength) + "\r\n"))
+	case req.body != nil || isFormMethod(req.Method):
+		buf.Write([]byte("Content-Length: " + str.Itoa(len(req.body)) + "\r\n"))
+	}
+	buf.Write([]byte("\r\n"))
+	buf.Write(req.body)
+	if _, err := writer.Write(buf.Bytes); err != nil || !streamed {
+		return err
+	}
+	return writeBody(writer, req.Body, req.contentLength < 0)
+}
+
+// writeBody streams a request body, in chunks when its length isn't known.
+func writeBody(writer io.Writer, body io.Reader, chunked bool) error {
+	buf := make([]byte, maxBufferedBody)
+	for {
+		n, err := body.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if chunked {
+			err = writeChunk(writer, buf[:n])
+		} else {
+			_, err = writer.Write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if chunked {
+		return writeChunk(writer, nil)
+	}
+	return nil
+}
+
+// isReplayable reports whether the request can be sent again, which a body
+// streamed from Body can't.
+func (req *Request) isReplayable() bool {
+	return req.Body == nil || req.body != nil
+}
+
+func readResponse(
+	lr *io.LineReader,
+	req *Request,
+) (*Response, *bodyReader, error) {
+	for {
+		readLine := headerLineReader(lr, maxResponseHeaderBytes)
+		line, err := readLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		protocol, code, status, err := parseStatusLine(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		headers, err := readHeader(readLine)
+		if err != nil {
+			return nil, nil, err
+		}
+		if code >= 100 && code < 200 && code != 101 {
+			continue
+		}
+		contentLength, err := parseResponseFraming(headers, req.Method, code)
+		if err != nil {
+			return nil, nil, err
+		}
+		var trailer Header
+		if contentLength == chunkedBody {
+			trailer = make(Header)
+		}
+		reader := newBodyReader(lr, contentLength, trailer, maxResponseBodyBytes)
+		return &Response{
+			Status: status, StatusCode: code, Proto: protocol,
+			Header: headers, Trailer: trailer, ContentLength: contentLength,
+			Request: req}, reader, nil
+	}
+}
+
+func parseStatusLine(line string) (string, int, string, error) {
+	space := str.IndexOf(line, ' ')
+	if space < 0 {
+		return "", 0, "", protocolError("Invalid status line")
+	}
+	protocol, status := line[:space], line[space+1:]
+	code := status
+	if space = str.IndexOf(status, ' '); space >= 0 {
+		code = status[:space]
+	}
+	if protocol != "HTTP/1.1" && protocol != "HTTP/1.0" ||
+		len(code) != 3 || !isDigits(code) {
+		return "", 0, "", protocolError("Invalid status line")
+	}
+	return protocol, str.Atoi(code), status, nil
+}
+
+func parseResponseFraming(headers Header, method string, code int) (int, error) {
+	if method == "HEAD" || code == 204 || code == 304 ||
+		code >= 100 && code < 200 {
+		return 0, nil
+	}
+	if len(headers.Values("Transfer-Encoding")) == 0 &&
+		len(headers.Values("Content-Length")) == 0 {
+		return closeDelimitedBody, nil
+	}
+	return parseBodyFraming(headers)
+}
+
+func redirectRequest(req *Request, res *Response) (*Request, error) {
+	switch res.StatusCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil, nil
+	}
+	location := res.Header.Get("location")
+	if location == "" {
+		return nil, nil
+	}
+	url, err := req.URL.resolve(location)
+	if err != nil {
+		return nil, err
+	}
+	header := make(Header)
+	next := &Request{Method: req.Method, URL: url, Header: &header,
+		Proto: req.Proto, body: req.body, contentLength: req.contentLength}
+	dropBody := res.StatusCode != 307 && res.StatusCode != 308
+	if dropBody {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			next.Method = "GET"
+		}
+		next.body = nil
+		next.contentLength = 0
+	}
+	for name, values := range *req.Header {
+		switch str.ToLowerAscii(name) {
+		case "content-type":
+			if dropBody {
+				continue
+			}
+		case "authorization", "cookie":
+			if url.Host != req.URL.Host {
+				continue
+			}
+		}
+		header[name] = append([]string(nil), values...)
+	}
+	return next, nil
+}
+
+func discardResponse(res *Response) {
+	tmp := make([]byte, 4096)
+	for discarded := 0; discarded <= maxDiscardSize; {
+		n, err := res.Body.Read(tmp)
+		if err != nil {
+			break
+		}
+		discarded += n
+	}
+	res.Body.Close()
+}
+
+func (client *Client) getConn(
+	addr string,
+	deadline time.Time,
+) (*conn, bool, error) {
+	var c *conn
+	withPoolLock(func() {
+		idle := client.idleConns[addr]
+		for len(idle) > 0 && c == nil {
+			c, idle = idle[len(idle)-1], idle[:len(idle)-1]
+			if !isConnAlive(c) {
+				syscall.Close(c.fd)
+				c = nil
+			}
+		}
+		if client.idleConns != nil {
+			client.idleConns[addr] = idle
+		}
+	})
+	if c != nil {
+		return c, true, nil
+	}
+	timeout := syscall.Timeval{}
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, false, ErrTimeout
+		}
+		timeout = remaining.Timeval()
+	}
+	fd, err := io.Dial(addr, timeout)
+	if err == syscall.ETIMEDOUT {
+		err = ErrTimeout
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	c = &conn{fd: fd}
+	c.lr = io.NewLineReader(c)
+	return c, false, nil
+}
+
+func (client *Client) putIdleConn(addr string, c *conn) {
+	max := client.MaxIdleConnsPerHost
+	if max == 0 {
+		max = defaultMaxIdleConnsPerHost
+	}
+	pooled := false
+	withPoolLock(func() {
+		if client.idleConns == nil {
+			client.idleConns = make(map[string][]*conn)
+		}
+		if len(client.idleConns[addr]) < max && c.lr.Buffered() == 0 {
+			client.idleConns[addr] = append(client.idleConns[addr], c)
+			pooled = true
+		}
+	})
+	if !pooled {
+		syscall.Close(c.fd)
+	}
+}
+
+func (client *Client) CloseIdleConnections() {
+	withPoolLock(func() {
+		for addr, idle := range client.idleConns {
+			for _, c := range idle {
+				syscall.Close(c.fd)
+			}
+			delete(client.idleConns, addr)
+		}
+	})
+}
+
+func (client *Client) maxRedirects() int {
+	if client.MaxRedirects > 0 {
+		return client.MaxRedirects
+	}
+	return defaultMaxRedirects
+}
+
+func isConnAlive(c *conn) bool {
+	buf := make([]byte, 1)
+	_, _, err := syscall.Recvfrom(
+		c.fd, buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	return err == syscall.EAGAIN
+}
+
+func isStaleConnErr(err error) bool {
+	return err == io.EOF || err == syscall.EPIPE || err == syscall.ECONNRESET
+}
+
+func hostPort(host string) string {
+	if bracket := str.IndexOf(host, ']'); bracket >= 0 {
+		if bracket == len(host)-1 {
+			return host + ":80"
+		}
+		return host
+	}
+	if str.IndexOf(host, ':') < 0 {
+		return host + ":80"
+	}
+	return host
+}
+
+type responseBody struct {
+	client    *Client
+	addr      string
+	c         *conn
+	reader    *bodyReader
+	keepAlive bool
+	released  bool
+	closed    bool
+}
+
+func (body *responseBody) Read(buf []byte) (int, error) {
+	if body.closed {
+		return -1, errBodyClosed
+	}
+	if body.released && body.reader.err == nil {
+		return -1, io.EOF
+	}
+	n, err := body.reader.Read(buf)
+	if err == io.EOF {
+		body.release(body.keepAlive && !body.reader.untilEOF)
+	} else if err != nil {
+		body.release(false)
+	}
+	return n, err
+}
+
+func (body *responseBody) Close() error {
+	body.closed = true
+	body.release(false)
+	return nil
+}
+
+func (body *responseBody) release(keepAlive bool) {
+	if body.released {
+		return
+	}
+	body.released = true
+	if keepAlive {
+		body.client.putIdleConn(body.addr, body.c)
+	} else {
+		syscall.Close(body.c.fd)
+	}
+}
+
+// switchedBody is the Body of a 101 response: the connection itself, now
+// speaking the protocol of the Upgrade header in both directions.
+type switchedBody struct {
+	c *conn
+}
+
+func (body *switchedBody) Read(buf []byte) (int, error) {
+	return body.c.lr.Read(buf)
+}
+
+func (body *switchedBody) Write(buf []byte) (int, error) {
+	return body.c.Write(buf)
+}
+
+func (body *switchedBody) Close() error {
+	syscall.Shutdown(body.c.fd, syscall.SHUT_RDWR)
+	return syscall.Close(body.c.fd)
+}
+
+func newLock() chan any {
+	lock := make(chan any, 1)
+	lock <- struct{}{}
+	return lock
+}
+
+func withPoolLock(fn func()) {
+	locked := <-poolLock
+	defer func() {
+		poolLock <- locked
+	}()
+	fn()
+}
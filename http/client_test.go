@@ -0,0 +1,162 @@
+package http
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+func clientTestServer(t *testing.T) string {
+	mux := NewServeMux()
+	mux.HandleFunc("/addr", func(res ResponseWriter, req *Request) {
+		res.Write([]byte(req.RemoteAddr))
+	})
+	mux.HandleFunc("/fixed", func(res ResponseWriter, req *Request) {
+		res.Header().Set("Content-Length", "5")
+		res.Write([]byte("fixed"))
+	})
+	mux.HandleFunc("/chunked", func(res ResponseWriter, req *Request) {
+		res.Write([]byte("chunk"))
+		res.(Flusher).Flush()
+		res.Write([]byte("ed"))
+	})
+	mux.HandleFunc("/redirect/{n}", func(res ResponseWriter, req *Request) {
+		n := str.Atoi(req.PathValue("n"))
+		res.Header().Set("Location", "/redirect/"+str.Itoa(n+1))
+		res.WriteHeader(302)
+	})
+	mux.HandleFunc("/slow", func(res ResponseWriter, req *Request) {
+		time.Sleep(500 * time.Millisecond)
+		res.Write([]byte("late"))
+	})
+	return "http://" + startServer(t, &Server{Handler: mux})
+}
+
+func getBody(t *testing.T, client *Client, url string) (*Response, string) {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := readAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func TestClientReusesPooledConns(t *testing.T) {
+	url := clientTestServer(t)
+	client := &Client{}
+	defer client.CloseIdleConnections()
+	_, first := getBody(t, client, url+"/addr")
+	_, second := getBody(t, client, url+"/addr")
+	if first != second {
+		t.Errorf("requests came from %s and %s", first, second)
+	}
+	client.CloseIdleConnections()
+	if _, third := getBody(t, client, url+"/addr"); third == first {
+		t.Errorf("closed connection %s was reused", third)
+	}
+}
+
+func TestClientResponseFraming(t *testing.T) {
+	url := clientTestServer(t)
+	client := &Client{}
+	defer client.CloseIdleConnections()
+	tests := []struct {
+		path          string
+		contentLength int
+		body          string
+	}{
+		{"/fixed", 5, "fixed"},
+		{"/chunked", chunkedBody, "chunked"},
+	}
+	for _, test := range tests {
+		res, body := getBody(t, client, url+test.path)
+		if res.ContentLength != test.contentLength || body != test.body {
+			t.Errorf("%s: got %d %q, want %d %q", test.path,
+				res.ContentLength, body, test.contentLength, test.body)
+		}
+	}
+	_, first := getBody(t, client, url+"/addr")
+	if _, second := getBody(t, client, url+"/addr"); first != second {
+		t.Error("connection wasn't reused after reading the bodies")
+	}
+}
+
+func TestClientRedirectLimit(t *testing.T) {
+	url := clientTestServer(t)
+	client := &Client{MaxRedirects: 3}
+	defer client.CloseIdleConnections()
+	if _, err := client.Get(url + "/redirect/0"); err != ErrTooManyRedirects {
+		t.Errorf("got %v, want ErrTooManyRedirects", err)
+	}
+	client.MaxRedirects = -1
+	res, _ := getBody(t, client, url+"/redirect/0")
+	if res.StatusCode != 302 || res.Header.Get("Location") != "/redirect/1" {
+		t.Errorf("got %s to %s, want the redirect itself", res.Status,
+			res.Header.Get("Location"))
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	url := clientTestServer(t)
+	client := &Client{Timeout: 100 * time.Millisecond}
+	defer client.CloseIdleConnections()
+	start := time.Now()
+	if _, err := client.Get(url + "/slow"); err != ErrTimeout {
+		t.Errorf("got %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("timed out after %dms", elapsed.Milliseconds())
+	}
+}
+
+// TestClientRetriesStaleConn has the server drop a pooled connection after
+// reading the next request, as happens when a keep-alive timeout races with
+// a new request.
+func TestClientRetriesStaleConn(t *testing.T) {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sockfd)
+	syscall.SetNonblock(sockfd, false)
+	sockaddr, _ := syscall.Getsockname(sockfd)
+	accepted := make(chan int, 2)
+	go func() {
+		for i := 1; i <= 2; i++ {
+			connfd, _, err := syscall.Accept4(sockfd, syscall.SOCK_CLOEXEC)
+			if err != nil {
+				return
+			}
+			accepted <- i
+			c := &conn{fd: connfd}
+			c.lr = io.NewLineReader(c)
+			readRequest(c.lr, DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+			io.Write(connfd, []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n"+
+				str.Itoa(i)))
+			if i == 1 {
+				readRequest(c.lr, DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+			}
+			syscall.Close(connfd)
+		}
+	}()
+	client := &Client{Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	url := "http://" + io.FormatSockaddr(sockaddr) + "/"
+	if _, body := getBody(t, client, url); body != "1" {
+		t.Fatalf("first response %q", body)
+	}
+	if _, body := getBody(t, client, url); body != "2" {
+		t.Errorf("retried response %q, want it from a new connection", body)
+	}
+	if n := len(accepted); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
@@ -0,0 +1,289 @@
+package http
+
+import (
+	"github.com/alaisi/syscalltodo/compress/gzip"
+	"github.com/alaisi/syscalltodo/compress/zlib"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const minCompressSize = 1024
+
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/pdf":              true,
+	"application/x-7z-compressed":  true,
+	"application/x-bzip2":          true,
+	"application/x-gzip":           true,
+	"application/x-rar-compressed": true,
+	"application/x-xz":             true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+type encoder interface {
+	Write([]byte) (int, error)
+	Flush() error
+	Close() error
+}
+
+type compressWriter struct {
+	res      ResponseWriter
+	encoding string
+	status   int
+	buffer   []byte
+	encoder  encoder
+	decided  bool
+	err      error
+}
+
+type decodedBody struct {
+	decoder io.Reader
+	body    *bodyReader
+	read    int
+}
+
+func CompressHandler(next Handler) Handler {
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		if status := decodeRequestBody(req); status != 0 {
+			Error(res, statusTexts[status], status)
+			return
+		}
+		res.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		if encoding == "" || req.Method == "HEAD" ||
+			req.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		writer := &compressWriter{res: res, encoding: encoding}
+		next.ServeHTTP(writer, req)
+		writer.Close()
+	})
+}
+
+func negotiateEncoding(accept string) string {
+	best, bestQuality := "", 0
+	for _, part := range str.Split(accept, ',') {
+		coding, params := parseMediaType(part)
+		quality := 1000
+		if q, found := params["q"]; found {
+			quality = parseQuality(q)
+		}
+		if coding == "*" || coding == "x-gzip" {
+			coding = "gzip"
+		}
+		if coding != "gzip" && coding != "deflate" {
+			continue
+		}
+		if quality > bestQuality ||
+			(quality == bestQuality && coding == "gzip") {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+func parseQuality(q string) int {
+	if q == "" || (q[0] != '0' && q[0] != '1') {
+		return 0
+	}
+	quality, scale := int(q[0]-'0')*1000, 100
+	if len(q) > 1 && q[1] != '.' {
+		return 0
+	}
+	for i := 2; i < len(q) && scale > 0; i++ {
+		if q[i] < '0' || q[i] > '9' {
+			return 0
+		}
+		quality += int(q[i]-'0') * scale
+		scale /= 10
+	}
+	if quality > 1000 {
+		return 1000
+	}
+	return quality
+}
+
+func (w *compressWriter) Header() Header {
+	return w.res.Header()
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return -1, w.err
+	}
+	if w.status == 0 {
+		w.status = 200
+	}
+	if !w.decided {
+		w.buffer = append(w.buffer, data...)
+		if len(w.buffer) >= minCompressSize {
+			w.decide(false)
+		}
+		return len(data), w.err
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.res.Write(data)
+}
+
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.encoder != nil && w.err == nil {
+		w.err = w.encoder.Flush()
+	}
+	if flusher, isFlusher := w.res.(Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// sendFile lets files that aren't compressed, such as images or ranges, go
+// out with sendfile. The decision is made on the headers alone, as
+// FileServer sets Content-Length and Content-Type before sending.
+func (w *compressWriter) sendFile(fd int, offset int64, count int64) error {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.encoder != nil {
+		return copyFile(w.encoder, fd, offset, count)
+	}
+	return sendFileRange(w.res, fd, offset, count)
+}
+
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.encoder != nil && w.err == nil {
+		w.err = w.encoder.Close()
+	}
+	return w.err
+}
+
+func (w *compressWriter) decide(final bool) {
+	w.decided = true
+	header := w.res.Header()
+	if w.shouldCompress(final) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		if etag := header.Values("ETag"); len(etag) == 1 &&
+			(len(etag[0]) < 2 || etag[0][:2] != "W/") {
+			header.Set("ETag", "W/"+etag[0])
+		}
+		if w.encoding == "gzip" {
+			w.encoder = gzip.NewWriter(w.res)
+		} else {
+			w.encoder = zlib.NewWriter(w.res)
+		}
+	}
+	if w.status != 0 {
+		w.res.WriteHeader(w.status)
+	}
+	if len(w.buffer) == 0 {
+		return
+	}
+	if w.encoder != nil {
+		_, w.err = w.encoder.Write(w.buffer)
+	} else {
+		_, w.err = w.res.Write(w.buffer)
+	}
+	w.buffer = nil
+}
+
+func (w *compressWriter) shouldCompress(final bool) bool {
+	header := w.res.Header()
+	if !bodyAllowed(w.status) || w.status == 206 ||
+		header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if final && len(w.buffer) < minCompressSize {
+		return false
+	}
+	if length := header.Values("Content-Length"); len(length) == 1 &&
+		str.Atol(length[0]) < minCompressSize {
+		return false
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		mediaType, _ := parseMediaType(contentType)
+		return !isCompressedType(mediaType)
+	}
+	return true
+}
+
+func isCompressedType(mediaType string) bool {
+	if compressedTypes[mediaType] {
+		return true
+	}
+	slash := str.IndexOf(mediaType, '/')
+	if slash < 0 {
+		return false
+	}
+	switch mediaType[:slash] {
+	case "image":
+		return mediaType != "image/svg+xml" && mediaType != "image/x-icon" &&
+			mediaType != "image/bmp"
+	case "audio", "video":
+		return mediaType != "audio/wav"
+	}
+	return false
+}
+
+func decodeRequestBody(req *Request) int {
+	encoding := str.ToLowerAscii(str.Trim(req.Header.Get("Content-Encoding")))
+	var decoder io.Reader
+	var err error
+	switch encoding {
+	case "", "identity":
+		return 0
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(req.bodyReader)
+	case "deflate":
+		decoder, err = zlib.NewReader(req.bodyReader)
+	default:
+		return 415
+	}
+	if err != nil {
+		if req.bodyReader.err != nil {
+			return errorStatus(req.bodyReader.err)
+		}
+		return 400
+	}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.Body = &decodedBody{decoder: decoder, body: req.bodyReader}
+	return 0
+}
+
+func (body *decodedBody) Read(buf []byte) (int, error) {
+	n, err := body.decoder.Read(buf)
+	if err != nil {
+		return -1, err
+	}
+	if body.read += n; body.read > body.body.limit {
+		body.body.err = ErrBodyTooLarge
+		return -1, ErrBodyTooLarge
+	}
+	return n, nil
+}
+
+func (body *decodedBody) exceeded() {
+	body.body.exceeded()
+}
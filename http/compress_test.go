@@ -0,0 +1,126 @@
+package http
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/compress/gzip"
+	"github.com/alaisi/syscalltodo/io"
+)
+
+// fileSenderRecorder is a ResponseWriter that records what was passed to
+// sendfile.
+type fileSenderRecorder struct {
+	header Header
+	status int
+	body   []byte
+	sent   int64
+}
+
+func (rec *fileSenderRecorder) Header() Header {
+	return rec.header
+}
+
+func (rec *fileSenderRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *fileSenderRecorder) Write(buf []byte) (int, error) {
+	rec.body = append(rec.body, buf...)
+	return len(buf), nil
+}
+
+func (rec *fileSenderRecorder) sendFile(fd int, offset int64, count int64) error {
+	rec.sent += count
+	return copyFile(rec, fd, offset, count)
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	fd, err := syscall.Open(path, syscall.O_CREAT|syscall.O_WRONLY|syscall.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if _, err := io.Write(fd, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressHandlerSendsUncompressedFiles(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 4096)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	writeTestFile(t, dir+"/image.png", content)
+	writeTestFile(t, dir+"/style.css", content)
+	handler := CompressHandler(FileServer(Dir(dir)))
+	tests := []struct {
+		path, rangeHeader string
+		compressed        bool
+		body              []byte
+	}{
+		{"/image.png", "", false, content},
+		{"/style.css", "bytes=10-19", false, content[10:20]},
+		{"/style.css", "", true, content},
+	}
+	for _, test := range tests {
+		header := Header{"Accept-Encoding": {"gzip"}}
+		if test.rangeHeader != "" {
+			header.Set("Range", test.rangeHeader)
+		}
+		req := &Request{Method: "GET", URL: &URL{Path: test.path}, Header: &header}
+		rec := &fileSenderRecorder{header: make(Header)}
+		handler.ServeHTTP(rec, req)
+		body := rec.body
+		if test.compressed {
+			reader, err := gzip.NewReader(io.NewByteArrayReader(rec.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = readAll(reader); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != string(test.body) {
+			t.Errorf("%s %s: got %d bytes, want %d", test.path, test.rangeHeader,
+				len(body), len(test.body))
+		}
+		encoding := rec.header.Get("Content-Encoding")
+		if test.compressed && (encoding != "gzip" || rec.sent != 0) {
+			t.Errorf("%s: encoding %q, %d bytes with sendfile", test.path,
+				encoding, rec.sent)
+		}
+		if !test.compressed && (encoding != "" || rec.sent != int64(len(test.body))) {
+			t.Errorf("%s %s: encoding %q, %d bytes with sendfile", test.path,
+				test.rangeHeader, encoding, rec.sent)
+		}
+	}
+}
+
+func TestCompressHandlerKeepsDefaultStatus(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/empty", func(res ResponseWriter, req *Request) {})
+	mux.HandleFunc("/header", func(res ResponseWriter, req *Request) {
+		res.Header().Set("X-Test", "set")
+	})
+	mux.HandleFunc("/write", func(res ResponseWriter, req *Request) {
+		res.Write(nil)
+	})
+	c := dialTest(t, startServer(t, &Server{Handler: CompressHandler(mux)}))
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/empty", 404},
+		{"/header", 404},
+		{"/write", 200},
+	}
+	for _, test := range tests {
+		c.send("GET " + test.path + " HTTP/1.1\r\nHost: test\r\n" +
+			"Accept-Encoding: gzip\r\n\r\n")
+		if res, _ := c.response("GET"); res.StatusCode != test.status {
+			t.Errorf("%s: got %d, want %d", test.path, res.StatusCode, test.status)
+		}
+	}
+}
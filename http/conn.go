@@ -0,0 +1,186 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/context"
+	"github.com/alaisi/syscalltodo/crypto/tls"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const ErrTimeout = protocolError("I/O timeout")
+
+type conn struct {
+	fd              int
+	lr              *io.LineReader
+	tls             *tls.Conn
+	state           connState
+	nonblocking     bool
+	started         bool
+	scanned         int
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	requestDeadline time.Time
+	rcvTimeout      bool
+	sndTimeout      bool
+	cancel          context.CancelFunc
+	remoteAddr      string
+	localAddr       string
+	proxyHeader     *io.LineReader
+	overCapacity    bool
+	goAway          func()
+}
+
+func newConn(fd int) *conn {
+	c := &conn{fd: fd, nonblocking: true}
+	c.lr = io.NewLineReader(c)
+	return c
+}
+
+func (c *conn) Read(buf []byte) (int, error) {
+	if c.nonblocking {
+		return io.Read(c.fd, buf)
+	}
+	set, err := c.setTimeout(syscall.SO_RCVTIMEO, c.readDeadline, c.rcvTimeout)
+	if err != nil {
+		return -1, err
+	}
+	c.rcvTimeout = set
+	n, err := io.Read(c.fd, buf)
+	if err == syscall.EAGAIN {
+		return -1, ErrTimeout
+	}
+	return n, err
+}
+
+func (c *conn) Write(buf []byte) (int, error) {
+	set, err := c.setTimeout(syscall.SO_SNDTIMEO, c.writeDeadline, c.sndTimeout)
+	if err != nil {
+		return -1, err
+	}
+	c.sndTimeout = set
+	n, err := io.Write(c.fd, buf)
+	if err == syscall.EAGAIN {
+		return -1, ErrTimeout
+	}
+	return n, err
+}
+
+func (c *conn) sendFile(fd int, offset int64, count int64) error {
+	set, err := c.setTimeout(syscall.SO_SNDTIMEO, c.writeDeadline, c.sndTimeout)
+	if err != nil {
+		return err
+	}
+	c.sndTimeout = set
+	_, err = io.SendFile(c.fd, fd, offset, count)
+	if err == syscall.EAGAIN {
+		return ErrTimeout
+	}
+	return err
+}
+
+type hijackedConn struct {
+	c *conn
+}
+
+func (h *hijackedConn) Read(buf []byte) (int, error) {
+	return h.c.lr.Read(buf)
+}
+
+func (h *hijackedConn) Write(buf []byte) (int, error) {
+	return h.c.writer().Write(buf)
+}
+
+func (h *hijackedConn) Close() error {
+	if h.c.tls != nil {
+		h.c.tls.Close()
+	}
+	syscall.Shutdown(h.c.fd, syscall.SHUT_RDWR)
+	return syscall.Close(h.c.fd)
+}
+
+func (h *hijackedConn) SetReadDeadline(deadline time.Time) {
+	h.c.readDeadline = deadline
+}
+
+func (h *hijackedConn) SetWriteDeadline(deadline time.Time) {
+	h.c.writeDeadline = deadline
+}
+
+func (c *conn) writer() io.Writer {
+	if c.tls != nil {
+		return c.tls
+	}
+	return c
+}
+
+func (c *conn) fillPending() error {
+	if err := c.setNonblock(true); err != nil {
+		return err
+	}
+	for c.tls.Pending() {
+		if err := c.lr.Fill(); err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return c.setNonblock(false)
+}
+
+func (c *conn) setNonblock(nonblocking bool) error {
+	if err := syscall.SetNonblock(c.fd, nonblocking); err != nil {
+		return err
+	}
+	c.nonblocking = nonblocking
+	return nil
+}
+
+func (c *conn) headerComplete() bool {
+	buf, _ := c.lr.Peek(c.lr.Buffered())
+	for i := c.scanned; i < len(buf); i++ {
+		if buf[i] != '\n' {
+			continue
+		}
+		if i+1 < len(buf) && buf[i+1] == '\n' ||
+			i+2 < len(buf) && buf[i+1] == '\r' && buf[i+2] == '\n' {
+			return true
+		}
+	}
+	if c.scanned = len(buf) - 2; c.scanned < 0 {
+		c.scanned = 0
+	}
+	return false
+}
+
+func (c *conn) setTimeout(
+	option int,
+	deadline time.Time,
+	isSet bool,
+) (bool, error) {
+	timeout := syscall.Timeval{}
+	if deadline.IsZero() {
+		if !isSet {
+			return false, nil
+		}
+	} else {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return isSet, ErrTimeout
+		}
+		if remaining < time.Microsecond {
+			remaining = time.Microsecond
+		}
+		timeout = remaining.Timeval()
+	}
+	err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, option, &timeout)
+	return !deadline.IsZero(), err
+}
+
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,221 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+type SameSite int
+
+const (
+	SameSiteDefaultMode SameSite = iota + 1
+	SameSiteLaxMode
+	SameSiteStrictMode
+	SameSiteNoneMode
+)
+
+const ErrNoCookie = protocolError("Named cookie not present")
+
+type Cookie struct {
+	Name        string
+	Value       string
+	Quoted      bool
+	Path        string
+	Domain      string
+	Expires     int64
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+func (req *Request) Cookies() []*Cookie {
+	cookies := make([]*Cookie, 0, 4)
+	for _, line := range req.Header.Values("Cookie") {
+		for _, part := range str.Split(line, ';') {
+			part = str.Trim(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if eq := str.IndexOf(part, '='); eq >= 0 {
+				name, value = part[:eq], part[eq+1:]
+			}
+			if !isToken(name) {
+				continue
+			}
+			value, quoted, ok := parseCookieValue(value)
+			if !ok {
+				continue
+			}
+			cookies = append(cookies,
+				&Cookie{Name: name, Value: value, Quoted: quoted})
+		}
+	}
+	return cookies
+}
+
+func (req *Request) Cookie(name string) (*Cookie, error) {
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			return cookie, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
+
+func SetCookie(res ResponseWriter, cookie *Cookie) {
+	if v := cookie.String(); v != "" {
+		res.Header().Add("Set-Cookie", v)
+	}
+}
+
+func (c *Cookie) String() string {
+	if c == nil || !isToken(c.Name) {
+		return ""
+	}
+	s := c.Name + "=" + sanitizeCookieValue(c.Value, c.Quoted)
+	if c.Path != "" {
+		s += "; Path=" + sanitizeCookiePath(c.Path)
+	}
+	if c.Domain != "" && isCookieDomainName(c.Domain) {
+		domain := c.Domain
+		if domain[0] == '.' {
+			domain = domain[1:]
+		}
+		s += "; Domain=" + domain
+	}
+	if c.Expires > 0 {
+		s += "; Expires=" + formatHttpDate(c.Expires)
+	}
+	if c.MaxAge > 0 {
+		s += "; Max-Age=" + str.Itoa(c.MaxAge)
+	} else if c.MaxAge < 0 {
+		s += "; Max-Age=0"
+	}
+	if c.HttpOnly {
+		s += "; HttpOnly"
+	}
+	if c.Secure {
+		s += "; Secure"
+	}
+	switch c.SameSite {
+	case SameSiteNoneMode:
+		s += "; SameSite=None"
+	case SameSiteLaxMode:
+		s += "; SameSite=Lax"
+	case SameSiteStrictMode:
+		s += "; SameSite=Strict"
+	}
+	if c.Partitioned {
+		s += "; Partitioned"
+	}
+	return s
+}
+
+func (c *Cookie) Valid() error {
+	if c == nil {
+		return protocolError("Cookie is nil")
+	}
+	if !isToken(c.Name) {
+		return protocolError("Invalid cookie name")
+	}
+	for i := 0; i < len(c.Value); i++ {
+		if !isCookieValueByte(c.Value[i]) {
+			return protocolError("Invalid byte in cookie value")
+		}
+	}
+	for i := 0; i < len(c.Path); i++ {
+		if !isCookiePathByte(c.Path[i]) {
+			return protocolError("Invalid byte in cookie path")
+		}
+	}
+	if c.Domain != "" && !isCookieDomainName(c.Domain) {
+		return protocolError("Invalid cookie domain")
+	}
+	if c.Partitioned && !c.Secure {
+		return protocolError("Partitioned cookies must be set with Secure")
+	}
+	return nil
+}
+
+func parseCookieValue(raw string) (string, bool, bool) {
+	quoted := len(raw) > 1 && raw[0] == '"' && raw[len(raw)-1] == '"'
+	if quoted {
+		raw = raw[1 : len(raw)-1]
+	}
+	for i := 0; i < len(raw); i++ {
+		if !isCookieValueByte(raw[i]) {
+			return "", false, false
+		}
+	}
+	return raw, quoted, true
+}
+
+// isCookieValueByte reports whether b is a cookie-octet as defined by
+// RFC 6265 section 4.1.1, relaxed to allow space and comma like browsers do.
+func isCookieValueByte(b byte) bool {
+	return 0x20 <= b && b < 0x7f && b != '"' && b != ';' && b != '\\'
+}
+
+func isCookiePathByte(b byte) bool {
+	return 0x20 <= b && b < 0x7f && b != ';'
+}
+
+func sanitizeCookieValue(value string, quoted bool) string {
+	sanitized := make([]byte, 0, len(value)+2)
+	for i := 0; i < len(value); i++ {
+		if isCookieValueByte(value[i]) {
+			sanitized = append(sanitized, value[i])
+		}
+	}
+	if len(sanitized) == 0 {
+		return ""
+	}
+	if quoted || str.IndexOf(string(sanitized), ' ') >= 0 ||
+		str.IndexOf(string(sanitized), ',') >= 0 {
+		return "\"" + string(sanitized) + "\""
+	}
+	return string(sanitized)
+}
+
+func sanitizeCookiePath(path string) string {
+	sanitized := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		if isCookiePathByte(path[i]) {
+			sanitized = append(sanitized, path[i])
+		}
+	}
+	return string(sanitized)
+}
+
+func isCookieDomainName(domain string) bool {
+	if domain[0] == '.' {
+		domain = domain[1:]
+	}
+	if len(domain) == 0 || len(domain) > 255 {
+		return false
+	}
+	last := byte('.')
+	labelLen := 0
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		switch {
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9':
+			labelLen++
+		case c == '-':
+			if last == '.' {
+				return false
+			}
+			labelLen++
+		case c == '.':
+			if last == '.' || last == '-' || labelLen > 63 {
+				return false
+			}
+			labelLen = 0
+		default:
+			return false
+		}
+		last = c
+	}
+	return last != '-' && labelLen <= 63
+}
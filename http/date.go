@@ -0,0 +1,107 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+var monthNames = []string{
+	"Jan", "Feb", "Mar", "Apr", "May", "Jun",
+	"Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+func formatHttpDate(unix int64) string {
+	days := unix / 86400
+	secs := unix % 86400
+	if secs < 0 {
+		days--
+		secs += 86400
+	}
+	year, month, day := civilFromDays(days)
+	weekday := (days + 4) % 7
+	if weekday < 0 {
+		weekday += 7
+	}
+	return weekdayNames[weekday] + ", " +
+		pad2(day) + " " + monthNames[month-1] + " " + str.Ltoa(year) + " " +
+		pad2(secs/3600) + ":" + pad2(secs/60%60) + ":" + pad2(secs%60) +
+		" GMT"
+}
+
+func pad2(n int64) string {
+	if n < 10 {
+		return "0" + str.Ltoa(n)
+	}
+	return str.Ltoa(n)
+}
+
+// civilFromDays converts days since 1970-01-01 to a proleptic Gregorian
+// date, following Howard Hinnant's chrono-compatible date algorithms.
+func civilFromDays(days int64) (int64, int64, int64) {
+	z := days + 719468
+	era := z / 146097
+	if z < 0 && z%146097 != 0 {
+		era--
+	}
+	doe := z - era*146097
+	yoe := (doe - doe/1460 + doe/36524 - doe/146096) / 365
+	doy := doe - (365*yoe + yoe/4 - yoe/100)
+	mp := (5*doy + 2) / 153
+	day := doy - (153*mp+2)/5 + 1
+	month := mp + 3
+	if month > 12 {
+		month -= 12
+	}
+	year := yoe + era*400
+	if month <= 2 {
+		year++
+	}
+	return year, month, day
+}
+
+func parseHttpDate(date string) (int64, bool) {
+	if len(date) != 29 || date[3] != ',' || date[4] != ' ' ||
+		date[7] != ' ' || date[11] != ' ' || date[16] != ' ' ||
+		date[19] != ':' || date[22] != ':' || date[25:] != " GMT" {
+		return 0, false
+	}
+	month := int64(-1)
+	for i, name := range monthNames {
+		if date[8:11] == name {
+			month = int64(i) + 1
+		}
+	}
+	day, dayOk := parseDigits(date[5:7])
+	year, yearOk := parseDigits(date[12:16])
+	hour, hourOk := parseDigits(date[17:19])
+	min, minOk := parseDigits(date[20:22])
+	sec, secOk := parseDigits(date[23:25])
+	if month < 0 || !dayOk || !yearOk || !hourOk || !minOk || !secOk ||
+		day < 1 || day > 31 || hour > 23 || min > 59 || sec > 60 {
+		return 0, false
+	}
+	return daysFromCivil(year, month, day)*86400 + hour*3600 + min*60 + sec, true
+}
+
+func parseDigits(s string) (int64, bool) {
+	n := int64(0)
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(s[i]-'0')
+	}
+	return n, true
+}
+
+func daysFromCivil(year int64, month int64, day int64) int64 {
+	if month <= 2 {
+		year--
+	}
+	era := year / 400
+	if year < 0 && year%400 != 0 {
+		era--
+	}
+	yoe := year - era*400
+	mp := (month + 9) % 12
+	doy := (153*mp+2)/5 + day - 1
+	doe := yoe*365 + yoe/4 - yoe/100 + doy
+	return era*146097 + doe - 719468
+}
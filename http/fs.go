@@ -0,0 +1,387 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/crypto"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+type Dir string
+
+type fileHandler struct {
+	root Dir
+}
+
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+const errInvalidRange = protocolError("Invalid range")
+
+var mimeTypes = map[string]string{
+	".avif":  "image/avif",
+	".css":   "text/css; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".gif":   "image/gif",
+	".gz":    "application/gzip",
+	".htm":   "text/html; charset=utf-8",
+	".html":  "text/html; charset=utf-8",
+	".ico":   "image/x-icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".md":    "text/markdown; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".ogg":   "audio/ogg",
+	".otf":   "font/otf",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".ttf":   "font/ttf",
+	".txt":   "text/plain; charset=utf-8",
+	".wasm":  "application/wasm",
+	".wav":   "audio/wav",
+	".webm":  "video/webm",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".xml":   "text/xml; charset=utf-8",
+	".zip":   "application/zip",
+}
+
+func FileServer(root Dir) Handler {
+	return &fileHandler{root}
+}
+
+func StripPrefix(prefix string, handler Handler) Handler {
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		path := req.URL.Path
+		if len(path) < len(prefix) || path[:len(prefix)] != prefix {
+			Error(res, "Not Found", 404)
+			return
+		}
+		stripped := *req
+		url := *req.URL
+		url.Path = path[len(prefix):]
+		url.RawPath = ""
+		stripped.URL = &url
+		handler.ServeHTTP(res, &stripped)
+	})
+}
+
+func (handler *fileHandler) ServeHTTP(res ResponseWriter, req *Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		res.Header().Set("Allow", "GET, HEAD")
+		Error(res, "Method Not Allowed", 405)
+		return
+	}
+	name := req.URL.Path
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	if !isSafePath(name) {
+		Error(res, "Bad Request", 400)
+		return
+	}
+	fd, stat, err := openFile(string(handler.root) + name)
+	if err != nil {
+		fileError(res, err)
+		return
+	}
+	if stat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		syscall.Close(fd)
+		if name[len(name)-1] != '/' {
+			redirectToDir(res, req)
+			return
+		}
+		name += "index.html"
+		if fd, stat, err = openFile(string(handler.root) + name); err != nil {
+			fileError(res, err)
+			return
+		}
+	}
+	defer syscall.Close(fd)
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		Error(res, "Not Found", 404)
+		return
+	}
+	serveFile(res, req, name, fd, stat)
+}
+
+func isSafePath(name string) bool {
+	for _, segment := range str.Split(name, '/') {
+		if segment == ".." {
+			return false
+		}
+	}
+	return str.IndexOf(name, 0) < 0
+}
+
+func openFile(path string) (int, *syscall.Stat_t, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	stat := &syscall.Stat_t{}
+	if err := syscall.Fstat(fd, stat); err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	return fd, stat, nil
+}
+
+func fileError(res ResponseWriter, err error) {
+	switch err {
+	case syscall.ENOENT, syscall.ENOTDIR, syscall.ENAMETOOLONG:
+		Error(res, "Not Found", 404)
+	case syscall.EACCES, syscall.EPERM:
+		Error(res, "Forbidden", 403)
+	default:
+		Error(res, "Internal Server Error", 500)
+	}
+}
+
+func redirectToDir(res ResponseWriter, req *Request) {
+	location := req.URL.EscapedPath()
+	if slash := str.LastIndexOf(location, '/'); slash >= 0 {
+		location = location[slash+1:]
+	}
+	location = "./" + location + "/"
+	if req.URL.RawQuery != "" {
+		location += "?" + req.URL.RawQuery
+	}
+	res.Header().Set("Location", location)
+	res.WriteHeader(301)
+}
+
+func serveFile(
+	res ResponseWriter,
+	req *Request,
+	name string,
+	fd int,
+	stat *syscall.Stat_t,
+) {
+	modTime := stat.Mtim.Sec
+	etag := "\"" + formatChunkSize(int(modTime)) + "-" +
+		formatChunkSize(int(stat.Size)) + "\""
+	lastModified := formatHttpDate(modTime)
+	res.Header().Set("ETag", etag)
+	res.Header().Set("Last-Modified", lastModified)
+	res.Header().Set("Accept-Ranges", "bytes")
+	if isNotModified(req, etag, modTime) {
+		res.WriteHeader(304)
+		return
+	}
+	contentType := mimeType(name)
+	res.Header().Set("Content-Type", contentType)
+
+	size := stat.Size
+	rangeHeader := req.Header.Get("Range")
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" &&
+		ifRange != etag && ifRange != lastModified {
+		rangeHeader = ""
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		res.Header().Set("Content-Range", "bytes */"+str.Ltoa(size))
+		Error(res, "Range Not Satisfiable", 416)
+		return
+	}
+	if rangesLength(ranges) > size {
+		ranges = nil
+	}
+	switch len(ranges) {
+	case 0:
+		res.Header().Set("Content-Length", str.Ltoa(size))
+		res.WriteHeader(200)
+		sendFileRange(res, fd, 0, size)
+	case 1:
+		res.Header().Set("Content-Range", contentRange(ranges[0], size))
+		res.Header().Set("Content-Length", str.Ltoa(ranges[0].length))
+		res.WriteHeader(206)
+		sendFileRange(res, fd, ranges[0].start, ranges[0].length)
+	default:
+		sendMultipartRanges(res, fd, ranges, size, contentType)
+	}
+}
+
+func sendMultipartRanges(
+	res ResponseWriter,
+	fd int,
+	ranges []httpRange,
+	size int64,
+	contentType string,
+) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		Error(res, "Internal Server Error", 500)
+		return
+	}
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		partHeaders[i] = "\r\n--" + boundary + "\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Range: " + contentRange(r, size) + "\r\n\r\n"
+		length += int64(len(partHeaders[i])) + r.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+	res.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	res.Header().Set("Content-Length", str.Ltoa(length))
+	res.WriteHeader(206)
+	for i, r := range ranges {
+		if _, err := res.Write([]byte(partHeaders[i])); err != nil {
+			return
+		}
+		if err := sendFileRange(res, fd, r.start, r.length); err != nil {
+			return
+		}
+	}
+	res.Write([]byte(closing))
+}
+
+type fileSender interface {
+	sendFile(fd int, offset int64, count int64) error
+}
+
+func sendFileRange(res ResponseWriter, fd int, offset int64, count int64) error {
+	if sender, isSender := res.(fileSender); isSender {
+		return sender.sendFile(fd, offset, count)
+	}
+	return copyFile(res, fd, offset, count)
+}
+
+func copyFile(writer io.Writer, fd int, offset int64, count int64) error {
+	buf := make([]byte, maxBufferedBody)
+	for count > 0 {
+		chunk := buf
+		if int64(len(chunk)) > count {
+			chunk = chunk[:count]
+		}
+		n, err := io.ReadAt(fd, chunk, offset)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(chunk[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+		count -= int64(n)
+	}
+	return nil
+}
+
+func isNotModified(req *Request, etag string, modTime int64) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range str.Split(ifNoneMatch, ',') {
+			candidate = str.Trim(candidate)
+			if len(candidate) > 2 && candidate[:2] == "W/" {
+				candidate = candidate[2:]
+			}
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, ok := parseHttpDate(req.Header.Get("If-Modified-Since"))
+	return ok && modTime <= since
+}
+
+func mimeType(name string) string {
+	dot := str.LastIndexOf(name, '.')
+	if dot < 0 || dot < str.LastIndexOf(name, '/') {
+		return "application/octet-stream"
+	}
+	if mime, found := mimeTypes[str.ToLowerAscii(name[dot:])]; found {
+		return mime
+	}
+	return "application/octet-stream"
+}
+
+func parseRange(header string, size int64) ([]httpRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	if len(header) < 6 || header[:6] != "bytes=" {
+		return nil, nil
+	}
+	ranges := make([]httpRange, 0, 1)
+	for _, spec := range str.Split(header[6:], ',') {
+		spec = str.Trim(spec)
+		if spec == "" {
+			continue
+		}
+		dash := str.IndexOf(spec, '-')
+		if dash < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := str.Trim(spec[:dash]), str.Trim(spec[dash+1:])
+		r := httpRange{}
+		if first == "" {
+			suffix, ok := parseDigits(last)
+			if !ok || last == "" {
+				return nil, errInvalidRange
+			}
+			if suffix > size {
+				suffix = size
+			}
+			r.start, r.length = size-suffix, suffix
+		} else {
+			start, ok := parseDigits(first)
+			if !ok {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				if end, ok = parseDigits(last); !ok || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r.start, r.length = start, end-start+1
+		}
+		if r.start < size && r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func rangesLength(ranges []httpRange) int64 {
+	length := int64(0)
+	for _, r := range ranges {
+		length += r.length
+	}
+	return length
+}
+
+func contentRange(r httpRange, size int64) string {
+	return "bytes " + str.Ltoa(r.start) + "-" +
+		str.Ltoa(r.start+r.length-1) + "/" + str.Ltoa(size)
+}
+
+func randomBoundary() (string, error) {
+	random := make([]byte, 15)
+	if err := crypto.Rand(random); err != nil {
+		return "", err
+	}
+	const digits = "0123456789abcdef"
+	boundary := make([]byte, 0, len(random)*2)
+	for _, b := range random {
+		boundary = append(boundary, digits[b>>4], digits[b&15])
+	}
+	return string(boundary), nil
+}
@@ -0,0 +1,1234 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/context"
+	"github.com/alaisi/syscalltodo/http/hpack"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const (
+	h2StreamWindow = 1 << 20
+	h2ConnWindow   = 4 << 20
+	h2MaxStreams   = 100
+)
+
+const errH2Closed = protocolError("HTTP/2 stream closed")
+
+// h2Conn is an HTTP/2 connection. The serving goroutine reads frames while
+// each stream runs its handler in a goroutine of its own; lock guards the
+// stream and flow-control state and writeLock keeps frames, and the HPACK
+// encoder state, in order on the socket. writeLock may be held while taking
+// lock but never the other way around.
+type h2Conn struct {
+	srv           *Server
+	c             *conn
+	lock          chan any
+	writeLock     chan any
+	changed       chan struct{}
+	decoder       *hpack.Decoder
+	encoder       *hpack.Encoder
+	encoded       *io.ByteArrayWriter
+	streams       map[uint32]*h2Stream
+	handlers      int
+	lastStream    uint32
+	sendWindow    int64
+	recvWindow    int64
+	unacked       int64
+	peerWindow    int64
+	peerFrameSize uint32
+	goingAway     bool
+	closed        bool
+}
+
+type h2Stream struct {
+	id         uint32
+	sendWindow int64
+	recvWindow int64
+	unacked    int64
+	data       []byte
+	bodyErr    error
+	declared   int
+	received   int
+	remoteDone bool
+	reset      bool
+	trailer    Header
+	cancel     context.CancelFunc
+}
+
+func newH2Conn(srv *Server, c *conn) *h2Conn {
+	hc := &h2Conn{
+		srv:           srv,
+		c:             c,
+		lock:          newLock(),
+		writeLock:     newLock(),
+		changed:       make(chan struct{}),
+		decoder:       hpack.NewDecoder(h2DefaultHeaderTable),
+		encoded:       io.NewByteArrayWriter(),
+		streams:       make(map[uint32]*h2Stream),
+		sendWindow:    h2DefaultWindow,
+		recvWindow:    h2DefaultWindow,
+		peerWindow:    h2DefaultWindow,
+		peerFrameSize: h2DefaultFrameSize,
+	}
+	hc.encoder = hpack.NewEncoder(hc.encoded)
+	hc.decoder.SetMaxStringLength(srv.maxHeaderBytes())
+	hc.decoder.SetMaxHeaderListSize(uint32(srv.maxHeaderBytes()))
+	return hc
+}
+
+// serveH2 runs an HTTP/2 connection, started either by the client preface
+// or by an "Upgrade: h2c" request that is answered as stream 1.
+func (srv *Server) serveH2(c *conn, upgrade *Request, settings []byte) {
+	hc := newH2Conn(srv, c)
+	shuttingDown := false
+	srv.withLock(func() {
+		c.goAway = hc.shutdown
+		shuttingDown = srv.shuttingDown
+	})
+	defer hc.close()
+	if err := hc.writeSettings(); err != nil {
+		return
+	}
+	if shuttingDown || c.overCapacity {
+		hc.shutdown()
+	}
+	if upgrade != nil {
+		if err := hc.applySettings(settings); err != nil {
+			hc.fail(err)
+			return
+		}
+		s := &h2Stream{id: 1, declared: -1, remoteDone: true, bodyErr: io.EOF}
+		upgrade.ctx = hc.streamContext(s)
+		hc.lastStream = 1
+		hc.startStream(s, upgrade, 0)
+	}
+	c.readDeadline = deadlineAfter(srv.headerTimeout())
+	preface := make([]byte, len(h2Preface))
+	if err := readFull(c.lr, preface); err != nil {
+		return
+	}
+	if string(preface) != h2Preface {
+		hc.fail(h2ConnError{h2ProtocolError, "Invalid connection preface"})
+		return
+	}
+	hc.fail(hc.readFrames())
+}
+
+func isH2Preface(c *conn) bool {
+	buf, _ := c.lr.Peek(c.lr.Buffered())
+	line := h2Preface[:16]
+	return len(buf) >= len(line) && string(buf[:len(line)]) == line
+}
+
+// h2cUpgradeSettings returns the decoded HTTP2-Settings of a request asking
+// to upgrade a cleartext connection.
+func h2cUpgradeSettings(c *conn, req *Request) ([]byte, bool) {
+	if c.tls != nil || req.Proto != "HTTP/1.1" ||
+		!req.Header.hasToken("Upgrade", "h2c") ||
+		!req.Header.hasToken("Connection", "upgrade") ||
+		!req.Header.hasToken("Connection", "http2-settings") {
+		return nil, false
+	}
+	values := req.Header.Values("Http2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	return decodeB64Url(values[0])
+}
+
+func (srv *Server) upgradeH2c(c *conn, req *Request, settings []byte) {
+	body, err := readBody(req)
+	if err != nil {
+		if status := errorStatus(err); status != 0 {
+			sendErrorResponse(c.writer(), status)
+		}
+		return
+	}
+	req.Header.Del("Connection")
+	req.Header.Del("Upgrade")
+	req.Header.Del("Http2-Settings")
+	req.Proto = "HTTP/2.0"
+	req.body = nil
+	req.contentLength = len(body)
+	req.bodyReader = newBodyReader(
+		io.NewLineReader(io.NewByteArrayReader(body)),
+		len(body), nil, srv.maxBodyBytes())
+	req.Body = req.bodyReader
+	if _, err := c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n")); err != nil {
+		return
+	}
+	srv.serveH2(c, req, settings)
+}
+
+func decodeB64Url(s string) ([]byte, bool) {
+	encoded := make([]byte, 0, len(s)+3)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-':
+			c = '+'
+		case c == '_':
+			c = '/'
+		default:
+			return nil, false
+		}
+		encoded = append(encoded, c)
+	}
+	if len(encoded) == 0 {
+		return []byte{}, true
+	}
+	if len(encoded)%4 == 1 {
+		return nil, false
+	}
+	for len(encoded)%4 != 0 {
+		encoded = append(encoded, '=')
+	}
+	return str.DecodeB64(string(encoded)), true
+}
+
+func (hc *h2Conn) readFrames() error {
+	for first := true; ; first = false {
+		idle, done := false, false
+		hc.withLock(func() {
+			idle = len(hc.streams) == 0
+			done = idle && hc.goingAway
+		})
+		if done {
+			return nil
+		}
+		hc.c.readDeadline = time.Time{}
+		if idle {
+			hc.c.readDeadline = deadlineAfter(hc.srv.idleTimeout())
+		}
+		frame, err := readH2Frame(hc.c.lr, h2DefaultFrameSize)
+		if err != nil {
+			return err
+		}
+		if first && frame.typ != h2FrameSettings {
+			return h2ConnError{h2ProtocolError, "Expected SETTINGS"}
+		}
+		if err := hc.handleFrame(frame); err != nil {
+			streamErr, isStreamErr := err.(h2StreamError)
+			if !isStreamErr {
+				return err
+			}
+			hc.resetStream(streamErr.stream, streamErr.code)
+		}
+	}
+}
+
+// fail ends the connection with a GOAWAY, unless the peer is already gone.
+func (hc *h2Conn) fail(err error) {
+	if err == nil {
+		return
+	}
+	if connErr, isConnErr := err.(h2ConnError); isConnErr {
+		hc.writeGoAway(connErr.code, connErr.reason)
+	} else if err == ErrTimeout {
+		hc.writeGoAway(h2NoError, "")
+	}
+}
+
+// close cancels the streams that are still running and waits for their
+// handlers, so that the socket isn't closed under them.
+func (hc *h2Conn) close() {
+	hc.srv.withLock(func() {
+		hc.c.goAway = nil
+	})
+	streams := make([]*h2Stream, 0)
+	hc.withLock(func() {
+		hc.closed = true
+		for _, s := range hc.streams {
+			s.bodyErr = errH2Closed
+			streams = append(streams, s)
+		}
+		hc.notify()
+	})
+	for _, s := range streams {
+		s.cancel()
+	}
+	for {
+		var wait chan struct{}
+		hc.withLock(func() {
+			if hc.handlers > 0 {
+				wait = hc.changed
+			}
+		})
+		if wait == nil {
+			return
+		}
+		<-wait
+	}
+}
+
+// shutdown is called by Server.Shutdown: the client is told not to open new
+// streams, and the connection closes once the running ones finish.
+func (hc *h2Conn) shutdown() {
+	send, idle := false, false
+	hc.withLock(func() {
+		if !hc.goingAway && !hc.closed {
+			hc.goingAway = true
+			send = true
+		}
+		idle = len(hc.streams) == 0
+	})
+	if send {
+		hc.writeGoAway(h2NoError, "")
+	}
+	if idle {
+		syscall.Shutdown(hc.c.fd, syscall.SHUT_RD)
+	}
+}
+
+func (hc *h2Conn) handleFrame(frame *h2Frame) error {
+	switch frame.typ {
+	case h2FrameData:
+		return hc.handleData(frame)
+	case h2FrameHeaders:
+		return hc.handleHeaders(frame)
+	case h2FramePriority:
+		if frame.stream == 0 {
+			return h2ConnError{h2ProtocolError, "PRIORITY on stream 0"}
+		}
+		if len(frame.payload) != 5 {
+			return h2StreamError{frame.stream, h2FrameSizeError}
+		}
+		if readUint32(frame.payload)&h2MaxWindow == frame.stream {
+			return h2StreamError{frame.stream, h2ProtocolError}
+		}
+	case h2FrameRstStream:
+		return hc.handleRstStream(frame)
+	case h2FrameSettings:
+		return hc.handleSettings(frame)
+	case h2FramePushPromise:
+		return h2ConnError{h2ProtocolError, "PUSH_PROMISE from client"}
+	case h2FramePing:
+		if frame.stream != 0 {
+			return h2ConnError{h2ProtocolError, "PING on a stream"}
+		}
+		if len(frame.payload) != 8 {
+			return h2ConnError{h2FrameSizeError, "Invalid PING"}
+		}
+		if frame.flags&h2FlagAck == 0 {
+			return hc.writeFrame(h2FramePing, h2FlagAck, 0, frame.payload)
+		}
+	case h2FrameGoAway:
+		if frame.stream != 0 {
+			return h2ConnError{h2ProtocolError, "GOAWAY on a stream"}
+		}
+		hc.withLock(func() {
+			hc.goingAway = true
+		})
+	case h2FrameWindowUpdate:
+		return hc.handleWindowUpdate(frame)
+	case h2FrameContinuation:
+		return h2ConnError{h2ProtocolError, "Unexpected CONTINUATION"}
+	}
+	return nil
+}
+
+func (hc *h2Conn) handleHeaders(frame *h2Frame) error {
+	if frame.stream%2 == 0 {
+		return h2ConnError{h2ProtocolError, "Invalid stream identifier"}
+	}
+	block, err := hc.readHeaderBlock(frame)
+	if err != nil {
+		return err
+	}
+	fields, err := hc.decoder.DecodeFull(block)
+	if err == hpack.ErrHeaderListTooLarge {
+		return h2ConnError{h2EnhanceYourCalm, err.Error()}
+	}
+	if err != nil {
+		return h2ConnError{h2CompressionError, err.Error()}
+	}
+	endStream := frame.flags&h2FlagEndStream != 0
+	var existing *h2Stream
+	isNew, ignored, refused := false, false, false
+	hc.withLock(func() {
+		existing = hc.streams[frame.stream]
+		if existing != nil || frame.stream <= hc.lastStream {
+			return
+		}
+		if hc.goingAway {
+			ignored = true
+			return
+		}
+		isNew = true
+		hc.lastStream = frame.stream
+		refused = len(hc.streams) >= h2MaxStreams
+	})
+	if existing != nil {
+		return hc.handleTrailers(existing, fields, endStream)
+	}
+	if ignored {
+		return nil
+	}
+	if !isNew {
+		return h2ConnError{h2StreamClosed, "HEADERS on a closed stream"}
+	}
+	if frame.flags&h2FlagPriority != 0 {
+		if readUint32(frame.payload[frame.padLength():])&h2MaxWindow == frame.stream {
+			return h2StreamError{frame.stream, h2ProtocolError}
+		}
+	}
+	if refused {
+		return h2StreamError{frame.stream, h2RefusedStream}
+	}
+	s := &h2Stream{id: frame.stream, declared: -1, remoteDone: endStream}
+	req, status, err := hc.newRequest(s, fields)
+	if err != nil {
+		return err
+	}
+	hc.startStream(s, req, status)
+	return nil
+}
+
+// readHeaderBlock joins a HEADERS frame with the CONTINUATION frames that
+// must follow it directly.
+func (hc *h2Conn) readHeaderBlock(frame *h2Frame) ([]byte, error) {
+	data, err := frame.data()
+	if err != nil {
+		return nil, err
+	}
+	block := append([]byte(nil), data...)
+	for frame.flags&h2FlagEndHeaders == 0 {
+		next, err := readH2Frame(hc.c.lr, h2DefaultFrameSize)
+		if err != nil {
+			return nil, err
+		}
+		if next.typ != h2FrameContinuation || next.stream != frame.stream {
+			return nil, h2ConnError{h2ProtocolError, "Expected CONTINUATION"}
+		}
+		if block = append(block, next.payload...); len(block) > 2*hc.srv.maxHeaderBytes() {
+			return nil, h2ConnError{h2EnhanceYourCalm, "Header block too large"}
+		}
+		frame.flags |= next.flags & h2FlagEndHeaders
+	}
+	return block, nil
+}
+
+func (hc *h2Conn) handleTrailers(
+	s *h2Stream,
+	fields []hpack.HeaderField,
+	endStream bool,
+) error {
+	if !endStream {
+		return h2StreamError{s.id, h2ProtocolError}
+	}
+	var err error
+	hc.withLock(func() {
+		if s.remoteDone {
+			err = h2StreamError{s.id, h2StreamClosed}
+			return
+		}
+		for _, f := range fields {
+			if len(f.Name) == 0 || f.Name[0] == ':' {
+				err = h2StreamError{s.id, h2ProtocolError}
+				return
+			}
+			if s.trailer != nil {
+				s.trailer.Add(f.Name, f.Value)
+			}
+		}
+		s.remoteDone = true
+		s.bodyErr = s.endOfBody()
+		hc.notify()
+	})
+	return err
+}
+
+func (hc *h2Conn) newRequest(
+	s *h2Stream,
+	fields []hpack.HeaderField,
+) (*Request, int, error) {
+	malformed := h2StreamError{s.id, h2ProtocolError}
+	header := make(Header)
+	method, scheme, authority, path := "", "", "", ""
+	regular := false
+	for _, f := range fields {
+		if len(f.Name) > 0 && f.Name[0] == ':' {
+			var pseudo *string
+			switch f.Name {
+			case ":method":
+				pseudo = &method
+			case ":scheme":
+				pseudo = &scheme
+			case ":authority":
+				pseudo = &authority
+			case ":path":
+				pseudo = &path
+			}
+			if regular || pseudo == nil || *pseudo != "" || f.Value == "" {
+				return nil, 0, malformed
+			}
+			*pseudo = f.Value
+			continue
+		}
+		regular = true
+		if !isToken(f.Name) || str.ToLowerAscii(f.Name) != f.Name ||
+			!isValidFieldValue(f.Value) {
+			return nil, 0, malformed
+		}
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection",
+			"transfer-encoding", "upgrade":
+			return nil, 0, malformed
+		case "te":
+			if f.Value != "trailers" {
+				return nil, 0, malformed
+			}
+		}
+		header.Add(f.Name, f.Value)
+	}
+	if method == "" || scheme == "" || path == "" || !isToken(method) {
+		return nil, 0, malformed
+	}
+	if cookies := header.Values("Cookie"); len(cookies) > 1 {
+		joined := cookies[0]
+		for _, cookie := range cookies[1:] {
+			joined += "; " + cookie
+		}
+		header.Set("Cookie", joined)
+	}
+	if lengths := header.Values("Content-Length"); len(lengths) > 0 {
+		for _, length := range lengths {
+			if length != lengths[0] || !isDigits(length) {
+				return nil, 0, malformed
+			}
+		}
+		s.declared = str.Atoi(lengths[0])
+		if s.remoteDone && s.declared != 0 {
+			return nil, 0, malformed
+		}
+	}
+	host := authority
+	if host == "" {
+		host = header.Get("Host")
+	}
+	req := &Request{
+		Method:     method,
+		Header:     &header,
+		Proto:      "HTTP/2.0",
+		Host:       host,
+		RemoteAddr: hc.c.remoteAddr,
+		LocalAddr:  hc.c.localAddr,
+		ctx:        hc.streamContext(s),
+		clientIP:   hc.srv.clientIP(hc.c.remoteAddr, &header),
+	}
+	framing := closeDelimitedBody
+	if s.remoteDone {
+		framing = 0
+		s.bodyErr = io.EOF
+	} else {
+		s.trailer = make(Header)
+		req.Trailer = s.trailer
+		if s.declared >= 0 {
+			framing = s.declared
+		}
+	}
+	body := &h2Body{hc: hc, stream: s, ctx: req.ctx}
+	req.contentLength = framing
+	req.bodyReader = newBodyReader(
+		io.NewLineReader(body), framing, nil, hc.srv.maxBodyBytes())
+	req.Body = req.bodyReader
+	url, err := parseRequestURI(path)
+	if err != nil {
+		req.URL = &URL{Path: "/"}
+		return req, 400, nil
+	}
+	req.URL = url
+	if s.declared > hc.srv.maxBodyBytes() {
+		return req, 413, nil
+	}
+	return req, 0, nil
+}
+
+func isValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// streamContext gives the stream's request a context that is cancelled when
+// the stream is reset, and like HTTP/1 requests, at the write timeout.
+func (hc *h2Conn) streamContext(s *h2Stream) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	if hc.srv.WriteTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), hc.srv.WriteTimeout)
+	}
+	s.cancel = cancel
+	return ctx
+}
+
+func (hc *h2Conn) startStream(s *h2Stream, req *Request, status int) {
+	hc.withLock(func() {
+		s.sendWindow = hc.peerWindow
+		s.recvWindow = h2StreamWindow
+		hc.streams[s.id] = s
+		hc.handlers++
+	})
+	go hc.runStream(s, req, status)
+}
+
+func (hc *h2Conn) runStream(s *h2Stream, req *Request, status int) {
+	defer hc.finishStream(s)
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrAbortHandler {
+				io.Write(2, []byte(str.ToString(r)))
+			}
+			hc.resetStream(s.id, h2InternalError)
+		}
+	}()
+	res := newH2Response(hc, s, req)
+	if status != 0 {
+		Error(res, statusTexts[status], status)
+	} else {
+		hc.srv.Handler.ServeHTTP(res, req)
+	}
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+	if err := req.bodyReader.err; (err == ErrBodyTooLarge ||
+		err == ErrTimeout) && !res.streaming {
+		res = newH2Response(hc, s, req)
+		Error(res, err.Error(), errorStatus(err))
+	}
+	if res.finish(); res.err != nil && res.err != errH2Closed {
+		hc.resetStream(s.id, h2InternalError)
+	}
+}
+
+// finishStream closes the stream once its handler returns. A client still
+// sending the request body is told to stop with a RST_STREAM.
+func (hc *h2Conn) finishStream(s *h2Stream) {
+	reset, wake := false, false
+	credit := 0
+	hc.withLock(func() {
+		delete(hc.streams, s.id)
+		reset = !s.remoteDone && !s.reset && !hc.closed
+		s.reset = true
+		credit = len(s.data)
+		s.data = nil
+		s.bodyErr = errH2Closed
+		wake = hc.goingAway && len(hc.streams) == 0
+		hc.notify()
+	})
+	s.cancel()
+	if reset {
+		hc.writeFrame(h2FrameRstStream, 0, s.id, appendUint32(nil, h2NoError))
+	}
+	if credit > 0 {
+		hc.returnCredit(nil, credit)
+	}
+	if wake {
+		syscall.Shutdown(hc.c.fd, syscall.SHUT_RD)
+	}
+	hc.withLock(func() {
+		hc.handlers--
+		hc.notify()
+	})
+}
+
+func (hc *h2Conn) resetStream(id uint32, code uint32) {
+	var s *h2Stream
+	hc.withLock(func() {
+		if s = hc.streams[id]; s != nil && !s.reset {
+			s.reset = true
+			s.bodyErr = errH2Closed
+			hc.notify()
+		}
+	})
+	if s != nil {
+		s.cancel()
+	}
+	hc.writeFrame(h2FrameRstStream, 0, id, appendUint32(nil, code))
+}
+
+func (hc *h2Conn) handleData(frame *h2Frame) error {
+	if frame.stream == 0 {
+		return h2ConnError{h2ProtocolError, "DATA on stream 0"}
+	}
+	data, err := frame.data()
+	if err != nil {
+		return err
+	}
+	length := int64(len(frame.payload))
+	var s *h2Stream
+	err = nil
+	hc.withLock(func() {
+		if hc.recvWindow -= length; hc.recvWindow < 0 {
+			err = h2ConnError{h2FlowControlError, "Connection window exceeded"}
+			return
+		}
+		if frame.stream > hc.lastStream {
+			err = h2ConnError{h2ProtocolError, "DATA on an idle stream"}
+			return
+		}
+		stream := hc.streams[frame.stream]
+		switch {
+		case stream == nil || stream.reset:
+		case stream.remoteDone:
+			err = h2StreamError{frame.stream, h2StreamClosed}
+		case stream.recvWindow-length < 0:
+			err = h2StreamError{frame.stream, h2FlowControlError}
+		default:
+			s = stream
+			s.recvWindow -= length
+			s.received += len(data)
+			s.data = append(s.data, data...)
+			if s.declared >= 0 && s.received > s.declared {
+				err = h2StreamError{s.id, h2ProtocolError}
+			} else if frame.flags&h2FlagEndStream != 0 {
+				s.remoteDone = true
+				s.bodyErr = s.endOfBody()
+			}
+			hc.notify()
+		}
+	})
+	if _, isConnErr := err.(h2ConnError); isConnErr {
+		return err
+	}
+	if s == nil {
+		hc.returnCredit(nil, int(length))
+	} else if padding := int(length) - len(data); padding > 0 {
+		hc.returnCredit(s, padding)
+	}
+	return err
+}
+
+func (s *h2Stream) endOfBody() error {
+	if s.declared >= 0 && s.received != s.declared {
+		return errUnexpectedEndOfBody
+	}
+	return io.EOF
+}
+
+// returnCredit hands consumed bytes back to the peer with WINDOW_UPDATE
+// frames, batched until half of a window has been used.
+func (hc *h2Conn) returnCredit(s *h2Stream, n int) {
+	connIncrement, streamIncrement := int64(0), int64(0)
+	hc.withLock(func() {
+		if hc.closed {
+			return
+		}
+		if hc.unacked += int64(n); hc.unacked >= h2ConnWindow/2 {
+			connIncrement = hc.unacked
+			hc.recvWindow += hc.unacked
+			hc.unacked = 0
+		}
+		if s == nil || s.remoteDone || s.reset {
+			return
+		}
+		if s.unacked += int64(n); s.unacked >= h2StreamWindow/2 {
+			streamIncrement = s.unacked
+			s.recvWindow += s.unacked
+			s.unacked = 0
+		}
+	})
+	if connIncrement > 0 {
+		hc.writeWindowUpdate(0, uint32(connIncrement))
+	}
+	if streamIncrement > 0 {
+		hc.writeWindowUpdate(s.id, uint32(streamIncrement))
+	}
+}
+
+func (hc *h2Conn) handleRstStream(frame *h2Frame) error {
+	if frame.stream == 0 {
+		return h2ConnError{h2ProtocolError, "RST_STREAM on stream 0"}
+	}
+	if len(frame.payload) != 4 {
+		return h2ConnError{h2FrameSizeError, "Invalid RST_STREAM"}
+	}
+	var s *h2Stream
+	var err error
+	hc.withLock(func() {
+		if frame.stream > hc.lastStream {
+			err = h2ConnError{h2ProtocolError, "RST_STREAM on an idle stream"}
+			return
+		}
+		if s = hc.streams[frame.stream]; s != nil {
+			s.reset = true
+			s.bodyErr = errH2Closed
+			hc.notify()
+		}
+	})
+	if s != nil {
+		s.cancel()
+	}
+	return err
+}
+
+func (hc *h2Conn) handleSettings(frame *h2Frame) error {
+	if frame.stream != 0 {
+		return h2ConnError{h2ProtocolError, "SETTINGS on a stream"}
+	}
+	if frame.flags&h2FlagAck != 0 {
+		if len(frame.payload) != 0 {
+			return h2ConnError{h2FrameSizeError, "Invalid SETTINGS acknowledgement"}
+		}
+		return nil
+	}
+	if err := hc.applySettings(frame.payload); err != nil {
+		return err
+	}
+	return hc.writeFrame(h2FrameSettings, h2FlagAck, 0, nil)
+}
+
+func (hc *h2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return h2ConnError{h2FrameSizeError, "Invalid SETTINGS"}
+	}
+	for i := 0; i < len(payload); i += 6 {
+		id := int(payload[i])<<8 | int(payload[i+1])
+		value := readUint32(payload[i+2:])
+		var err error
+		switch id {
+		case h2SettingHeaderTableSize:
+			hc.withWriteLock(func() {
+				hc.encoder.SetMaxDynamicTableSize(value)
+			})
+		case h2SettingEnablePush:
+			if value > 1 {
+				err = h2ConnError{h2ProtocolError, "Invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case h2SettingInitialWindowSize:
+			if value > h2MaxWindow {
+				return h2ConnError{h2FlowControlError, "Invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			hc.withLock(func() {
+				delta := int64(value) - hc.peerWindow
+				hc.peerWindow = int64(value)
+				for _, s := range hc.streams {
+					if s.sendWindow += delta; s.sendWindow > h2MaxWindow {
+						err = h2ConnError{h2FlowControlError, "Stream window overflow"}
+					}
+				}
+				hc.notify()
+			})
+		case h2SettingMaxFrameSize:
+			if value < h2DefaultFrameSize || value > h2MaxFrameSize {
+				return h2ConnError{h2ProtocolError, "Invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			hc.withLock(func() {
+				hc.peerFrameSize = value
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hc *h2Conn) handleWindowUpdate(frame *h2Frame) error {
+	if len(frame.payload) != 4 {
+		return h2ConnError{h2FrameSizeError, "Invalid WINDOW_UPDATE"}
+	}
+	increment := int64(readUint32(frame.payload) & h2MaxWindow)
+	var err error
+	hc.withLock(func() {
+		if frame.stream == 0 {
+			if increment == 0 {
+				err = h2ConnError{h2ProtocolError, "Zero WINDOW_UPDATE"}
+			} else if hc.sendWindow += increment; hc.sendWindow > h2MaxWindow {
+				err = h2ConnError{h2FlowControlError, "Connection window overflow"}
+			}
+			hc.notify()
+			return
+		}
+		if frame.stream > hc.lastStream {
+			err = h2ConnError{h2ProtocolError, "WINDOW_UPDATE on an idle stream"}
+			return
+		}
+		s := hc.streams[frame.stream]
+		if s == nil || s.reset {
+			return
+		}
+		if increment == 0 {
+			err = h2StreamError{s.id, h2ProtocolError}
+		} else if s.sendWindow += increment; s.sendWindow > h2MaxWindow {
+			err = h2StreamError{s.id, h2FlowControlError}
+		}
+		hc.notify()
+	})
+	return err
+}
+
+func (hc *h2Conn) writeSettings() error {
+	payload := make([]byte, 0, 18)
+	payload = appendH2Setting(payload, h2SettingMaxConcurrentStreams, h2MaxStreams)
+	payload = appendH2Setting(payload, h2SettingInitialWindowSize, h2StreamWindow)
+	payload = appendH2Setting(payload, h2SettingMaxHeaderListSize,
+		uint32(hc.srv.maxHeaderBytes()))
+	if err := hc.writeFrame(h2FrameSettings, 0, 0, payload); err != nil {
+		return err
+	}
+	hc.withLock(func() {
+		hc.recvWindow = h2ConnWindow
+	})
+	return hc.writeWindowUpdate(0, h2ConnWindow-h2DefaultWindow)
+}
+
+func appendH2Setting(dst []byte, id int, value uint32) []byte {
+	dst = append(dst, byte(id>>8), byte(id))
+	return appendUint32(dst, value)
+}
+
+func (hc *h2Conn) writeWindowUpdate(stream uint32, increment uint32) error {
+	return hc.writeFrame(h2FrameWindowUpdate, 0, stream, appendUint32(nil, increment))
+}
+
+func (hc *h2Conn) writeGoAway(code uint32, reason string) error {
+	lastStream := uint32(0)
+	hc.withLock(func() {
+		lastStream = hc.lastStream
+	})
+	payload := appendUint32(appendUint32(nil, lastStream), code)
+	return hc.writeFrame(h2FrameGoAway, 0, 0, append(payload, reason...))
+}
+
+func (hc *h2Conn) writeFrame(
+	typ byte,
+	flags byte,
+	stream uint32,
+	payload []byte,
+) error {
+	var err error
+	hc.withWriteLock(func() {
+		closed := false
+		hc.withLock(func() {
+			closed = hc.closed
+		})
+		if closed {
+			err = errH2Closed
+			return
+		}
+		err = hc.writeFrameLocked(typ, flags, stream, payload)
+	})
+	return err
+}
+
+func (hc *h2Conn) writeFrameLocked(
+	typ byte,
+	flags byte,
+	stream uint32,
+	payload []byte,
+) error {
+	frame := appendH2Frame(make([]byte, 0, 9+len(payload)), typ, flags, stream, payload)
+	hc.c.writeDeadline = deadlineAfter(hc.srv.WriteTimeout)
+	if _, err := hc.c.Write(frame); err != nil {
+		hc.withLock(func() {
+			hc.closed = true
+			hc.notify()
+		})
+		syscall.Shutdown(hc.c.fd, syscall.SHUT_RDWR)
+		return err
+	}
+	return nil
+}
+
+// writeHeaders encodes and sends a header block, split into CONTINUATION
+// frames as needed, without letting other frames in between.
+func (hc *h2Conn) writeHeaders(
+	s *h2Stream,
+	fields []hpack.HeaderField,
+	endStream bool,
+) error {
+	var err error
+	hc.withWriteLock(func() {
+		frameSize, closed := 0, false
+		hc.withLock(func() {
+			frameSize = int(hc.peerFrameSize)
+			closed = hc.closed || s.reset
+		})
+		if closed {
+			err = errH2Closed
+			return
+		}
+		hc.encoded.Bytes = hc.encoded.Bytes[:0]
+		for _, f := range fields {
+			hc.encoder.WriteField(f)
+		}
+		block := hc.encoded.Bytes
+		typ, flags := byte(h2FrameHeaders), byte(0)
+		if endStream {
+			flags = h2FlagEndStream
+		}
+		for {
+			n := min(len(block), frameSize)
+			if n == len(block) {
+				flags |= h2FlagEndHeaders
+			}
+			err = hc.writeFrameLocked(typ, flags, s.id, block[:n])
+			if err != nil || n == len(block) {
+				return
+			}
+			block = block[n:]
+			typ, flags = h2FrameContinuation, 0
+		}
+	})
+	return err
+}
+
+// writeData sends DATA frames as the stream and connection windows allow,
+// waiting for WINDOW_UPDATEs until the request context is done.
+func (hc *h2Conn) writeData(
+	s *h2Stream,
+	data []byte,
+	endStream bool,
+	ctx context.Context,
+) error {
+	for {
+		n := 0
+		var wait chan struct{}
+		var err error
+		hc.withLock(func() {
+			if hc.closed || s.reset {
+				err = errH2Closed
+				return
+			}
+			n = int(min(int64(len(data)), int64(hc.peerFrameSize),
+				s.sendWindow, hc.sendWindow))
+			if n <= 0 && len(data) > 0 {
+				wait = hc.changed
+				return
+			}
+			n = max(n, 0)
+			s.sendWindow -= int64(n)
+			hc.sendWindow -= int64(n)
+		})
+		if err != nil {
+			return err
+		}
+		if wait != nil {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return ErrTimeout
+			}
+		}
+		last := endStream && n == len(data)
+		flags := byte(0)
+		if last {
+			flags = h2FlagEndStream
+		}
+		if err := hc.writeFrame(h2FrameData, flags, s.id, data[:n]); err != nil {
+			return err
+		}
+		if data = data[n:]; len(data) == 0 && (last || !endStream) {
+			return nil
+		}
+	}
+}
+
+// notify wakes everyone waiting for the connection state to change: body
+// readers, writers blocked on flow control and close waiting for handlers.
+func (hc *h2Conn) notify() {
+	close(hc.changed)
+	hc.changed = make(chan struct{})
+}
+
+func (hc *h2Conn) withLock(fn func()) {
+	locked := <-hc.lock
+	defer func() {
+		hc.lock <- locked
+	}()
+	fn()
+}
+
+func (hc *h2Conn) withWriteLock(fn func()) {
+	locked := <-hc.writeLock
+	defer func() {
+		hc.writeLock <- locked
+	}()
+	fn()
+}
+
+// h2Body is the request body of a stream, fed by the DATA frames the
+// connection reads.
+type h2Body struct {
+	hc     *h2Conn
+	stream *h2Stream
+	ctx    context.Context
+}
+
+func (body *h2Body) Read(buf []byte) (int, error) {
+	hc, s := body.hc, body.stream
+	for {
+		n := 0
+		var err error
+		var wait chan struct{}
+		hc.withLock(func() {
+			if len(s.data) > 0 {
+				n = copy(buf, s.data)
+				s.data = s.data[n:]
+			} else if s.bodyErr != nil {
+				err = s.bodyErr
+			} else {
+				wait = hc.changed
+			}
+		})
+		if n > 0 {
+			hc.returnCredit(s, n)
+			return n, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		select {
+		case <-wait:
+		case <-body.ctx.Done():
+			if body.ctx.Err() == context.DeadlineExceeded {
+				return -1, ErrTimeout
+			}
+			return -1, errH2Closed
+		}
+	}
+}
+
+type h2Response struct {
+	hc        *h2Conn
+	stream    *h2Stream
+	ctx       context.Context
+	header    Header
+	status    int
+	buffer    *io.ByteArrayWriter
+	head      bool
+	streaming bool
+	declared  int64
+	written   int64
+	err       error
+}
+
+func newH2Response(hc *h2Conn, s *h2Stream, req *Request) *h2Response {
+	return &h2Response{
+		hc:       hc,
+		stream:   s,
+		ctx:      req.Context(),
+		header:   make(Header),
+		buffer:   io.NewByteArrayWriter(),
+		head:     req.Method == "HEAD",
+		declared: -1,
+	}
+}
+
+func (res *h2Response) Header() Header {
+	return res.header
+}
+
+func (res *h2Response) WriteHeader(status int) {
+	res.status = status
+}
+
+func (res *h2Response) Write(body []byte) (int, error) {
+	if res.err != nil {
+		return -1, res.err
+	}
+	if res.status == 0 {
+		res.status = 200
+	}
+	n, _ := res.buffer.Write(body)
+	if len(res.buffer.Bytes) >= maxBufferedBody {
+		res.Flush()
+	}
+	return n, res.err
+}
+
+func (res *h2Response) Flush() {
+	if res.err != nil {
+		return
+	}
+	if !res.streaming {
+		if res.status == 0 {
+			res.status = 200
+		}
+		res.declared = declaredContentLength(res.header)
+		res.streaming = true
+		if res.err = res.hc.writeHeaders(res.stream, res.fields(), false); res.err != nil {
+			return
+		}
+	}
+	res.flushBody(false)
+}
+
+func (res *h2Response) flushBody(endStream bool) {
+	body := res.buffer.Bytes
+	res.buffer.Bytes = res.buffer.Bytes[:0]
+	if res.head {
+		body = nil
+	}
+	if res.declared >= 0 && res.written+int64(len(body)) > res.declared {
+		res.err = ErrContentLength
+		return
+	}
+	if len(body) > 0 || endStream {
+		res.err = res.hc.writeData(res.stream, body, endStream, res.ctx)
+	}
+	res.written += int64(len(body))
+}
+
+// finish sends what the handler left in the buffer and ends the stream,
+// with a Content-Length when the whole body was buffered.
+func (res *h2Response) finish() {
+	if res.err != nil {
+		return
+	}
+	if res.status == 0 {
+		res.status = 404
+	}
+	if !res.streaming {
+		res.streaming = true
+		if !bodyAllowed(res.status) {
+			res.err = res.hc.writeHeaders(res.stream, res.fields(), true)
+			return
+		}
+		if declaredContentLength(res.header) < 0 &&
+			!(res.head && len(res.buffer.Bytes) == 0) {
+			res.header.Set("Content-Length", str.Itoa(len(res.buffer.Bytes)))
+		}
+		res.declared = declaredContentLength(res.header)
+		endStream := res.head || len(res.buffer.Bytes) == 0
+		res.err = res.hc.writeHeaders(res.stream, res.fields(), endStream)
+		if res.err != nil || endStream {
+			return
+		}
+	}
+	res.flushBody(true)
+	if res.err == nil && !res.head && res.declared >= 0 &&
+		res.written != res.declared {
+		res.err = ErrContentLength
+	}
+}
+
+func (res *h2Response) fields() []hpack.HeaderField {
+	if _, hasDate := res.header["Date"]; !hasDate {
+		res.header.Set("Date", formatHttpDate(time.Now().Unix()))
+	}
+	fields := make([]hpack.HeaderField, 0, len(res.header)+1)
+	fields = append(fields, hpack.HeaderField{Name: ":status", Value: str.Itoa(res.status)})
+	for _, name := range res.header.sortedKeys() {
+		lower := str.ToLowerAscii(name)
+		switch lower {
+		case "connection", "keep-alive", "proxy-connection",
+			"transfer-encoding", "upgrade":
+			continue
+		}
+		for _, value := range res.header[name] {
+			fields = append(fields, hpack.HeaderField{Name: lower, Value: value})
+		}
+	}
+	return fields
+}
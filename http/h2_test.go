@@ -0,0 +1,443 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/http/hpack"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+// h2Client speaks HTTP/2 frame by frame over a test connection.
+type h2Client struct {
+	*testConn
+	encoded *io.ByteArrayWriter
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+}
+
+// dialH2 sends the connection preface with the given settings.
+func dialH2(t *testing.T, addr string, settings ...uint32) *h2Client {
+	t.Helper()
+	c := &h2Client{testConn: dialTest(t, addr), encoded: io.NewByteArrayWriter(),
+		decoder: hpack.NewDecoder(h2DefaultHeaderTable)}
+	c.encoder = hpack.NewEncoder(c.encoded)
+	payload := []byte{}
+	for i := 0; i+1 < len(settings); i += 2 {
+		payload = appendH2Setting(payload, int(settings[i]), settings[i+1])
+	}
+	c.send(h2Preface)
+	c.write(h2FrameSettings, 0, 0, payload)
+	return c
+}
+
+func (c *h2Client) write(typ byte, flags byte, stream uint32, payload []byte) {
+	c.t.Helper()
+	c.send(string(appendH2Frame(nil, typ, flags, stream, payload)))
+}
+
+func (c *h2Client) next() *h2Frame {
+	c.t.Helper()
+	frame, err := readH2Frame(c.lr, h2MaxFrameSize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return frame
+}
+
+// expect reads the next frame of the given type, skipping the server's
+// SETTINGS and WINDOW_UPDATE frames.
+func (c *h2Client) expect(typ byte, stream uint32) *h2Frame {
+	c.t.Helper()
+	for {
+		frame := c.next()
+		if frame.typ == typ && frame.stream == stream {
+			return frame
+		}
+		if frame.typ != h2FrameSettings && frame.typ != h2FrameWindowUpdate {
+			c.t.Fatalf("got frame type %d on stream %d, want %d on %d: % x",
+				frame.typ, frame.stream, typ, stream, frame.payload)
+		}
+	}
+}
+
+func (c *h2Client) expectGoAway(code uint32) {
+	c.t.Helper()
+	frame := c.expect(h2FrameGoAway, 0)
+	if got := readUint32(frame.payload[4:]); got != code {
+		c.t.Errorf("GOAWAY %d %q, want %d", got, frame.payload[8:], code)
+	}
+	if !c.closed() {
+		c.t.Error("connection left open after GOAWAY")
+	}
+}
+
+func (c *h2Client) expectRst(stream uint32, code uint32) {
+	c.t.Helper()
+	frame := c.expect(h2FrameRstStream, stream)
+	if got := readUint32(frame.payload); got != code {
+		c.t.Errorf("RST_STREAM %d on stream %d, want %d", got, stream, code)
+	}
+}
+
+func (c *h2Client) headerBlock(method string, path string) []byte {
+	c.encoded.Bytes = c.encoded.Bytes[:0]
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "test"},
+	} {
+		c.encoder.WriteField(f)
+	}
+	return append([]byte(nil), c.encoded.Bytes...)
+}
+
+func (c *h2Client) request(stream uint32, path string, endStream bool) {
+	c.t.Helper()
+	flags := byte(h2FlagEndHeaders)
+	if endStream {
+		flags |= h2FlagEndStream
+	}
+	c.write(h2FrameHeaders, flags, stream, c.headerBlock("GET", path))
+}
+
+// response reads the headers of a stream and its body until END_STREAM.
+func (c *h2Client) response(stream uint32) (map[string]string, string) {
+	c.t.Helper()
+	frame := c.expect(h2FrameHeaders, stream)
+	fields, err := c.decoder.DecodeFull(frame.payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	header := map[string]string{}
+	for _, f := range fields {
+		header[f.Name] = f.Value
+	}
+	body := []byte{}
+	for frame.flags&h2FlagEndStream == 0 {
+		frame = c.expect(h2FrameData, stream)
+		body = append(body, frame.payload...)
+	}
+	return header, string(body)
+}
+
+func (c *h2Client) ping(data string) {
+	c.t.Helper()
+	c.write(h2FramePing, 0, 0, []byte(data))
+	if frame := c.expect(h2FramePing, 0); frame.flags != h2FlagAck ||
+		string(frame.payload) != data {
+		c.t.Errorf("PING reply %x % x", frame.flags, frame.payload)
+	}
+}
+
+// h2TestHandler serves a greeting at /, n bytes at /bytes/{n}, and at /wait
+// blocks until release is closed or the stream is cancelled, reporting both
+// on events.
+func h2TestHandler(release chan struct{}, events chan string) Handler {
+	mux := NewServeMux()
+	mux.HandleFunc("/", func(res ResponseWriter, req *Request) {
+		res.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/bytes/{n}", func(res ResponseWriter, req *Request) {
+		res.Write(make([]byte, str.Atoi(req.PathValue("n"))))
+	})
+	mux.HandleFunc("/wait", func(res ResponseWriter, req *Request) {
+		events <- "started"
+		select {
+		case <-release:
+			res.Write([]byte("released"))
+		case <-req.Context().Done():
+			events <- "cancelled"
+		}
+	})
+	return mux
+}
+
+func startH2Server(t *testing.T, srv *Server) (string, chan struct{}, chan string) {
+	release, events := make(chan struct{}), make(chan string, 2*h2MaxStreams)
+	srv.Handler = h2TestHandler(release, events)
+	return startServer(t, srv), release, events
+}
+
+func TestH2Preface(t *testing.T) {
+	addr, _, _ := startH2Server(t, &Server{})
+	c := dialH2(t, addr)
+	settings := c.next()
+	if settings.typ != h2FrameSettings || settings.flags != 0 {
+		t.Fatalf("first frame type %d flags %x, want SETTINGS", settings.typ, settings.flags)
+	}
+	want := map[int]uint32{
+		h2SettingMaxConcurrentStreams: h2MaxStreams,
+		h2SettingInitialWindowSize:    h2StreamWindow,
+		h2SettingMaxHeaderListSize:    DefaultMaxHeaderBytes,
+	}
+	for i := 0; i+6 <= len(settings.payload); i += 6 {
+		id := int(settings.payload[i])<<8 | int(settings.payload[i+1])
+		if value := readUint32(settings.payload[i+2:]); value != want[id] {
+			t.Errorf("setting %d = %d, want %d", id, value, want[id])
+		}
+		delete(want, id)
+	}
+	if len(want) > 0 {
+		t.Errorf("settings %v missing", want)
+	}
+	if update := c.next(); update.typ != h2FrameWindowUpdate || update.stream != 0 ||
+		readUint32(update.payload) != h2ConnWindow-h2DefaultWindow {
+		t.Errorf("got frame type %d % x, want the connection WINDOW_UPDATE",
+			update.typ, update.payload)
+	}
+	if ack := c.next(); ack.typ != h2FrameSettings || ack.flags != h2FlagAck {
+		t.Errorf("got frame type %d flags %x, want SETTINGS ack", ack.typ, ack.flags)
+	}
+	c.request(1, "/", true)
+	if header, body := c.response(1); header[":status"] != "200" || body != "hello" ||
+		header["content-length"] != "5" {
+		t.Errorf("got %v %q", header, body)
+	}
+	// The second request is sent mostly as dynamic table references.
+	c.request(3, "/", true)
+	if header, body := c.response(3); header[":status"] != "200" || body != "hello" {
+		t.Errorf("got %v %q", header, body)
+	}
+}
+
+func TestH2ConnectionErrors(t *testing.T) {
+	addr, _, _ := startH2Server(t, &Server{MaxHeaderBytes: 1024})
+	tests := []struct {
+		name  string
+		write func(c *h2Client)
+		code  uint32
+	}{
+		{"invalid preface", func(c *h2Client) {
+			c.close()
+			c.testConn = dialTest(t, addr)
+			c.send("PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n")
+		}, h2ProtocolError},
+		{"PING before SETTINGS", func(c *h2Client) {
+			c.close()
+			c.testConn = dialTest(t, addr)
+			c.send(h2Preface)
+			c.write(h2FramePing, 0, 0, make([]byte, 8))
+		}, h2ProtocolError},
+		{"invalid SETTINGS length", func(c *h2Client) {
+			c.write(h2FrameSettings, 0, 0, make([]byte, 5))
+		}, h2FrameSizeError},
+		{"invalid ENABLE_PUSH", func(c *h2Client) {
+			c.write(h2FrameSettings, 0, 0, appendH2Setting(nil, h2SettingEnablePush, 2))
+		}, h2ProtocolError},
+		{"invalid INITIAL_WINDOW_SIZE", func(c *h2Client) {
+			c.write(h2FrameSettings, 0, 0,
+				appendH2Setting(nil, h2SettingInitialWindowSize, 1<<31))
+		}, h2FlowControlError},
+		{"PING on a stream", func(c *h2Client) {
+			c.write(h2FramePing, 0, 1, make([]byte, 8))
+		}, h2ProtocolError},
+		{"short PING", func(c *h2Client) {
+			c.write(h2FramePing, 0, 0, make([]byte, 7))
+		}, h2FrameSizeError},
+		{"RST_STREAM on stream 0", func(c *h2Client) {
+			c.write(h2FrameRstStream, 0, 0, appendUint32(nil, h2Cancel))
+		}, h2ProtocolError},
+		{"RST_STREAM on an idle stream", func(c *h2Client) {
+			c.write(h2FrameRstStream, 0, 5, appendUint32(nil, h2Cancel))
+		}, h2ProtocolError},
+		{"connection window overflow", func(c *h2Client) {
+			c.write(h2FrameWindowUpdate, 0, 0, appendUint32(nil, h2MaxWindow))
+		}, h2FlowControlError},
+		{"zero WINDOW_UPDATE", func(c *h2Client) {
+			c.write(h2FrameWindowUpdate, 0, 0, appendUint32(nil, 0))
+		}, h2ProtocolError},
+		{"invalid HPACK index", func(c *h2Client) {
+			c.write(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, []byte{0x80})
+		}, h2CompressionError},
+		{"even stream", func(c *h2Client) {
+			c.request(2, "/", true)
+		}, h2ProtocolError},
+		{"stray CONTINUATION", func(c *h2Client) {
+			c.write(h2FrameContinuation, h2FlagEndHeaders, 1, nil)
+		}, h2ProtocolError},
+		{"CONTINUATION on another stream", func(c *h2Client) {
+			c.write(h2FrameHeaders, 0, 1, c.headerBlock("GET", "/"))
+			c.write(h2FrameContinuation, h2FlagEndHeaders, 3, nil)
+		}, h2ProtocolError},
+		{"oversized CONTINUATION block", func(c *h2Client) {
+			c.write(h2FrameHeaders, 0, 1, make([]byte, 200))
+			for i := 0; i < 5; i++ {
+				c.write(h2FrameContinuation, 0, 1, make([]byte, 500))
+			}
+		}, h2EnhanceYourCalm},
+		{"header list too large", func(c *h2Client) {
+			block := c.headerBlock("GET", "/")
+			c.encoded.Bytes = c.encoded.Bytes[:0]
+			for i := 0; i < 4; i++ {
+				c.encoder.WriteField(hpack.HeaderField{Name: "x-large",
+					Value: string(make([]byte, 300)), Sensitive: true})
+			}
+			block = append(block, c.encoded.Bytes...)
+			c.write(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, block)
+		}, h2EnhanceYourCalm},
+		{"frame too large", func(c *h2Client) {
+			c.write(h2FrameData, 0, 1, make([]byte, h2DefaultFrameSize+1))
+		}, h2FrameSizeError},
+		{"PUSH_PROMISE", func(c *h2Client) {
+			c.write(h2FramePushPromise, h2FlagEndHeaders, 1, make([]byte, 4))
+		}, h2ProtocolError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialH2(t, addr)
+			test.write(c)
+			c.expectGoAway(test.code)
+		})
+	}
+}
+
+func TestH2Ping(t *testing.T) {
+	addr, _, _ := startH2Server(t, &Server{})
+	c := dialH2(t, addr)
+	c.ping("pingpong")
+	c.write(h2FramePing, h2FlagAck, 0, []byte("ignored!"))
+	c.ping("01234567")
+}
+
+func TestH2FlowControl(t *testing.T) {
+	addr, _, _ := startH2Server(t, &Server{})
+	c := dialH2(t, addr, h2SettingInitialWindowSize, 10)
+	c.request(1, "/bytes/25", true)
+	c.expect(h2FrameHeaders, 1)
+	for i, size := range []int{10, 10, 5} {
+		if i > 0 {
+			// Until the window is opened, nothing but the PING reply comes.
+			c.ping("window!" + str.Itoa(i))
+			c.write(h2FrameWindowUpdate, 0, 1, appendUint32(nil, 10))
+		}
+		frame := c.expect(h2FrameData, 1)
+		last := frame.flags&h2FlagEndStream != 0
+		if len(frame.payload) != size || last != (i == 2) {
+			t.Fatalf("DATA %d: %d bytes, END_STREAM %v", i, len(frame.payload), last)
+		}
+	}
+
+	// The 65535 byte connection window runs out before the stream's.
+	c = dialH2(t, addr, h2SettingInitialWindowSize, 1<<20)
+	c.request(1, "/bytes/70000", true)
+	c.expect(h2FrameHeaders, 1)
+	received := 0
+	for received < h2DefaultWindow {
+		frame := c.expect(h2FrameData, 1)
+		if len(frame.payload) > h2DefaultFrameSize {
+			t.Fatalf("DATA of %d bytes", len(frame.payload))
+		}
+		received += len(frame.payload)
+	}
+	c.ping("conn-win")
+	c.write(h2FrameWindowUpdate, 0, 0, appendUint32(nil, 70000-h2DefaultWindow))
+	for {
+		frame := c.expect(h2FrameData, 1)
+		if received += len(frame.payload); frame.flags&h2FlagEndStream != 0 {
+			break
+		}
+	}
+	if received != 70000 {
+		t.Errorf("received %d bytes", received)
+	}
+}
+
+func TestH2StreamErrors(t *testing.T) {
+	addr, _, events := startH2Server(t, &Server{})
+	c := dialH2(t, addr)
+
+	// A client that overruns the stream window gets the stream reset.
+	c.request(1, "/wait", false)
+	if event := <-events; event != "started" {
+		t.Fatal(event)
+	}
+	chunk := make([]byte, h2DefaultFrameSize)
+	for sent := 0; sent < h2StreamWindow; sent += len(chunk) {
+		c.write(h2FrameData, 0, 1, chunk)
+	}
+	c.write(h2FrameData, 0, 1, []byte{0})
+	c.expectRst(1, h2FlowControlError)
+	if event := <-events; event != "cancelled" {
+		t.Errorf("handler %s after the reset", event)
+	}
+
+	// So does a stream WINDOW_UPDATE that overflows.
+	c.request(3, "/wait", true)
+	<-events
+	c.write(h2FrameWindowUpdate, 0, 3, appendUint32(nil, h2MaxWindow))
+	c.expectRst(3, h2FlowControlError)
+	<-events
+
+	// The server stops reading a body its handler didn't consume.
+	c.request(5, "/", false)
+	if _, body := c.response(5); body != "hello" {
+		t.Errorf("got %q", body)
+	}
+	c.expectRst(5, h2NoError)
+
+	// A client reset cancels the handler and leaves the connection usable.
+	c.request(7, "/wait", true)
+	<-events
+	c.write(h2FrameRstStream, 0, 7, appendUint32(nil, h2Cancel))
+	if event := <-events; event != "cancelled" {
+		t.Errorf("handler %s after RST_STREAM", event)
+	}
+	c.ping("still-up")
+}
+
+func TestH2MaxStreams(t *testing.T) {
+	addr, release, events := startH2Server(t, &Server{})
+	c := dialH2(t, addr)
+	for i := 0; i < h2MaxStreams; i++ {
+		c.request(uint32(2*i+1), "/wait", true)
+	}
+	for i := 0; i < h2MaxStreams; i++ {
+		<-events
+	}
+	refused := uint32(2*h2MaxStreams + 1)
+	c.request(refused, "/wait", true)
+	c.expectRst(refused, h2RefusedStream)
+	close(release)
+	// The streams finish in any order.
+	for finished := 0; finished < h2MaxStreams; {
+		frame := c.next()
+		if frame.typ == h2FrameRstStream {
+			t.Fatalf("stream %d reset", frame.stream)
+		}
+		if frame.typ == h2FrameData && frame.flags&h2FlagEndStream != 0 {
+			finished++
+		}
+	}
+}
+
+func TestH2GoAwayOnShutdown(t *testing.T) {
+	srv := &Server{}
+	addr, release, events := startH2Server(t, srv)
+	c := dialH2(t, addr)
+	c.request(1, "/wait", true)
+	<-events
+	shutdown := make(chan int, 1)
+	go func() {
+		shutdown <- srv.Shutdown(5 * time.Second)
+	}()
+	frame := c.expect(h2FrameGoAway, 0)
+	if last, code := readUint32(frame.payload), readUint32(frame.payload[4:]); last != 1 ||
+		code != h2NoError {
+		t.Errorf("GOAWAY last stream %d, code %d", last, code)
+	}
+	// Streams opened after the GOAWAY are ignored, running ones finish.
+	c.request(3, "/", true)
+	close(release)
+	if header, body := c.response(1); header[":status"] != "200" || body != "released" {
+		t.Errorf("got %v %q", header, body)
+	}
+	if !c.closed() {
+		t.Error("connection left open after the last stream")
+	}
+	if cut := <-shutdown; cut != 0 {
+		t.Errorf("Shutdown cut %d connections", cut)
+	}
+}
@@ -0,0 +1,163 @@
+package http
+
+import (
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FramePriority     = 0x2
+	h2FrameRstStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FramePing         = 0x6
+	h2FrameGoAway       = 0x7
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+)
+
+const (
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+const (
+	h2SettingHeaderTableSize      = 0x1
+	h2SettingEnablePush           = 0x2
+	h2SettingMaxConcurrentStreams = 0x3
+	h2SettingInitialWindowSize    = 0x4
+	h2SettingMaxFrameSize         = 0x5
+	h2SettingMaxHeaderListSize    = 0x6
+)
+
+const (
+	h2NoError            = 0x0
+	h2ProtocolError      = 0x1
+	h2InternalError      = 0x2
+	h2FlowControlError   = 0x3
+	h2StreamClosed       = 0x5
+	h2FrameSizeError     = 0x6
+	h2RefusedStream      = 0x7
+	h2Cancel             = 0x8
+	h2CompressionError   = 0x9
+	h2EnhanceYourCalm    = 0xb
+	h2DefaultWindow      = 65535
+	h2MaxWindow          = 1<<31 - 1
+	h2DefaultFrameSize   = 16384
+	h2MaxFrameSize       = 1<<24 - 1
+	h2DefaultHeaderTable = 4096
+)
+
+// h2ConnError ends the whole connection with a GOAWAY, h2StreamError only
+// resets the stream.
+type h2ConnError struct {
+	code   uint32
+	reason string
+}
+
+func (err h2ConnError) Error() string {
+	return "HTTP/2 connection error " + str.Itoa(int(err.code)) + ": " + err.reason
+}
+
+type h2StreamError struct {
+	stream uint32
+	code   uint32
+}
+
+func (err h2StreamError) Error() string {
+	return "HTTP/2 stream " + str.Itoa(int(err.stream)) + " error " +
+		str.Itoa(int(err.code))
+}
+
+type h2Frame struct {
+	typ     byte
+	flags   byte
+	stream  uint32
+	payload []byte
+}
+
+func readH2Frame(reader io.Reader, maxSize uint32) (*h2Frame, error) {
+	head := make([]byte, 9)
+	if err := readFull(reader, head); err != nil {
+		return nil, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	frame := &h2Frame{
+		typ:    head[3],
+		flags:  head[4],
+		stream: readUint32(head[5:]) & h2MaxWindow,
+	}
+	if length > maxSize {
+		return nil, h2ConnError{h2FrameSizeError, "Frame too large"}
+	}
+	frame.payload = make([]byte, length)
+	if err := readFull(reader, frame.payload); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func appendH2Frame(
+	dst []byte,
+	typ byte,
+	flags byte,
+	stream uint32,
+	payload []byte,
+) []byte {
+	length := len(payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), typ, flags)
+	dst = appendUint32(dst, stream)
+	return append(dst, payload...)
+}
+
+// data strips the padding of DATA and HEADERS frames, and the priority
+// fields of HEADERS.
+func (frame *h2Frame) data() ([]byte, error) {
+	payload := frame.payload
+	if frame.flags&h2FlagPadded != 0 {
+		if len(payload) == 0 || int(payload[0]) >= len(payload) {
+			return nil, h2ConnError{h2ProtocolError, "Invalid padding"}
+		}
+		payload = payload[1 : len(payload)-int(payload[0])]
+	}
+	if frame.typ == h2FrameHeaders && frame.flags&h2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, h2ConnError{h2FrameSizeError, "Invalid priority"}
+		}
+		payload = payload[5:]
+	}
+	return payload, nil
+}
+
+func (frame *h2Frame) padLength() int {
+	if frame.flags&h2FlagPadded != 0 {
+		return 1
+	}
+	return 0
+}
+
+func readFull(reader io.Reader, buf []byte) error {
+	for read := 0; read < len(buf); {
+		n, err := reader.Read(buf[read:])
+		if err != nil {
+			return err
+		}
+		read += n
+	}
+	return nil
+}
+
+func readUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func appendUint32(dst []byte, n uint32) []byte {
+	return append(dst, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
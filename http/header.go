@@ -0,0 +1,73 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+type Header map[string][]string
+
+func (header Header) Set(name string, value string) {
+	header[CanonicalHeaderKey(name)] = []string{value}
+}
+
+func (header Header) Add(name string, value string) {
+	key := CanonicalHeaderKey(name)
+	header[key] = append(header[key], value)
+}
+
+func (header Header) Get(name string) string {
+	values := header[CanonicalHeaderKey(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (header Header) Values(name string) []string {
+	return header[CanonicalHeaderKey(name)]
+}
+
+func (header Header) Del(name string) {
+	delete(header, CanonicalHeaderKey(name))
+}
+
+// CanonicalHeaderKey upper-cases the first letter and every letter after a
+// hyphen, like "Content-Type". Names that are not valid tokens are kept as is.
+func CanonicalHeaderKey(name string) string {
+	if !isToken(name) {
+		return name
+	}
+	key := []byte(name)
+	upper := true
+	for i, c := range key {
+		if upper && c >= 'a' && c <= 'z' {
+			key[i] = c - 32
+		} else if !upper && c >= 'A' && c <= 'Z' {
+			key[i] = c + 32
+		}
+		upper = c == '-'
+	}
+	return string(key)
+}
+
+func (header Header) hasToken(name string, token string) bool {
+	for _, value := range header[CanonicalHeaderKey(name)] {
+		for _, part := range str.Split(value, ',') {
+			if str.ToLowerAscii(str.Trim(part)) == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (header Header) sortedKeys() []string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		i := len(keys)
+		keys = append(keys, key)
+		for ; i > 0 && keys[i-1] > key; i-- {
+			keys[i] = keys[i-1]
+		}
+		keys[i] = key
+	}
+	return keys
+}
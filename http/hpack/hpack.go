@@ -0,0 +1,441 @@
+package hpack
+
+import "github.com/alaisi/syscalltodo/io"
+
+type hpackError string
+
+func (err hpackError) Error() string {
+	return string(err)
+}
+
+// ErrHeaderListTooLarge is returned by DecodeFull as soon as the decoded
+// fields exceed the header list size limit.
+const ErrHeaderListTooLarge = hpackError("HPACK header list too large")
+
+const (
+	errInvalidIndex      = hpackError("Invalid HPACK index")
+	errInvalidInteger    = hpackError("Invalid HPACK integer")
+	errInvalidHuffman    = hpackError("Invalid HPACK Huffman string")
+	errInvalidTableSize  = hpackError("Invalid HPACK dynamic table size update")
+	errStringTooLong     = hpackError("HPACK string too long")
+	errTruncatedBlock    = hpackError("Truncated HPACK header block")
+	defaultTableSize     = 4096
+	entryOverhead        = 32
+	maxInteger           = 1<<32 - 1
+	defaultMaxStringSize = 16 << 10
+)
+
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + entryOverhead)
+}
+
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable keeps the newest entry last; HPACK index len(staticTable)+1
+// refers to it.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (table *dynamicTable) add(f HeaderField) {
+	table.entries = append(table.entries, f)
+	table.size += f.Size()
+	table.evict()
+}
+
+func (table *dynamicTable) setMaxSize(size uint32) {
+	table.maxSize = size
+	table.evict()
+}
+
+func (table *dynamicTable) evict() {
+	evicted := 0
+	for table.size > table.maxSize && evicted < len(table.entries) {
+		table.size -= table.entries[evicted].Size()
+		evicted++
+	}
+	if evicted > 0 {
+		table.entries = append(table.entries[:0], table.entries[evicted:]...)
+	}
+}
+
+func (table *dynamicTable) get(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	index -= uint64(len(staticTable))
+	if index > uint64(len(table.entries)) {
+		return HeaderField{}, false
+	}
+	return table.entries[uint64(len(table.entries))-index], true
+}
+
+// search returns the index of an exact match, or failing that of an entry
+// with the same name.
+func (table *dynamicTable) search(f HeaderField) (uint64, bool) {
+	nameIndex := uint64(0)
+	for i, entry := range staticTable {
+		if entry.Name != f.Name {
+			continue
+		}
+		if entry.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(i + 1)
+		}
+	}
+	for i := len(table.entries) - 1; i >= 0; i-- {
+		entry := table.entries[i]
+		if entry.Name != f.Name {
+			continue
+		}
+		index := uint64(len(staticTable) + len(table.entries) - i)
+		if entry.Value == f.Value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
+
+type Encoder struct {
+	w             io.Writer
+	table         dynamicTable
+	minSizeUpdate uint32
+	pendingUpdate bool
+	buf           []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:     w,
+		table: dynamicTable{maxSize: defaultTableSize},
+		buf:   make([]byte, 0, 128),
+	}
+}
+
+// SetMaxDynamicTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// encoder never grows its table past the 4096 byte default, and signals any
+// change at the start of the next field written.
+func (e *Encoder) SetMaxDynamicTableSize(size uint32) {
+	size = min(size, defaultTableSize)
+	if size == e.table.maxSize {
+		return
+	}
+	if !e.pendingUpdate || size < e.minSizeUpdate {
+		e.minSizeUpdate = size
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(size)
+}
+
+func (e *Encoder) WriteField(f HeaderField) error {
+	buf := e.buf[:0]
+	if e.pendingUpdate {
+		if e.minSizeUpdate < e.table.maxSize {
+			buf = appendInt(buf, 5, 0x20, uint64(e.minSizeUpdate))
+		}
+		buf = appendInt(buf, 5, 0x20, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	index, exact := e.table.search(f)
+	switch {
+	case exact && !f.Sensitive:
+		buf = appendInt(buf, 7, 0x80, index)
+	case f.Sensitive:
+		buf = appendLiteral(buf, 4, 0x10, index, f)
+	case f.Size() > e.table.maxSize:
+		buf = appendLiteral(buf, 4, 0x00, index, f)
+	default:
+		buf = appendLiteral(buf, 6, 0x40, index, f)
+		e.table.add(f)
+	}
+	e.buf = buf
+	_, err := e.w.Write(buf)
+	return err
+}
+
+func appendLiteral(
+	dst []byte,
+	prefixBits uint8,
+	flags byte,
+	nameIndex uint64,
+	f HeaderField,
+) []byte {
+	dst = appendInt(dst, prefixBits, flags, nameIndex)
+	if nameIndex == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+func appendInt(dst []byte, prefixBits uint8, flags byte, value uint64) []byte {
+	limit := uint64(1)<<prefixBits - 1
+	if value < limit {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(limit))
+	value -= limit
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if encodedLength := huffmanEncodedLength(s); encodedLength < len(s) {
+		dst = appendInt(dst, 7, 0x80, uint64(encodedLength))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 7, 0, uint64(len(s)))
+	return append(dst, s...)
+}
+
+type Decoder struct {
+	table         dynamicTable
+	maxSizeLimit  uint32
+	maxStringSize int
+	maxListSize   uint32
+}
+
+func NewDecoder(maxDynamicTableSize uint32) *Decoder {
+	return &Decoder{
+		table:         dynamicTable{maxSize: maxDynamicTableSize},
+		maxSizeLimit:  maxDynamicTableSize,
+		maxStringSize: defaultMaxStringSize,
+	}
+}
+
+// SetMaxDynamicTableSize changes the limit we advertise in SETTINGS; the
+// peer's size updates must stay within it.
+func (d *Decoder) SetMaxDynamicTableSize(size uint32) {
+	d.maxSizeLimit = size
+	if d.table.maxSize > size {
+		d.table.setMaxSize(size)
+	}
+}
+
+func (d *Decoder) SetMaxStringLength(size int) {
+	d.maxStringSize = size
+}
+
+// SetMaxHeaderListSize limits the total size of the fields in a header block,
+// counted as in SETTINGS_MAX_HEADER_LIST_SIZE. Zero means no limit.
+func (d *Decoder) SetMaxHeaderListSize(size uint32) {
+	d.maxListSize = size
+}
+
+// DecodeFull decodes a complete header block. An error leaves the decoder
+// unusable, as it is a connection error in HTTP/2.
+func (d *Decoder) DecodeFull(block []byte) ([]HeaderField, error) {
+	fields := make([]HeaderField, 0, 16)
+	listSize := uint64(0)
+	sizeUpdateAllowed := true
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		switch {
+		case b&0x80 != 0:
+			var index uint64
+			if index, block, err = readInt(block, 7); err != nil {
+				return nil, err
+			}
+			f, ok := d.table.get(index)
+			if !ok {
+				return nil, errInvalidIndex
+			}
+			fields = append(fields, HeaderField{Name: f.Name, Value: f.Value})
+		case b&0xc0 == 0x40:
+			var f HeaderField
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+			fields = append(fields, f)
+		case b&0xe0 == 0x20:
+			if !sizeUpdateAllowed {
+				return nil, errInvalidTableSize
+			}
+			var size uint64
+			if size, block, err = readInt(block, 5); err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxSizeLimit) {
+				return nil, errInvalidTableSize
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			var f HeaderField
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0xf0 == 0x10
+			fields = append(fields, f)
+		}
+		listSize += uint64(fields[len(fields)-1].Size())
+		if d.maxListSize > 0 && listSize > uint64(d.maxListSize) {
+			return nil, ErrHeaderListTooLarge
+		}
+		sizeUpdateAllowed = false
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(
+	block []byte,
+	prefixBits uint8,
+) (HeaderField, []byte, error) {
+	f := HeaderField{}
+	nameIndex, block, err := readInt(block, prefixBits)
+	if err != nil {
+		return f, nil, err
+	}
+	if nameIndex == 0 {
+		if f.Name, block, err = d.readString(block); err != nil {
+			return f, nil, err
+		}
+	} else {
+		indexed, ok := d.table.get(nameIndex)
+		if !ok {
+			return f, nil, errInvalidIndex
+		}
+		f.Name = indexed.Name
+	}
+	if f.Value, block, err = d.readString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errTruncatedBlock
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) {
+		return "", nil, errTruncatedBlock
+	}
+	if length > uint64(d.maxStringSize) {
+		return "", nil, errStringTooLong
+	}
+	data := block[:length]
+	if !huffman {
+		return string(data), block[length:], nil
+	}
+	decoded, err := huffmanDecode(data, d.maxStringSize)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), block[length:], nil
+}
+
+func readInt(block []byte, prefixBits uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errTruncatedBlock
+	}
+	limit := uint64(1)<<prefixBits - 1
+	value := uint64(block[0]) & limit
+	block = block[1:]
+	if value < limit {
+		return value, block, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		if shift > 28 {
+			return 0, nil, errInvalidInteger
+		}
+		if len(block) == 0 {
+			return 0, nil, errTruncatedBlock
+		}
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if value > maxInteger {
+			return 0, nil, errInvalidInteger
+		}
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+}
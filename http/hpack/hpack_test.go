@@ -0,0 +1,242 @@
+package hpack
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+func fromHex(s string) []byte {
+	digit := func(c byte) byte {
+		if c >= 'a' {
+			return c - 'a' + 10
+		}
+		return c - '0'
+	}
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' {
+			continue
+		}
+		b = append(b, digit(s[i])<<4|digit(s[i+1]))
+		i++
+	}
+	return b
+}
+
+func toHex(b []byte) string {
+	const digits = "0123456789abcdef"
+	s := make([]byte, 0, 2*len(b))
+	for _, c := range b {
+		s = append(s, digits[c>>4], digits[c&0xf])
+	}
+	return string(s)
+}
+
+type block struct {
+	fields  []HeaderField
+	encoded string
+	size    uint32
+}
+
+// RFC 7541 appendix C.4: requests with Huffman coding.
+var requestBlocks = []block{
+	{[]HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, "828684418cf1e3c2e5f23a6ba0ab90f4ff", 57},
+	{[]HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "cache-control", Value: "no-cache"},
+	}, "828684be5886a8eb10649cbf", 110},
+	{[]HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}, "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf", 164},
+}
+
+// RFC 7541 appendix C.6: responses with Huffman coding in a 256 byte table,
+// which evicts entries.
+var responseBlocks = []block{
+	{[]HeaderField{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}, "488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff" +
+		"6e919d29ad171863c78f0b97c8e9ae82ae43d3", 222},
+	{[]HeaderField{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}, "4883640effc1c0bf", 222},
+	{[]HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie",
+			Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}, "88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7" +
+		"821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c0" +
+		"03ed4ee5b1063d5007", 215},
+}
+
+func checkFields(t *testing.T, i int, got []HeaderField, want []HeaderField) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("block %d: got %v, want %v", i, got, want)
+	}
+	for j := range got {
+		if got[j] != want[j] {
+			t.Errorf("block %d field %d: got %v, want %v", i, j, got[j], want[j])
+		}
+	}
+}
+
+func TestDecodeRFC7541(t *testing.T) {
+	for _, test := range []struct {
+		tableSize uint32
+		blocks    []block
+	}{{4096, requestBlocks}, {256, responseBlocks}} {
+		decoder := NewDecoder(test.tableSize)
+		for i, b := range test.blocks {
+			fields, err := decoder.DecodeFull(fromHex(b.encoded))
+			if err != nil {
+				t.Fatalf("block %d: %v", i, err)
+			}
+			checkFields(t, i, fields, b.fields)
+			if decoder.table.size != b.size {
+				t.Errorf("block %d: table size %d, want %d", i, decoder.table.size, b.size)
+			}
+		}
+	}
+}
+
+func TestEncodeRFC7541(t *testing.T) {
+	out := io.NewByteArrayWriter()
+	encoder := NewEncoder(out)
+	for i, b := range requestBlocks {
+		out.Bytes = out.Bytes[:0]
+		for _, f := range b.fields {
+			encoder.WriteField(f)
+		}
+		if got := toHex(out.Bytes); got != b.encoded {
+			t.Errorf("request %d: got %s, want %s", i, got, b.encoded)
+		}
+	}
+
+	// The smaller table is announced with a size update before the first
+	// field. Strings are only Huffman coded when that makes them shorter, so
+	// the second block spells out "307" where the RFC codes it in 3 bytes.
+	out = io.NewByteArrayWriter()
+	encoder = NewEncoder(out)
+	encoder.SetMaxDynamicTableSize(256)
+	for i, b := range responseBlocks {
+		out.Bytes = out.Bytes[:0]
+		for _, f := range b.fields {
+			encoder.WriteField(f)
+		}
+		want := b.encoded
+		switch i {
+		case 0:
+			want = "3fe101" + want
+		case 1:
+			want = "4803333037c1c0bf"
+		}
+		if got := toHex(out.Bytes); got != want {
+			t.Errorf("response %d: got %s, want %s", i, got, want)
+		}
+		if encoder.table.size != b.size {
+			t.Errorf("response %d: table size %d, want %d", i, encoder.table.size, b.size)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	out := io.NewByteArrayWriter()
+	encoder := NewEncoder(out)
+	decoder := NewDecoder(4096)
+	value := string(make([]byte, 300))
+	for i := 0; i < 40; i++ {
+		fields := []HeaderField{
+			{Name: ":path", Value: "/items/" + string(rune('a'+i%26))},
+			{Name: "x-large", Value: value[:100+i*5]},
+			{Name: "authorization", Value: "secret", Sensitive: true},
+			{Name: "x-binary", Value: "\x00\xff\x7f"},
+		}
+		out.Bytes = out.Bytes[:0]
+		for _, f := range fields {
+			encoder.WriteField(f)
+		}
+		decoded, err := decoder.DecodeFull(out.Bytes)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		checkFields(t, i, decoded, fields)
+		if encoder.table.size != decoder.table.size || encoder.table.size > 4096 {
+			t.Fatalf("block %d: table sizes %d and %d", i, encoder.table.size,
+				decoder.table.size)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		encoded string
+		err     error
+	}{
+		{"80", errInvalidIndex},
+		{"be", errInvalidIndex},
+		{"7f00", errInvalidIndex},
+		{"3fe21f", errInvalidTableSize},
+		{"823f01", errInvalidTableSize},
+		{"ff80808080808001", errInvalidInteger},
+		{"ff", errTruncatedBlock},
+		{"410a6162", errTruncatedBlock},
+		{"4181ff", errInvalidHuffman},
+		{"418100", errInvalidHuffman},
+		{"41837fffff", errInvalidHuffman},
+		{"4105" + "6162636465", errStringTooLong},
+	}
+	for _, test := range tests {
+		decoder := NewDecoder(4096)
+		decoder.SetMaxStringLength(4)
+		if _, err := decoder.DecodeFull(fromHex(test.encoded)); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.encoded, err, test.err)
+		}
+	}
+}
+
+func TestDecodeHeaderListSize(t *testing.T) {
+	out := io.NewByteArrayWriter()
+	encoder := NewEncoder(out)
+	field := HeaderField{Name: "x-large", Value: string(make([]byte, 61))}
+	for i := 0; i < 3; i++ {
+		encoder.WriteField(field)
+	}
+	decoder := NewDecoder(4096)
+	decoder.SetMaxHeaderListSize(3 * field.Size())
+	if fields, err := decoder.DecodeFull(out.Bytes); err != nil || len(fields) != 3 {
+		t.Fatalf("at the limit: %d fields, %v", len(fields), err)
+	}
+
+	// The limit is hit at the second field, before the truncated rest of the
+	// block is looked at.
+	block := append(append([]byte{}, out.Bytes...), 0xff)
+	decoder = NewDecoder(4096)
+	decoder.SetMaxHeaderListSize(2*field.Size() - 1)
+	if fields, err := decoder.DecodeFull(block); err != ErrHeaderListTooLarge || fields != nil {
+		t.Errorf("over the limit: %d fields, %v", len(fields), err)
+	}
+}
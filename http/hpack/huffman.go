@@ -0,0 +1,84 @@
+package hpack
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   byte
+	leaf     bool
+}
+
+// huffmanRoot is the decoding tree. EOS is left out so that decoding it fails
+// like any invalid code.
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for symbol, code := range huffmanCodes {
+		node := root
+		for bit := int(huffmanLengths[symbol]) - 1; bit >= 0; bit-- {
+			branch := code >> uint(bit) & 1
+			if node.children[branch] == nil {
+				node.children[branch] = &huffmanNode{}
+			}
+			node = node.children[branch]
+		}
+		node.symbol = byte(symbol)
+		node.leaf = true
+	}
+	return root
+}
+
+func huffmanEncodedLength(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanLengths[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends the code of s, padding the last byte with the most
+// significant bits of EOS, which are all ones.
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	bits := uint(0)
+	for i := 0; i < len(s); i++ {
+		length := uint(huffmanLengths[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		dst = append(dst, byte(acc<<(8-bits))|byte(0xff>>bits))
+	}
+	return dst
+}
+
+func huffmanDecode(data []byte, maxLength int) ([]byte, error) {
+	decoded := make([]byte, 0, len(data)*8/5)
+	node := huffmanRoot
+	depth, padding := 0, true
+	for _, b := range data {
+		for shift := 7; shift >= 0; shift-- {
+			bit := b >> uint(shift) & 1
+			if node = node.children[bit]; node == nil {
+				return nil, errInvalidHuffman
+			}
+			depth++
+			padding = padding && bit == 1
+			if !node.leaf {
+				continue
+			}
+			if len(decoded) >= maxLength {
+				return nil, errStringTooLong
+			}
+			decoded = append(decoded, node.symbol)
+			node, depth, padding = huffmanRoot, 0, true
+		}
+	}
+	if depth > 7 || !padding {
+		return nil, errInvalidHuffman
+	}
+	return decoded, nil
+}
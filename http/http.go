@@ -3,31 +3,137 @@ package http
 import (
 	"syscall"
 
+	"github.com/alaisi/syscalltodo/context"
+	"github.com/alaisi/syscalltodo/crypto/tls"
 	"github.com/alaisi/syscalltodo/io"
 	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
 )
 
 type Server struct {
-	Addr    string
-	Handler Handler
-	closefd int
+	Addr                 string
+	Handler              Handler
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxHeaderBytes       int
+	MaxBodyBytes         int
+	MaxConns             int
+	Prefork              int
+	TrustedProxies       []string
+	AcceptProxyProtocol  bool
+	ProxyProtocolSources []string
+	ProxyHeaderTimeout   time.Duration
+	trustedProxies       []ipPrefix
+	proxySources         []ipPrefix
+	tlsConfig            *tls.Config
+	closefd              int
+	lock                 chan any
+	poller               *io.Poller
+	conns                map[int]*conn
+	workers              map[int]int
+	serving              bool
+	shuttingDown         bool
+	closed               bool
 }
 
-const ErrServerClosed = protocolError("Server closed")
+type connState int
 
-func (srv *Server) Close() {
-	if srv.closefd > 0 {
-		close := []byte{0, 0, 0, 0, 0, 0, 0, 1}
-		io.Write(srv.closefd, close)
+const (
+	stateIdle connState = iota
+	stateActive
+	stateHijacked
+)
+
+const epollET = 1 << 31
+const connEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | epollET
+
+// acceptBackoff is how long the listener is left out of the poller when
+// accepting fails for lack of file descriptors or memory, as the level
+// triggered listener would otherwise wake the loop again right away.
+const acceptBackoff = 100 * time.Millisecond
+
+const (
+	DefaultMaxHeaderBytes = 1 << 20
+	DefaultMaxBodyBytes   = 10 << 20
+)
+
+const (
+	ErrServerClosed      = protocolError("Server closed")
+	ErrBodyTooLarge      = protocolError("Request body too large")
+	ErrContentLength     = protocolError("Wrote more than the declared Content-Length")
+	ErrHijacked          = protocolError("Connection has been hijacked")
+	ErrAbortHandler      = protocolError("Handler aborted")
+	errHeaderTooLarge    = protocolError("Request header too large")
+	errExpectationFailed = protocolError("Unsupported expectation")
+	errTooManyConns      = protocolError("Too many connections")
+)
+
+// serversLock guards the lazy setup of the Server lock, as Close and Shutdown
+// may be called while Serve is starting up.
+var serversLock = newLock()
+
+func (srv *Server) init() {
+	locked := <-serversLock
+	defer func() {
+		serversLock <- locked
+	}()
+	if srv.lock == nil {
+		srv.lock = newLock()
+		srv.conns = make(map[int]*conn)
 	}
 }
 
+func (srv *Server) Close() {
+	srv.init()
+	srv.withLock(func() {
+		if !srv.closed {
+			for pid := range srv.workers {
+				syscall.Kill(pid, syscall.SIGTERM)
+			}
+		}
+		srv.closed = true
+		if srv.closefd > 0 {
+			close := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+			io.Write(srv.closefd, close)
+		}
+	})
+}
+
+// ListenAndServe listens on Addr, or with Prefork above 1, starts that many
+// worker processes that each listen on Addr.
 func (srv *Server) ListenAndServe() error {
-	sockfd, err := io.Listen(str.Atoi(str.Split(srv.Addr, ':')[1]))
+	if srv.Prefork > 1 && !IsPreforkWorker() {
+		return srv.supervise()
+	}
+	if srv.Prefork > 1 {
+		sockfd, err := io.ListenReusePort(srv.Addr)
+		if err != nil {
+			return err
+		}
+		return srv.Serve(sockfd)
+	}
+	sockfd, err := io.Listen(srv.Addr)
 	if err != nil {
 		return err
 	}
-	defer syscall.Close(sockfd)
+	return srv.serveListener(sockfd, io.CloseListener)
+}
+
+// Serve accepts connections on a listening socket, which is closed when
+// Serve returns. Unlike with ListenAndServe, a unix socket path is left in
+// place, as the socket may have been inherited and still be in use.
+func (srv *Server) Serve(sockfd int) error {
+	return srv.serveListener(sockfd, syscall.Close)
+}
+
+func (srv *Server) serveListener(sockfd int, closeListener func(int) error) error {
+	defer closeListener(sockfd)
+	if err := srv.parseProxies(); err != nil {
+		return err
+	}
+	srv.init()
 	eventfd, _, errno := syscall.Syscall(
 		syscall.SYS_EVENTFD,
 		uintptr(0),
@@ -36,92 +142,642 @@ func (srv *Server) ListenAndServe() error {
 	if errno != 0 {
 		return syscall.Errno(errno)
 	}
-	srv.closefd = int(eventfd)
-	defer syscall.Close(srv.closefd)
-	return io.Epoll(func(event syscall.EpollEvent) error {
-		if int(event.Fd) == sockfd {
-			if connfd, _, err := syscall.Accept(sockfd); err == nil {
-				go srv.serve(connfd)
+	closefd := int(eventfd)
+	defer func() {
+		srv.withLock(func() {
+			srv.closefd = 0
+		})
+		syscall.Close(closefd)
+	}()
+	poller, err := io.NewPoller()
+	if err != nil {
+		return err
+	}
+	defer poller.Close()
+	if err := poller.Add(sockfd, syscall.EPOLLIN); err != nil {
+		return err
+	}
+	if err := poller.Add(closefd, syscall.EPOLLIN); err != nil {
+		return err
+	}
+	closed := false
+	srv.withLock(func() {
+		srv.closefd = closefd
+		srv.poller = poller
+		srv.serving = true
+		closed = srv.closed
+	})
+	defer srv.closeIdleConns()
+	if closed {
+		return ErrServerClosed
+	}
+	events := make([]syscall.EpollEvent, 256)
+	lastSweep := time.Now()
+	var acceptPaused time.Time
+	for {
+		timeout := 1000
+		if !acceptPaused.IsZero() {
+			timeout = int(acceptBackoff.Milliseconds())
+		}
+		n, err := poller.Wait(events, timeout)
+		if err != nil && err != syscall.EINTR {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			switch fd := int(events[i].Fd); fd {
+			case sockfd:
+				if srv.acceptConns(sockfd) && poller.Remove(sockfd) == nil {
+					acceptPaused = time.Now()
+				}
+			case closefd:
+				return ErrServerClosed
+			default:
+				srv.connReady(fd)
 			}
-		} else if int(event.Fd) == srv.closefd {
-			return ErrServerClosed
 		}
-		return nil
-	}, sockfd, srv.closefd)
+		if !acceptPaused.IsZero() && time.Since(acceptPaused) >= acceptBackoff {
+			if err := poller.Add(sockfd, syscall.EPOLLIN); err != nil {
+				return err
+			}
+			acceptPaused = time.Time{}
+		}
+		if time.Since(lastSweep) >= time.Second {
+			srv.expireIdleConns()
+			lastSweep = time.Now()
+		}
+	}
+}
+
+func (srv *Server) ListenAndServeTLS(certFile string, keyFile string) error {
+	if err := srv.loadCertificate(certFile, keyFile); err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
+
+func (srv *Server) ServeTLS(sockfd int, certFile string, keyFile string) error {
+	if err := srv.loadCertificate(certFile, keyFile); err != nil {
+		syscall.Close(sockfd)
+		return err
+	}
+	return srv.Serve(sockfd)
+}
+
+func (srv *Server) loadCertificate(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	return nil
+}
+
+func (srv *Server) Shutdown(timeout time.Duration) int {
+	srv.init()
+	srv.withLock(func() {
+		srv.shuttingDown = true
+		for _, c := range srv.conns {
+			if c.goAway != nil {
+				c.goAway()
+			}
+		}
+	})
+	srv.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := 0
+		srv.withLock(func() {
+			remaining = len(srv.conns) + len(srv.workers)
+		})
+		if remaining == 0 {
+			return 0
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cut := 0
+	srv.withLock(func() {
+		for connfd := range srv.conns {
+			syscall.Shutdown(connfd, syscall.SHUT_RDWR)
+			cut++
+		}
+		for pid := range srv.workers {
+			syscall.Kill(pid, syscall.SIGKILL)
+			cut++
+		}
+	})
+	return cut
+}
+
+func (srv *Server) withLock(fn func()) {
+	locked := <-srv.lock
+	defer func() {
+		srv.lock <- locked
+	}()
+	fn()
+}
+
+func (srv *Server) isShuttingDown() bool {
+	shuttingDown := false
+	srv.withLock(func() {
+		shuttingDown = srv.shuttingDown
+	})
+	return shuttingDown
+}
+
+// acceptConns accepts pending connections until the listener would block.
+// It reports whether accepting stopped because file descriptors or memory
+// ran out, in which case the connections are left in the backlog for now.
+func (srv *Server) acceptConns(sockfd int) bool {
+	for {
+		connfd, sockaddr, err := syscall.Accept4(
+			sockfd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		}
+		switch err {
+		case nil:
+		case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+			return true
+		default:
+			return false
+		}
+		if err := configureConn(connfd); err != nil {
+			syscall.Close(connfd)
+			continue
+		}
+		c := newConn(connfd)
+		c.remoteAddr = io.FormatSockaddr(sockaddr)
+		if local, err := syscall.Getsockname(connfd); err == nil {
+			c.localAddr = io.FormatSockaddr(local)
+		}
+		srv.startRequest(c)
+		var transport tls.Transport = c
+		if srv.AcceptProxyProtocol {
+			if !srv.isProxySource(sockaddr) {
+				syscall.Close(connfd)
+				continue
+			}
+			c.proxyHeader = c.lr
+			c.readDeadline = deadlineAfter(srv.proxyHeaderTimeout())
+			transport = &bufferedConn{c, c.lr}
+		}
+		if srv.tlsConfig != nil {
+			c.tls = tls.Server(transport, srv.tlsConfig)
+			c.lr = io.NewLineReader(c.tls)
+			c.state = stateActive
+			srv.withLock(func() {
+				c.overCapacity = srv.MaxConns > 0 && len(srv.conns) >= srv.MaxConns
+				srv.conns[connfd] = c
+			})
+			go srv.serve(c)
+			continue
+		}
+		watched := false
+		srv.withLock(func() {
+			c.overCapacity = srv.MaxConns > 0 && len(srv.conns) >= srv.MaxConns
+			srv.conns[connfd] = c
+			watched = srv.poller.Add(connfd, connEvents) == nil
+		})
+		if !watched {
+			srv.closeConn(c)
+		}
+	}
+}
+
+func (srv *Server) connReady(connfd int) {
+	var idle *conn
+	var cancel context.CancelFunc
+	srv.withLock(func() {
+		if c := srv.conns[connfd]; c != nil && c.state == stateIdle {
+			idle = c
+		} else if c != nil {
+			cancel = c.cancel
+		}
+	})
+	if cancel != nil {
+		cancel()
+	}
+	if idle != nil {
+		srv.readIdleConn(idle)
+	}
+}
+
+func (srv *Server) readIdleConn(c *conn) {
+	for {
+		if err := c.lr.Fill(); err == syscall.EAGAIN {
+			return
+		} else if err != nil {
+			srv.closeConn(c)
+			return
+		}
+		if !c.started {
+			srv.startRequest(c)
+		}
+		if c.headerComplete() || c.lr.Buffered() > srv.maxHeaderBytes() {
+			srv.dispatch(c)
+			return
+		}
+	}
+}
+
+func (srv *Server) expireIdleConns() {
+	now := time.Now()
+	expired := make([]*conn, 0)
+	srv.withLock(func() {
+		for _, c := range srv.conns {
+			if c.state == stateIdle && !c.readDeadline.IsZero() &&
+				!now.Before(c.readDeadline) {
+				expired = append(expired, c)
+			}
+		}
+	})
+	for _, c := range expired {
+		if c.lr.Buffered() > 0 {
+			srv.dispatch(c)
+		} else {
+			srv.closeConn(c)
+		}
+	}
+}
+
+func (srv *Server) closeIdleConns() {
+	srv.withLock(func() {
+		srv.serving = false
+		for connfd, c := range srv.conns {
+			if c.state == stateIdle {
+				delete(srv.conns, connfd)
+				syscall.Close(connfd)
+			}
+		}
+	})
+}
+
+func (srv *Server) dispatch(c *conn) {
+	srv.withLock(func() {
+		c.state = stateActive
+		srv.poller.Remove(c.fd)
+	})
+	go srv.serve(c)
+}
+
+func (srv *Server) startRequest(c *conn) {
+	c.started = true
+	c.scanned = 0
+	c.readDeadline = deadlineAfter(srv.headerTimeout())
+	c.requestDeadline = deadlineAfter(srv.ReadTimeout)
+}
+
+func (srv *Server) rearmConn(c *conn) {
+	c.writeDeadline = time.Time{}
+	if err := c.setNonblock(true); err != nil {
+		srv.closeConn(c)
+		return
+	}
+	if c.lr.Buffered() > 0 {
+		srv.startRequest(c)
+	} else {
+		c.started = false
+		c.readDeadline = deadlineAfter(srv.idleTimeout())
+	}
+	watched := false
+	srv.withLock(func() {
+		if srv.serving && !srv.shuttingDown {
+			c.state = stateIdle
+			watched = srv.poller.Add(c.fd, connEvents) == nil
+		}
+	})
+	if !watched {
+		srv.closeConn(c)
+	}
 }
 
-func (srv *Server) serve(connfd int) {
-	defer syscall.Close(connfd)
+func (srv *Server) closeConn(c *conn) {
+	srv.withLock(func() {
+		delete(srv.conns, c.fd)
+	})
+	if c.tls != nil && c.setNonblock(true) == nil {
+		c.tls.Close()
+	}
+	syscall.Close(c.fd)
+}
+
+func (srv *Server) serve(c *conn) {
+	keepAlive := false
 	defer func() {
 		if r := recover(); r != nil {
-			io.Write(2, []byte(str.ToString(r)))
+			if r != ErrAbortHandler {
+				io.Write(2, []byte(str.ToString(r)))
+			}
+			keepAlive = false
+		}
+		if c.state == stateHijacked {
+			return
+		}
+		if keepAlive {
+			srv.rearmConn(c)
+		} else {
+			srv.closeConn(c)
 		}
 	}()
-	if err := configureTimeouts(connfd); err != nil {
+	if err := c.setNonblock(false); err != nil {
 		return
 	}
-	reader := io.NewFileReader(connfd)
-	lr := io.NewLineReader(reader)
-	writer := io.NewFileWriter(connfd)
-	for {
-		req, err := readRequest(lr, reader)
-		if err != nil {
-			if err != io.EOF {
-				sendBadRequestResponse(writer)
-			}
-			break
+	if c.proxyHeader != nil && srv.readProxyHeader(c) != nil {
+		return
+	}
+	handshake := c.tls != nil && !c.tls.ConnectionState().HandshakeComplete
+	for ; ; handshake = false {
+		if handshake {
+			c.writeDeadline = c.readDeadline
+			keepAlive = c.tls.Handshake() == nil
+		} else if c.tls == nil && isH2Preface(c) {
+			srv.serveH2(c, nil, nil)
+			keepAlive = false
+		} else {
+			keepAlive = srv.serveRequest(c)
 		}
-		res := newHttpResponse(req.Proto)
-		srv.Handler.ServeHTTP(res, req)
-		if res.status == 0 {
-			res.status = 404
+		if keepAlive && c.tls != nil && c.tls.Pending() {
+			keepAlive = c.fillPending() == nil
 		}
-		keepAlive := setKeepAlive(res, req)
-		sendResponse(res, writer)
-		_, err = readBody(req)
-		if !keepAlive || err != nil {
-			break
+		if !keepAlive || !c.headerComplete() {
+			return
 		}
+		srv.startRequest(c)
 	}
 }
 
-func setKeepAlive(res *httpResponse, req *Request) bool {
-	connection := (*req.Header)["connection"]
-	if len(connection) == 1 {
-		value := str.ToLowerAscii(connection[0])
-		if req.Proto == "HTTP/1.1" && value != "close" {
-			return true
+func (srv *Server) serveRequest(c *conn) bool {
+	req, err := srv.readNextRequest(c)
+	if err != nil {
+		if status := errorStatus(err); status != 0 {
+			sendErrorResponse(c.writer(), status)
 		}
-		if req.Proto == "HTTP/1.0" && value == "keep-alive" {
-			res.Header().Set("Connection", connection[0])
+		return false
+	}
+	if c.tls != nil {
+		state := c.tls.ConnectionState()
+		req.TLS = &state
+	}
+	req.RemoteAddr = c.remoteAddr
+	req.LocalAddr = c.localAddr
+	req.clientIP = srv.clientIP(c.remoteAddr, req.Header)
+	if c.overCapacity {
+		res := newHttpResponse(req.Proto, c.writer())
+		res.head = req.Method == "HEAD"
+		res.Header().Set("Retry-After", "1")
+		res.Header().Set("Connection", "close")
+		Error(res, errTooManyConns.Error(), 429)
+		sendResponse(res)
+		return false
+	}
+	if req.Proto == "HTTP/1.1" && req.Header.Get("Expect") != "" {
+		req.bodyReader.continueWriter = c.writer()
+	}
+	if settings, isUpgrade := h2cUpgradeSettings(c, req); isUpgrade &&
+		!srv.isShuttingDown() {
+		srv.upgradeH2c(c, req, settings)
+		return false
+	}
+	cancel, unwatch := srv.watchRequest(c, req)
+	defer cancel()
+	defer unwatch()
+	res := newHttpResponse(req.Proto, c.writer())
+	res.head = req.Method == "HEAD"
+	res.requestBody = req.bodyReader
+	res.hijack = func() HijackedConn {
+		unwatch()
+		srv.withLock(func() {
+			delete(srv.conns, c.fd)
+			c.state = stateHijacked
+		})
+		c.readDeadline, c.writeDeadline = time.Time{}, time.Time{}
+		return &hijackedConn{c}
+	}
+	srv.Handler.ServeHTTP(res, req)
+	unwatch()
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+	if res.hijacked {
+		return false
+	}
+	if err := req.bodyReader.err; (err == ErrBodyTooLarge ||
+		err == ErrTimeout) && !res.streaming {
+		res = newHttpResponse(req.Proto, c.writer())
+		res.head = req.Method == "HEAD"
+		res.requestBody = req.bodyReader
+		Error(res, err.Error(), errorStatus(err))
+	}
+	if res.status == 0 {
+		res.status = 404
+	}
+	keepAlive := setKeepAlive(res, req)
+	if (srv.isShuttingDown() || req.bodyReader.err != nil ||
+		req.bodyReader.bodyWithheld()) && keepAlive {
+		res.Header().Set("Connection", "close")
+		keepAlive = false
+	}
+	if err := sendResponse(res); err != nil {
+		return false
+	}
+	if req.bodyReader.bodyWithheld() {
+		return false
+	}
+	return discardBody(req) == nil && keepAlive
+}
+
+// watchRequest gives the request a context that is cancelled at the write
+// deadline, or when the epoll loop sees the client hang up while the handler
+// is running.
+func (srv *Server) watchRequest(
+	c *conn,
+	req *Request,
+) (context.CancelFunc, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !c.writeDeadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), c.writeDeadline)
+	}
+	req.ctx = ctx
+	watched := false
+	srv.withLock(func() {
+		c.cancel = cancel
+		watched = srv.poller.Add(c.fd, syscall.EPOLLRDHUP|epollET) == nil
+	})
+	unwatch := func() {
+		srv.withLock(func() {
+			c.cancel = nil
+			if watched {
+				srv.poller.Remove(c.fd)
+				watched = false
+			}
+		})
+	}
+	return cancel, unwatch
+}
+
+func (srv *Server) readNextRequest(c *conn) (*Request, error) {
+	c.scanned = 0
+	c.writeDeadline = time.Time{}
+	req, err := readRequest(c.lr, srv.maxHeaderBytes(), srv.maxBodyBytes())
+	if err != nil {
+		return nil, err
+	}
+	c.readDeadline = c.requestDeadline
+	c.writeDeadline = deadlineAfter(srv.WriteTimeout)
+	return req, nil
+}
+
+func (srv *Server) headerTimeout() time.Duration {
+	if srv.ReadHeaderTimeout > 0 {
+		return srv.ReadHeaderTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout > 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes > 0 {
+		return srv.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (srv *Server) maxBodyBytes() int {
+	if srv.MaxBodyBytes > 0 {
+		return srv.MaxBodyBytes
+	}
+	return DefaultMaxBodyBytes
+}
+
+func errorStatus(err error) int {
+	switch err {
+	case io.EOF:
+		return 0
+	case ErrTimeout:
+		return 408
+	case ErrBodyTooLarge:
+		return 413
+	case errHeaderTooLarge:
+		return 431
+	case errExpectationFailed:
+		return 417
+	}
+	if _, isErrno := err.(syscall.Errno); isErrno {
+		return 0
+	}
+	return 400
+}
+
+func setKeepAlive(res *httpResponse, req *Request) bool {
+	if res.closeDelimited || res.header.hasToken("Connection", "close") {
+		return false
+	}
+	if req.Header.hasToken("Connection", "close") {
+		res.header.Set("Connection", "close")
+		return false
+	}
+	if req.Proto == "HTTP/1.0" {
+		if req.Header.hasToken("Connection", "keep-alive") {
+			res.header.Set("Connection", "keep-alive")
 			return true
 		}
+		return false
 	}
-	return req.Proto == "HTTP/1.1"
+	return true
 }
 
-func readRequest(lr *io.LineReader, raw io.Reader) (*Request, error) {
-	line, err := lr.ReadLine()
+func ReadRequest(lr *io.LineReader) (*Request, error) {
+	return readRequest(lr, DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+}
+
+func readRequest(
+	lr *io.LineReader,
+	maxHeaderBytes int,
+	maxBodyBytes int,
+) (*Request, error) {
+	readLine := headerLineReader(lr, maxHeaderBytes)
+	line, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	method, target, protocol, err := parseRequestStart(line)
 	if err != nil {
 		return nil, err
 	}
-	method, path, protocol, err := parseRequestStart(line)
+	url, err := parseRequestURI(target)
 	if err != nil {
 		return nil, err
 	}
+	headers, err := readHeader(readLine)
+	if err != nil {
+		return nil, err
+	}
+	if hosts := headers.Values("Host"); len(hosts) > 1 ||
+		len(hosts) == 0 && protocol == "HTTP/1.1" {
+		return nil, protocolError("Missing or duplicate Host header")
+	}
+	if expect := headers.Get("Expect"); expect != "" &&
+		str.ToLowerAscii(expect) != "100-continue" {
+		return nil, errExpectationFailed
+	}
+	contentLength, err := parseBodyFraming(headers)
+	if err != nil {
+		return nil, err
+	}
+	if contentLength > maxBodyBytes {
+		return nil, ErrBodyTooLarge
+	}
+	var trailer Header
+	if contentLength == chunkedBody {
+		trailer = make(Header)
+	}
+	req := &Request{
+		Method: method, URL: url, Header: &headers, Trailer: trailer,
+		Proto: protocol, Host: headers.Get("Host"),
+		contentLength: contentLength,
+		bodyReader:    newBodyReader(lr, contentLength, trailer, maxBodyBytes)}
+	req.Body = req.bodyReader
+	return req, nil
+}
+
+func headerLineReader(
+	lr *io.LineReader,
+	maxHeaderBytes int,
+) func() (string, error) {
+	budget := maxHeaderBytes
+	return func() (string, error) {
+		line, err := lr.ReadLineMax(budget)
+		if err == io.ErrLineTooLong {
+			return "", errHeaderTooLarge
+		}
+		if budget -= len(line) + 2; budget < 0 {
+			return "", errHeaderTooLarge
+		}
+		return line, err
+	}
+}
+
+func readHeader(readLine func() (string, error)) (Header, error) {
 	headers := make(Header)
-	var body []byte
 	for {
-		line, err = lr.ReadLine()
+		line, err := readLine()
 		if err != nil {
 			return nil, err
 		}
 		if line == "" {
-			contentLen := headers["content-length"]
-			if len(contentLen) == 1 {
-				body = lr.GetTail(str.Atoi(contentLen[0]))
-			}
-			break
+			return headers, nil
 		}
 		header, value, err := parseHeader(line)
 		if err != nil {
@@ -129,10 +785,44 @@ func readRequest(lr *io.LineReader, raw io.Reader) (*Request, error) {
 		}
 		headers[header] = append(headers[header], value)
 	}
-	req := &Request{
-		Method: method, URL: &URL{Path: path}, Header: &headers,
-		Proto: protocol, body: body, reader: raw}
-	return req, nil
+}
+
+func parseBodyFraming(headers Header) (int, error) {
+	transferEncoding := headers.Values("Transfer-Encoding")
+	contentLength := headers.Values("Content-Length")
+	if len(transferEncoding) > 0 {
+		if len(contentLength) > 0 {
+			return 0, protocolError(
+				"Both Transfer-Encoding and Content-Length present")
+		}
+		codings := str.Split(transferEncoding[len(transferEncoding)-1], ',')
+		coding := str.ToLowerAscii(str.Trim(codings[len(codings)-1]))
+		if len(transferEncoding) > 1 || len(codings) > 1 || coding != "chunked" {
+			return 0, protocolError("Unsupported Transfer-Encoding")
+		}
+		return chunkedBody, nil
+	}
+	if len(contentLength) == 0 {
+		return 0, nil
+	}
+	for _, value := range contentLength[1:] {
+		if value != contentLength[0] {
+			return 0, protocolError("Conflicting Content-Length")
+		}
+	}
+	if !isDigits(contentLength[0]) {
+		return 0, protocolError("Invalid Content-Length")
+	}
+	return str.Atoi(contentLength[0]), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0 && len(s) < 19
 }
 
 func parseRequestStart(line string) (string, string, string, error) {
@@ -152,60 +842,78 @@ func parseRequestStart(line string) (string, string, string, error) {
 
 func parseHeader(line string) (string, string, error) {
 	split := str.IndexOf(line, ':')
-	if split < 1 || split == len(line)-1 {
+	if split < 1 || !isToken(line[:split]) {
 		return "", "", protocolError("Invalid header")
 	}
-	name := str.ToLowerAscii(str.Trim(line[:split]))
-	value := str.Trim(line[split+1:])
-	return name, value, nil
+	value := line[split+1:]
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return "", "", protocolError("Invalid header")
+		}
+	}
+	return CanonicalHeaderKey(line[:split]), trimOWS(value), nil
 }
 
-func sendBadRequestResponse(writer io.Writer) {
-	res := newHttpResponse("HTTP/1.1")
-	res.WriteHeader(400)
+func trimOWS(value string) string {
+	for len(value) > 0 && (value[0] == ' ' || value[0] == '\t') {
+		value = value[1:]
+	}
+	for len(value) > 0 && (value[len(value)-1] == ' ' || value[len(value)-1] == '\t') {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+func sendErrorResponse(writer io.Writer, status int) {
+	res := newHttpResponse("HTTP/1.1", writer)
+	res.WriteHeader(status)
 	res.Header().Set("Connection", "close")
-	sendResponse(res, writer)
+	sendResponse(res)
 }
 
 type Request struct {
-	Method string
-	URL    *URL
-	Header *Header
-	Proto  string
-	Form   UrlValues
-	body   []byte
-	reader io.Reader
+	Method        string
+	URL           *URL
+	Header        *Header
+	Body          io.Reader
+	Trailer       Header
+	Proto         string
+	Host          string
+	Form          UrlValues
+	PostForm      UrlValues
+	MultipartForm *MultipartForm
+	TLS           *tls.ConnectionState
+	RemoteAddr    string
+	LocalAddr     string
+	ctx           context.Context
+	clientIP      string
+	body          []byte
+	contentLength int
+	bodyReader    *bodyReader
+	pattern       string
+	pathValues    map[string]string
 }
-type URL struct {
-	Path string
-}
-type Header map[string][]string
 
-func (header Header) Set(name string, value string) {
-	header[name] = []string{value}
-}
-func (values Header) Get(key string) string {
-	v := values[str.ToLowerAscii(key)]
-	if len(v) == 0 {
-		return ""
-	}
-	return v[0]
+type ResponseWriter interface {
+	WriteHeader(status int)
+	Header() Header
+	Write([]byte) (int, error)
 }
 
-type UrlValues map[string][]string
-
-func (values UrlValues) Get(key string) string {
-	v := values[key]
-	if len(v) == 0 {
-		return ""
-	}
-	return v[0]
+type Flusher interface {
+	Flush()
 }
 
-type ResponseWriter interface {
-	WriteHeader(status int)
-	Header() Header
+type HijackedConn interface {
+	Read([]byte) (int, error)
 	Write([]byte) (int, error)
+	Close() error
+	SetReadDeadline(time.Time)
+	SetWriteDeadline(time.Time)
+}
+
+type Hijacker interface {
+	Hijack() (HijackedConn, error)
 }
 
 type Handler interface {
@@ -224,17 +932,31 @@ func (err protocolError) Error() string {
 }
 
 type httpResponse struct {
-	protocol string
-	buffer   *io.ByteArrayWriter
-	status   int
-	header   Header
+	protocol       string
+	buffer         *io.ByteArrayWriter
+	status         int
+	header         Header
+	writer         io.Writer
+	streaming      bool
+	closeDelimited bool
+	contentLength  int64
+	written        int64
+	head           bool
+	requestBody    *bodyReader
+	hijack         func() HijackedConn
+	hijacked       bool
+	err            error
 }
 
-func newHttpResponse(protocol string) *httpResponse {
+const maxBufferedBody = 32 * 1024
+
+func newHttpResponse(protocol string, writer io.Writer) *httpResponse {
 	return &httpResponse{
-		protocol: protocol,
-		header:   make(Header),
-		buffer:   io.NewByteArrayWriter(),
+		protocol:      protocol,
+		header:        make(Header),
+		buffer:        io.NewByteArrayWriter(),
+		writer:        writer,
+		contentLength: -1,
 	}
 }
 
@@ -243,11 +965,58 @@ func (res *httpResponse) Header() Header {
 }
 
 var statusTexts = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
 	200: "OK",
-	302: "Temporary redirect",
+	201: "Created",
+	202: "Accepted",
+	203: "Non-Authoritative Information",
+	204: "No Content",
+	205: "Reset Content",
+	206: "Partial Content",
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	305: "Use Proxy",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
 	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
 	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	409: "Conflict",
+	410: "Gone",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	421: "Misdirected Request",
+	422: "Unprocessable Content",
+	426: "Upgrade Required",
+	428: "Precondition Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	451: "Unavailable For Legal Reasons",
 	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+func StatusText(code int) string {
+	return statusTexts[code]
 }
 
 func (res *httpResponse) WriteHeader(status int) {
@@ -255,33 +1024,180 @@ func (res *httpResponse) WriteHeader(status int) {
 }
 
 func (res *httpResponse) Write(body []byte) (int, error) {
+	if res.hijacked {
+		return -1, ErrHijacked
+	}
+	if res.err != nil {
+		return -1, res.err
+	}
 	if res.status == 0 {
 		res.status = 200
 	}
-	return res.buffer.Write(body)
+	n, _ := res.buffer.Write(body)
+	if len(res.buffer.Bytes) >= maxBufferedBody {
+		res.Flush()
+	}
+	return n, res.err
 }
 
-func sendResponse(res *httpResponse, writer io.Writer) error {
-	statusLine := res.protocol + " " +
-		str.Itoa(res.status) + " " +
-		statusTexts[res.status] + "\r\n"
-	if _, err := writer.Write([]byte(statusLine)); err != nil {
+func (res *httpResponse) Flush() {
+	if res.err != nil || res.hijacked {
+		return
+	}
+	if !res.streaming {
+		if res.status == 0 {
+			res.status = 200
+		}
+		framing := ""
+		if length := res.declaredLength(); length >= 0 {
+			res.contentLength = length
+		} else if res.head {
+		} else if res.protocol == "HTTP/1.0" {
+			res.closeDelimited = true
+			res.header.Set("Connection", "close")
+		} else {
+			framing = "Transfer-Encoding: chunked\r\n"
+		}
+		res.streaming = true
+		if res.err = res.writeHead(framing); res.err != nil {
+			return
+		}
+	}
+	if len(res.buffer.Bytes) == 0 || res.head {
+		res.buffer.Bytes = res.buffer.Bytes[:0]
+		return
+	}
+	if res.contentLength >= 0 {
+		res.err = res.writeFixed(res.buffer.Bytes)
+	} else if res.closeDelimited {
+		_, res.err = res.writer.Write(res.buffer.Bytes)
+	} else {
+		res.err = writeChunk(res.writer, res.buffer.Bytes)
+	}
+	res.buffer.Bytes = res.buffer.Bytes[:0]
+}
+
+func (res *httpResponse) Hijack() (HijackedConn, error) {
+	if res.hijack == nil {
+		return nil, protocolError("Connection can't be hijacked")
+	}
+	if res.hijacked {
+		return nil, ErrHijacked
+	}
+	if res.streaming || len(res.buffer.Bytes) > 0 {
+		return nil, protocolError("Response already written")
+	}
+	res.hijacked = true
+	return res.hijack(), nil
+}
+
+func (res *httpResponse) writeFixed(body []byte) error {
+	if res.written+int64(len(body)) > res.contentLength {
+		return ErrContentLength
+	}
+	if _, err := res.writer.Write(body); err != nil {
 		return err
 	}
-	for header, values := range res.header {
-		for _, value := range values {
-			headerLine := header + ": " + value + "\r\n"
-			if _, err := writer.Write([]byte(headerLine)); err != nil {
-				return err
-			}
+	res.written += int64(len(body))
+	return nil
+}
+
+func (res *httpResponse) sendFile(fd int, offset int64, count int64) error {
+	if !res.streaming && res.declaredLength() < 0 {
+		res.header.Set("Content-Length", str.Ltoa(count))
+	}
+	res.Flush()
+	if res.err != nil || res.head {
+		return res.err
+	}
+	c, isConn := res.writer.(*conn)
+	if res.contentLength < 0 || !isConn {
+		return copyFile(res, fd, offset, count)
+	}
+	if res.written+count > res.contentLength {
+		return ErrContentLength
+	}
+	if res.err = c.sendFile(fd, offset, count); res.err != nil {
+		return res.err
+	}
+	res.written += count
+	return nil
+}
+
+func (res *httpResponse) declaredLength() int64 {
+	return declaredContentLength(res.header)
+}
+
+func declaredContentLength(header Header) int64 {
+	values := header.Values("Content-Length")
+	if len(values) != 1 || values[0] == "" {
+		return -1
+	}
+	length := str.Atol(values[0])
+	if length < 0 || (length == 0 && values[0] != "0") {
+		return -1
+	}
+	return length
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+func (res *httpResponse) writeHead(framing string) error {
+	if res.requestBody != nil {
+		res.requestBody.skipContinue()
+	}
+	if _, hasDate := res.header["Date"]; !hasDate {
+		res.header.Set("Date", formatHttpDate(time.Now().Unix()))
+	}
+	head := make([]byte, 0, 256)
+	head = append(head, res.protocol+" "+
+		str.Itoa(res.status)+" "+
+		StatusText(res.status)+"\r\n"...)
+	for _, header := range res.header.sortedKeys() {
+		for _, value := range res.header[header] {
+			head = append(head, header+": "+value+"\r\n"...)
+		}
+	}
+	head = append(head, framing+"\r\n"...)
+	_, err := res.writer.Write(head)
+	return err
+}
+
+func sendResponse(res *httpResponse) error {
+	if !res.streaming && !bodyAllowed(res.status) {
+		return res.writeHead("")
+	}
+	if !res.streaming && res.declaredLength() >= 0 {
+		res.Flush()
+	}
+	if res.streaming {
+		res.Flush()
+		if res.err != nil || res.head {
+			return res.err
+		}
+		if res.contentLength >= 0 &&
+			res.written != res.contentLength {
+			res.err = ErrContentLength
 		}
+		if res.err == nil && res.contentLength < 0 && !res.closeDelimited {
+			res.err = writeChunk(res.writer, nil)
+		}
+		return res.err
+	}
+	contentLength := "Content-Length: " + str.Itoa(len(res.buffer.Bytes)) +
+		"\r\n"
+	if res.head && len(res.buffer.Bytes) == 0 {
+		contentLength = ""
 	}
-	endHeaders := "Content-Length: " + str.Itoa(len(res.buffer.Bytes)) +
-		"\r\n\r\n"
-	if _, err := writer.Write([]byte(endHeaders)); err != nil {
+	if err := res.writeHead(contentLength); err != nil {
 		return err
 	}
-	if _, err := writer.Write(res.buffer.Bytes); err != nil {
+	if res.head {
+		return nil
+	}
+	if _, err := res.writer.Write(res.buffer.Bytes); err != nil {
 		return err
 	}
 	return nil
@@ -293,78 +1209,113 @@ func Error(res ResponseWriter, body string, code int) {
 	res.Write([]byte(body))
 }
 
-func configureTimeouts(connfd int) error {
-	timeout := syscall.Timeval{Sec: 10}
-	if err := syscall.SetsockoptTimeval(
-		connfd, syscall.SOL_SOCKET,
-		syscall.SO_SNDTIMEO, &timeout); err != nil {
-		return err
-	}
-	if err := syscall.SetsockoptInt(
-		connfd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil {
-		return err
+func configureConn(connfd int) error {
+	err := syscall.SetsockoptInt(
+		connfd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1)
+	if err == syscall.EOPNOTSUPP {
+		return nil
 	}
-	return nil
+	return err
 }
 
 func readBody(req *Request) ([]byte, error) {
-	size := str.Atoi(req.Header.Get("content-length"))
-	if size < 1 || size > 8192 {
-		return []byte{}, nil
-	}
-	if len(req.body) == size {
+	if req.body != nil || req.Body == nil {
 		return req.body, nil
 	}
-	buf := make([]byte, size)
-	copy(buf, req.body)
-	for read := len(req.body); read < size; {
-		n, err := req.reader.Read(buf[read:])
-		if err != nil {
-			return nil, err
-		}
-		read += n
+	body, err := readAll(req.Body)
+	if err != nil {
+		return nil, err
 	}
-	req.body = buf
+	req.body = body
 	return req.body, nil
 }
 
-func (req *Request) ParseForm() error {
-	if req.Header.Get("content-type") != "application/x-www-form-urlencoded" {
-		return protocolError("Unsupported Content-Type")
-	}
-	body, err := readBody(req)
-	if err != nil {
-		return err
+func (req *Request) Context() context.Context {
+	if req.ctx != nil {
+		return req.ctx
 	}
-	req.Form = make(UrlValues, 8)
-	for _, field := range str.Split(string(body), '&') {
-		eq := str.IndexOf(field, '=')
-		if eq > 0 {
-			k := urlDecode(field[0:eq])
-			v := ""
-			if eq < len(field)-1 {
-				v = urlDecode(field[eq+1:])
+	return context.Background()
+}
+
+func (req *Request) WithContext(ctx context.Context) *Request {
+	copied := *req
+	copied.ctx = ctx
+	return &copied
+}
+
+func (req *Request) ParseForm() error {
+	var err error
+	if req.PostForm == nil {
+		req.PostForm = make(UrlValues)
+		mediaType, _ := parseMediaType(req.Header.Get("content-type"))
+		if isFormMethod(req.Method) &&
+			mediaType == "application/x-www-form-urlencoded" {
+			var body []byte
+			if body, err = readBody(req); err != nil {
+				return err
 			}
-			req.Form[k] = append(req.Form[k], v)
+			req.PostForm, err = parseQuery(string(body))
 		}
 	}
-	return nil
+	if req.Form == nil {
+		query, queryErr := parseQuery(req.URL.RawQuery)
+		if err == nil {
+			err = queryErr
+		}
+		req.Form = make(UrlValues, len(req.PostForm)+len(query))
+		for k, v := range req.PostForm {
+			req.Form[k] = append(req.Form[k], v...)
+		}
+		for k, v := range query {
+			req.Form[k] = append(req.Form[k], v...)
+		}
+	}
+	return err
 }
 
-func urlDecode(s string) string {
-	encoded := []byte(s)
-	decoded := make([]byte, 0, len(encoded))
-	for i := 0; i < len(encoded); i++ {
-		b := encoded[i]
-		if b == '+' {
-			decoded = append(decoded, ' ')
-		} else if b == '%' && i < len(encoded)-2 {
-			c := str.DecodeHex(encoded[i+1 : i+3])
-			decoded = append(decoded, c...)
-			i += 2
-		} else {
-			decoded = append(decoded, b)
+func isFormMethod(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+func parseMediaType(value string) (string, map[string]string) {
+	params := make(map[string]string)
+	semicolon := str.IndexOf(value, ';')
+	if semicolon < 0 {
+		return str.ToLowerAscii(str.Trim(value)), params
+	}
+	mediaType := str.ToLowerAscii(str.Trim(value[:semicolon]))
+	rest := value[semicolon+1:]
+	for {
+		for len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t' || rest[0] == ';') {
+			rest = rest[1:]
+		}
+		eq := str.IndexOf(rest, '=')
+		if eq < 1 {
+			return mediaType, params
+		}
+		key := str.ToLowerAscii(str.Trim(rest[:eq]))
+		rest = str.Trim(rest[eq+1:])
+		if len(rest) > 0 && rest[0] == '"' {
+			unquoted := make([]byte, 0, len(rest))
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				unquoted = append(unquoted, rest[i])
+			}
+			params[key] = string(unquoted)
+			if i < len(rest) {
+				i++
+			}
+			rest = rest[i:]
+			continue
+		}
+		end := str.IndexOf(rest, ';')
+		if end < 0 {
+			end = len(rest)
 		}
+		params[key] = str.Trim(rest[:end])
+		rest = rest[end:]
 	}
-	return string(decoded)
 }
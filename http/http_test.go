@@ -0,0 +1,418 @@
+package http
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+// startServer serves srv on an ephemeral loopback port until the test ends.
+func startServer(t testing.TB, srv *Server) string {
+	t.Helper()
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockaddr, err := syscall.Getsockname(sockfd)
+	if err != nil {
+		syscall.Close(sockfd)
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(sockfd)
+	}()
+	t.Cleanup(func() {
+		srv.Shutdown(time.Second)
+		<-done
+	})
+	return io.FormatSockaddr(sockaddr)
+}
+
+// testConn is a client connection that writes raw requests and reads the
+// responses with the client's parser.
+type testConn struct {
+	t  testing.TB
+	fd int
+	lr *io.LineReader
+}
+
+func dialTest(t testing.TB, addr string) *testConn {
+	t.Helper()
+	fd, err := io.Dial(addr, syscall.Timeval{Sec: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := syscall.Timeval{Sec: 5}
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	c := &testConn{t: t, fd: fd}
+	c.lr = io.NewLineReader(c)
+	t.Cleanup(c.close)
+	return c
+}
+
+func (c *testConn) close() {
+	if c.fd >= 0 {
+		syscall.Close(c.fd)
+		c.fd = -1
+	}
+}
+
+func (c *testConn) Read(buf []byte) (int, error) {
+	return io.Read(c.fd, buf)
+}
+
+func (c *testConn) send(raw string) {
+	c.t.Helper()
+	if _, err := io.Write(c.fd, []byte(raw)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// response reads a response to a request with the given method, and its body.
+func (c *testConn) response(method string) (*Response, string) {
+	c.t.Helper()
+	res, reader, err := readResponse(c.lr, &Request{Method: method})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := readAll(reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// closed reports whether the server closed the connection.
+func (c *testConn) closed() bool {
+	_, err := c.lr.Peek(1)
+	return err == io.EOF || err == syscall.ECONNRESET
+}
+
+var helloHandler = HandlerFunc(func(res ResponseWriter, req *Request) {
+	res.Write([]byte("hello"))
+})
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func TestAcceptBacksOffWhenOutOfFiles(t *testing.T) {
+	addr := startServer(t, &Server{Handler: helloHandler})
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = 256
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip("can't lower RLIMIT_NOFILE: " + err.Error())
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	filler := make([]int, 0, 256)
+	defer func() {
+		for _, fd := range filler {
+			syscall.Close(fd)
+		}
+	}()
+	for {
+		fd, err := syscall.Dup(0)
+		if err == syscall.EMFILE {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		filler = append(filler, fd)
+	}
+	syscall.Close(filler[len(filler)-1])
+	filler = filler[:len(filler)-1]
+	c := dialTest(t, addr)
+
+	start := cpuTime()
+	time.Sleep(500 * time.Millisecond)
+	if used := cpuTime() - start; used > 200*time.Millisecond {
+		t.Errorf("accept loop used %dms of CPU in 500ms", used.Milliseconds())
+	}
+
+	for _, fd := range filler {
+		syscall.Close(fd)
+	}
+	filler = filler[:0]
+	c.send("GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if res, body := c.response("GET"); res.StatusCode != 200 || body != "hello" {
+		t.Errorf("got %d %q after the backoff", res.StatusCode, body)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		raw    string
+		status int
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", 0},
+		{"GET / HTTP/1.0\r\n\r\n", 0},
+		{"GET / HTTP/1.1\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", 400},
+		{"GET / HTTP/1.0\r\nHost: a\r\nHost: a\r\n\r\n", 400},
+		{"GET / HTTP/2.0\r\nHost: a\r\n\r\n", 400},
+		{"GET * HTTP/1.1\r\nHost: a\r\n\r\n", 400},
+		{"GET  / HTTP/1.1\r\nHost: a\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: a\r\nExpect: 100-Continue\r\n\r\n", 0},
+		{"POST / HTTP/1.1\r\nHost: a\r\nExpect: fancy\r\n\r\n", 417},
+		{"GET / HTTP/1.1\r\nHost : a\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\n: empty\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nNo-Colon\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX(y): z\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: a\x01b\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: a\x7fb\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: a\tb\r\n\r\n", 0},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\n" +
+			"Content-Length: 2\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\n" +
+			"Content-Length: 1\r\n\r\nx", 0},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999\r\n\r\n", 413},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: " + string(make([]byte, 100)) +
+			"\r\n\r\n", 400},
+	}
+	for _, test := range tests {
+		lr := io.NewLineReader(io.NewByteArrayReader([]byte(test.raw)))
+		_, err := readRequest(lr, DefaultMaxHeaderBytes, 1024*1024)
+		if status := errorStatus(err); err != nil && status != test.status ||
+			err == nil && test.status != 0 {
+			t.Errorf("%q: got %v, want status %d", test.raw, err, test.status)
+		}
+	}
+}
+
+func TestReadRequestHeaders(t *testing.T) {
+	raw := "GET /a?b=c HTTP/1.1\r\nhost: example.com\r\n" +
+		"x-forwarded-FOR: \t 10.0.0.1 \r\naccept: a\r\nACCEPT: b\r\n\r\n"
+	req, err := readRequest(io.NewLineReader(io.NewByteArrayReader([]byte(raw))),
+		DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Host != "example.com" || req.URL.Path != "/a" ||
+		req.URL.RawQuery != "b=c" {
+		t.Errorf("got host %q, url %s?%s", req.Host, req.URL.Path, req.URL.RawQuery)
+	}
+	header := *req.Header
+	if values := header["X-Forwarded-For"]; len(values) != 1 || values[0] != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For %q", values)
+	}
+	if values := header["Accept"]; len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("Accept %q", values)
+	}
+}
+
+func conformanceHandler() Handler {
+	mux := NewServeMux()
+	mux.HandleFunc("/", func(res ResponseWriter, req *Request) {
+		res.Header().Set("x-b", "2")
+		res.Header().Set("X-a", "1")
+		res.Header().Set("content-type", "text/plain")
+		res.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/echo", func(res ResponseWriter, req *Request) {
+		body, err := readBody(req)
+		if err != nil {
+			res.WriteHeader(400)
+			return
+		}
+		res.Write(body)
+	})
+	mux.HandleFunc("/ignore", func(res ResponseWriter, req *Request) {
+		res.Write([]byte("ignored"))
+	})
+	mux.HandleFunc("/flush", func(res ResponseWriter, req *Request) {
+		res.Write([]byte("flushed:"))
+		res.(Flusher).Flush()
+		body, _ := readBody(req)
+		res.Write(body)
+	})
+	return mux
+}
+
+func TestServerConformance(t *testing.T) {
+	addr := startServer(t, &Server{Handler: conformanceHandler()})
+	tests := []struct {
+		name       string
+		raw        string
+		method     string
+		status     int
+		header     string
+		value      string
+		body       string
+		keepsAlive bool
+	}{
+		{"GET", "GET / HTTP/1.1\r\nHost: t\r\n\r\n", "GET",
+			200, "Content-Length", "5", "hello", true},
+		{"HEAD", "HEAD / HTTP/1.1\r\nHost: t\r\n\r\n", "HEAD",
+			200, "Content-Length", "5", "", true},
+		{"missing Host", "GET / HTTP/1.1\r\n\r\n", "GET",
+			400, "Connection", "close", "", false},
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", "GET",
+			400, "Connection", "close", "", false},
+		{"unsupported Expect", "GET / HTTP/1.1\r\nHost: t\r\nExpect: x\r\n\r\n",
+			"GET", 417, "Connection", "close", "", false},
+		{"invalid header", "GET / HTTP/1.1\r\nHost: t\r\nX\r\n\r\n", "GET",
+			400, "Connection", "close", "", false},
+		{"Connection: close", "GET / HTTP/1.1\r\nHost: t\r\nConnection: close\r\n\r\n",
+			"GET", 200, "Connection", "close", "hello", false},
+		{"HTTP/1.0", "GET / HTTP/1.0\r\n\r\n", "GET",
+			200, "Connection", "", "hello", false},
+		{"HTTP/1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+			"GET", 200, "Connection", "keep-alive", "hello", true},
+		{"unknown length on HTTP/1.0", "POST /flush HTTP/1.0\r\n" +
+			"Connection: keep-alive\r\nContent-Length: 1\r\n\r\nx", "POST",
+			200, "Connection", "close", "flushed:x", false},
+		{"chunked body", "POST /echo HTTP/1.1\r\nHost: t\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n1;ext=1\r\nd\r\n0\r\n\r\n",
+			"POST", 200, "Content-Length", "4", "abcd", true},
+		{"unread body", "POST /ignore HTTP/1.1\r\nHost: t\r\n" +
+			"Content-Length: 3\r\n\r\nabc", "POST",
+			200, "Content-Length", "7", "ignored", true},
+	}
+	for _, test := range tests {
+		c := dialTest(t, addr)
+		c.send(test.raw)
+		res, body := c.response(test.method)
+		if res.StatusCode != test.status || body != test.body ||
+			res.Header.Get(test.header) != test.value {
+			t.Errorf("%s: got %d %s %q, body %q", test.name, res.StatusCode,
+				test.header, res.Header.Get(test.header), body)
+		}
+		if date := res.Header.Get("Date"); len(date) != 29 ||
+			date[len(date)-4:] != " GMT" {
+			t.Errorf("%s: Date %q", test.name, date)
+		}
+		if !test.keepsAlive {
+			if !c.closed() {
+				t.Errorf("%s: connection left open", test.name)
+			}
+			c.close()
+			continue
+		}
+		c.send("GET / HTTP/1.1\r\nHost: t\r\n\r\n")
+		if res, body := c.response("GET"); res.StatusCode != 200 || body != "hello" {
+			t.Errorf("%s: next request got %d %q", test.name, res.StatusCode, body)
+		}
+		c.close()
+	}
+}
+
+// readHead reads a response's status line and header lines as sent.
+func readHead(t *testing.T, c *testConn) []string {
+	t.Helper()
+	lines := []string{}
+	for {
+		line, err := c.lr.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestResponseHeadOrder(t *testing.T) {
+	c := dialTest(t, startServer(t, &Server{Handler: conformanceHandler()}))
+	c.send("GET / HTTP/1.1\r\nHost: t\r\n\r\n")
+	head := readHead(t, c)
+	want := []string{"HTTP/1.1 200 OK", "Content-Type: text/plain", "Date: ",
+		"X-A: 1", "X-B: 2", "Content-Length: 5"}
+	if len(head) != len(want) {
+		t.Fatalf("got %q", head)
+	}
+	for i, line := range want {
+		if len(head[i]) < len(line) || head[i][:len(line)] != line {
+			t.Errorf("line %d: got %q, want %q", i, head[i], line)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startServer(t, &Server{Handler: conformanceHandler()})
+
+	c := dialTest(t, addr)
+	c.send("POST /echo HTTP/1.1\r\nHost: t\r\nExpect: 100-continue\r\n" +
+		"Content-Length: 4\r\n\r\n")
+	if head := readHead(t, c); len(head) != 1 || head[0] != "HTTP/1.1 100 Continue" {
+		t.Fatalf("got %q, want 100 Continue", head)
+	}
+	c.send("body")
+	if res, body := c.response("POST"); res.StatusCode != 200 || body != "body" {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+
+	c = dialTest(t, addr)
+	c.send("POST /ignore HTTP/1.1\r\nHost: t\r\nExpect: 100-continue\r\n" +
+		"Content-Length: 4\r\n\r\n")
+	res, body := c.response("POST")
+	if res.StatusCode != 200 || body != "ignored" ||
+		res.Header.Get("Connection") != "close" || !c.closed() {
+		t.Errorf("unread body: got %d %q, Connection %q", res.StatusCode, body,
+			res.Header.Get("Connection"))
+	}
+
+	// The handler starts the response before reading the body, so the
+	// interim response must not follow the final one.
+	c = dialTest(t, addr)
+	c.send("POST /flush HTTP/1.1\r\nHost: t\r\nExpect: 100-continue\r\n" +
+		"Content-Length: 4\r\n\r\n")
+	if start, err := c.lr.Peek(12); err != nil || string(start) != "HTTP/1.1 200" {
+		t.Fatalf("got %q, %v before sending the body", start, err)
+	}
+	c.send("body")
+	res, body = c.response("POST")
+	if res.StatusCode != 200 || body != "flushed:body" {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+	c.send("GET / HTTP/1.1\r\nHost: t\r\n\r\n")
+	if res, body := c.response("GET"); res.StatusCode != 200 || body != "hello" {
+		t.Errorf("next request got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestCloseBeforeServe(t *testing.T) {
+	srv := &Server{Handler: helloHandler}
+	srv.Close()
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(sockfd); err != ErrServerClosed {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+}
+
+// TestShutdownRacesServe stops servers while Serve is still setting up, which
+// used to race on the lazily created lock. Run it with -race.
+func TestShutdownRacesServe(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		sockfd, err := io.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{Handler: helloHandler}
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.Serve(sockfd)
+		}()
+		srv.Shutdown(time.Second)
+		if err := <-done; err != ErrServerClosed {
+			t.Fatalf("got %v, want ErrServerClosed", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package httptest
+
+import (
+	"github.com/alaisi/syscalltodo/crypto/tls"
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
+// NewRequest returns a request as the server would hand it to a handler.
+// The target is a path or an absolute URL, whose host becomes the Host header
+// instead of example.com. It panics on invalid arguments.
+func NewRequest(method string, target string, body io.Reader) *http.Request {
+	if method == "" {
+		method = "GET"
+	}
+	host, scheme := "example.com", "http"
+	if sep := str.IndexOfString(target, "://"); sep >= 0 {
+		scheme = str.ToLowerAscii(target[:sep])
+		rest := target[sep+3:]
+		if slash := str.IndexOf(rest, '/'); slash >= 0 {
+			host, target = rest[:slash], rest[slash:]
+		} else {
+			host, target = rest, "/"
+		}
+	}
+	raw := io.NewByteArrayWriter()
+	raw.Write([]byte(method + " " + target + " HTTP/1.1\r\nHost: " + host + "\r\n"))
+	var content []byte
+	if body != nil {
+		content = readAll(body)
+		raw.Write([]byte("Content-Length: " + str.Itoa(len(content)) + "\r\n"))
+	}
+	raw.Write([]byte("\r\n"))
+	raw.Write(content)
+	lr := io.NewLineReader(io.NewByteArrayReader(raw.Bytes))
+	req, err := http.ReadRequest(lr)
+	if err != nil {
+		panic("httptest: invalid NewRequest arguments: " + err.Error())
+	}
+	req.RemoteAddr = DefaultRemoteAddr
+	if scheme == "https" {
+		req.TLS = &tls.ConnectionState{
+			Version:           tls.VersionTLS13,
+			HandshakeComplete: true,
+			ServerName:        host,
+		}
+	}
+	return req
+}
+
+func readAll(reader io.Reader) []byte {
+	content := make([]byte, 0, 512)
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			content = append(content, buf[:n]...)
+		}
+		if err == io.EOF {
+			return content
+		}
+		if err != nil {
+			panic("httptest: reading NewRequest body: " + err.Error())
+		}
+	}
+}
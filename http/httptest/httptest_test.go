@@ -0,0 +1,67 @@
+package httptest
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/io"
+)
+
+func echoHandler(res http.ResponseWriter, req *http.Request) {
+	body := readAll(req.Body)
+	res.Header().Set("X-Method", req.Method)
+	res.Header().Set("X-Host", req.Host)
+	res.WriteHeader(201)
+	res.Write([]byte(req.URL.Path + ":" + string(body)))
+}
+
+func TestNewServer(t *testing.T) {
+	server := NewServer(http.HandlerFunc(echoHandler))
+	defer server.Close()
+	req, err := http.NewRequest("PUT", server.URL+"/path",
+		io.NewByteArrayReader([]byte("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body := readAll(res.Body)
+	if res.StatusCode != 201 || string(body) != "/path:body" ||
+		res.Header.Get("X-Method") != "PUT" ||
+		"http://"+res.Header.Get("X-Host") != server.URL {
+		t.Errorf("got %d %q, headers %v", res.StatusCode, body, res.Header)
+	}
+}
+
+func TestRecorderMatchesServer(t *testing.T) {
+	req := NewRequest("POST", "https://example.org/path",
+		io.NewByteArrayReader([]byte("body")))
+	if req.Host != "example.org" || req.TLS == nil ||
+		req.RemoteAddr != DefaultRemoteAddr {
+		t.Errorf("got host %q, TLS %v, remote %q", req.Host, req.TLS != nil,
+			req.RemoteAddr)
+	}
+	rec := NewRecorder()
+	echoHandler(rec, req)
+	res := rec.Result()
+	body := readAll(res.Body)
+	if res.StatusCode != 201 || string(body) != "/path:body" ||
+		res.Header.Get("X-Method") != "POST" {
+		t.Errorf("got %d %q, headers %v", res.StatusCode, body, res.Header)
+	}
+
+	rec = NewRecorder()
+	rec.Header().Set("X-Before", "1")
+	rec.Write([]byte("a"))
+	rec.Flush()
+	rec.Header().Set("X-After", "1")
+	rec.WriteHeader(500)
+	res = rec.Result()
+	if res.StatusCode != 200 || res.Header.Get("X-Before") != "1" ||
+		res.Header.Get("X-After") != "" {
+		t.Errorf("after Flush: got %d, headers %v", res.StatusCode, res.Header)
+	}
+}
@@ -0,0 +1,102 @@
+package httptest
+
+import (
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+// ResponseRecorder captures what a handler writes. Like the server, it keeps
+// the status and headers open until the handler flushes, so headers set
+// after WriteHeader still end up in the result.
+type ResponseRecorder struct {
+	Code        int
+	HeaderMap   http.Header
+	Body        *io.ByteArrayWriter
+	Flushed     bool
+	wroteHeader bool
+	flushedHead http.Header
+}
+
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{
+		Code:      200,
+		HeaderMap: make(http.Header),
+		Body:      io.NewByteArrayWriter(),
+	}
+}
+
+func (rec *ResponseRecorder) Header() http.Header {
+	if rec.HeaderMap == nil {
+		rec.HeaderMap = make(http.Header)
+	}
+	return rec.HeaderMap
+}
+
+func (rec *ResponseRecorder) WriteHeader(status int) {
+	if rec.Flushed {
+		return
+	}
+	rec.Code = status
+	rec.wroteHeader = true
+}
+
+func (rec *ResponseRecorder) Write(buf []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(200)
+	}
+	if rec.Body == nil {
+		rec.Body = io.NewByteArrayWriter()
+	}
+	return rec.Body.Write(buf)
+}
+
+func (rec *ResponseRecorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(200)
+	}
+	if !rec.Flushed {
+		rec.flushedHead = cloneHeader(rec.Header())
+	}
+	rec.Flushed = true
+}
+
+// Result returns the response as a client would have received it.
+func (rec *ResponseRecorder) Result() *http.Response {
+	header := rec.flushedHead
+	if !rec.Flushed {
+		header = cloneHeader(rec.Header())
+	}
+	var body []byte
+	if rec.Body != nil {
+		body = rec.Body.Bytes
+	}
+	contentLength := -1
+	if length := header.Get("Content-Length"); length != "" {
+		contentLength = str.Atoi(length)
+	}
+	return &http.Response{
+		Status:        str.Itoa(rec.Code) + " " + http.StatusText(rec.Code),
+		StatusCode:    rec.Code,
+		Proto:         "HTTP/1.1",
+		Header:        header,
+		ContentLength: contentLength,
+		Body:          &recordedBody{io.NewByteArrayReader(body)},
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	cloned := make(http.Header, len(header))
+	for name, values := range header {
+		cloned[name] = append([]string(nil), values...)
+	}
+	return cloned
+}
+
+type recordedBody struct {
+	*io.ByteArrayReader
+}
+
+func (body *recordedBody) Close() error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package httptest
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+// Server serves a handler on an ephemeral loopback port for tests that need
+// a real connection.
+type Server struct {
+	URL    string
+	Config *http.Server
+	client *http.Client
+	done   chan error
+}
+
+func NewServer(handler http.Handler) *Server {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		panic("httptest: failed to listen: " + err.Error())
+	}
+	sockaddr, err := syscall.Getsockname(sockfd)
+	if err != nil {
+		syscall.Close(sockfd)
+		panic("httptest: failed to listen: " + err.Error())
+	}
+	s := &Server{
+		URL:    "http://" + io.FormatSockaddr(sockaddr),
+		Config: &http.Server{Handler: handler},
+		client: &http.Client{},
+		done:   make(chan error, 1),
+	}
+	go func() {
+		s.done <- s.Config.Serve(sockfd)
+	}()
+	return s
+}
+
+// Client returns a client whose idle connections are closed with the server.
+func (s *Server) Client() *http.Client {
+	return s.client
+}
+
+// Close waits for running requests to finish and stops the server.
+func (s *Server) Close() {
+	s.client.CloseIdleConnections()
+	s.Config.Shutdown(5 * time.Second)
+	<-s.done
+}
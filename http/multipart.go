@@ -0,0 +1,372 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+const defaultMaxMemory = 32 << 20
+const maxMultipartValueBytes = 10 << 20
+const maxMultipartParts = 1000
+const maxPartHeaderBytes = 8192
+
+const (
+	ErrNotMultipart    = protocolError("Content-Type isn't multipart/form-data")
+	ErrMissingFile     = protocolError("No such file")
+	ErrMessageTooLarge = protocolError("Multipart message too large")
+)
+
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+type FileHeader struct {
+	Filename string
+	Header   Header
+	Size     int64
+	content  []byte
+	tmpfd    int
+	removed  bool
+}
+
+type File interface {
+	Read(p []byte) (int, error)
+	Close() error
+}
+
+func (req *Request) ParseMultipartForm(maxMemory int64) error {
+	if req.MultipartForm != nil {
+		return nil
+	}
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+	mediaType, params := parseMediaType(req.Header.Get("content-type"))
+	boundary := params["boundary"]
+	if mediaType != "multipart/form-data" || boundary == "" {
+		return ErrNotMultipart
+	}
+	reader := newMultipartReader(req.Body, boundary)
+	form, err := readMultipartForm(reader, maxMemory)
+	if err != nil {
+		return err
+	}
+	req.MultipartForm = form
+	for k, v := range form.Value {
+		req.Form[k] = append(req.Form[k], v...)
+		req.PostForm[k] = append(req.PostForm[k], v...)
+	}
+	return nil
+}
+
+func (req *Request) FormFile(key string) (File, *FileHeader, error) {
+	if req.MultipartForm == nil {
+		if err := req.ParseMultipartForm(defaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+	files := req.MultipartForm.File[key]
+	if len(files) == 0 {
+		return nil, nil, ErrMissingFile
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, files[0], nil
+}
+
+func (form *MultipartForm) RemoveAll() error {
+	var err error
+	for _, files := range form.File {
+		for _, fh := range files {
+			if fh.tmpfd >= 0 && !fh.removed {
+				if closeErr := syscall.Close(fh.tmpfd); closeErr != nil {
+					err = closeErr
+				}
+			}
+			fh.content = nil
+			fh.removed = true
+		}
+	}
+	return err
+}
+
+func (fh *FileHeader) Open() (File, error) {
+	if fh.removed {
+		return nil, protocolError("Multipart file removed")
+	}
+	if fh.tmpfd < 0 {
+		return &memoryFile{io.NewByteArrayReader(fh.content)}, nil
+	}
+	return &tempFile{fd: fh.tmpfd}, nil
+}
+
+func (fh *FileHeader) write(b []byte, memory *int64) error {
+	if fh.tmpfd < 0 && int64(len(fh.content)+len(b)) > *memory {
+		fd, err := io.CreateTemp("")
+		if err != nil {
+			return err
+		}
+		fh.tmpfd = fd
+		if _, err := io.Write(fd, fh.content); err != nil {
+			return err
+		}
+		fh.content = nil
+	}
+	fh.Size += int64(len(b))
+	if fh.tmpfd >= 0 {
+		_, err := io.Write(fh.tmpfd, b)
+		return err
+	}
+	fh.content = append(fh.content, b...)
+	return nil
+}
+
+type memoryFile struct {
+	*io.ByteArrayReader
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+type tempFile struct {
+	fd     int
+	offset int64
+}
+
+func (f *tempFile) Read(buf []byte) (int, error) {
+	n, err := io.ReadAt(f.fd, buf, f.offset)
+	if err != nil {
+		return -1, err
+	}
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *tempFile) Close() error {
+	return nil
+}
+
+func readMultipartForm(
+	mr *multipartReader,
+	maxMemory int64,
+) (*MultipartForm, error) {
+	form := &MultipartForm{
+		Value: make(map[string][]string),
+		File:  make(map[string][]*FileHeader),
+	}
+	memory := maxMemory
+	valueBudget := maxMemory + maxMultipartValueBytes
+	for parts := 0; ; parts++ {
+		header, err := mr.nextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err == nil && parts >= maxMultipartParts {
+			err = ErrMessageTooLarge
+		}
+		if err == nil {
+			err = readFormPart(form, mr, header, &memory, &valueBudget)
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+	}
+}
+
+func readFormPart(
+	form *MultipartForm,
+	mr *multipartReader,
+	header Header,
+	memory *int64,
+	valueBudget *int64,
+) error {
+	disposition, params := parseMediaType(header.Get("content-disposition"))
+	name := params["name"]
+	if disposition != "form-data" || name == "" {
+		return mr.readPart(func([]byte) error { return nil })
+	}
+	filename, isFile := params["filename"]
+	if !isFile {
+		value := make([]byte, 0, 64)
+		err := mr.readPart(func(b []byte) error {
+			if int64(len(value)+len(b)) > *valueBudget {
+				return ErrMessageTooLarge
+			}
+			value = append(value, b...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		*valueBudget -= int64(len(value))
+		*memory -= int64(len(value))
+		form.Value[name] = append(form.Value[name], string(value))
+		return nil
+	}
+	fh := &FileHeader{Filename: baseName(filename), Header: header, tmpfd: -1}
+	form.File[name] = append(form.File[name], fh)
+	if err := mr.readPart(func(b []byte) error {
+		return fh.write(b, memory)
+	}); err != nil {
+		return err
+	}
+	*memory -= int64(len(fh.content))
+	return nil
+}
+
+func baseName(filename string) string {
+	for i := len(filename) - 1; i >= 0; i-- {
+		if filename[i] == '/' || filename[i] == '\\' {
+			return filename[i+1:]
+		}
+	}
+	return filename
+}
+
+type multipartReader struct {
+	reader  io.Reader
+	buf     []byte
+	tmp     []byte
+	delim   []byte
+	started bool
+	done    bool
+}
+
+func newMultipartReader(reader io.Reader, boundary string) *multipartReader {
+	return &multipartReader{
+		reader: reader,
+		buf:    []byte("\r\n"),
+		tmp:    make([]byte, 4096),
+		delim:  []byte("\r\n--" + boundary),
+	}
+}
+
+func (mr *multipartReader) nextPart() (Header, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+	if !mr.started {
+		mr.started = true
+		if err := mr.readPart(func([]byte) error { return nil }); err != nil {
+			return nil, err
+		}
+	}
+	for len(mr.buf) < 2 {
+		if err := mr.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if mr.buf[0] == '-' && mr.buf[1] == '-' {
+		mr.done = true
+		return nil, io.EOF
+	}
+	padding, err := mr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(padding); i++ {
+		if padding[i] != ' ' && padding[i] != '\t' {
+			return nil, protocolError("Invalid multipart boundary")
+		}
+	}
+	header := make(Header)
+	for size := 0; ; {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		if size += len(line); size > maxPartHeaderBytes {
+			return nil, ErrMessageTooLarge
+		}
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		header[name] = append(header[name], value)
+	}
+}
+
+func (mr *multipartReader) readPart(sink func([]byte) error) error {
+	for {
+		if i := indexBytes(mr.buf, mr.delim); i >= 0 {
+			if err := sink(mr.buf[:i]); err != nil {
+				return err
+			}
+			mr.consume(i + len(mr.delim))
+			return nil
+		}
+		if keep := len(mr.delim) - 1; len(mr.buf) > keep {
+			safe := len(mr.buf) - keep
+			if err := sink(mr.buf[:safe]); err != nil {
+				return err
+			}
+			mr.consume(safe)
+		}
+		if err := mr.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+func (mr *multipartReader) readLine() (string, error) {
+	for {
+		for i, b := range mr.buf {
+			if b == '\n' {
+				end := i
+				if end > 0 && mr.buf[end-1] == '\r' {
+					end--
+				}
+				line := string(mr.buf[:end])
+				mr.consume(i + 1)
+				return line, nil
+			}
+		}
+		if len(mr.buf) > maxPartHeaderBytes {
+			return "", ErrMessageTooLarge
+		}
+		if err := mr.fill(); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (mr *multipartReader) fill() error {
+	n, err := mr.reader.Read(mr.tmp)
+	if err == io.EOF {
+		return protocolError("Unexpected end of multipart body")
+	}
+	if err != nil {
+		return err
+	}
+	mr.buf = append(mr.buf, mr.tmp[:n]...)
+	return nil
+}
+
+func (mr *multipartReader) consume(n int) {
+	mr.buf = mr.buf[:copy(mr.buf, mr.buf[n:])]
+}
+
+func indexBytes(haystack []byte, needle []byte) int {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		match := true
+		for j := 0; j < len(needle); j++ {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
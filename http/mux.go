@@ -0,0 +1,182 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+type ServeMux struct {
+	routes []*route
+}
+
+type route struct {
+	pattern *pattern
+	handler Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{routes: make([]*route, 0, 8)}
+}
+
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("http: nil handler for pattern " + pattern)
+	}
+	p, err := parsePattern(pattern)
+	if err != nil {
+		panic("http: invalid pattern " + pattern + ": " + err.Error())
+	}
+	for _, r := range mux.routes {
+		if p.conflictsWith(r.pattern) {
+			panic("http: pattern " + pattern +
+				" conflicts with pattern " + r.pattern.text)
+		}
+	}
+	mux.routes = append(mux.routes, &route{p, handler})
+}
+
+func (mux *ServeMux) HandleFunc(
+	pattern string,
+	handler func(ResponseWriter, *Request),
+) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+func (mux *ServeMux) Handler(req *Request) (Handler, string) {
+	host := stripPort(str.ToLowerAscii(req.Host))
+	path := splitPath(req.URL.EscapedPath())
+	for i, segment := range path {
+		if unescaped, err := unescape(segment, false); err == nil {
+			path[i] = unescaped
+		}
+	}
+	if r, values := mux.match(req.Method, host, path); r != nil {
+		req.pattern = r.pattern.text
+		req.pathValues = values
+		return r.handler, r.pattern.text
+	}
+	if allow := mux.allowedMethods(host, path); len(allow) > 0 {
+		return HandlerFunc(func(res ResponseWriter, req *Request) {
+			res.Header().Set("Allow", joinMethods(allow))
+			Error(res, "Method Not Allowed", 405)
+		}), ""
+	}
+	if r, _ := mux.match(req.Method, host, append(path, "")); r != nil {
+		location := req.URL.EscapedPath() + "/"
+		if req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+		return redirectHandler(location, 301), r.pattern.text
+	}
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		Error(res, "Not Found", 404)
+	}), ""
+}
+
+func (mux *ServeMux) ServeHTTP(res ResponseWriter, req *Request) {
+	handler, _ := mux.Handler(req)
+	handler.ServeHTTP(res, req)
+}
+
+func (mux *ServeMux) match(
+	method string,
+	host string,
+	path []string,
+) (*route, map[string]string) {
+	var best *route
+	var bestValues map[string]string
+	for _, r := range mux.routes {
+		if !r.pattern.matchesMethod(method) || !r.pattern.matchesHost(host) {
+			continue
+		}
+		values, ok := r.pattern.matchPath(path)
+		if !ok {
+			continue
+		}
+		if best == nil || r.pattern.isPreferredTo(best.pattern) {
+			best, bestValues = r, values
+		}
+	}
+	return best, bestValues
+}
+
+func (mux *ServeMux) allowedMethods(host string, path []string) []string {
+	allow := make([]string, 0, 4)
+	for _, r := range mux.routes {
+		if !r.pattern.matchesHost(host) {
+			continue
+		}
+		if _, ok := r.pattern.matchPath(path); !ok {
+			continue
+		}
+		if r.pattern.method == "" {
+			return nil
+		}
+		allow = appendMethod(allow, r.pattern.method)
+		if r.pattern.method == "GET" {
+			allow = appendMethod(allow, "HEAD")
+		}
+	}
+	return allow
+}
+
+func appendMethod(methods []string, method string) []string {
+	for i, m := range methods {
+		if m == method {
+			return methods
+		}
+		if m > method {
+			methods = append(methods, "")
+			copy(methods[i+1:], methods[i:])
+			methods[i] = method
+			return methods
+		}
+	}
+	return append(methods, method)
+}
+
+func joinMethods(methods []string) string {
+	joined := ""
+	for i, m := range methods {
+		if i > 0 {
+			joined += ", "
+		}
+		joined += m
+	}
+	return joined
+}
+
+func redirectHandler(location string, code int) Handler {
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		res.Header().Set("Location", location)
+		res.WriteHeader(code)
+	})
+}
+
+func (req *Request) PathValue(name string) string {
+	return req.pathValues[name]
+}
+
+func (req *Request) SetPathValue(name string, value string) {
+	if req.pathValues == nil {
+		req.pathValues = make(map[string]string)
+	}
+	req.pathValues[name] = value
+}
+
+func stripPort(host string) string {
+	if len(host) > 0 && host[0] == '[' {
+		if end := str.IndexOf(host, ']'); end > 0 {
+			return host[:end+1]
+		}
+		return host
+	}
+	if colon := str.IndexOf(host, ':'); colon >= 0 {
+		return host[:colon]
+	}
+	return host
+}
+
+func splitPath(path string) []string {
+	if len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+	return str.Split(path, '/')
+}
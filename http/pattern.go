@@ -0,0 +1,274 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+type pattern struct {
+	text     string
+	method   string
+	host     string
+	segments []segment
+}
+
+type segment struct {
+	s     string
+	wild  bool
+	multi bool
+}
+
+const dollarSegment = "/"
+
+type relationship int
+
+const (
+	equivalent relationship = iota
+	moreGeneral
+	moreSpecific
+	disjoint
+	overlaps
+)
+
+func parsePattern(text string) (*pattern, error) {
+	p := &pattern{text: text}
+	rest := text
+	if space := str.IndexOf(rest, ' '); space >= 0 {
+		p.method = rest[:space]
+		rest = str.Trim(rest[space+1:])
+		if !isToken(p.method) {
+			return nil, protocolError("invalid method")
+		}
+	}
+	slash := str.IndexOf(rest, '/')
+	if slash < 0 {
+		return nil, protocolError("missing path")
+	}
+	p.host = str.ToLowerAscii(rest[:slash])
+	names := make(map[string]bool)
+	parts := splitPath(rest[slash:])
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if part == "" {
+			if !last {
+				return nil, protocolError("empty path segment")
+			}
+			p.segments = append(p.segments, segment{multi: true})
+			break
+		}
+		if part[0] != '{' {
+			if str.IndexOf(part, '{') >= 0 || str.IndexOf(part, '}') >= 0 {
+				return nil, protocolError("bad wildcard segment")
+			}
+			p.segments = append(p.segments, segment{s: part})
+			continue
+		}
+		if part[len(part)-1] != '}' {
+			return nil, protocolError("bad wildcard segment")
+		}
+		name := part[1 : len(part)-1]
+		if name == "$" {
+			if !last {
+				return nil, protocolError("{$} not at end")
+			}
+			p.segments = append(p.segments, segment{s: dollarSegment})
+			continue
+		}
+		multi := len(name) > 3 && name[len(name)-3:] == "..."
+		if multi {
+			if !last {
+				return nil, protocolError("{...} wildcard not at end")
+			}
+			name = name[:len(name)-3]
+		}
+		if !isIdentifier(name) {
+			return nil, protocolError("bad wildcard name " + name)
+		}
+		if names[name] {
+			return nil, protocolError("duplicate wildcard name " + name)
+		}
+		names[name] = true
+		p.segments = append(p.segments, segment{s: name, wild: true, multi: multi})
+	}
+	return p, nil
+}
+
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || str.IndexOf("()<>@,;:\\\"/[]?={}", rune(c)) >= 0 {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func isIdentifier(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		letter := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func (p *pattern) matchesMethod(method string) bool {
+	return p.method == "" || p.method == method ||
+		p.method == "GET" && method == "HEAD"
+}
+
+func (p *pattern) matchesHost(host string) bool {
+	return p.host == "" || p.host == host
+}
+
+func (p *pattern) matchPath(path []string) (map[string]string, bool) {
+	var values map[string]string
+	for i, seg := range p.segments {
+		if i >= len(path) {
+			return nil, false
+		}
+		if seg.multi {
+			if seg.s != "" {
+				if values == nil {
+					values = make(map[string]string)
+				}
+				values[seg.s] = joinPath(path[i:])
+			}
+			return values, true
+		}
+		if seg.wild {
+			if path[i] == "" {
+				return nil, false
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[seg.s] = path[i]
+		} else if seg.s == dollarSegment {
+			if path[i] != "" || i != len(path)-1 {
+				return nil, false
+			}
+		} else if seg.s != path[i] {
+			return nil, false
+		}
+	}
+	return values, len(path) == len(p.segments)
+}
+
+func joinPath(path []string) string {
+	joined := ""
+	for i, p := range path {
+		if i > 0 {
+			joined += "/"
+		}
+		joined += p
+	}
+	return joined
+}
+
+func (p *pattern) isPreferredTo(other *pattern) bool {
+	if p.host != other.host {
+		return p.host != ""
+	}
+	return p.comparePathsAndMethods(other) == moreSpecific
+}
+
+func (p *pattern) conflictsWith(other *pattern) bool {
+	if p.host != other.host {
+		return false
+	}
+	rel := p.comparePathsAndMethods(other)
+	return rel == equivalent || rel == overlaps
+}
+
+func (p *pattern) comparePathsAndMethods(other *pattern) relationship {
+	return combineRelationships(p.compareMethods(other), p.comparePaths(other))
+}
+
+func (p *pattern) compareMethods(other *pattern) relationship {
+	switch {
+	case p.method == other.method:
+		return equivalent
+	case p.method == "":
+		return moreGeneral
+	case other.method == "":
+		return moreSpecific
+	case p.method == "GET" && other.method == "HEAD":
+		return moreGeneral
+	case p.method == "HEAD" && other.method == "GET":
+		return moreSpecific
+	default:
+		return disjoint
+	}
+}
+
+func (p *pattern) comparePaths(other *pattern) relationship {
+	segs1, segs2 := p.segments, other.segments
+	rel := equivalent
+	for ; len(segs1) > 0 && len(segs2) > 0; segs1, segs2 = segs1[1:], segs2[1:] {
+		if segs1[0].multi || segs2[0].multi {
+			break
+		}
+		rel = combineRelationships(rel, compareSegments(segs1[0], segs2[0]))
+		if rel == disjoint {
+			return rel
+		}
+	}
+	switch {
+	case len(segs1) == 0 && len(segs2) == 0:
+		return rel
+	case len(segs1) == 0 || len(segs2) == 0:
+		return disjoint
+	case segs1[0].multi && segs2[0].multi:
+		return rel
+	case segs1[0].multi:
+		return combineRelationships(rel, moreGeneral)
+	case segs2[0].multi:
+		return combineRelationships(rel, moreSpecific)
+	default:
+		return disjoint
+	}
+}
+
+func compareSegments(s1 segment, s2 segment) relationship {
+	switch {
+	case s1.wild && s2.wild:
+		return equivalent
+	case s1.wild:
+		if s2.s == dollarSegment {
+			return disjoint
+		}
+		return moreGeneral
+	case s2.wild:
+		if s1.s == dollarSegment {
+			return disjoint
+		}
+		return moreSpecific
+	case s1.s == s2.s:
+		return equivalent
+	default:
+		return disjoint
+	}
+}
+
+func combineRelationships(r1 relationship, r2 relationship) relationship {
+	switch r1 {
+	case equivalent:
+		return r2
+	case disjoint:
+		return disjoint
+	case overlaps:
+		if r2 == disjoint {
+			return disjoint
+		}
+		return overlaps
+	default:
+		switch {
+		case r2 == equivalent:
+			return r1
+		case r2 == r1 || r2 == disjoint || r2 == overlaps:
+			return r2
+		default:
+			return overlaps
+		}
+	}
+}
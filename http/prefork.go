@@ -0,0 +1,143 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/slog"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const preforkWorkerEnv = "PREFORK_WORKER"
+
+// The workers are given up on if they are restarted more than twice each
+// within restartPeriod.
+const restartPeriod = 10 * time.Second
+
+const errWorkersFailing = protocolError("Prefork workers keep failing")
+
+// IsPreforkWorker reports whether this process is a Prefork worker. Workers
+// run main from the start, so one-time setup such as schema migrations
+// should be left to the supervisor.
+func IsPreforkWorker() bool {
+	worker, _ := io.GetEnv(preforkWorkerEnv)
+	return worker != ""
+}
+
+// supervise runs Prefork workers, each a new instance of the executable that
+// binds its own SO_REUSEPORT listener. A Go process can't fork without exec,
+// as only the forking thread would live on in the child. The workers get a
+// process group of their own, so Close and Shutdown decide when they get
+// SIGTERM, and crashed workers are restarted.
+func (srv *Server) supervise() error {
+	family, _, err := io.ResolveSockaddr(srv.Addr)
+	if err != nil {
+		return err
+	}
+	if family == syscall.AF_UNIX {
+		return syscall.EINVAL
+	}
+	if err := srv.parseProxies(); err != nil {
+		return err
+	}
+	srv.init()
+	closed := false
+	srv.withLock(func() {
+		srv.workers = make(map[int]int)
+		closed = srv.closed
+	})
+	if closed {
+		return ErrServerClosed
+	}
+	for slot := 0; slot < srv.Prefork; slot++ {
+		if err := srv.startWorker(slot); err != nil {
+			return srv.stopWorkers(err)
+		}
+	}
+	restarts := make([]time.Time, 0)
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return srv.stopWorkers(err)
+		}
+		slot, isWorker, remaining := 0, false, 0
+		srv.withLock(func() {
+			slot, isWorker = srv.workers[pid]
+			delete(srv.workers, pid)
+			closed, remaining = srv.closed, len(srv.workers)
+		})
+		if !isWorker {
+			continue
+		}
+		if closed {
+			if remaining == 0 {
+				return ErrServerClosed
+			}
+			continue
+		}
+		slog.Error("Worker " + str.Itoa(pid) + " " + describeExit(status) +
+			", restarting")
+		now := time.Now()
+		for len(restarts) > 0 && now.Sub(restarts[0]) > restartPeriod {
+			restarts = restarts[1:]
+		}
+		if restarts = append(restarts, now); len(restarts) > 2*srv.Prefork {
+			return srv.stopWorkers(errWorkersFailing)
+		}
+		if err := srv.startWorker(slot); err != nil {
+			return srv.stopWorkers(err)
+		}
+	}
+}
+
+func (srv *Server) startWorker(slot int) error {
+	var err error
+	srv.withLock(func() {
+		if srv.closed {
+			return
+		}
+		env := []string{preforkWorkerEnv + "=" + str.Itoa(slot+1)}
+		pid := 0
+		pid, err = io.StartSelf(env, nil, &syscall.SysProcAttr{
+			Setpgid:   true,
+			Pdeathsig: syscall.SIGTERM,
+		})
+		if err == nil {
+			srv.workers[pid] = slot
+		}
+	})
+	return err
+}
+
+// stopWorkers closes the server and waits for the workers to exit.
+func (srv *Server) stopWorkers(err error) error {
+	srv.Close()
+	for {
+		remaining := 0
+		srv.withLock(func() {
+			remaining = len(srv.workers)
+		})
+		if remaining == 0 {
+			return err
+		}
+		pid, waitErr := syscall.Wait4(-1, nil, 0, nil)
+		if waitErr == syscall.ECHILD {
+			return err
+		}
+		srv.withLock(func() {
+			delete(srv.workers, pid)
+		})
+	}
+}
+
+func describeExit(status syscall.WaitStatus) string {
+	if status.Signaled() {
+		return "killed by signal " + str.Itoa(int(status.Signal()))
+	}
+	return "exited with status " + str.Itoa(status.ExitStatus())
+}
@@ -0,0 +1,183 @@
+package http
+
+import (
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+type ipPrefix struct {
+	ip   [16]byte
+	bits int
+	unix bool
+}
+
+// parseTrustedProxy accepts an address, a CIDR range or "unix" for peers
+// connected over a unix socket.
+func parseTrustedProxy(s string) (ipPrefix, bool) {
+	if s == "unix" {
+		return ipPrefix{unix: true}, true
+	}
+	bits := -1
+	if slash := str.IndexOf(s, '/'); slash >= 0 {
+		digits := s[slash+1:]
+		if len(digits) == 0 || len(digits) > 3 {
+			return ipPrefix{}, false
+		}
+		for i := 0; i < len(digits); i++ {
+			if digits[i] < '0' || digits[i] > '9' {
+				return ipPrefix{}, false
+			}
+		}
+		bits = str.Atoi(digits)
+		s = s[:slash]
+	}
+	if ip, ok := io.ParseIPv4(s); ok {
+		if bits > 32 {
+			return ipPrefix{}, false
+		}
+		if bits < 0 {
+			bits = 32
+		}
+		return ipPrefix{ip: ipv4Mapped(ip), bits: 96 + bits}, true
+	}
+	if ip, ok := io.ParseIPv6(s); ok {
+		if bits > 128 {
+			return ipPrefix{}, false
+		}
+		if bits < 0 {
+			bits = 128
+		}
+		return ipPrefix{ip: ip, bits: bits}, true
+	}
+	return ipPrefix{}, false
+}
+
+func (prefix ipPrefix) contains(ip [16]byte) bool {
+	for i := 0; i < prefix.bits; i += 8 {
+		mask := byte(0xff)
+		if prefix.bits-i < 8 {
+			mask <<= 8 - (prefix.bits - i)
+		}
+		if ip[i/8]&mask != prefix.ip[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+func ipv4Mapped(ip [4]byte) [16]byte {
+	return [16]byte{10: 0xff, 11: 0xff, 12: ip[0], 13: ip[1], 14: ip[2], 15: ip[3]}
+}
+
+func parseIP(s string) ([16]byte, bool) {
+	if ip, ok := io.ParseIPv4(s); ok {
+		return ipv4Mapped(ip), true
+	}
+	return io.ParseIPv6(s)
+}
+
+// clientIP is the peer address, or when the peer is a trusted proxy, the
+// first address from the right of the forwarding chain that isn't one.
+func (srv *Server) clientIP(remoteAddr string, header *Header) string {
+	client, trusted := remoteAddr, false
+	if host, _, err := io.SplitHostPort(remoteAddr); err == nil {
+		ip, ok := parseIP(host)
+		client, trusted = host, ok && srv.isTrustedProxy(ip)
+	} else {
+		trusted = srv.isTrustedUnix()
+	}
+	if !trusted {
+		return client
+	}
+	hops := forwardedHops(header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		client = io.FormatIP(ip)
+		if !srv.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (srv *Server) isTrustedProxy(ip [16]byte) bool {
+	for _, prefix := range srv.trustedProxies {
+		if !prefix.unix && prefix.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) isTrustedUnix() bool {
+	for _, prefix := range srv.trustedProxies {
+		if prefix.unix {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops lists the "for" addresses of the Forwarded header, or of
+// X-Forwarded-For when there is no Forwarded header, in the order the proxies
+// appended them.
+func forwardedHops(header *Header) []string {
+	hops := make([]string, 0)
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, value := range forwarded {
+			for _, element := range str.Split(value, ',') {
+				hop := ""
+				for _, pair := range str.Split(element, ';') {
+					pair = trimOWS(pair)
+					if len(pair) > 4 && str.ToLowerAscii(pair[:4]) == "for=" {
+						hop = pair[4:]
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range str.Split(value, ',') {
+			hops = append(hops, trimOWS(hop))
+		}
+	}
+	return hops
+}
+
+func parseHop(hop string) ([16]byte, bool) {
+	if len(hop) >= 2 && hop[0] == '"' && hop[len(hop)-1] == '"' {
+		hop = hop[1 : len(hop)-1]
+	}
+	if len(hop) > 0 && hop[0] == '[' {
+		end := str.IndexOf(hop, ']')
+		if end < 0 {
+			return [16]byte{}, false
+		}
+		ip, ok := io.ParseIPv6(hop[1:end])
+		return ip, ok
+	}
+	if ip, ok := parseIP(hop); ok {
+		return ip, true
+	}
+	if host, _, err := io.SplitHostPort(hop); err == nil {
+		if ip, ok := io.ParseIPv4(host); ok {
+			return ipv4Mapped(ip), true
+		}
+	}
+	return [16]byte{}, false
+}
+
+func (req *Request) ClientIP() string {
+	if req.clientIP != "" {
+		return req.clientIP
+	}
+	if host, _, err := io.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
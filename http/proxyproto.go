@@ -0,0 +1,196 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+const (
+	proxyV2Signature  = "\r\n\r\n\x00\r\nQUIT\n"
+	proxyV2HeaderSize = 16
+	maxProxyV1Line    = 107
+)
+
+const (
+	errInvalidProxyHeader = protocolError("Invalid PROXY protocol header")
+	errNoProxySources     = protocolError("AcceptProxyProtocol requires ProxyProtocolSources")
+)
+
+// bufferedConn lets TLS read what was buffered after the PROXY header.
+type bufferedConn struct {
+	*conn
+	lr *io.LineReader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.lr.Read(buf)
+}
+
+// parseProxies parses TrustedProxies and ProxyProtocolSources. Accepting
+// PROXY headers from any peer would let clients spoof their address, so
+// AcceptProxyProtocol without sources is refused.
+func (srv *Server) parseProxies() error {
+	srv.trustedProxies = make([]ipPrefix, 0, len(srv.TrustedProxies))
+	for _, proxy := range srv.TrustedProxies {
+		prefix, ok := parseTrustedProxy(proxy)
+		if !ok {
+			return protocolError("Invalid trusted proxy: " + proxy)
+		}
+		srv.trustedProxies = append(srv.trustedProxies, prefix)
+	}
+	if srv.AcceptProxyProtocol && len(srv.ProxyProtocolSources) == 0 {
+		return errNoProxySources
+	}
+	srv.proxySources = make([]ipPrefix, 0, len(srv.ProxyProtocolSources))
+	for _, source := range srv.ProxyProtocolSources {
+		prefix, ok := parseTrustedProxy(source)
+		if !ok {
+			return protocolError("Invalid PROXY protocol source: " + source)
+		}
+		srv.proxySources = append(srv.proxySources, prefix)
+	}
+	return nil
+}
+
+// isProxySource reports whether the peer may send PROXY headers.
+func (srv *Server) isProxySource(sockaddr syscall.Sockaddr) bool {
+	var ip [16]byte
+	switch addr := sockaddr.(type) {
+	case *syscall.SockaddrInet4:
+		ip = ipv4Mapped(addr.Addr)
+	case *syscall.SockaddrInet6:
+		ip = addr.Addr
+	default:
+		for _, prefix := range srv.proxySources {
+			if prefix.unix {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prefix := range srv.proxySources {
+		if !prefix.unix && prefix.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) proxyHeaderTimeout() time.Duration {
+	if srv.ProxyHeaderTimeout > 0 {
+		return srv.ProxyHeaderTimeout
+	}
+	return DefaultProxyHeaderTimeout
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header that a load
+// balancer sends ahead of the request, and takes the client and server
+// addresses from it. LOCAL and UNKNOWN headers, as used for health checks,
+// keep the addresses of the connection.
+func (srv *Server) readProxyHeader(c *conn) error {
+	lr := c.proxyHeader
+	c.proxyHeader = nil
+	start, err := lr.Peek(len(proxyV2Signature))
+	if err != nil {
+		return err
+	}
+	var remote, local syscall.Sockaddr
+	if string(start) == proxyV2Signature {
+		remote, local, err = readProxyV2(lr)
+	} else {
+		remote, local, err = readProxyV1(lr)
+	}
+	if err != nil {
+		return err
+	}
+	if remote != nil {
+		c.remoteAddr = io.FormatSockaddr(remote)
+		c.localAddr = io.FormatSockaddr(local)
+	}
+	c.readDeadline = deadlineAfter(srv.headerTimeout())
+	return nil
+}
+
+func readProxyV1(lr *io.LineReader) (syscall.Sockaddr, syscall.Sockaddr, error) {
+	line, err := lr.ReadLineMax(maxProxyV1Line)
+	if err == io.ErrLineTooLong {
+		return nil, nil, errInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := str.Split(line, ' ')
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, errInvalidProxyHeader
+	}
+	remote := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	local := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if remote == nil || local == nil {
+		return nil, nil, errInvalidProxyHeader
+	}
+	return remote, local, nil
+}
+
+func parseProxyV1Addr(family string, host string, port string) syscall.Sockaddr {
+	if !isDigits(port) || len(port) > 5 || len(port) > 1 && port[0] == '0' ||
+		str.Atoi(port) > 65535 {
+		return nil
+	}
+	if family == "TCP4" {
+		if ip, ok := io.ParseIPv4(host); ok {
+			return &syscall.SockaddrInet4{Port: str.Atoi(port), Addr: ip}
+		}
+		return nil
+	}
+	if ip, ok := io.ParseIPv6(host); ok {
+		return &syscall.SockaddrInet6{Port: str.Atoi(port), Addr: ip}
+	}
+	return nil
+}
+
+func readProxyV2(lr *io.LineReader) (syscall.Sockaddr, syscall.Sockaddr, error) {
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(lr, header); err != nil {
+		return nil, nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 || command > 1 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+	body := make([]byte, int(header[14])<<8|int(header[15]))
+	if _, err := io.ReadFull(lr, body); err != nil {
+		return nil, nil, err
+	}
+	if command == 0 || transport != 1 {
+		return nil, nil, nil
+	}
+	switch {
+	case family == 1 && len(body) >= 12:
+		remote := &syscall.SockaddrInet4{Port: int(body[8])<<8 | int(body[9])}
+		local := &syscall.SockaddrInet4{Port: int(body[10])<<8 | int(body[11])}
+		copy(remote.Addr[:], body[0:4])
+		copy(local.Addr[:], body[4:8])
+		return remote, local, nil
+	case family == 2 && len(body) >= 36:
+		remote := &syscall.SockaddrInet6{Port: int(body[32])<<8 | int(body[33])}
+		local := &syscall.SockaddrInet6{Port: int(body[34])<<8 | int(body[35])}
+		copy(remote.Addr[:], body[0:16])
+		copy(local.Addr[:], body[16:32])
+		return remote, local, nil
+	case family == 1 || family == 2:
+		return nil, nil, errInvalidProxyHeader
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+)
+
+var remoteAddrHandler = HandlerFunc(func(res ResponseWriter, req *Request) {
+	res.Write([]byte(req.RemoteAddr))
+})
+
+func TestProxyProtocolRequiresSources(t *testing.T) {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: remoteAddrHandler, AcceptProxyProtocol: true}
+	if err := srv.Serve(sockfd); err != errNoProxySources {
+		t.Errorf("got %v, want %v", err, errNoProxySources)
+	}
+	srv = &Server{Addr: "127.0.0.1:0", Prefork: 2, AcceptProxyProtocol: true,
+		ProxyProtocolSources: []string{}}
+	if err := srv.ListenAndServe(); err != errNoProxySources {
+		t.Errorf("prefork: got %v, want %v", err, errNoProxySources)
+	}
+}
+
+func TestProxyProtocolSources(t *testing.T) {
+	addr := startServer(t, &Server{Handler: remoteAddrHandler,
+		AcceptProxyProtocol: true, ProxyProtocolSources: []string{"127.0.0.0/8"}})
+	c := dialTest(t, addr)
+	c.send("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\n" +
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if res, body := c.response("GET"); res.StatusCode != 200 || body != "192.0.2.1:5000" {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+
+	addr = startServer(t, &Server{Handler: remoteAddrHandler,
+		AcceptProxyProtocol: true, ProxyProtocolSources: []string{"10.0.0.0/8"}})
+	c = dialTest(t, addr)
+	c.send("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\n")
+	if !c.closed() {
+		t.Error("connection from an unlisted peer was not closed")
+	}
+}
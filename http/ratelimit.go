@@ -0,0 +1,128 @@
+package http
+
+import (
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+const defaultMaxRateLimitClients = 65536
+
+// RateLimiter gives each client IP a token bucket that holds Burst requests
+// and refills at Rate requests per Interval. At most MaxClients buckets are
+// kept; when full, the bucket of the least recently seen client is dropped.
+type RateLimiter struct {
+	Rate       int
+	Interval   time.Duration
+	Burst      int
+	MaxClients int
+	lock       chan any
+	buckets    map[string]*tokenBucket
+	recent     tokenBucket
+	lastSweep  time.Time
+}
+
+// tokenBucket counts its tokens as time credit, one token being worth the
+// refill interval of a single request. The buckets form a ring through
+// RateLimiter.recent, most recently used first.
+type tokenBucket struct {
+	client string
+	credit time.Duration
+	last   time.Time
+	prev   *tokenBucket
+	next   *tokenBucket
+}
+
+func NewRateLimiter(rate int, interval time.Duration, burst int) *RateLimiter {
+	limiter := &RateLimiter{
+		Rate:       rate,
+		Interval:   interval,
+		Burst:      burst,
+		MaxClients: defaultMaxRateLimitClients,
+		lock:       make(chan any, 1),
+		buckets:    make(map[string]*tokenBucket),
+		lastSweep:  time.Now(),
+	}
+	limiter.recent.prev = &limiter.recent
+	limiter.recent.next = &limiter.recent
+	limiter.lock <- struct{}{}
+	return limiter
+}
+
+func (limiter *RateLimiter) Handler(next Handler) Handler {
+	return HandlerFunc(func(res ResponseWriter, req *Request) {
+		allowed, retryAfter := limiter.Allow(req.ClientIP())
+		if !allowed {
+			seconds := int((retryAfter + time.Second - 1) / time.Second)
+			res.Header().Set("Retry-After", str.Itoa(max(seconds, 1)))
+			Error(res, statusTexts[429], 429)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// Allow takes a token from the client's bucket, or tells how long until the
+// next token is available.
+func (limiter *RateLimiter) Allow(client string) (bool, time.Duration) {
+	cost := limiter.Interval / time.Duration(max(limiter.Rate, 1))
+	capacity := cost * time.Duration(max(limiter.Burst, 1))
+	now := time.Now()
+	allowed := false
+	var retryAfter time.Duration
+	limiter.withLock(func() {
+		if now.Sub(limiter.lastSweep) >= capacity {
+			limiter.sweep(now, capacity)
+		}
+		bucket := limiter.buckets[client]
+		if bucket == nil {
+			if len(limiter.buckets) >= max(limiter.MaxClients, 1) {
+				limiter.remove(limiter.recent.prev)
+			}
+			bucket = &tokenBucket{client: client, credit: capacity, last: now}
+			limiter.buckets[client] = bucket
+		} else {
+			bucket.unlink()
+		}
+		bucket.prev, bucket.next = &limiter.recent, limiter.recent.next
+		bucket.next.prev = bucket
+		limiter.recent.next = bucket
+		bucket.credit = min(bucket.credit+now.Sub(bucket.last), capacity)
+		bucket.last = now
+		if bucket.credit >= cost {
+			bucket.credit -= cost
+			allowed = true
+		} else {
+			retryAfter = cost - bucket.credit
+		}
+	})
+	return allowed, retryAfter
+}
+
+// sweep drops the buckets that have refilled completely, as a new bucket
+// would be identical.
+func (limiter *RateLimiter) sweep(now time.Time, capacity time.Duration) {
+	for _, bucket := range limiter.buckets {
+		if bucket.credit+now.Sub(bucket.last) >= capacity {
+			limiter.remove(bucket)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+func (limiter *RateLimiter) remove(bucket *tokenBucket) {
+	bucket.unlink()
+	delete(limiter.buckets, bucket.client)
+}
+
+func (bucket *tokenBucket) unlink() {
+	bucket.prev.next = bucket.next
+	bucket.next.prev = bucket.prev
+}
+
+func (limiter *RateLimiter) withLock(fn func()) {
+	locked := <-limiter.lock
+	defer func() {
+		limiter.lock <- locked
+	}()
+	fn()
+}
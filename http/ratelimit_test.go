@@ -0,0 +1,77 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Hour, 2)
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("10.0.0.1"); !allowed {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("10.0.0.1")
+	if allowed || retryAfter <= 0 || retryAfter > time.Hour {
+		t.Errorf("third request: allowed %v, retry after %v", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.Allow("10.0.0.2"); !allowed {
+		t.Error("other client denied")
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Hour, 1)
+	limiter.MaxClients = 3
+	for _, client := range []string{"a", "b", "c"} {
+		limiter.Allow(client)
+	}
+	// Seeing "a" again makes "b" the least recently used.
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Fatal("a allowed past its burst")
+	}
+	limiter.Allow("d")
+	if len(limiter.buckets) != 3 || limiter.buckets["b"] != nil {
+		t.Fatalf("buckets after eviction: %v", limiter.buckets)
+	}
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("a lost its bucket")
+	}
+	if allowed, _ := limiter.Allow("b"); !allowed {
+		t.Error("evicted client b denied")
+	}
+
+	for i := 0; i < 10000; i++ {
+		limiter.Allow("10.1." + str.Itoa(i))
+	}
+	if len(limiter.buckets) != limiter.MaxClients {
+		t.Errorf("%d buckets, want %d", len(limiter.buckets), limiter.MaxClients)
+	}
+	count := 0
+	for bucket := limiter.recent.next; bucket != &limiter.recent; bucket = bucket.next {
+		if limiter.buckets[bucket.client] != bucket {
+			t.Fatalf("stale bucket %q in the ring", bucket.client)
+		}
+		count++
+	}
+	if count != len(limiter.buckets) {
+		t.Errorf("%d buckets in the ring, %d in the map", count, len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(1000, time.Millisecond, 1)
+	limiter.Allow("a")
+	limiter.Allow("b")
+	time.Sleep(5 * time.Millisecond)
+	limiter.Allow("c")
+	if len(limiter.buckets) != 1 || limiter.buckets["c"] == nil {
+		t.Errorf("buckets after sweep: %v", limiter.buckets)
+	}
+	if limiter.recent.next != limiter.buckets["c"] || limiter.recent.prev != limiter.buckets["c"] {
+		t.Error("swept buckets left in the ring")
+	}
+}
@@ -0,0 +1,268 @@
+package http
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/slog"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+// hopHeaders only apply to a single connection, so they aren't forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const errUnexpectedUpgrade = protocolError("Backend switched to an unrequested protocol")
+
+var proxyClient = &Client{MaxRedirects: -1}
+
+// ReverseProxy forwards requests to the backend chosen by Director and
+// streams the response back. Client defaults to one that doesn't follow
+// redirects, and failures are answered with 502 unless ErrorHandler is set.
+type ReverseProxy struct {
+	Director       func(*Request)
+	Client         *Client
+	ModifyResponse func(*Response) error
+	ErrorHandler   func(ResponseWriter, *Request, error)
+}
+
+// NewSingleHostReverseProxy forwards requests to target, appending their
+// path to the path of target. The Host header is that of target, the one
+// the client sent is passed on as X-Forwarded-Host.
+func NewSingleHostReverseProxy(target string) (*ReverseProxy, error) {
+	url, err := parseURL(target)
+	if err != nil {
+		return nil, err
+	}
+	if url.Scheme != "http" {
+		return nil, protocolError("Unsupported protocol scheme " + url.Scheme)
+	}
+	return &ReverseProxy{Director: func(req *Request) {
+		path := joinURLPath(url.Path, req.URL.Path)
+		escaped := joinURLPath(url.EscapedPath(), req.URL.EscapedPath())
+		req.URL.Scheme, req.URL.Host, req.URL.Path = url.Scheme, url.Host, path
+		req.URL.RawPath = ""
+		if escaped != escapePath(path) {
+			req.URL.RawPath = escaped
+		}
+		if url.RawQuery != "" && req.URL.RawQuery != "" {
+			req.URL.RawQuery = url.RawQuery + "&" + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = url.RawQuery + req.URL.RawQuery
+		}
+		req.Host = ""
+	}}, nil
+}
+
+func joinURLPath(base string, path string) string {
+	baseSlash := len(base) > 0 && base[len(base)-1] == '/'
+	pathSlash := len(path) > 0 && path[0] == '/'
+	switch {
+	case baseSlash && pathSlash:
+		return base + path[1:]
+	case !baseSlash && !pathSlash:
+		return base + "/" + path
+	}
+	return base + path
+}
+
+func (proxy *ReverseProxy) ServeHTTP(res ResponseWriter, req *Request) {
+	out := outgoingRequest(req)
+	if proxy.Director != nil {
+		proxy.Director(out)
+	}
+	upgrade := ""
+	if req.Header.hasToken("Connection", "upgrade") {
+		upgrade = req.Header.Get("Upgrade")
+	}
+	// Te is a hop header, but a client that accepts trailers would lose
+	// the backend's gRPC-style trailers without it.
+	trailers := req.Header.hasToken("Te", "trailers")
+	removeHopHeaders(*out.Header)
+	if upgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		out.Header.Set("Te", "trailers")
+	}
+	client := proxy.Client
+	if client == nil {
+		client = proxyClient
+	}
+	backend, err := client.Do(out)
+	if err != nil {
+		proxy.handleError(res, req, err)
+		return
+	}
+	defer backend.Body.Close()
+	if backend.StatusCode == 101 {
+		if str.ToLowerAscii(backend.Header.Get("Upgrade")) !=
+			str.ToLowerAscii(upgrade) || upgrade == "" {
+			proxy.handleError(res, req, errUnexpectedUpgrade)
+			return
+		}
+	} else {
+		removeHopHeaders(backend.Header)
+	}
+	if proxy.ModifyResponse != nil {
+		if err := proxy.ModifyResponse(backend); err != nil {
+			proxy.handleError(res, req, err)
+			return
+		}
+	}
+	if backend.StatusCode == 101 {
+		proxy.switchProtocols(res, req, backend)
+		return
+	}
+	for name, values := range backend.Header {
+		for _, value := range values {
+			res.Header().Add(name, value)
+		}
+	}
+	res.WriteHeader(backend.StatusCode)
+	copyResponse(res, backend)
+}
+
+// outgoingRequest copies the request for the backend, sharing its body and
+// adding the X-Forwarded headers.
+func outgoingRequest(req *Request) *Request {
+	header := make(Header, len(*req.Header)+3)
+	for name, values := range *req.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	url := *req.URL
+	out := &Request{Method: req.Method, URL: &url, Header: &header,
+		Proto: "HTTP/1.1", Host: req.Host, ctx: req.ctx}
+	switch {
+	case req.body != nil:
+		out.body, out.contentLength = req.body, len(req.body)
+	case req.contentLength != 0 && req.Body != nil:
+		out.Body = req.Body
+		out.contentLength = int(declaredContentLength(*req.Header))
+	}
+	if host, _, err := io.SplitHostPort(req.RemoteAddr); err == nil {
+		chain := ""
+		for _, prior := range header.Values("X-Forwarded-For") {
+			chain += prior + ", "
+		}
+		header.Set("X-Forwarded-For", chain+host)
+	}
+	header.Set("X-Forwarded-Host", req.Host)
+	if req.TLS != nil {
+		header.Set("X-Forwarded-Proto", "https")
+	} else {
+		header.Set("X-Forwarded-Proto", "http")
+	}
+	return out
+}
+
+func removeHopHeaders(header Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range str.Split(value, ',') {
+			if name = str.Trim(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// copyResponse streams the backend's response body. Bodies of unknown
+// length are flushed as they arrive, so that event streams aren't held back.
+// A body cut short by the backend aborts the handler, so that the client
+// connection is closed instead of the response looking complete.
+func copyResponse(res ResponseWriter, backend *Response) {
+	flusher, canFlush := res.(Flusher)
+	flush := canFlush && backend.ContentLength < 0
+	buf := make([]byte, maxBufferedBody)
+	for {
+		n, err := backend.Body.Read(buf)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			slog.Error("Proxy error: " + err.Error())
+			panic(ErrAbortHandler)
+		}
+		if _, err := res.Write(buf[:n]); err != nil {
+			return
+		}
+		if flush {
+			flusher.Flush()
+		}
+	}
+}
+
+// switchProtocols hands the client connection over to the backend once it
+// has accepted an upgrade, such as to WebSocket, and relays data both ways
+// until either side closes.
+func (proxy *ReverseProxy) switchProtocols(
+	res ResponseWriter,
+	req *Request,
+	backend *Response,
+) {
+	upstream, isSwitched := backend.Body.(*switchedBody)
+	hijacker, isHijacker := res.(Hijacker)
+	if !isSwitched || !isHijacker {
+		proxy.handleError(res, req, protocolError("Connection can't be hijacked"))
+		return
+	}
+	client, err := hijacker.Hijack()
+	if err != nil {
+		proxy.handleError(res, req, err)
+		return
+	}
+	defer client.Close()
+	head := []byte("HTTP/1.1 101 Switching Protocols\r\n")
+	for _, name := range backend.Header.sortedKeys() {
+		for _, value := range backend.Header[name] {
+			head = append(head, name+": "+value+"\r\n"...)
+		}
+	}
+	if _, err := client.Write(append(head, '\r', '\n')); err != nil {
+		return
+	}
+	done := make(chan any, 2)
+	relay := func(dst io.Writer, src io.Reader) {
+		buf := make([]byte, maxBufferedBody)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				break
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go relay(client, upstream)
+	go relay(upstream, client)
+	<-done
+	syscall.Shutdown(upstream.c.fd, syscall.SHUT_RDWR)
+	if hijacked, isConn := client.(*hijackedConn); isConn {
+		syscall.Shutdown(hijacked.c.fd, syscall.SHUT_RDWR)
+	}
+	<-done
+}
+
+func (proxy *ReverseProxy) handleError(res ResponseWriter, req *Request, err error) {
+	if proxy.ErrorHandler != nil {
+		proxy.ErrorHandler(res, req, err)
+		return
+	}
+	slog.Error("Proxy error: " + err.Error())
+	Error(res, statusTexts[502], 502)
+}
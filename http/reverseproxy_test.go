@@ -0,0 +1,282 @@
+package http
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+)
+
+// proxyBackend records the requests it receives and serves the paths the
+// proxy tests forward to it.
+type proxyBackend struct {
+	requests chan *Request
+	bodies   chan string
+	proceed  chan struct{}
+}
+
+func (backend *proxyBackend) ServeHTTP(res ResponseWriter, req *Request) {
+	body, err := readBody(req)
+	if err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	switch req.URL.Path {
+	case "/hop":
+		res.Header().Set("Connection", "X-Backend-Hop")
+		res.Header().Set("X-Backend-Hop", "1")
+		res.Header().Set("Keep-Alive", "timeout=5")
+		res.Header().Set("X-Backend", "ok")
+	case "/stream":
+		res.Write([]byte("first"))
+		res.(Flusher).Flush()
+		<-backend.proceed
+		res.Write([]byte("second"))
+		return
+	case "/ws":
+		conn, err := res.(Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(append([]byte("echo "), buf[:n]...))
+		}
+	}
+	backend.requests <- req
+	backend.bodies <- string(body)
+	res.Write(body)
+}
+
+func startProxy(t *testing.T) (string, *proxyBackend) {
+	backend := &proxyBackend{requests: make(chan *Request, 10),
+		bodies: make(chan string, 10), proceed: make(chan struct{})}
+	proxy, err := NewSingleHostReverseProxy("http://" +
+		startServer(t, &Server{Handler: backend}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startServer(t, &Server{Handler: proxy}), backend
+}
+
+func TestReverseProxyHopHeaders(t *testing.T) {
+	addr, backend := startProxy(t)
+	c := dialTest(t, addr)
+	c.send("GET /hop HTTP/1.1\r\nHost: front.example\r\n" +
+		"Connection: keep-alive, X-Client-Hop\r\nX-Client-Hop: 1\r\n" +
+		"Keep-Alive: 300\r\nTe: trailers\r\nProxy-Authorization: Basic x\r\n" +
+		"Upgrade: h2c\r\nX-Forwarded-For: 10.0.0.1\r\nX-Client: yes\r\n\r\n")
+	res, _ := c.response("GET")
+	req := <-backend.requests
+	for _, name := range []string{"X-Client-Hop", "Keep-Alive",
+		"Proxy-Authorization", "Upgrade"} {
+		if value := req.Header.Get(name); value != "" {
+			t.Errorf("backend got %s: %s", name, value)
+		}
+	}
+	want := map[string]string{
+		"Te":                "trailers",
+		"X-Client":          "yes",
+		"X-Forwarded-For":   "10.0.0.1, 127.0.0.1",
+		"X-Forwarded-Host":  "front.example",
+		"X-Forwarded-Proto": "http",
+	}
+	for name, value := range want {
+		if got := req.Header.Get(name); got != value {
+			t.Errorf("backend got %s: %q, want %q", name, got, value)
+		}
+	}
+	if res.Header.Get("X-Backend") != "ok" || res.Header.Get("X-Backend-Hop") != "" ||
+		res.Header.Get("Keep-Alive") != "" {
+		t.Errorf("client got headers %v", res.Header)
+	}
+}
+
+func TestReverseProxyTe(t *testing.T) {
+	addr, backend := startProxy(t)
+	tests := []struct {
+		te   string
+		want string
+	}{
+		{"trailers", "trailers"},
+		{"Trailers", "trailers"},
+		{"deflate, trailers", "trailers"},
+		{"gzip", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		c := dialTest(t, addr)
+		raw := "GET / HTTP/1.1\r\nHost: t\r\n"
+		if test.te != "" {
+			raw += "Te: " + test.te + "\r\n"
+		}
+		c.send(raw + "\r\n")
+		c.response("GET")
+		req := <-backend.requests
+		if got := req.Header.Values("Te"); len(got) > 1 ||
+			req.Header.Get("Te") != test.want {
+			t.Errorf("Te: %s: backend got %q, want %q", test.te, got, test.want)
+		}
+	}
+}
+
+func TestReverseProxyRequestBodies(t *testing.T) {
+	addr, backend := startProxy(t)
+	large := make([]byte, 3*maxBufferedBody)
+	for i := range large {
+		large[i] = byte('a' + i%26)
+	}
+	tests := []struct {
+		name      string
+		raw       string
+		body      string
+		framing   string
+		framedAs  string
+		keepAlive bool
+	}{
+		{"Content-Length", "POST / HTTP/1.1\r\nHost: t\r\nContent-Length: " +
+			str.Itoa(len(large)) + "\r\n\r\n" + string(large), string(large),
+			"Content-Length", str.Itoa(len(large)), true},
+		{"chunked", "POST / HTTP/1.1\r\nHost: t\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n", "hello world",
+			"Transfer-Encoding", "chunked", true},
+	}
+	for _, test := range tests {
+		c := dialTest(t, addr)
+		c.send(test.raw)
+		res, body := c.response("POST")
+		if res.StatusCode != 200 || body != test.body {
+			t.Errorf("%s: got %d with %d bytes", test.name, res.StatusCode, len(body))
+		}
+		req, received := <-backend.requests, <-backend.bodies
+		if got := req.Header.Get(test.framing); got != test.framedAs ||
+			received != test.body {
+			t.Errorf("%s: backend got %s %q and %d bytes", test.name, test.framing,
+				got, len(received))
+		}
+	}
+}
+
+func TestReverseProxyFlushesStreams(t *testing.T) {
+	addr, backend := startProxy(t)
+	c := dialTest(t, addr)
+	c.send("GET /stream HTTP/1.1\r\nHost: t\r\n\r\n")
+	res, reader, err := readResponse(c.lr, &Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, 5)
+	if err := readFull(reader, first); err != nil || string(first) != "first" {
+		t.Fatalf("got %q, %v before the backend finished", first, err)
+	}
+	close(backend.proceed)
+	rest, err := readAll(reader)
+	if err != nil || string(rest) != "second" || res.ContentLength != chunkedBody {
+		t.Errorf("got %q, %v, length %d", rest, err, res.ContentLength)
+	}
+}
+
+func TestReverseProxyUpgrade(t *testing.T) {
+	addr, _ := startProxy(t)
+	c := dialTest(t, addr)
+	c.send("GET /ws HTTP/1.1\r\nHost: t\r\nConnection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n\r\n")
+	if head := readHead(t, c); len(head) == 0 ||
+		head[0] != "HTTP/1.1 101 Switching Protocols" {
+		t.Fatalf("got %q", head)
+	}
+	for _, message := range []string{"hello", "relay"} {
+		c.send(message)
+		reply := make([]byte, len("echo ")+len(message))
+		if err := readFull(c.lr, reply); err != nil ||
+			string(reply) != "echo "+message {
+			t.Errorf("got %q, %v", reply, err)
+		}
+	}
+
+	// A backend may only switch protocols when the client asked to.
+	c = dialTest(t, addr)
+	c.send("GET /ws HTTP/1.1\r\nHost: t\r\n\r\n")
+	if res, _ := c.response("GET"); res.StatusCode != 502 {
+		t.Errorf("unrequested upgrade: got %d", res.StatusCode)
+	}
+}
+
+func TestReverseProxyDeadBackend(t *testing.T) {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockaddr, _ := syscall.Getsockname(sockfd)
+	syscall.Close(sockfd)
+	proxy, _ := NewSingleHostReverseProxy("http://" + io.FormatSockaddr(sockaddr))
+	c := dialTest(t, startServer(t, &Server{Handler: proxy}))
+	c.send("GET / HTTP/1.1\r\nHost: t\r\n\r\n")
+	if res, _ := c.response("GET"); res.StatusCode != 502 {
+		t.Errorf("got %d, want 502", res.StatusCode)
+	}
+}
+
+// rawBackend answers a single request with a response written as is, and
+// then closes the connection.
+func rawBackend(t *testing.T, response string) string {
+	sockfd, err := io.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(sockfd)
+	})
+	syscall.SetNonblock(sockfd, false)
+	sockaddr, _ := syscall.Getsockname(sockfd)
+	go func() {
+		connfd, _, err := syscall.Accept4(sockfd, syscall.SOCK_CLOEXEC)
+		if err != nil {
+			return
+		}
+		c := &conn{fd: connfd}
+		c.lr = io.NewLineReader(c)
+		readRequest(c.lr, DefaultMaxHeaderBytes, DefaultMaxBodyBytes)
+		io.Write(connfd, []byte(response))
+		syscall.Close(connfd)
+	}()
+	return io.FormatSockaddr(sockaddr)
+}
+
+func TestReverseProxyTruncatedBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"Content-Length", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial"},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"7\r\npartial\r\n"},
+		{"missing body", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"},
+	}
+	for _, test := range tests {
+		proxy, _ := NewSingleHostReverseProxy("http://" + rawBackend(t, test.response))
+		proxy.Client = &Client{MaxRedirects: -1}
+		c := dialTest(t, startServer(t, &Server{Handler: proxy}))
+		c.send("GET / HTTP/1.1\r\nHost: t\r\n\r\n")
+		res, reader, err := readResponse(c.lr, &Request{Method: "GET"})
+		if err == nil {
+			var body []byte
+			body, err = readAll(reader)
+			if err == nil {
+				t.Errorf("%s: got a complete %d response %q", test.name,
+					res.StatusCode, body)
+			}
+		}
+		if !c.closed() {
+			t.Errorf("%s: client connection left open", test.name)
+		}
+	}
+}
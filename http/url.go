@@ -0,0 +1,219 @@
+package http
+
+import "github.com/alaisi/syscalltodo/str"
+
+type URL struct {
+	Scheme   string
+	Host     string
+	Path     string
+	RawPath  string
+	RawQuery string
+}
+
+func parseURL(raw string) (*URL, error) {
+	if hash := str.IndexOf(raw, '#'); hash >= 0 {
+		raw = raw[:hash]
+	}
+	sep := indexBytes([]byte(raw), []byte("://"))
+	if sep <= 0 {
+		return nil, protocolError("Invalid URL " + raw)
+	}
+	scheme := str.ToLowerAscii(raw[:sep])
+	rest := raw[sep+3:]
+	end := len(rest)
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == '/' || rest[i] == '?' {
+			end = i
+			break
+		}
+	}
+	host, target := rest[:end], rest[end:]
+	if host == "" || str.IndexOf(host, '@') >= 0 {
+		return nil, protocolError("Invalid URL host " + raw)
+	}
+	if target == "" || target[0] == '?' {
+		target = "/" + target
+	}
+	url, err := parseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+	url.Scheme = scheme
+	url.Host = host
+	return url, nil
+}
+
+func (url *URL) resolve(ref string) (*URL, error) {
+	if hash := str.IndexOf(ref, '#'); hash >= 0 {
+		ref = ref[:hash]
+	}
+	if indexBytes([]byte(ref), []byte("://")) > 0 {
+		return parseURL(ref)
+	}
+	if len(ref) > 1 && ref[0] == '/' && ref[1] == '/' {
+		return parseURL(url.Scheme + ":" + ref)
+	}
+	base := url.Scheme + "://" + url.Host
+	path := url.EscapedPath()
+	switch {
+	case ref == "":
+		return parseURL(base + url.RequestURI())
+	case ref[0] == '/':
+		return parseURL(base + ref)
+	case ref[0] == '?':
+		return parseURL(base + path + ref)
+	}
+	dir := path
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			dir = path[:i+1]
+			break
+		}
+	}
+	return parseURL(base + dir + ref)
+}
+
+func parseRequestURI(target string) (*URL, error) {
+	url := &URL{}
+	rawPath := target
+	if question := str.IndexOf(target, '?'); question >= 0 {
+		rawPath = target[:question]
+		url.RawQuery = target[question+1:]
+	}
+	path, err := unescape(rawPath, false)
+	if err != nil {
+		return nil, err
+	}
+	url.Path = path
+	if escapePath(path) != rawPath {
+		url.RawPath = rawPath
+	}
+	return url, nil
+}
+
+func (url *URL) EscapedPath() string {
+	if url.RawPath != "" {
+		return url.RawPath
+	}
+	return escapePath(url.Path)
+}
+
+func (url *URL) RequestURI() string {
+	uri := url.EscapedPath()
+	if url.RawQuery != "" {
+		uri += "?" + url.RawQuery
+	}
+	return uri
+}
+
+func (url *URL) Query() UrlValues {
+	values, _ := parseQuery(url.RawQuery)
+	return values
+}
+
+func (url *URL) String() string {
+	if url.Host != "" {
+		return url.Scheme + "://" + url.Host + url.RequestURI()
+	}
+	return url.RequestURI()
+}
+
+type UrlValues map[string][]string
+
+func (values UrlValues) Get(key string) string {
+	v := values[key]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (values UrlValues) Set(key string, value string) {
+	values[key] = []string{value}
+}
+
+func (values UrlValues) Add(key string, value string) {
+	values[key] = append(values[key], value)
+}
+
+func (values UrlValues) Has(key string) bool {
+	_, ok := values[key]
+	return ok
+}
+
+func parseQuery(query string) (UrlValues, error) {
+	values := make(UrlValues)
+	var err error
+	for _, field := range str.Split(query, '&') {
+		if field == "" {
+			continue
+		}
+		if str.IndexOf(field, ';') >= 0 {
+			err = protocolError("Invalid semicolon separator in query")
+			continue
+		}
+		k, v := field, ""
+		if eq := str.IndexOf(field, '='); eq >= 0 {
+			k, v = field[:eq], field[eq+1:]
+		}
+		key, keyErr := urlDecode(k)
+		value, valueErr := urlDecode(v)
+		if keyErr != nil || valueErr != nil {
+			if err == nil {
+				err = protocolError("Invalid URL escape in query")
+			}
+			continue
+		}
+		values[key] = append(values[key], value)
+	}
+	return values, err
+}
+
+func urlDecode(s string) (string, error) {
+	return unescape(s, true)
+}
+
+func unescape(s string, plusAsSpace bool) (string, error) {
+	encoded := []byte(s)
+	decoded := make([]byte, 0, len(encoded))
+	for i := 0; i < len(encoded); i++ {
+		b := encoded[i]
+		if b == '+' && plusAsSpace {
+			decoded = append(decoded, ' ')
+		} else if b == '%' {
+			if i > len(encoded)-3 ||
+				!isHex(encoded[i+1]) || !isHex(encoded[i+2]) {
+				return "", protocolError("Invalid URL escape")
+			}
+			c := str.DecodeHex(encoded[i+1 : i+3])
+			decoded = append(decoded, c...)
+			i += 2
+		} else {
+			decoded = append(decoded, b)
+		}
+	}
+	return string(decoded), nil
+}
+
+func escapePath(s string) string {
+	const hex = "0123456789ABCDEF"
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) || str.IndexOf("/$&+,:;=@", rune(c)) >= 0 {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	return string(escaped)
+}
+
+func isUnreserved(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
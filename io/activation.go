@@ -0,0 +1,154 @@
+package io
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/str"
+)
+
+const listenFdsStart = 3
+
+// ListenFds returns the listening sockets passed by systemd socket
+// activation, or by a parent that started this process with Reexec. They
+// begin at fd 3, and LISTEN_PID names the process they are meant for.
+func ListenFds() ([]int, error) {
+	pid, _ := GetEnv("LISTEN_PID")
+	count, _ := GetEnv("LISTEN_FDS")
+	if pid == "" || count == "" {
+		return nil, nil
+	}
+	if target := str.Atoi(pid); target != syscall.Getpid() &&
+		target != syscall.Getppid() {
+		return nil, nil
+	}
+	n := str.Atoi(count)
+	if n <= 0 {
+		return nil, nil
+	}
+	fds := make([]int, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		accepting, err := syscall.GetsockoptInt(
+			fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return nil, err
+		}
+		if accepting != 1 {
+			return nil, syscall.EINVAL
+		}
+		syscall.CloseOnExec(fd)
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// ReexecParent returns the pid of the process that handed over its sockets
+// with Reexec, or 0.
+func ReexecParent() int {
+	pid, _ := GetEnv("LISTEN_PID")
+	if count, _ := GetEnv("LISTEN_FDS"); count == "" || pid == "" {
+		return 0
+	}
+	if parent := syscall.Getppid(); str.Atoi(pid) == parent {
+		return parent
+	}
+	return 0
+}
+
+// Reexec starts a new instance of the running executable with the listening
+// sockets as LISTEN_FDS.
+func Reexec(fds ...int) (int, error) {
+	env := []string{
+		"LISTEN_FDS=" + str.Itoa(len(fds)),
+		"LISTEN_PID=" + str.Itoa(syscall.Getpid()),
+	}
+	return StartSelf(env, fds, nil)
+}
+
+// StartSelf starts a new instance of the running executable with the same
+// arguments and environment, env overriding variables of the same name. The
+// child gets fds as fd 3 onwards; socket activation variables are only passed
+// on in env. The executable is looked up again, so a binary replaced on disk
+// is picked up.
+func StartSelf(env []string, fds []int, sys *syscall.SysProcAttr) (int, error) {
+	path, err := executablePath()
+	if err != nil {
+		return -1, err
+	}
+	cmdline, err := ReadFile("/proc/self/cmdline")
+	if err != nil {
+		return -1, err
+	}
+	environ, err := ReadFile("/proc/self/environ")
+	if err != nil {
+		return -1, err
+	}
+	overridden := []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"}
+	for _, e := range env {
+		overridden = append(overridden, e[:max(str.IndexOf(e, '='), 0)])
+	}
+	childEnv := make([]string, 0)
+	for _, e := range splitNul(environ) {
+		if !hasName(e, overridden) {
+			childEnv = append(childEnv, e)
+		}
+	}
+	files := []uintptr{0, 1, 2}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	return syscall.ForkExec(path, splitNul(cmdline), &syscall.ProcAttr{
+		Env:   append(childEnv, env...),
+		Files: files,
+		Sys:   sys,
+	})
+}
+
+// Notify sends a state such as "READY=1" to the service manager listening
+// on NOTIFY_SOCKET. It does nothing when there is no service manager.
+func Notify(state string) error {
+	path, _ := GetEnv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	fd, err := syscall.Socket(
+		syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.Sendto(fd, []byte(state), 0, &syscall.SockaddrUnix{Name: path})
+}
+
+func executablePath() (string, error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Readlink("/proc/self/exe", buf)
+	if err != nil {
+		return "", err
+	}
+	path := string(buf[:n])
+	if deleted := " (deleted)"; len(path) > len(deleted) &&
+		path[len(path)-len(deleted):] == deleted {
+		path = path[:len(path)-len(deleted)]
+	}
+	return path, nil
+}
+
+func splitNul(data []byte) []string {
+	parts := str.Split(string(data), '\000')
+	if len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return parts
+}
+
+func hasName(e string, names []string) bool {
+	for _, name := range names {
+		if len(e) > len(name) && e[:len(name)] == name && e[len(name)] == '=' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package io
+
+import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/str"
+)
+
+type addrError string
+
+func (err addrError) Error() string {
+	return "Invalid address: " + string(err)
+}
+
+const unixPrefix = "unix:"
+
+func ResolveSockaddr(addr string) (int, syscall.Sockaddr, error) {
+	if len(addr) > len(unixPrefix) && addr[:len(unixPrefix)] == unixPrefix {
+		path := addr[len(unixPrefix):]
+		if len(path) > 107 {
+			return 0, nil, addrError(addr)
+		}
+		return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: path}, nil
+	}
+	host, port, err := SplitHostPort(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if host == "" {
+		return syscall.AF_INET6, &syscall.SockaddrInet6{Port: port}, nil
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	if ip, ok := ParseIPv4(host); ok {
+		return syscall.AF_INET, &syscall.SockaddrInet4{Port: port, Addr: ip}, nil
+	}
+	if ip, ok := ParseIPv6(host); ok {
+		return syscall.AF_INET6, &syscall.SockaddrInet6{Port: port, Addr: ip}, nil
+	}
+	return 0, nil, addrError(addr)
+}
+
+func SplitHostPort(addr string) (string, int, error) {
+	colon := -1
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", 0, addrError(addr)
+	}
+	host, port := addr[:colon], addr[colon+1:]
+	if len(host) > 0 && host[0] == '[' {
+		if host[len(host)-1] != ']' {
+			return "", 0, addrError(addr)
+		}
+		host = host[1 : len(host)-1]
+	} else if str.IndexOf(host, ':') >= 0 {
+		return "", 0, addrError(addr)
+	}
+	if len(port) == 0 || len(port) > 5 {
+		return "", 0, addrError(addr)
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return "", 0, addrError(addr)
+		}
+	}
+	portNum := str.Atoi(port)
+	if portNum > 65535 {
+		return "", 0, addrError(addr)
+	}
+	return host, portNum, nil
+}
+
+func ParseIPv4(s string) ([4]byte, bool) {
+	ip := [4]byte{}
+	parts := str.Split(s, '.')
+	if len(parts) != 4 {
+		return ip, false
+	}
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 3 || len(part) > 1 && part[0] == '0' {
+			return ip, false
+		}
+		n := 0
+		for j := 0; j < len(part); j++ {
+			if part[j] < '0' || part[j] > '9' {
+				return ip, false
+			}
+			n = n*10 + int(part[j]-'0')
+		}
+		if n > 255 {
+			return ip, false
+		}
+		ip[i] = byte(n)
+	}
+	return ip, true
+}
+
+func ParseIPv6(s string) ([16]byte, bool) {
+	ip := [16]byte{}
+	if zone := str.IndexOf(s, '%'); zone >= 0 {
+		s = s[:zone]
+	}
+	ellipsis := -1
+	if len(s) >= 2 && s[0] == ':' && s[1] == ':' {
+		ellipsis = 0
+		s = s[2:]
+		if len(s) == 0 {
+			return ip, true
+		}
+	}
+	i := 0
+	for i < 16 {
+		end := 0
+		n := 0
+		for ; end < len(s) && end < 5 && isHexDigit(s[end]); end++ {
+			n = n*16 + hexValue(s[end])
+		}
+		if end == 0 || end > 4 {
+			return ip, false
+		}
+		if end < len(s) && s[end] == '.' {
+			if ellipsis < 0 && i != 12 || i+4 > 16 {
+				return ip, false
+			}
+			ip4, ok := ParseIPv4(s)
+			if !ok {
+				return ip, false
+			}
+			copy(ip[i:], ip4[:])
+			i += 4
+			s = ""
+			break
+		}
+		ip[i] = byte(n >> 8)
+		ip[i+1] = byte(n)
+		i += 2
+		s = s[end:]
+		if len(s) == 0 {
+			break
+		}
+		if s[0] != ':' || len(s) == 1 {
+			return ip, false
+		}
+		s = s[1:]
+		if s[0] == ':' {
+			if ellipsis >= 0 {
+				return ip, false
+			}
+			ellipsis = i
+			s = s[1:]
+			if len(s) == 0 {
+				break
+			}
+		}
+	}
+	if len(s) != 0 {
+		return ip, false
+	}
+	if i < 16 {
+		if ellipsis < 0 {
+			return ip, false
+		}
+		shift := 16 - i
+		for j := i - 1; j >= ellipsis; j-- {
+			ip[j+shift] = ip[j]
+		}
+		for j := ellipsis + shift - 1; j >= ellipsis; j-- {
+			ip[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		return ip, false
+	}
+	return ip, true
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	default:
+		return int(c-'A') + 10
+	}
+}
+
+func FormatSockaddr(sockaddr syscall.Sockaddr) string {
+	switch sa := sockaddr.(type) {
+	case *syscall.SockaddrInet4:
+		return FormatIPv4(sa.Addr) + ":" + str.Itoa(sa.Port)
+	case *syscall.SockaddrInet6:
+		if isIPv4Mapped(sa.Addr) {
+			return FormatIP(sa.Addr) + ":" + str.Itoa(sa.Port)
+		}
+		return "[" + FormatIPv6(sa.Addr) + "]:" + str.Itoa(sa.Port)
+	case *syscall.SockaddrUnix:
+		if sa.Name == "" {
+			return "@"
+		}
+		return sa.Name
+	}
+	return ""
+}
+
+func FormatIPv4(ip [4]byte) string {
+	return str.Itoa(int(ip[0])) + "." + str.Itoa(int(ip[1])) + "." +
+		str.Itoa(int(ip[2])) + "." + str.Itoa(int(ip[3]))
+}
+
+// FormatIP formats a 16-byte address, writing IPv4-mapped addresses from
+// dual-stack sockets in dotted form.
+func FormatIP(ip [16]byte) string {
+	if isIPv4Mapped(ip) {
+		return FormatIPv4([4]byte{ip[12], ip[13], ip[14], ip[15]})
+	}
+	return FormatIPv6(ip)
+}
+
+// FormatIPv6 writes the RFC 5952 form, compressing the longest run of zero
+// groups with "::".
+func FormatIPv6(ip [16]byte) string {
+	bestStart, bestLen := -1, 1
+	for i := 0; i < 8; {
+		if ip[2*i] != 0 || ip[2*i+1] != 0 {
+			i++
+			continue
+		}
+		start := i
+		for i < 8 && ip[2*i] == 0 && ip[2*i+1] == 0 {
+			i++
+		}
+		if i-start > bestLen {
+			bestStart, bestLen = start, i-start
+		}
+	}
+	const hexDigits = "0123456789abcdef"
+	s := make([]byte, 0, 39)
+	for i := 0; i < 8; i++ {
+		if i == bestStart {
+			s = append(s, ':', ':')
+			i += bestLen - 1
+			continue
+		}
+		if i > 0 && s[len(s)-1] != ':' {
+			s = append(s, ':')
+		}
+		group := int(ip[2*i])<<8 | int(ip[2*i+1])
+		started := false
+		for shift := 12; shift >= 0; shift -= 4 {
+			digit := group >> shift & 0xf
+			if digit != 0 || started || shift == 0 {
+				s = append(s, hexDigits[digit])
+				started = true
+			}
+		}
+	}
+	return string(s)
+}
+
+func isIPv4Mapped(ip [16]byte) bool {
+	for i := 0; i < 10; i++ {
+		if ip[i] != 0 {
+			return false
+		}
+	}
+	return ip[10] == 0xff && ip[11] == 0xff
+}
@@ -2,66 +2,41 @@ package io
 
 import (
 	"syscall"
-	"unsafe"
 
 	"github.com/alaisi/syscalltodo/str"
 )
 
-func AtExit(fn func()) error {
-	sigmask := uint64(1<<(syscall.SIGINT-1)) | (1 << (syscall.SIGTERM - 1))
-	signalFdCreate := -1
-	fd, _, errno := syscall.Syscall(
-		syscall.SYS_SIGNALFD,
-		uintptr(signalFdCreate),
-		uintptr(unsafe.Pointer(&sigmask)),
-		uintptr(8))
-	if errno != 0 {
-		return syscall.Errno(errno)
-	}
-	go func() {
-		siginfo := make([]byte, 128)
-		for {
-			_, err := syscall.Read(int(fd), siginfo)
-			if err == nil {
-				break
-			}
-			if err != syscall.EINTR {
-				return
-			}
-		}
-		fn()
-	}()
-	return nil
+type Poller struct {
+	epfd int
 }
 
-func Epoll(fn func(syscall.EpollEvent) error, fds ...int) error {
-	epfd, err := syscall.EpollCreate1(0)
+func NewPoller() (*Poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
 	if err != nil {
-		return err
-	}
-	defer syscall.Close(epfd)
-	for _, fd := range fds {
-		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
-		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event)
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
-	events := make([]syscall.EpollEvent, len(fds))
-	defer syscall.Close(epfd)
-	for {
-		n, err := syscall.EpollWait(epfd, events, -1)
-		if err != nil && err != syscall.EINTR {
-			return err
-		}
-		for i := 0; i < n; i++ {
-			if events[i].Events != 0 {
-				if err := fn(events[i]); err != nil {
-					return err
-				}
-			}
-		}
+	return &Poller{epfd: epfd}, nil
+}
+
+func (p *Poller) Add(fd int, events uint32) error {
+	event := syscall.EpollEvent{Events: events, Fd: int32(fd)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+}
+
+func (p *Poller) Remove(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *Poller) Wait(events []syscall.EpollEvent, timeoutMillis int) (int, error) {
+	n, err := syscall.EpollWait(p.epfd, events, timeoutMillis)
+	if err != nil {
+		return 0, err
 	}
+	return n, nil
+}
+
+func (p *Poller) Close() error {
+	return syscall.Close(p.epfd)
 }
 
 func GetEnv(name string) (string, error) {
@@ -82,8 +57,38 @@ func GetEnv(name string) (string, error) {
 	return "", nil
 }
 
-func Listen(port int) (int, error) {
-	sockfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+func Listen(addr string) (int, error) {
+	return listen(addr, false)
+}
+
+const soReusePort = 0xf
+
+// ListenReusePort creates a TCP listener with SO_REUSEPORT, so that several
+// processes can bind the same address and the kernel balances connections
+// between them.
+func ListenReusePort(addr string) (int, error) {
+	return listen(addr, true)
+}
+
+func listen(addr string, reusePort bool) (int, error) {
+	family, sockaddr, err := ResolveSockaddr(addr)
+	if err != nil {
+		return -1, err
+	}
+	if reusePort && family == syscall.AF_UNIX {
+		return -1, syscall.EINVAL
+	}
+	sockfd, err := syscall.Socket(
+		family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err == syscall.EAFNOSUPPORT && family == syscall.AF_INET6 {
+		inet6 := sockaddr.(*syscall.SockaddrInet6)
+		if inet6.Addr == [16]byte{} {
+			family = syscall.AF_INET
+			sockaddr = &syscall.SockaddrInet4{Port: inet6.Port}
+			sockfd, err = syscall.Socket(
+				family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		}
+	}
 	if err != nil {
 		return -1, err
 	}
@@ -92,15 +97,19 @@ func Listen(port int) (int, error) {
 			syscall.Close(sockfd)
 		}
 	}()
-	if err = syscall.SetsockoptInt(
-		sockfd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+	if err = configureListener(sockfd, family, sockaddr); err != nil {
 		return -1, err
 	}
+	if reusePort {
+		if err = syscall.SetsockoptInt(
+			sockfd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return -1, err
+		}
+	}
 	if err = syscall.SetNonblock(sockfd, true); err != nil {
 		return -1, err
 	}
-	if err = syscall.Bind(
-		sockfd, &syscall.SockaddrInet4{Port: port}); err != nil {
+	if err = syscall.Bind(sockfd, sockaddr); err != nil {
 		return -1, err
 	}
 	if err = syscall.Listen(sockfd, 255); err != nil {
@@ -109,8 +118,67 @@ func Listen(port int) (int, error) {
 	return sockfd, nil
 }
 
+func configureListener(sockfd int, family int, sockaddr syscall.Sockaddr) error {
+	switch family {
+	case syscall.AF_UNIX:
+		return removeStaleSocket(sockaddr.(*syscall.SockaddrUnix).Name)
+	case syscall.AF_INET6:
+		if err := syscall.SetsockoptInt(
+			sockfd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return err
+		}
+	}
+	return syscall.SetsockoptInt(
+		sockfd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+func removeStaleSocket(path string) error {
+	if len(path) == 0 || path[0] == '@' {
+		return nil
+	}
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(path, &stat); err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		return syscall.EADDRINUSE
+	}
+	return syscall.Unlink(path)
+}
+
+func CloseListener(sockfd int) error {
+	sockaddr, err := syscall.Getsockname(sockfd)
+	if unix, isUnix := sockaddr.(*syscall.SockaddrUnix); err == nil && isUnix {
+		if len(unix.Name) > 0 && unix.Name[0] != '@' {
+			syscall.Unlink(unix.Name)
+		}
+	}
+	return syscall.Close(sockfd)
+}
+
 func Connect(addr [4]byte, port int) (int, error) {
-	sockfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	sockaddr := &syscall.SockaddrInet4{Addr: addr, Port: port}
+	return connect(syscall.AF_INET, sockaddr, syscall.Timeval{})
+}
+
+func Dial(addr string, timeout syscall.Timeval) (int, error) {
+	family, sockaddr, err := ResolveSockaddr(addr)
+	if err != nil {
+		return -1, err
+	}
+	return connect(family, sockaddr, timeout)
+}
+
+func connect(
+	family int,
+	sockaddr syscall.Sockaddr,
+	timeout syscall.Timeval,
+) (int, error) {
+	sockfd, err := syscall.Socket(
+		family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return -1, err
 	}
@@ -119,14 +187,31 @@ func Connect(addr [4]byte, port int) (int, error) {
 			syscall.Close(sockfd)
 		}
 	}()
-	sockaddr := syscall.SockaddrInet4{Addr: addr, Port: port}
-	if err = syscall.Connect(sockfd, &sockaddr); err != nil {
-		return -1, err
+	hasTimeout := timeout.Sec != 0 || timeout.Usec != 0
+	if hasTimeout {
+		if err = syscall.SetsockoptTimeval(
+			sockfd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &timeout); err != nil {
+			return -1, err
+		}
 	}
-	if err = syscall.SetsockoptInt(
-		sockfd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil {
+	if err = syscall.Connect(sockfd, sockaddr); err != nil {
+		if err == syscall.EINPROGRESS {
+			err = syscall.ETIMEDOUT
+		}
 		return -1, err
 	}
+	if hasTimeout {
+		if err = syscall.SetsockoptTimeval(sockfd, syscall.SOL_SOCKET,
+			syscall.SO_SNDTIMEO, &syscall.Timeval{}); err != nil {
+			return -1, err
+		}
+	}
+	if family != syscall.AF_UNIX {
+		if err = syscall.SetsockoptInt(
+			sockfd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil {
+			return -1, err
+		}
+	}
 	return sockfd, nil
 }
 
@@ -140,6 +225,13 @@ type Reader interface {
 type Writer interface {
 	Write(p []byte) (n int, err error)
 }
+type Closer interface {
+	Close() error
+}
+type ReadCloser interface {
+	Reader
+	Closer
+}
 
 type ByteArrayWriter struct {
 	Bytes []byte
@@ -154,9 +246,30 @@ func (writer *ByteArrayWriter) Write(buf []byte) (int, error) {
 	return len(buf), nil
 }
 
+type ByteArrayReader struct {
+	Bytes []byte
+	pos   int
+}
+
+func NewByteArrayReader(bytes []byte) *ByteArrayReader {
+	return &ByteArrayReader{Bytes: bytes}
+}
+
+func (reader *ByteArrayReader) Read(buf []byte) (int, error) {
+	if reader.pos >= len(reader.Bytes) {
+		return -1, EOF
+	}
+	n := copy(buf, reader.Bytes[reader.pos:])
+	reader.pos += n
+	return n, nil
+}
+
 type ReaderErr string
 
-const EOF ReaderErr = "EOF"
+const (
+	EOF            ReaderErr = "EOF"
+	ErrLineTooLong ReaderErr = "Line too long"
+)
 
 func (err ReaderErr) Error() string {
 	return string(err)
@@ -178,6 +291,34 @@ func Read(fd int, buf []byte) (int, error) {
 	}
 }
 
+func ReadFull(reader Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := reader.Read(buf[read:])
+		if err != nil {
+			return read, err
+		}
+		read += n
+	}
+	return read, nil
+}
+
+func ReadAt(fd int, buf []byte, offset int64) (int, error) {
+	for {
+		read, err := syscall.Pread(fd, buf, offset)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return -1, err
+		}
+		if read == 0 {
+			return -1, EOF
+		}
+		return read, nil
+	}
+}
+
 func Write(fd int, buf []byte) (int, error) {
 	size := len(buf)
 	pos := 0
@@ -194,6 +335,28 @@ func Write(fd int, buf []byte) (int, error) {
 	return pos, nil
 }
 
+func SendFile(outfd int, infd int, offset int64, count int64) (int64, error) {
+	sent := int64(0)
+	for sent < count {
+		chunk := count - sent
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		n, err := syscall.Sendfile(outfd, infd, &offset, int(chunk))
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return sent, err
+		}
+		if n == 0 {
+			return sent, EOF
+		}
+		sent += int64(n)
+	}
+	return sent, nil
+}
+
 type fileReader struct {
 	fd int
 }
@@ -228,6 +391,20 @@ func ReadFile(path string) ([]byte, error) {
 	return content, nil
 }
 
+const oTmpfile = 0x410000
+
+func CreateTemp(dir string) (int, error) {
+	if dir == "" {
+		if tmpdir, err := GetEnv("TMPDIR"); err == nil && tmpdir != "" {
+			dir = tmpdir
+		} else {
+			dir = "/tmp"
+		}
+	}
+	return syscall.Open(
+		dir, syscall.O_RDWR|syscall.O_CLOEXEC|oTmpfile, 0600)
+}
+
 type fileWriter struct {
 	fd int
 }
@@ -240,6 +417,55 @@ func NewFileWriter(fd int) Writer {
 	return &fileWriter{fd}
 }
 
+type ByteReader interface {
+	ReadByte() (byte, error)
+}
+
+type BufferedReader struct {
+	reader Reader
+	buf    []byte
+	pos    int
+	len    int
+}
+
+func NewBufferedReader(reader Reader) *BufferedReader {
+	return &BufferedReader{reader: reader, buf: make([]byte, 4096)}
+}
+
+func (br *BufferedReader) Read(buf []byte) (int, error) {
+	if br.pos == br.len {
+		if len(buf) >= len(br.buf) {
+			return br.reader.Read(buf)
+		}
+		if err := br.fill(); err != nil {
+			return -1, err
+		}
+	}
+	n := copy(buf, br.buf[br.pos:br.len])
+	br.pos += n
+	return n, nil
+}
+
+func (br *BufferedReader) ReadByte() (byte, error) {
+	if br.pos == br.len {
+		if err := br.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b := br.buf[br.pos]
+	br.pos++
+	return b, nil
+}
+
+func (br *BufferedReader) fill() error {
+	read, err := br.reader.Read(br.buf)
+	if err != nil {
+		return err
+	}
+	br.pos, br.len = 0, read
+	return nil
+}
+
 type LineReader struct {
 	reader Reader
 	buf    []byte
@@ -252,9 +478,16 @@ func NewLineReader(reader Reader) *LineReader {
 }
 
 func (lr *LineReader) ReadLine() (string, error) {
+	return lr.ReadLineMax(-1)
+}
+
+func (lr *LineReader) ReadLineMax(max int) (string, error) {
 	start := lr.pos
 	for {
 		for ; lr.pos < lr.len; lr.pos++ {
+			if max >= 0 && lr.pos-start > max+1 {
+				return "", ErrLineTooLong
+			}
 			if lr.buf[lr.pos] == '\n' {
 				skip := 1
 				if lr.pos > 0 && lr.buf[lr.pos-1] == '\r' {
@@ -272,6 +505,19 @@ func (lr *LineReader) ReadLine() (string, error) {
 	}
 }
 
+func (lr *LineReader) Peek(size int) ([]byte, error) {
+	for lr.len-lr.pos < size {
+		if err := lr.read(); err != nil {
+			return nil, err
+		}
+	}
+	return lr.buf[lr.pos : lr.pos+size], nil
+}
+
+func (lr *LineReader) Buffered() int {
+	return lr.len - lr.pos
+}
+
 func (lr *LineReader) GetTail(size int) []byte {
 	if size > lr.len {
 		size = lr.len
@@ -283,6 +529,22 @@ func (lr *LineReader) GetTail(size int) []byte {
 	return tail
 }
 
+func (lr *LineReader) Read(buf []byte) (int, error) {
+	if lr.pos == lr.len {
+		if err := lr.read(); err != nil {
+			return -1, err
+		}
+	}
+	n := copy(buf, lr.buf[lr.pos:lr.len])
+	lr.pos += n
+	lr.compact()
+	return n, nil
+}
+
+func (lr *LineReader) Fill() error {
+	return lr.read()
+}
+
 func (lr *LineReader) read() error {
 	if lr.len == len(lr.buf) {
 		lr.buf = append(lr.buf, make([]byte, lr.len)...)
@@ -0,0 +1,92 @@
+package io
+
+import (
+	"syscall"
+	_ "unsafe"
+)
+
+// Signals are taken from the Go runtime's signal queue, the one os/signal
+// uses. A signalfd only sees signals that are blocked on every thread, and
+// blocking them with rt_sigprocmask doesn't last: each thread the runtime
+// starts later unblocks SIGINT and SIGTERM again, and the runtime's handler
+// kills the process when one of them lands there without os/signal asking
+// for it.
+
+//go:linkname signalEnable os/signal.signal_enable
+func signalEnable(sig uint32)
+
+//go:linkname signalDisable os/signal.signal_disable
+func signalDisable(sig uint32)
+
+//go:linkname signalRecv os/signal.signal_recv
+func signalRecv() uint32
+
+var signals = newSignalHandlers()
+
+type signalHandlers struct {
+	lock     chan any
+	handlers map[uint32][]func()
+	started  bool
+}
+
+func newSignalHandlers() *signalHandlers {
+	s := &signalHandlers{
+		lock:     make(chan any, 1),
+		handlers: make(map[uint32][]func()),
+	}
+	s.lock <- struct{}{}
+	return s
+}
+
+// OnSignal calls fn in a goroutine of its own every time sig is received.
+func OnSignal(sig syscall.Signal, fn func()) {
+	signals.withLock(func() {
+		signals.handlers[uint32(sig)] = append(signals.handlers[uint32(sig)], fn)
+		if !signals.started {
+			signals.started = true
+			go signals.dispatch()
+		}
+	})
+	signalEnable(uint32(sig))
+}
+
+// AtExit calls fn once on SIGINT or SIGTERM. The signals get their default
+// action back, so a second one terminates the process right away.
+func AtExit(fn func()) error {
+	exiting := make(chan any, 1)
+	exiting <- struct{}{}
+	exit := func() {
+		select {
+		case <-exiting:
+		default:
+			return
+		}
+		signalDisable(uint32(syscall.SIGINT))
+		signalDisable(uint32(syscall.SIGTERM))
+		fn()
+	}
+	OnSignal(syscall.SIGINT, exit)
+	OnSignal(syscall.SIGTERM, exit)
+	return nil
+}
+
+func (s *signalHandlers) dispatch() {
+	for {
+		sig := signalRecv()
+		var handlers []func()
+		s.withLock(func() {
+			handlers = s.handlers[sig]
+		})
+		for _, fn := range handlers {
+			go fn()
+		}
+	}
+}
+
+func (s *signalHandlers) withLock(fn func()) {
+	locked := <-s.lock
+	defer func() {
+		s.lock <- locked
+	}()
+	fn()
+}
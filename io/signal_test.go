@@ -0,0 +1,24 @@
+package io
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestOnSignal(t *testing.T) {
+	received := make(chan syscall.Signal, 4)
+	OnSignal(syscall.SIGUSR2, func() {
+		received <- syscall.SIGUSR2
+	})
+	AtExit(func() {
+		received <- syscall.SIGTERM
+	})
+	for _, sig := range []syscall.Signal{syscall.SIGUSR2, syscall.SIGUSR2, syscall.SIGTERM} {
+		if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; got != sig {
+			t.Errorf("handler for %v ran on %v", got, sig)
+		}
+	}
+}
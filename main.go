@@ -1,6 +1,9 @@
 package main
 
 import (
+	"syscall"
+
+	"github.com/alaisi/syscalltodo/context"
 	"github.com/alaisi/syscalltodo/http"
 	"github.com/alaisi/syscalltodo/io"
 	_ "github.com/alaisi/syscalltodo/pg"
@@ -8,6 +11,8 @@ import (
 	"github.com/alaisi/syscalltodo/sql"
 	"github.com/alaisi/syscalltodo/str"
 	"github.com/alaisi/syscalltodo/template"
+	"github.com/alaisi/syscalltodo/time"
+	"github.com/alaisi/syscalltodo/websocket"
 )
 
 func main() {
@@ -24,23 +29,164 @@ func main() {
 	defer db.Close()
 	db.SetMaxOpenConns(25)
 
-	if err := migrateDb(db); err != nil {
-		slog.Error("Db schema migration failed: " + err.Error())
-		return
+	// Prefork workers start once the supervisor has migrated the schema.
+	if !http.IsPreforkWorker() {
+		if err := migrateDb(db); err != nil {
+			slog.Error("Db schema migration failed: " + err.Error())
+			return
+		}
 	}
 
-	addr := "0.0.0.0:9000"
-	server := http.Server{Addr: addr, Handler: errorMiddleware(routes(db))}
-	slog.Info("Starting server on http://" + addr)
+	mux := routes(db)
+	if legacy, _ := io.GetEnv("LEGACY_API_URL"); legacy != "" {
+		proxy, err := http.NewSingleHostReverseProxy(legacy)
+		if err != nil {
+			slog.Error("Invalid LEGACY_API_URL: " + err.Error())
+			return
+		}
+		mux.Handle("/api/legacy/", proxy)
+	}
+
+	addr, err := io.GetEnv("LISTEN_ADDR")
+	if err != nil || addr == "" {
+		addr = "0.0.0.0:9000"
+	}
+	server := http.Server{
+		Addr:              addr,
+		Handler:           errorMiddleware(http.CompressHandler(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxBodyBytes:      1 << 20,
+		MaxConns:          1024,
+	}
+	if proxies, _ := io.GetEnv("TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range str.Split(proxies, ',') {
+			server.TrustedProxies = append(server.TrustedProxies, str.Trim(proxy))
+		}
+	}
+	if sources, _ := io.GetEnv("PROXY_PROTOCOL"); sources != "" {
+		server.AcceptProxyProtocol = true
+		for _, source := range str.Split(sources, ',') {
+			server.ProxyProtocolSources = append(server.ProxyProtocolSources, str.Trim(source))
+		}
+	}
+	if workers, _ := io.GetEnv("PREFORK_WORKERS"); workers != "" {
+		server.Prefork = str.Atoi(workers)
+	}
+	if server.Prefork > 1 {
+		// The workers share nothing, so each gets its part of the limit.
+		server.MaxConns = max(server.MaxConns/server.Prefork, 1)
+	}
+	certFile, _ := io.GetEnv("TLS_CERT")
+	keyFile, _ := io.GetEnv("TLS_KEY")
+	shutdown := make(chan int, 1)
 	io.AtExit(func() {
-		server.Close()
+		shutdown <- server.Shutdown(10 * time.Second)
 	})
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if server.Prefork > 1 {
+		err = servePrefork(&server, certFile, keyFile)
+	} else {
+		err = serveSocket(&server, certFile, keyFile)
+	}
+	if err != http.ErrServerClosed {
 		slog.Error("Server failed: " + err.Error())
+		return
+	}
+	if cut := <-shutdown; cut > 0 {
+		slog.Error("Closed " + str.Itoa(cut) + " active connections on shutdown")
 	}
 	slog.Info("Server stopped")
 }
 
+// serveSocket serves on a socket of its own, handing it over to a new
+// instance on SIGUSR2.
+func serveSocket(server *http.Server, certFile string, keyFile string) error {
+	addr := server.Addr
+	sockfd, inherited, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if inherited {
+		sockaddr, _ := syscall.Getsockname(sockfd)
+		addr = io.FormatSockaddr(sockaddr)
+		if _, isUnix := sockaddr.(*syscall.SockaddrUnix); isUnix {
+			addr = "unix:" + addr
+		}
+	}
+	upgradeOnSignal(sockfd)
+	io.Notify("READY=1\nMAINPID=" + str.Itoa(syscall.Getpid()))
+	if parent := io.ReexecParent(); parent > 0 {
+		slog.Info("Taking over from process " + str.Itoa(parent))
+		syscall.Kill(parent, syscall.SIGTERM)
+	}
+	if certFile != "" {
+		slog.Info("Starting server on https://" + addr)
+		return server.ServeTLS(sockfd, certFile, keyFile)
+	}
+	slog.Info("Starting server on http://" + addr)
+	return server.Serve(sockfd)
+}
+
+// servePrefork runs the server in worker processes that each listen on the
+// address with SO_REUSEPORT.
+func servePrefork(server *http.Server, certFile string, keyFile string) error {
+	io.Notify("READY=1")
+	if certFile != "" {
+		slog.Info("Starting server on https://" + server.Addr)
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	slog.Info("Starting server on http://" + server.Addr)
+	return server.ListenAndServe()
+}
+
+// listen takes over the socket passed by systemd, or by the process that
+// re-executed this one, before creating a new one.
+func listen(addr string) (int, bool, error) {
+	fds, err := io.ListenFds()
+	if err != nil {
+		return -1, false, err
+	}
+	if len(fds) > 0 {
+		return fds[0], true, nil
+	}
+	sockfd, err := io.Listen(addr)
+	return sockfd, false, err
+}
+
+// upgradeOnSignal starts a new instance of the binary with the listening
+// socket on SIGUSR2. Once ready, the new instance tells this one to drain
+// with SIGTERM.
+func upgradeOnSignal(sockfd int) {
+	upgrading := make(chan any, 1)
+	upgrading <- struct{}{}
+	io.OnSignal(syscall.SIGUSR2, func() {
+		select {
+		case <-upgrading:
+		default:
+			return
+		}
+		defer func() {
+			upgrading <- struct{}{}
+		}()
+		pid, err := io.Reexec(sockfd)
+		if err != nil {
+			slog.Error("Upgrade failed: " + err.Error())
+			return
+		}
+		slog.Info("Upgrading to process " + str.Itoa(pid))
+		var status syscall.WaitStatus
+		for {
+			if _, err := syscall.Wait4(pid, &status, 0, nil); err != syscall.EINTR {
+				break
+			}
+		}
+		slog.Error("Upgrade failed: process " + str.Itoa(pid) +
+			" exited with status " + str.Itoa(status.ExitStatus()))
+	})
+}
+
 func migrateDb(db *sql.DB) error {
 	sql, err := io.ReadFile("schema.sql")
 	if err != nil {
@@ -50,39 +196,37 @@ func migrateDb(db *sql.DB) error {
 	return err
 }
 
-func routes(db *sql.DB) http.HandlerFunc {
-	index := indexHandler(db)
-	addTodo := addTodoHandler(db)
-	toggleTodo := toggleTodoHandler(db)
-	return func(res http.ResponseWriter, req *http.Request) {
-		switch req.Method + " " + req.URL.Path {
-		case "GET /":
-			index(res, req)
-		case "POST /":
-			addTodo(res, req)
-		case "POST /toggle":
-			toggleTodo(res, req)
-		default:
-			http.Error(res, "NOT_FOUND", 404)
-		}
-	}
+func routes(db *sql.DB) *http.ServeMux {
+	mux := http.NewServeMux()
+	updates := newUpdates()
+	limiter := http.NewRateLimiter(10, time.Minute, 5)
+	mux.Handle("GET /{$}", indexHandler(db))
+	mux.Handle("POST /{$}", limiter.Handler(addTodoHandler(db, updates)))
+	mux.Handle("POST /todos/{id}/toggle", toggleTodoHandler(db, updates))
+	mux.Handle("GET /updates", updates.handler())
+	mux.Handle("GET /static/",
+		http.StripPrefix("/static", http.FileServer(http.Dir("static"))))
+	return mux
 }
 
-func errorMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func errorMiddleware(next http.Handler) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
 				http.Error(res, str.ToString(r), 500)
 			}
 		}()
-		next(res, req)
+		next.ServeHTTP(res, req)
 	}
 }
 
 func indexHandler(db *sql.DB) http.HandlerFunc {
 	var indexHtml = template.Must(template.ParseFiles("main.html"))
 	return func(res http.ResponseWriter, req *http.Request) {
-		todos, err := getTodos(db)
+		todos, err := getTodos(req.Context(), db)
 		if err != nil {
 			http.Error(res, err.Error(), 500)
 			return
@@ -94,30 +238,27 @@ func indexHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func addTodoHandler(db *sql.DB) http.HandlerFunc {
+func addTodoHandler(db *sql.DB, updates *updates) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		if err := req.ParseForm(); err != nil {
 			http.Error(res, err.Error(), 500)
 			return
 		}
 		task := req.Form.Get("task")
-		if err := insertTodo(db, task); err != nil {
+		if err := insertTodo(req.Context(), db, task); err != nil {
 			http.Error(res, err.Error(), 500)
 			return
 		}
+		updates.broadcast()
 		res.Header().Set("Location", "/")
 		res.WriteHeader(302)
 	}
 }
 
-func toggleTodoHandler(db *sql.DB) http.HandlerFunc {
+func toggleTodoHandler(db *sql.DB, updates *updates) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		if err := req.ParseForm(); err != nil {
-			http.Error(res, err.Error(), 500)
-			return
-		}
-		id := str.Atol(req.Form.Get("id"))
-		found, err := updateTodoDone(db, id)
+		id := str.Atol(req.PathValue("id"))
+		found, err := updateTodoDone(req.Context(), db, id)
 		if err != nil {
 			http.Error(res, err.Error(), 500)
 			return
@@ -126,13 +267,71 @@ func toggleTodoHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(res, "NOT_FOUND", 404)
 			return
 		}
+		updates.broadcast()
 		res.Header().Set("Location", "/")
 		res.WriteHeader(302)
 	}
 }
 
-func getTodos(db *sql.DB) ([]map[string]any, error) {
-	rows, err := db.Query(`
+type updates struct {
+	upgrader websocket.Upgrader
+	lock     chan any
+	conns    map[*websocket.Conn]bool
+}
+
+func newUpdates() *updates {
+	u := &updates{
+		upgrader: websocket.Upgrader{MaxMessageSize: 1024},
+		lock:     make(chan any, 1),
+		conns:    map[*websocket.Conn]bool{},
+	}
+	u.lock <- struct{}{}
+	return u
+}
+
+func (u *updates) handler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		conn, err := u.upgrader.Upgrade(res, req)
+		if err != nil {
+			return
+		}
+		u.withLock(func() {
+			u.conns[conn] = true
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		u.withLock(func() {
+			delete(u.conns, conn)
+		})
+		conn.Close()
+	}
+}
+
+func (u *updates) broadcast() {
+	u.withLock(func() {
+		for conn := range u.conns {
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("changed")); err != nil {
+				delete(u.conns, conn)
+				conn.Close()
+			}
+		}
+	})
+}
+
+func (u *updates) withLock(fn func()) {
+	locked := <-u.lock
+	defer func() {
+		u.lock <- locked
+	}()
+	fn()
+}
+
+func getTodos(ctx context.Context, db *sql.DB) ([]map[string]any, error) {
+	rows, err := db.QueryContext(ctx, `
 		select id, task, done from todos
 		order by id`)
 	if err != nil {
@@ -152,14 +351,14 @@ func getTodos(db *sql.DB) ([]map[string]any, error) {
 	return todos, nil
 }
 
-func insertTodo(db *sql.DB, task string) error {
-	_, err := db.Exec(
+func insertTodo(ctx context.Context, db *sql.DB, task string) error {
+	_, err := db.ExecContext(ctx,
 		"insert into todos (task) values ($1)", task)
 	return err
 }
 
-func updateTodoDone(db *sql.DB, id int64) (bool, error) {
-	res, err := db.Exec(`
+func updateTodoDone(ctx context.Context, db *sql.DB, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, `
 		update todos set done = not(done)
 		where id = $1`, id)
 	if err != nil {
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/http/httptest"
+)
+
+func TestErrorMiddleware(t *testing.T) {
+	handler := errorMiddleware(http.HandlerFunc(
+		func(res http.ResponseWriter, req *http.Request) {
+			panic("broken")
+		}))
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 500 || string(rec.Body.Bytes) != "broken" {
+		t.Errorf("got %d %q", rec.Code, rec.Body.Bytes)
+	}
+}
+
+func TestErrorMiddlewarePassesAborts(t *testing.T) {
+	handler := errorMiddleware(http.HandlerFunc(
+		func(res http.ResponseWriter, req *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+	rec := httptest.NewRecorder()
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want ErrAbortHandler", r)
+		}
+		if len(rec.Body.Bytes) != 0 {
+			t.Errorf("wrote %q for an aborted handler", rec.Body.Bytes)
+		}
+	}()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+}
@@ -3,6 +3,7 @@ package pg
 import (
 	"syscall"
 
+	"github.com/alaisi/syscalltodo/context"
 	"github.com/alaisi/syscalltodo/io"
 	"github.com/alaisi/syscalltodo/sql"
 	"github.com/alaisi/syscalltodo/sql/driver"
@@ -10,12 +11,14 @@ import (
 )
 
 var (
-	_ driver.Driver = pgDriver{}
-	_ driver.Conn   = pgConn{}
-	_ driver.Tx     = pgConn{}
-	_ driver.Stmt   = pgStmt{}
-	_ driver.Rows   = pgRows{}
-	_ driver.Result = pgRows{}
+	_ driver.Driver           = pgDriver{}
+	_ driver.Conn             = pgConn{}
+	_ driver.Tx               = pgConn{}
+	_ driver.Stmt             = pgStmt{}
+	_ driver.StmtQueryContext = pgStmt{}
+	_ driver.StmtExecContext  = pgStmt{}
+	_ driver.Rows             = pgRows{}
+	_ driver.Result           = pgRows{}
 )
 
 func init() {
@@ -39,15 +42,20 @@ func (d pgDriver) Open(connStr string) (driver.Conn, error) {
 			syscall.Close(sockfd)
 		}
 	}()
-	stream := &pgStream{sockfd, &packet{buffer: make([]byte, 0, 4096)}, true}
+	stream := &pgStream{
+		sockfd:  sockfd,
+		backlog: &packet{buffer: make([]byte, 0, 4096)},
+		valid:   true,
+	}
 	if err = authenticate(stream, spec.db, spec.user, spec.password); err != nil {
 		return nil, err
 	}
-	return &pgConn{stream}, nil
+	return &pgConn{stream, spec}, nil
 }
 
 type pgConn struct {
 	stream *pgStream
+	spec   *connSpec
 }
 
 func (conn pgConn) Prepare(query string) (driver.Stmt, error) {
@@ -96,6 +104,66 @@ func (p pgStmt) Exec(args []driver.Value) (driver.Result, error) {
 	return rows.(pgRows), nil
 }
 
+func (p pgStmt) ExecContext(
+	ctx context.Context,
+	args []driver.Value,
+) (driver.Result, error) {
+	rows, err := p.QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return rows.(pgRows), nil
+}
+
+func (p pgStmt) QueryContext(
+	ctx context.Context,
+	args []driver.Value,
+) (driver.Rows, error) {
+	if ctx.Done() == nil {
+		return p.Query(args)
+	}
+	finished := make(chan struct{})
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+		select {
+		case <-ctx.Done():
+			p.conn.cancelRequest()
+		case <-finished:
+		}
+	}()
+	rows, err := p.Query(args)
+	close(finished)
+	<-watcher
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return rows, err
+}
+
+// cancelRequest asks the server to cancel the running query over a new
+// connection, and waits for the server to close it so that a late cancel
+// can't hit the next query on this connection.
+func (conn pgConn) cancelRequest() error {
+	if conn.stream.backendKey == nil {
+		return Error{Severity: "ERROR", Message: "No backend key for cancel"}
+	}
+	sockfd, err := io.Connect(conn.spec.ip, conn.spec.port)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sockfd)
+	if _, err := io.Write(sockfd, writeCancelRequest(conn.stream.backendKey)); err != nil {
+		return err
+	}
+	buf := make([]byte, 64)
+	for {
+		if _, err := io.Read(sockfd, buf); err != nil {
+			return nil
+		}
+	}
+}
+
 func (p pgStmt) NumInput() int {
 	return -1
 }
@@ -8,9 +8,10 @@ type msg struct {
 }
 
 type pgStream struct {
-	sockfd  int
-	backlog *packet
-	valid   bool
+	sockfd     int
+	backlog    *packet
+	valid      bool
+	backendKey []byte
 }
 
 func (s *pgStream) send(req []byte) error {
@@ -38,6 +39,9 @@ func (s *pgStream) recv(stopOnError bool) ([]*msg, error) {
 			}
 			msg := &msg{cmd, &packet{buffer: s.backlog.readBytes(size)}}
 			msgs = append(msgs, msg)
+			if cmd == 'K' {
+				s.backendKey = append([]byte(nil), msg.packet.buffer...)
+			}
 			if isResponseReady(msg, stopOnError) {
 				ready = true
 			}
@@ -82,6 +86,14 @@ func writeQuery(sql string) []byte {
 	return p.toBytes()
 }
 
+func writeCancelRequest(backendKey []byte) []byte {
+	p := &packet{buffer: make([]byte, 0, 8+len(backendKey))}
+	p.writeUint32(uint32(8 + len(backendKey)))
+	p.writeUint32(80877102)
+	p.writeByte(backendKey...)
+	return p.buffer
+}
+
 func writeTerminate() []byte {
 	return []byte{'X', 0, 0, 0, 4}
 }
@@ -1,5 +1,7 @@
 package driver
 
+import "github.com/alaisi/syscalltodo/context"
+
 type Driver interface {
 	Open(name string) (Conn, error)
 }
@@ -22,6 +24,14 @@ type Stmt interface {
 	Exec(args []Value) (Result, error)
 }
 
+type StmtQueryContext interface {
+	QueryContext(ctx context.Context, args []Value) (Rows, error)
+}
+
+type StmtExecContext interface {
+	ExecContext(ctx context.Context, args []Value) (Result, error)
+}
+
 type Value any
 
 type Rows interface {
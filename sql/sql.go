@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"github.com/alaisi/syscalltodo/context"
 	"github.com/alaisi/syscalltodo/sql/driver"
 	"github.com/alaisi/syscalltodo/str"
 )
@@ -53,7 +54,15 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) Exec(query string, args ...any) (Result, error) {
-	conn, err := db.getConnection()
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...any,
+) (Result, error) {
+	conn, err := db.getConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +72,7 @@ func (db *DB) Exec(query string, args ...any) (Result, error) {
 		return nil, err
 	}
 	defer stmt.Close()
-	res, err := stmt.Exec(toDriverValues(args))
+	res, err := stmtExec(ctx, stmt, toDriverValues(args))
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +80,15 @@ func (db *DB) Exec(query string, args ...any) (Result, error) {
 }
 
 func (db *DB) Query(query string, args ...any) (*Rows, error) {
-	conn, err := db.getConnection()
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryContext(
+	ctx context.Context,
+	query string,
+	args ...any,
+) (*Rows, error) {
+	conn, err := db.getConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -85,7 +102,7 @@ func (db *DB) Query(query string, args ...any) (*Rows, error) {
 		return nil, err
 	}
 	defer stmt.Close()
-	rs, err := stmt.Query(toDriverValues(args))
+	rs, err := stmtQuery(ctx, stmt, toDriverValues(args))
 	if err != nil {
 		return nil, err
 	}
@@ -93,8 +110,36 @@ func (db *DB) Query(query string, args ...any) (*Rows, error) {
 	return &Rows{db, conn, rs, values}, nil
 }
 
+func stmtQuery(
+	ctx context.Context,
+	stmt driver.Stmt,
+	args []driver.Value,
+) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if queryer, ok := stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	return stmt.Query(args)
+}
+
+func stmtExec(
+	ctx context.Context,
+	stmt driver.Stmt,
+	args []driver.Value,
+) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if execer, ok := stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	return stmt.Exec(args)
+}
+
 func (db *DB) Begin() (*Tx, error) {
-	conn, err := db.getConnection()
+	conn, err := db.getConnection(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -204,9 +249,9 @@ func (result *result) RowsAffected() (int64, error) {
 	return result.r.RowsAffected()
 }
 
-func (db *DB) getConnection() (driver.Conn, error) {
+func (db *DB) getConnection(ctx context.Context) (driver.Conn, error) {
 	for i := 0; i < db.maxSize; i++ {
-		conn, err := db.checkoutConnection()
+		conn, err := db.checkoutConnection(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -218,7 +263,7 @@ func (db *DB) getConnection() (driver.Conn, error) {
 	return nil, dbError("No db connection available")
 }
 
-func (db *DB) checkoutConnection() (driver.Conn, error) {
+func (db *DB) checkoutConnection(ctx context.Context) (driver.Conn, error) {
 	select {
 	case conn := <-db.pool:
 		return conn, nil
@@ -238,8 +283,12 @@ func (db *DB) checkoutConnection() (driver.Conn, error) {
 
 		}
 		db.sizeLock <- locked
-		conn := <-db.pool
-		return conn, nil
+		select {
+		case conn := <-db.pool:
+			return conn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
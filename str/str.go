@@ -71,6 +71,16 @@ func IndexOf(str string, c rune) int {
 	return -1
 }
 
+func LastIndexOf(str string, c rune) int {
+	last := -1
+	for i, s := range str {
+		if s == c {
+			last = i
+		}
+	}
+	return last
+}
+
 func IndexOfString(str string, str2 string) int {
 	size := len(str2)
 	for i := 0; i+size < len(str); i++ {
@@ -146,3 +156,38 @@ func ToLowerAscii(s string) string {
 	}
 	return string(bytes)
 }
+
+func ValidUtf8(b []byte) bool {
+	for i := 0; i < len(b); {
+		c := b[i]
+		size, min := 0, rune(0)
+		switch {
+		case c < 0x80:
+			i++
+			continue
+		case c&0xe0 == 0xc0:
+			size, min = 2, 0x80
+		case c&0xf0 == 0xe0:
+			size, min = 3, 0x800
+		case c&0xf8 == 0xf0:
+			size, min = 4, 0x10000
+		default:
+			return false
+		}
+		if i+size > len(b) {
+			return false
+		}
+		r := rune(c) & (0x7f >> size)
+		for j := 1; j < size; j++ {
+			if b[i+j]&0xc0 != 0x80 {
+				return false
+			}
+			r = r<<6 | rune(b[i+j]&0x3f)
+		}
+		if r < min || r > 0x10ffff || (r >= 0xd800 && r <= 0xdfff) {
+			return false
+		}
+		i += size
+	}
+	return true
+}
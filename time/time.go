@@ -0,0 +1,91 @@
+package time
+
+import "syscall"
+
+type Duration int64
+
+const (
+	Nanosecond  Duration = 1
+	Microsecond          = 1000 * Nanosecond
+	Millisecond          = 1000 * Microsecond
+	Second               = 1000 * Millisecond
+	Minute               = 60 * Second
+	Hour                 = 60 * Minute
+)
+
+func (d Duration) Milliseconds() int64 {
+	return int64(d / Millisecond)
+}
+
+func (d Duration) Seconds() int64 {
+	return int64(d / Second)
+}
+
+func (d Duration) Timeval() syscall.Timeval {
+	return syscall.NsecToTimeval(int64(d))
+}
+
+type Time struct {
+	nsec int64
+}
+
+func Now() Time {
+	tv := syscall.Timeval{}
+	if err := syscall.Gettimeofday(&tv); err != nil {
+		return Time{}
+	}
+	return Time{tv.Nano()}
+}
+
+func Unix(sec int64, nsec int64) Time {
+	return Time{sec*int64(Second) + nsec}
+}
+
+func Since(t Time) Duration {
+	return Now().Sub(t)
+}
+
+func Until(t Time) Duration {
+	return t.Sub(Now())
+}
+
+func (t Time) Unix() int64 {
+	return t.nsec / int64(Second)
+}
+
+func (t Time) UnixMilli() int64 {
+	return t.nsec / int64(Millisecond)
+}
+
+func (t Time) UnixNano() int64 {
+	return t.nsec
+}
+
+func (t Time) IsZero() bool {
+	return t.nsec == 0
+}
+
+func (t Time) Add(d Duration) Time {
+	return Time{t.nsec + int64(d)}
+}
+
+func (t Time) Sub(u Time) Duration {
+	return Duration(t.nsec - u.nsec)
+}
+
+func (t Time) Before(u Time) bool {
+	return t.nsec < u.nsec
+}
+
+func (t Time) After(u Time) bool {
+	return t.nsec > u.nsec
+}
+
+func Sleep(d Duration) {
+	ts := syscall.NsecToTimespec(int64(d))
+	for d > 0 {
+		if err := syscall.Nanosleep(&ts, &ts); err != syscall.EINTR {
+			return
+		}
+	}
+}
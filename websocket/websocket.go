@@ -0,0 +1,420 @@
+package websocket
+
+import (
+	"github.com/alaisi/syscalltodo/crypto"
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/str"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+type websocketError string
+
+func (err websocketError) Error() string {
+	return string(err)
+}
+
+const (
+	ErrBadHandshake    = websocketError("Bad websocket handshake")
+	ErrCloseSent       = websocketError("Websocket close already sent")
+	ErrInvalidMessage  = websocketError("Invalid websocket message type")
+	ErrControlTooLarge = websocketError("Websocket control frame too large")
+)
+
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalServerErr  = 1011
+)
+
+const (
+	DefaultMaxMessageSize = 1 << 20
+	maxControlPayload     = 125
+	acceptGuid            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (err *CloseError) Error() string {
+	return "Websocket closed: " + str.Itoa(err.Code) + " " + err.Text
+}
+
+type Upgrader struct {
+	Subprotocols   []string
+	CheckOrigin    func(req *http.Request) bool
+	MaxMessageSize int
+}
+
+type Conn struct {
+	conn           http.HijackedConn
+	subprotocol    string
+	maxMessageSize int
+	lock           chan any
+	closeSent      bool
+	closed         bool
+	readErr        error
+}
+
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+func (u *Upgrader) Upgrade(res http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if req.Method != "GET" ||
+		!hasToken(req.Header.Values("Connection"), "upgrade") ||
+		!hasToken(req.Header.Values("Upgrade"), "websocket") {
+		http.Error(res, "Bad Request", 400)
+		return nil, ErrBadHandshake
+	}
+	if str.Trim(req.Header.Get("Sec-WebSocket-Version")) != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(res, "Upgrade Required", 426)
+		return nil, ErrBadHandshake
+	}
+	key := str.Trim(req.Header.Get("Sec-WebSocket-Key"))
+	if !isValidKey(key) {
+		http.Error(res, "Bad Request", 400)
+		return nil, ErrBadHandshake
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = isSameOrigin
+	}
+	if !checkOrigin(req) {
+		http.Error(res, "Forbidden", 403)
+		return nil, ErrBadHandshake
+	}
+	hijacker, isHijacker := res.(http.Hijacker)
+	if !isHijacker {
+		http.Error(res, "Internal Server Error", 500)
+		return nil, ErrBadHandshake
+	}
+	conn, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(conn, u.selectSubprotocol(req), u.MaxMessageSize)
+	accept := crypto.Sha1([]byte(key + acceptGuid))
+	head := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + str.EncodeB64(accept) + "\r\n"
+	if c.subprotocol != "" {
+		head += "Sec-WebSocket-Protocol: " + c.subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(head + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConn(conn http.HijackedConn, subprotocol string, maxMessageSize int) *Conn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	c := &Conn{
+		conn:           conn,
+		subprotocol:    subprotocol,
+		maxMessageSize: maxMessageSize,
+		lock:           make(chan any, 1),
+	}
+	c.lock <- struct{}{}
+	return c
+}
+
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, part := range str.Split(value, ',') {
+			if str.ToLowerAscii(str.Trim(part)) == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isValidKey checks the shape of the key before decoding it, as the key is
+// always 16 random bytes in base64 and DecodeB64 trusts its input.
+func isValidKey(key string) bool {
+	if len(key) != 24 || key[22:] != "==" {
+		return false
+	}
+	for _, c := range key[:22] {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+			c >= '0' && c <= '9' || c == '+' || c == '/') {
+			return false
+		}
+	}
+	return len(str.DecodeB64(key)) == 16
+}
+
+func isSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	scheme := str.IndexOfString(origin, "://")
+	if scheme < 0 {
+		return false
+	}
+	return str.ToLowerAscii(origin[scheme+3:]) == str.ToLowerAscii(req.Host)
+}
+
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	for _, header := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range str.Split(header, ',') {
+			protocol = str.Trim(protocol)
+			for _, supported := range u.Subprotocols {
+				if protocol == supported {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) SetReadDeadline(deadline time.Time) {
+	c.conn.SetReadDeadline(deadline)
+}
+
+func (c *Conn) SetWriteDeadline(deadline time.Time) {
+	c.conn.SetWriteDeadline(deadline)
+}
+
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	messageType, message, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	return messageType, message, nil
+}
+
+func (c *Conn) readMessage() (int, []byte, error) {
+	messageType := 0
+	message := []byte{}
+	for {
+		f, err := c.readFrame(c.maxMessageSize - len(message))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, f.payload); err != nil &&
+				err != ErrCloseSent {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "Expected continuation frame")
+			}
+			messageType = f.opcode
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "Unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "Unknown opcode")
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if messageType == TextMessage && !str.ValidUtf8(message) {
+			return 0, nil, c.fail(CloseInvalidPayloadData, "Invalid UTF-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) readFrame(limit int) (frame, error) {
+	f := frame{}
+	header := [8]byte{}
+	if _, err := io.ReadFull(c.conn, header[:2]); err != nil {
+		return f, err
+	}
+	f.fin, f.opcode = header[0]&0x80 != 0, int(header[0]&0x0f)
+	if header[0]&0x70 != 0 {
+		return f, c.fail(CloseProtocolError, "Reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return f, c.fail(CloseProtocolError, "Unmasked client frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	if f.opcode&0x8 != 0 {
+		if !f.fin || length > maxControlPayload {
+			return f, c.fail(CloseProtocolError, "Invalid control frame")
+		}
+		limit = maxControlPayload
+	}
+	if length >= 126 {
+		size := 2
+		if length == 127 {
+			size = 8
+		}
+		if _, err := io.ReadFull(c.conn, header[:size]); err != nil {
+			return f, err
+		}
+		length = 0
+		for _, b := range header[:size] {
+			length = length<<8 | uint64(b)
+		}
+		if length>>63 != 0 {
+			return f, c.fail(CloseProtocolError, "Invalid payload length")
+		}
+	}
+	if length > uint64(limit) {
+		return f, c.fail(CloseMessageTooBig, "Message too big")
+	}
+	mask := [4]byte{}
+	if _, err := io.ReadFull(c.conn, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.conn, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i&3]
+	}
+	return f, nil
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	code, text := CloseNoStatusReceived, ""
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, "Invalid close frame")
+	}
+	if len(payload) >= 2 {
+		code = int(payload[0])<<8 | int(payload[1])
+		if !isValidCloseCode(code) {
+			return c.fail(CloseProtocolError, "Invalid close code")
+		}
+		if !str.ValidUtf8(payload[2:]) {
+			return c.fail(CloseInvalidPayloadData, "Invalid UTF-8")
+		}
+		text = string(payload[2:])
+		payload = payload[:2]
+	}
+	c.writeFrame(CloseMessage, payload)
+	c.Close()
+	return &CloseError{Code: code, Text: text}
+}
+
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+func (c *Conn) fail(code int, text string) error {
+	c.WriteClose(code, text)
+	c.Close()
+	return &CloseError{Code: code, Text: text}
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		if len(data) > maxControlPayload {
+			return ErrControlTooLarge
+		}
+	default:
+		return ErrInvalidMessage
+	}
+	return c.writeFrame(messageType, data)
+}
+
+func (c *Conn) WriteClose(code int, text string) error {
+	payload := append([]byte{byte(code >> 8), byte(code)}, text...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(CloseMessage, payload)
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	length := len(payload)
+	frame := make([]byte, 0, length+10)
+	frame = append(frame, 0x80|byte(opcode))
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127)
+		for shift := 56; shift >= 0; shift -= 8 {
+			frame = append(frame, byte(uint64(length)>>uint(shift)))
+		}
+	}
+	frame = append(frame, payload...)
+	var err error
+	c.withLock(func() {
+		if c.closeSent || c.closed {
+			err = ErrCloseSent
+			return
+		}
+		c.closeSent = opcode == CloseMessage
+		_, err = c.conn.Write(frame)
+	})
+	return err
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.withLock(func() {
+		if !c.closed {
+			c.closed = true
+			err = c.conn.Close()
+		}
+	})
+	return err
+}
+
+func (c *Conn) withLock(fn func()) {
+	locked := <-c.lock
+	defer func() {
+		c.lock <- locked
+	}()
+	fn()
+}
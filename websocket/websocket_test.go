@@ -0,0 +1,328 @@
+package websocket
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/alaisi/syscalltodo/http"
+	"github.com/alaisi/syscalltodo/http/httptest"
+	"github.com/alaisi/syscalltodo/io"
+	"github.com/alaisi/syscalltodo/time"
+)
+
+// fakeConn feeds the client's frames to Conn and collects what it writes.
+type fakeConn struct {
+	in     *io.ByteArrayReader
+	out    *io.ByteArrayWriter
+	closed bool
+}
+
+func (c *fakeConn) Read(buf []byte) (int, error) {
+	return c.in.Read(buf)
+}
+
+func (c *fakeConn) Write(buf []byte) (int, error) {
+	return c.out.Write(buf)
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(time.Time) {}
+
+func (c *fakeConn) SetWriteDeadline(time.Time) {}
+
+func newTestConn(maxMessageSize int, frames ...[]byte) (*Conn, *fakeConn) {
+	input := []byte{}
+	for _, f := range frames {
+		input = append(input, f...)
+	}
+	fake := &fakeConn{in: io.NewByteArrayReader(input), out: io.NewByteArrayWriter()}
+	return newConn(fake, "", maxMessageSize), fake
+}
+
+// clientFrame encodes a frame as a client sends it, masked.
+func clientFrame(fin bool, opcode int, payload string) []byte {
+	return encodeFrame(fin, opcode, []byte(payload), true)
+}
+
+func encodeFrame(fin bool, opcode int, payload []byte, masked bool) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	frame := []byte{first}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0,
+			byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+// serverFrames decodes the unmasked frames written by the server.
+func serverFrames(t *testing.T, out []byte) []frame {
+	t.Helper()
+	frames := []frame{}
+	for len(out) > 0 {
+		if len(out) < 2 || out[1]&0x80 != 0 {
+			t.Fatalf("invalid server frame % x", out)
+		}
+		f := frame{fin: out[0]&0x80 != 0, opcode: int(out[0] & 0x0f)}
+		length, header := int(out[1]), 2
+		switch length {
+		case 126:
+			length, header = int(out[2])<<8|int(out[3]), 4
+		case 127:
+			length, header = 0, 10
+			for _, b := range out[2:10] {
+				length = length<<8 | int(b)
+			}
+		}
+		f.payload, out = out[header:header+length], out[header+length:]
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func closePayload(code int, text string) string {
+	return string([]byte{byte(code >> 8), byte(code)}) + text
+}
+
+// expectClose checks that reading failed with code and that the server sent
+// a close frame with it and closed the connection.
+func expectClose(t *testing.T, name string, c *Conn, fake *fakeConn, code int) {
+	t.Helper()
+	_, _, err := c.ReadMessage()
+	closeErr, isClose := err.(*CloseError)
+	if !isClose || closeErr.Code != code {
+		t.Errorf("%s: got %v, want close %d", name, err, code)
+		return
+	}
+	frames := serverFrames(t, fake.out.Bytes)
+	last := frames[len(frames)-1]
+	if last.opcode != CloseMessage || len(last.payload) < 2 ||
+		int(last.payload[0])<<8|int(last.payload[1]) != code {
+		t.Errorf("%s: last frame %d % x, want close %d", name, last.opcode,
+			last.payload, code)
+	}
+	if !fake.closed {
+		t.Errorf("%s: connection left open", name)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{"unmasked", [][]byte{encodeFrame(true, TextMessage, []byte("hi"), false)},
+			CloseProtocolError},
+		{"reserved bits", [][]byte{func() []byte {
+			f := clientFrame(true, TextMessage, "hi")
+			f[0] |= 0x40
+			return f
+		}()}, CloseProtocolError},
+		{"unknown opcode", [][]byte{clientFrame(true, 3, "")}, CloseProtocolError},
+		{"unexpected continuation", [][]byte{clientFrame(true, continuationFrame, "x")},
+			CloseProtocolError},
+		{"interleaved data frames", [][]byte{
+			clientFrame(false, TextMessage, "a"),
+			clientFrame(true, BinaryMessage, "b"),
+		}, CloseProtocolError},
+		{"fragmented ping", [][]byte{clientFrame(false, PingMessage, "")},
+			CloseProtocolError},
+		{"oversized ping", [][]byte{clientFrame(true, PingMessage,
+			string(make([]byte, 126)))}, CloseProtocolError},
+		{"oversized close", [][]byte{clientFrame(true, CloseMessage,
+			closePayload(1000, string(make([]byte, 124))))}, CloseProtocolError},
+		{"invalid UTF-8 text", [][]byte{clientFrame(true, TextMessage, "\xff")},
+			CloseInvalidPayloadData},
+		{"invalid UTF-8 across fragments", [][]byte{
+			clientFrame(false, TextMessage, "\xe2\x82"),
+			clientFrame(true, continuationFrame, "x"),
+		}, CloseInvalidPayloadData},
+		{"invalid UTF-8 close reason", [][]byte{clientFrame(true, CloseMessage,
+			closePayload(1000, "\xc3"))}, CloseInvalidPayloadData},
+		{"one byte close", [][]byte{clientFrame(true, CloseMessage, "\x03")},
+			CloseProtocolError},
+	}
+	for _, test := range tests {
+		c, fake := newTestConn(0, test.frames...)
+		expectClose(t, test.name, c, fake, test.code)
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	tests := []struct {
+		code  int
+		valid bool
+	}{
+		{999, false}, {1000, true}, {1001, true}, {1003, true}, {1004, false},
+		{1005, false}, {1006, false}, {1007, true}, {1011, true}, {1014, true},
+		{1015, false}, {2999, false}, {3000, true}, {4999, true}, {5000, false},
+	}
+	for _, test := range tests {
+		c, fake := newTestConn(0,
+			clientFrame(true, CloseMessage, closePayload(test.code, "bye")))
+		if !test.valid {
+			expectClose(t, "close code", c, fake, CloseProtocolError)
+			continue
+		}
+		_, _, err := c.ReadMessage()
+		closeErr, isClose := err.(*CloseError)
+		if !isClose || closeErr.Code != test.code || closeErr.Text != "bye" {
+			t.Errorf("close %d: got %v", test.code, err)
+		}
+		frames := serverFrames(t, fake.out.Bytes)
+		if len(frames) != 1 || frames[0].opcode != CloseMessage ||
+			string(frames[0].payload) != closePayload(test.code, "") {
+			t.Errorf("close %d: echoed %v", test.code, frames)
+		}
+	}
+
+	c, fake := newTestConn(0, clientFrame(true, CloseMessage, ""))
+	_, _, err := c.ReadMessage()
+	if closeErr, isClose := err.(*CloseError); !isClose ||
+		closeErr.Code != CloseNoStatusReceived {
+		t.Errorf("empty close: got %v", err)
+	}
+	frames := serverFrames(t, fake.out.Bytes)
+	if len(frames) != 1 || frames[0].opcode != CloseMessage || len(frames[0].payload) != 0 {
+		t.Errorf("empty close: echoed %v", frames)
+	}
+	if err := c.WriteMessage(TextMessage, []byte("late")); err != ErrCloseSent {
+		t.Errorf("write after close: got %v, want ErrCloseSent", err)
+	}
+}
+
+func TestFragmentsWithInterleavedControlFrames(t *testing.T) {
+	c, fake := newTestConn(0,
+		clientFrame(false, TextMessage, "Hel"),
+		clientFrame(true, PingMessage, "ping"),
+		clientFrame(false, continuationFrame, "lo \xe2\x82"),
+		clientFrame(true, PongMessage, "unsolicited"),
+		clientFrame(true, continuationFrame, "\xac"),
+		clientFrame(true, BinaryMessage, "\x00\xff"),
+	)
+	messageType, message, err := c.ReadMessage()
+	if err != nil || messageType != TextMessage || string(message) != "Hello €" {
+		t.Errorf("got %d %q %v", messageType, message, err)
+	}
+	messageType, message, err = c.ReadMessage()
+	if err != nil || messageType != BinaryMessage || string(message) != "\x00\xff" {
+		t.Errorf("got %d %q %v", messageType, message, err)
+	}
+	frames := serverFrames(t, fake.out.Bytes)
+	if len(frames) != 1 || frames[0].opcode != PongMessage ||
+		string(frames[0].payload) != "ping" {
+		t.Errorf("replies %v, want a single pong", frames)
+	}
+	if _, _, err := c.ReadMessage(); err != io.EOF {
+		t.Errorf("got %v at the end of input, want EOF", err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	c, _ := newTestConn(10, clientFrame(true, BinaryMessage, "0123456789"))
+	if _, message, err := c.ReadMessage(); err != nil || len(message) != 10 {
+		t.Errorf("message at the limit: %q, %v", message, err)
+	}
+	c, fake := newTestConn(10, clientFrame(true, BinaryMessage, "0123456789a"))
+	expectClose(t, "single frame", c, fake, CloseMessageTooBig)
+	c, fake = newTestConn(10,
+		clientFrame(false, BinaryMessage, "012345"),
+		clientFrame(true, continuationFrame, "6789a"))
+	expectClose(t, "fragmented", c, fake, CloseMessageTooBig)
+	c, fake = newTestConn(10, clientFrame(true, BinaryMessage,
+		string(make([]byte, 70000))))
+	expectClose(t, "64-bit length", c, fake, CloseMessageTooBig)
+}
+
+func TestWriteFrames(t *testing.T) {
+	c, fake := newTestConn(0)
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		if err := c.WriteMessage(BinaryMessage, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, f := range serverFrames(t, fake.out.Bytes) {
+		if !f.fin || f.opcode != BinaryMessage {
+			t.Errorf("frame %d: fin %v opcode %d", i, f.fin, f.opcode)
+		}
+	}
+	if err := c.WriteMessage(PingMessage, make([]byte, 126)); err != ErrControlTooLarge {
+		t.Errorf("oversized ping: got %v", err)
+	}
+	if err := c.WriteMessage(3, nil); err != ErrInvalidMessage {
+		t.Errorf("unknown type: got %v", err)
+	}
+}
+
+// RFC 6455 section 1.3.
+func TestUpgrade(t *testing.T) {
+	upgrader := &Upgrader{Subprotocols: []string{"chat"}}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(res http.ResponseWriter, req *http.Request) {
+			c, err := upgrader.Upgrade(res, req)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			if messageType, message, err := c.ReadMessage(); err == nil {
+				c.WriteMessage(messageType, message)
+			}
+		}))
+	defer server.Close()
+	fd, err := io.Dial(server.URL[len("http://"):], syscall.Timeval{Sec: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	timeout := syscall.Timeval{Sec: 5}
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	io.Write(fd, []byte("GET /chat HTTP/1.1\r\nHost: server.example.com\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Origin: http://server.example.com\r\n"+
+		"Sec-WebSocket-Protocol: superchat, chat\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	io.Write(fd, clientFrame(true, TextMessage, "echo"))
+	lr := io.NewLineReader(io.NewFileReader(fd))
+	want := []string{
+		"HTTP/1.1 101 Switching Protocols",
+		"Upgrade: websocket",
+		"Connection: Upgrade",
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		"Sec-WebSocket-Protocol: chat",
+		"",
+	}
+	for _, line := range want {
+		if got, err := lr.ReadLine(); got != line || err != nil {
+			t.Fatalf("got %q, %v, want %q", got, err, line)
+		}
+	}
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(lr, reply); err != nil || string(reply) != "\x81\x04echo" {
+		t.Errorf("got % x, %v", reply, err)
+	}
+}